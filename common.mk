@@ -7,3 +7,4 @@ export TEST_SUITE_DIR := $(MKFILE_PATH)test-suite
 export STATE_DIR := $(WORK_DIR)/state
 export IPFS_DIR := $(WORK_DIR)/ipfs
 export CONFIG_DIR := $(WORK_DIR)/config
+export LOCAL_BACKNET_DIR := $(WORK_DIR)/local
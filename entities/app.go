@@ -5,6 +5,22 @@ type AppID string
 
 // App represents an application running on a community's servers.
 type App struct {
-	AppID   string `json:"id"`
-	Running bool   `json:"running"`
+	AppID   AppID `json:"id" mapstructure:"id"`
+	Running bool  `json:"running"`
+}
+
+// Copy returns a copy of the app
+func (a *App) Copy() *App {
+	if a == nil {
+		return nil
+	}
+	copy := *a
+	return &copy
+}
+
+// Validate checks the app's fields
+func (a *App) Validate() error {
+	v := &validator{}
+	v.check("id", a.AppID.Validate())
+	return v.err()
 }
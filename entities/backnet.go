@@ -1,5 +1,7 @@
 package entities
 
+import "sort"
+
 // BacknetType enumerates types of backnets
 type BacknetType string
 
@@ -29,3 +31,100 @@ func InitBacknet(backnetType BacknetType) *Backnet {
 		Bootstrap: make([]string, 0),
 	}
 }
+
+// Copy returns a deep copy of the backnet
+func (b *Backnet) Copy() *Backnet {
+	if b == nil {
+		return nil
+	}
+
+	copy := *b
+	if b.Bootstrap != nil {
+		copy.Bootstrap = make([]string, len(b.Bootstrap))
+		for i, address := range b.Bootstrap {
+			copy.Bootstrap[i] = address
+		}
+	}
+	copy.Local = b.Local.Copy()
+	return &copy
+}
+
+// Copy returns a deep copy of the local backnet config
+func (l LocalBacknetConfig) Copy() LocalBacknetConfig {
+	if l.PortMap == nil {
+		return l
+	}
+
+	portMap := make(map[string]int, len(l.PortMap))
+	for name, port := range l.PortMap {
+		portMap[name] = port
+	}
+	return LocalBacknetConfig{PortMap: portMap}
+}
+
+// Equal checks whether two backnets have the same configuration. Missing and empty lists and maps are the same.
+func (b *Backnet) Equal(other *Backnet) bool {
+	if b == nil || other == nil {
+		return b == other
+	}
+	if b.Type != other.Type || len(b.Bootstrap) != len(other.Bootstrap) || len(b.Local.PortMap) != len(other.Local.PortMap) {
+		return false
+	}
+	for i, address := range b.Bootstrap {
+		if other.Bootstrap[i] != address {
+			return false
+		}
+	}
+	for name, port := range b.Local.PortMap {
+		if otherPort, ok := other.Local.PortMap[name]; !ok || otherPort != port {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks the backnet's type, that the bootstrap peers are multiaddrs, and the local config
+func (b *Backnet) Validate() error {
+	v := &validator{}
+	switch b.Type {
+	case Local, IPFS, DAT:
+	default:
+		v.addf("type", "unknown backnet type %q", b.Type)
+	}
+	for i, address := range b.Bootstrap {
+		v.check(indexField("bootstrap", i), validateMultiaddr(address))
+	}
+	v.check("local_backnet_config", b.Local.Validate())
+	return v.err()
+}
+
+// Validate checks that every port is valid and only used for one thing
+func (l LocalBacknetConfig) Validate() error {
+	v := &validator{}
+
+	names := make([]string, 0, len(l.PortMap))
+	for name := range l.PortMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	usedBy := make(map[int]string)
+	for _, name := range names {
+		port := l.PortMap[name]
+		field := indexField("port_map", name)
+		if name == "" {
+			v.addf(field, "port name is required")
+		}
+		err := validatePort(port)
+		if err != nil {
+			v.check(field, err)
+			continue
+		}
+		if other, ok := usedBy[port]; ok {
+			v.addf(field, "port %d is already used for %s", port, other)
+			continue
+		}
+		usedBy[port] = name
+	}
+	return v.err()
+}
@@ -1,8 +1,8 @@
 package entities
 
 import (
-	"encoding/json"
 	"errors"
+	"time"
 )
 
 // CommunityID identifies a Community
@@ -15,7 +15,20 @@ type Community struct {
 	Members map[UserID]*User `json:"members"`
 	Peers   []*Peer          `json:"peers"`
 	Backnet *Backnet         `json:"backnet"`
-	Apps    []*AppID         `json:"apps"`
+	Apps    []*App           `json:"apps"`
+	Bans    map[UserID]*Ban  `json:"bans"`
+	// Roles of members that aren't regular members
+	Roles map[UserID]Role `json:"roles"`
+	// Archived communities are kept around, but their files are read-only
+	Archived bool `json:"archived"`
+}
+
+// Ban records that a user is not allowed back into a community
+type Ban struct {
+	UserID    UserID    `json:"user_id" mapstructure:"user_id"`
+	Reason    string    `json:"reason"`
+	BannedBy  UserID    `json:"banned_by" mapstructure:"banned_by"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
 func InitCommunity(id CommunityID, name string, backnetType BacknetType) *Community {
@@ -25,34 +38,96 @@ func InitCommunity(id CommunityID, name string, backnetType BacknetType) *Commun
 		Members: make(map[UserID]*User),
 		Peers:   make([]*Peer, 0),
 		Backnet: InitBacknet(backnetType),
-		Apps:    make([]*AppID, 0),
+		Apps:    make([]*App, 0),
+		Bans:    make(map[UserID]*Ban),
+		Roles:   make(map[UserID]Role),
 	}
 }
 
+// Copy returns a deep copy of the community, which shares no maps, slices or pointers with the original
 func (c *Community) Copy() (*Community, error) {
-	// dirty trick for copying: just marshal and unmarshal.
-	// if performance is a huge issue, we can eventually create real copy methods
-
-	marshalled, err := json.Marshal(c)
-	if err != nil {
-		return nil, err
+	if c == nil {
+		return nil, nil
 	}
 
-	var copy Community
-	err = json.Unmarshal(marshalled, &copy)
-	if err != nil {
-		return nil, err
+	copy := *c
+	if c.Members != nil {
+		copy.Members = make(map[UserID]*User, len(c.Members))
+		for id, member := range c.Members {
+			memberCopy, err := member.Copy()
+			if err != nil {
+				return nil, err
+			}
+			copy.Members[id] = memberCopy
+		}
 	}
+	if c.Peers != nil {
+		copy.Peers = make([]*Peer, len(c.Peers))
+		for i, peer := range c.Peers {
+			copy.Peers[i] = peer.Copy()
+		}
+	}
+	copy.Backnet = c.Backnet.Copy()
+	if c.Apps != nil {
+		copy.Apps = make([]*App, len(c.Apps))
+		for i, app := range c.Apps {
+			copy.Apps[i] = app.Copy()
+		}
+	}
+	if c.Bans != nil {
+		copy.Bans = make(map[UserID]*Ban, len(c.Bans))
+		for id, ban := range c.Bans {
+			copy.Bans[id] = ban.Copy()
+		}
+	}
+	if c.Roles != nil {
+		copy.Roles = make(map[UserID]Role, len(c.Roles))
+		for id, role := range c.Roles {
+			copy.Roles[id] = role
+		}
+	}
+
+	return &copy, nil
+}
 
-	return &copy, err
+// Copy returns a copy of the ban
+func (b *Ban) Copy() *Ban {
+	if b == nil {
+		return nil
+	}
+	copy := *b
+	return &copy
 }
 
+// AddMember adds a copy of the user to the community, which lists the community in its Communities. The user
+// passed in is left untouched.
 func (c *Community) AddMember(u *User) error {
 	if _, ok := c.Members[u.ID]; ok {
 		return errors.New("User already exists in this community!")
-	} else {
-		c.Members[u.ID] = u
-		return nil
+	} else if c.IsBanned(u.ID) {
+		return errors.New("User is banned from this community!")
+	}
+
+	member, err := u.Copy()
+	if err != nil {
+		return err
+	}
+	if !valInSlice(c.ID, member.Communities) {
+		err := member.AddCommunity(c.ID)
+		if err != nil {
+			return err
+		}
+	}
+	c.Members[u.ID] = member
+	return nil
+}
+
+// LinkMembers adds the community to the Communities of every member that doesn't list it yet
+func (c *Community) LinkMembers() {
+	for _, member := range c.Members {
+		if member != nil && !valInSlice(c.ID, member.Communities) {
+			member.Communities = append(member.Communities, c.ID)
+		}
 	}
 }
 
@@ -61,6 +136,219 @@ func (c *Community) RemoveMember(u *User) error {
 		return errors.New("User is already not in this community!")
 	} else {
 		delete(c.Members, u.ID)
+		delete(c.Roles, u.ID)
 		return nil
 	}
 }
+
+// IsBanned checks whether a user is on the community's ban list
+func (c *Community) IsBanned(id UserID) bool {
+	_, ok := c.Bans[id]
+	return ok
+}
+
+// BanMember removes a user from the community if they are a member, and adds them to the ban list
+func (c *Community) BanMember(ban *Ban) error {
+	if c.IsBanned(ban.UserID) {
+		return errors.New("User is already banned from this community!")
+	}
+	// Communities from before ban lists were introduced don't have one yet
+	if c.Bans == nil {
+		c.Bans = make(map[UserID]*Ban)
+	}
+	delete(c.Members, ban.UserID)
+	delete(c.Roles, ban.UserID)
+	c.Bans[ban.UserID] = ban
+	return nil
+}
+
+// UnbanMember takes a user off the ban list. They are not added back as a member.
+func (c *Community) UnbanMember(id UserID) error {
+	if !c.IsBanned(id) {
+		return errors.New("User is not banned from this community!")
+	}
+	delete(c.Bans, id)
+	return nil
+}
+
+// RoleOf returns a member's role in the community, or an empty role if the user is not a member
+func (c *Community) RoleOf(id UserID) Role {
+	if _, ok := c.Members[id]; !ok {
+		return ""
+	}
+	if role, ok := c.Roles[id]; ok {
+		return role
+	}
+	return Member
+}
+
+// SetRole changes a member's role
+func (c *Community) SetRole(id UserID, role Role) error {
+	if _, ok := c.Members[id]; !ok {
+		return errors.New("User is not in this community!")
+	}
+	if !role.Valid() {
+		return errors.New("Unknown role!")
+	}
+	if role == Member {
+		delete(c.Roles, id)
+		return nil
+	}
+	// Communities from before roles were introduced don't have any yet
+	if c.Roles == nil {
+		c.Roles = make(map[UserID]Role)
+	}
+	c.Roles[id] = role
+	return nil
+}
+
+// Owners lists the members with the owner role
+func (c *Community) Owners() []UserID {
+	res := make([]UserID, 0)
+	for id, role := range c.Roles {
+		if _, ok := c.Members[id]; ok && role == Owner {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// GetApp returns an installed app, or nil if the app is not installed
+func (c *Community) GetApp(id AppID) *App {
+	for _, app := range c.Apps {
+		if app.AppID == id {
+			return app
+		}
+	}
+	return nil
+}
+
+// InstallApp adds an app to the community. Apps are installed stopped.
+func (c *Community) InstallApp(id AppID) error {
+	if c.GetApp(id) != nil {
+		return errors.New("App is already installed in this community!")
+	}
+	c.Apps = append(c.Apps, &App{
+		AppID: id,
+	})
+	return nil
+}
+
+// UninstallApp removes an app from the community
+func (c *Community) UninstallApp(id AppID) error {
+	for i, app := range c.Apps {
+		if app.AppID == id {
+			c.Apps = append(c.Apps[:i], c.Apps[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("App is not installed in this community!")
+}
+
+// ValidateCommunityName checks that a name can be displayed as the name of a community
+func ValidateCommunityName(name string) error {
+	return validateName(name)
+}
+
+// Validate checks every field of the community and the entities in it, and reports all of the invalid ones
+func (c *Community) Validate() error {
+	v := &validator{}
+	v.check("id", c.ID.Validate())
+	v.check("name", validateName(c.Name))
+
+	memberIDs := make([]UserID, 0, len(c.Members))
+	for id := range c.Members {
+		memberIDs = append(memberIDs, id)
+	}
+	sortUserIDs(memberIDs)
+	for _, id := range memberIDs {
+		field := indexField("members", id)
+		member := c.Members[id]
+		if member == nil {
+			v.addf(field, "member is missing")
+			continue
+		}
+		if member.ID != id {
+			v.addf(joinField(field, "id"), "member %s is stored under %s", member.ID, id)
+		}
+		v.check(field, member.Validate())
+	}
+
+	peerKeys := make(map[string]bool)
+	for i, peer := range c.Peers {
+		field := indexField("peers", i)
+		if peer == nil {
+			v.addf(field, "peer is missing")
+			continue
+		}
+		v.check(field, peer.Validate())
+		if peerKeys[peer.Key] {
+			v.addf(joinField(field, "key"), "peer %s is listed more than once", peer.Key)
+		}
+		peerKeys[peer.Key] = true
+	}
+
+	if c.Backnet != nil {
+		v.check("backnet", c.Backnet.Validate())
+	}
+
+	appIDs := make(map[AppID]bool)
+	for i, app := range c.Apps {
+		field := indexField("apps", i)
+		if app == nil {
+			v.addf(field, "app is missing")
+			continue
+		}
+		v.check(field, app.Validate())
+		if appIDs[app.AppID] {
+			v.addf(joinField(field, "id"), "app %s is installed more than once", app.AppID)
+		}
+		appIDs[app.AppID] = true
+	}
+
+	bannedIDs := make([]UserID, 0, len(c.Bans))
+	for id := range c.Bans {
+		bannedIDs = append(bannedIDs, id)
+	}
+	sortUserIDs(bannedIDs)
+	for _, id := range bannedIDs {
+		field := indexField("bans", id)
+		ban := c.Bans[id]
+		if ban == nil {
+			v.addf(field, "ban is missing")
+			continue
+		}
+		if ban.UserID != id {
+			v.addf(joinField(field, "user_id"), "ban for %s is stored under %s", ban.UserID, id)
+		}
+		v.check(field, ban.Validate())
+	}
+
+	roleIDs := make([]UserID, 0, len(c.Roles))
+	for id := range c.Roles {
+		roleIDs = append(roleIDs, id)
+	}
+	sortUserIDs(roleIDs)
+	for _, id := range roleIDs {
+		field := indexField("roles", id)
+		if !c.Roles[id].Valid() {
+			v.addf(field, "unknown role %q", c.Roles[id])
+		}
+		if _, ok := c.Members[id]; !ok {
+			v.addf(field, "%s has a role but is not a member", id)
+		}
+	}
+
+	return v.err()
+}
+
+// Validate checks the ban's fields
+func (b *Ban) Validate() error {
+	v := &validator{}
+	v.check("user_id", b.UserID.Validate())
+	v.check("banned_by", b.BannedBy.Validate())
+	if b.Timestamp.IsZero() {
+		v.addf("timestamp", "timestamp is required")
+	}
+	return v.err()
+}
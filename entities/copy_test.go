@@ -0,0 +1,200 @@
+package entities
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCommunity has every field set, so that copying a field that gets added later is caught by assertNoZeroFields
+func testCommunity(members int) *Community {
+	community := InitCommunity("community_0", "My Community", IPFS)
+	community.Archived = true
+	community.Backnet.Bootstrap = []string{"/ip4/10.0.0.1/tcp/4001"}
+	community.Backnet.Local.PortMap = map[string]int{"swarm": 4001, "api": 4002, "gateway": 4003}
+	community.Peers = append(community.Peers, &Peer{Key: "peer_key", Address: "10.0.0.1:6000"})
+	community.Apps = append(community.Apps, &App{AppID: "chat", Running: true})
+	community.Bans["user_banned"] = &Ban{
+		UserID:    "user_banned",
+		Reason:    "spam",
+		BannedBy:  "user_0",
+		Timestamp: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC),
+	}
+	for i := 0; i < members; i++ {
+		id := UserID(fmt.Sprintf("user_%d", i))
+		community.Members[id] = &User{
+			ID:          id,
+			Handle:      fmt.Sprintf("handle_%d", i),
+			PublicKey:   "O2onvM62pC1io6jQKm8Nc2UyFXcd4kOmOsBIoYtZ2ik=",
+			Communities: []CommunityID{community.ID},
+		}
+	}
+	community.Roles["user_0"] = Owner
+	return community
+}
+
+func testHost() *Host {
+	host := InitHost()
+	host.Communities["community_0"] = testCommunity(3)
+	host.HostUsers["admin"] = HostUser{Username: "admin"}
+	return host
+}
+
+// assertNoZeroFields checks that every field of a struct, and of the structs it points to, is set
+func assertNoZeroFields(t *testing.T, v reflect.Value, path string) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		assert.False(t, v.IsNil(), "%s is nil", path)
+		if !v.IsNil() {
+			assertNoZeroFields(t, v.Elem(), path)
+		}
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			assert.False(t, v.Interface().(time.Time).IsZero(), "%s is zero", path)
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			assertNoZeroFields(t, v.Field(i), path+"."+v.Type().Field(i).Name)
+		}
+	case reflect.Map, reflect.Slice:
+		assert.NotEqual(t, 0, v.Len(), "%s is empty", path)
+		if v.Kind() == reflect.Map {
+			it := v.MapRange()
+			for it.Next() {
+				assertNoZeroFields(t, it.Value(), fmt.Sprintf("%s[%v]", path, it.Key()))
+			}
+		} else {
+			for i := 0; i < v.Len(); i++ {
+				assertNoZeroFields(t, v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	default:
+		assert.False(t, v.IsZero(), "%s is zero", path)
+	}
+}
+
+// assertNoAliasing checks that two values don't share any maps, slices or pointers
+func assertNoAliasing(t *testing.T, a, b reflect.Value, path string) {
+	switch a.Kind() {
+	case reflect.Ptr:
+		if a.IsNil() || b.IsNil() {
+			return
+		}
+		assert.NotEqual(t, a.Pointer(), b.Pointer(), "%s is shared", path)
+		assertNoAliasing(t, a.Elem(), b.Elem(), path)
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			assertNoAliasing(t, a.Field(i), b.Field(i), path+"."+a.Type().Field(i).Name)
+		}
+	case reflect.Map:
+		if a.IsNil() || b.IsNil() {
+			return
+		}
+		assert.NotEqual(t, a.Pointer(), b.Pointer(), "%s is shared", path)
+		it := a.MapRange()
+		for it.Next() {
+			assertNoAliasing(t, it.Value(), b.MapIndex(it.Key()), fmt.Sprintf("%s[%v]", path, it.Key()))
+		}
+	case reflect.Slice:
+		if a.Len() == 0 || b.Len() == 0 {
+			return
+		}
+		assert.NotEqual(t, a.Pointer(), b.Pointer(), "%s is shared", path)
+		for i := 0; i < a.Len() && i < b.Len(); i++ {
+			assertNoAliasing(t, a.Index(i), b.Index(i), fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+func TestCommunityCopy(t *testing.T) {
+	community := testCommunity(3)
+	assertNoZeroFields(t, reflect.ValueOf(community), "Community")
+
+	copy, err := community.Copy()
+	assert.Nil(t, err)
+	assert.Equal(t, community, copy)
+	assertNoAliasing(t, reflect.ValueOf(community), reflect.ValueOf(copy), "Community")
+
+	// Changes to the copy don't show up in the original
+	copy.Members["user_1"].Communities[0] = "community_1"
+	copy.Backnet.Local.PortMap["api"] = 5002
+	copy.Apps[0].Running = false
+	delete(copy.Roles, "user_0")
+	assert.Equal(t, CommunityID("community_0"), community.Members["user_1"].Communities[0])
+	assert.Equal(t, 4002, community.Backnet.Local.PortMap["api"])
+	assert.True(t, community.Apps[0].Running)
+	assert.Equal(t, Owner, community.Roles["user_0"])
+}
+
+func TestCopyMatchesJSONRoundTrip(t *testing.T) {
+	host := testHost()
+
+	copy, err := host.Copy()
+	assert.Nil(t, err)
+	assert.Equal(t, jsonCopy(t, host), copy)
+	assertNoAliasing(t, reflect.ValueOf(host), reflect.ValueOf(copy), "Host")
+
+	// Nil and empty collections are kept apart, just like they were by the JSON round trip
+	community := &Community{ID: "community_0", Members: make(map[UserID]*User)}
+	communityCopy, err := community.Copy()
+	assert.Nil(t, err)
+	assert.Equal(t, community, communityCopy)
+	assert.NotNil(t, communityCopy.Members)
+	assert.Nil(t, communityCopy.Peers)
+}
+
+func TestStateCopy(t *testing.T) {
+	state := &State{
+		Communities: map[CommunityID]*Community{"community_0": testCommunity(3)},
+		HostUsers:   map[string]HostUser{"admin": {Username: "admin"}},
+	}
+
+	copy, err := state.Copy()
+	assert.Nil(t, err)
+	assert.Equal(t, state, copy)
+	assertNoAliasing(t, reflect.ValueOf(state), reflect.ValueOf(copy), "State")
+}
+
+func TestCopyNil(t *testing.T) {
+	var community *Community
+	copy, err := community.Copy()
+	assert.Nil(t, err)
+	assert.Nil(t, copy)
+
+	var backnet *Backnet
+	assert.Nil(t, backnet.Copy())
+}
+
+// jsonCopy is how entities used to be copied, kept to compare against
+func jsonCopy(t testing.TB, host *Host) *Host {
+	marshalled, err := json.Marshal(host)
+	assert.Nil(t, err)
+	var copy Host
+	err = json.Unmarshal(marshalled, &copy)
+	assert.Nil(t, err)
+	return &copy
+}
+
+func BenchmarkCommunityCopy(b *testing.B) {
+	for _, members := range []int{100, 1000, 10000} {
+		community := testCommunity(members)
+		b.Run(fmt.Sprintf("members=%d", members), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := community.Copy()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		host := &Host{Communities: map[CommunityID]*Community{community.ID: community}}
+		b.Run(fmt.Sprintf("json/members=%d", members), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				jsonCopy(b, host)
+			}
+		})
+	}
+}
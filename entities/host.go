@@ -1,6 +1,6 @@
 package entities
 
-import "encoding/json"
+import "sort"
 
 // Host is the top level state object
 type Host struct {
@@ -15,23 +15,104 @@ func InitHost() *Host {
 	}
 }
 
+// Copy returns a deep copy of the host
 func (h *Host) Copy() (*Host, error) {
-	// TODO using json encode/decode for copying is a hack, and is way less efficient than this could be
-	marshalled, err := json.Marshal(h)
-	if err != nil {
-		return nil, err
+	if h == nil {
+		return nil, nil
 	}
 
-	var copy Host
-	err = json.Unmarshal(marshalled, &copy)
+	communities, err := copyCommunities(h.Communities)
 	if err != nil {
 		return nil, err
 	}
+	return &Host{
+		Communities: communities,
+		HostUsers:   copyHostUsers(h.HostUsers),
+	}, nil
+}
 
-	return &copy, nil
+func copyCommunities(communities map[CommunityID]*Community) (map[CommunityID]*Community, error) {
+	if communities == nil {
+		return nil, nil
+	}
+	res := make(map[CommunityID]*Community, len(communities))
+	for id, community := range communities {
+		communityCopy, err := community.Copy()
+		if err != nil {
+			return nil, err
+		}
+		res[id] = communityCopy
+	}
+	return res, nil
+}
+
+func copyHostUsers(users map[string]HostUser) map[string]HostUser {
+	if users == nil {
+		return nil
+	}
+	res := make(map[string]HostUser, len(users))
+	for username, user := range users {
+		res[username] = user
+	}
+	return res
 }
 
 // HostUser represents an account that is allowed to configure the physical node
 type HostUser struct {
 	Username string
 }
+
+// Validate checks every community on the host, and that no two communities' backnets use the same port
+func (h *Host) Validate() error {
+	v := &validator{}
+	validateCommunities(v, h.Communities)
+	validateHostUsers(v, h.HostUsers)
+	return v.err()
+}
+
+func validateCommunities(v *validator, communities map[CommunityID]*Community) {
+	ids := make([]string, 0, len(communities))
+	for id := range communities {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+
+	usedBy := make(map[int]CommunityID)
+	for _, id := range ids {
+		field := indexField("communities", id)
+		community := communities[CommunityID(id)]
+		if community == nil {
+			v.addf(field, "community is missing")
+			continue
+		}
+		if community.ID != CommunityID(id) {
+			v.addf(joinField(field, "id"), "community %s is stored under %s", community.ID, id)
+		}
+		v.check(field, community.Validate())
+
+		if community.Backnet == nil {
+			continue
+		}
+		names := make([]string, 0, len(community.Backnet.Local.PortMap))
+		for name := range community.Backnet.Local.PortMap {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			port := community.Backnet.Local.PortMap[name]
+			if other, ok := usedBy[port]; ok && other != community.ID {
+				v.addf(joinField(field, indexField("backnet.local_backnet_config.port_map", name)), "port %d is already used by community %s", port, other)
+				continue
+			}
+			usedBy[port] = community.ID
+		}
+	}
+}
+
+func validateHostUsers(v *validator, users map[string]HostUser) {
+	for username, user := range users {
+		if username == "" || user.Username != username {
+			v.addf(indexField("users", username), "host user %q is stored under %q", user.Username, username)
+		}
+	}
+}
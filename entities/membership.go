@@ -0,0 +1,118 @@
+package entities
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Every community keeps its own copy of its members' User records. A member's Communities has to list the
+// community it is stored in, and transitions keep both sides in step, so anything the membership checker finds has
+// drifted. The other communities a copy lists are only as fresh as the copy: a community's reducer can't update the
+// copies other communities keep, so they aren't checked against each other.
+
+// MembershipDrift is one place where a community's members and their Communities disagree
+type MembershipDrift struct {
+	CommunityID CommunityID
+	UserID      UserID
+	Reason      string
+}
+
+func (md *MembershipDrift) String() string {
+	return fmt.Sprintf("community %s, user %s: %s", md.CommunityID, md.UserID, md.Reason)
+}
+
+// MembershipDrifts lists the drift found by the membership checker, ordered by community and user
+type MembershipDrifts []*MembershipDrift
+
+func (mds MembershipDrifts) String() string {
+	res := make([]string, len(mds))
+	for i, md := range mds {
+		res[i] = md.String()
+	}
+	return strings.Join(res, "; ")
+}
+
+func (mds MembershipDrifts) addf(communityID CommunityID, userID UserID, format string, args ...interface{}) MembershipDrifts {
+	return append(mds, &MembershipDrift{
+		CommunityID: communityID,
+		UserID:      userID,
+		Reason:      fmt.Sprintf(format, args...),
+	})
+}
+
+// CheckMembership checks that the community's members and their Communities agree
+func (c *Community) CheckMembership() MembershipDrifts {
+	if c == nil {
+		return MembershipDrifts{}
+	}
+	return CheckMembership(map[CommunityID]*Community{c.ID: c})
+}
+
+// CheckMembership checks every community on the host, as it was added to the host
+func (h *Host) CheckMembership() MembershipDrifts {
+	return CheckMembership(h.Communities)
+}
+
+// CheckMembership reports every member of the communities that drifted from their community
+func CheckMembership(communities map[CommunityID]*Community) MembershipDrifts {
+	res := make(MembershipDrifts, 0)
+
+	communityIDs := make([]string, 0, len(communities))
+	for id := range communities {
+		communityIDs = append(communityIDs, string(id))
+	}
+	sort.Strings(communityIDs)
+
+	for _, communityID := range communityIDs {
+		community := communities[CommunityID(communityID)]
+		if community == nil {
+			continue
+		}
+
+		memberIDs := make([]UserID, 0, len(community.Members))
+		for id := range community.Members {
+			memberIDs = append(memberIDs, id)
+		}
+		sortUserIDs(memberIDs)
+
+		for _, id := range memberIDs {
+			member := community.Members[id]
+			if member == nil {
+				res = res.addf(community.ID, id, "member is missing")
+				continue
+			}
+			if member.ID != id {
+				res = res.addf(community.ID, id, "member %s is stored under %s", member.ID, id)
+			}
+			if community.IsBanned(id) {
+				res = res.addf(community.ID, id, "member is banned")
+			}
+
+			listed := make(map[CommunityID]bool)
+			for _, other := range member.Communities {
+				if listed[other] {
+					res = res.addf(community.ID, id, "community %s is listed more than once", other)
+					continue
+				}
+				listed[other] = true
+			}
+			if !listed[community.ID] {
+				res = res.addf(community.ID, id, "doesn't list the community")
+			}
+		}
+
+		roleIDs := make([]UserID, 0, len(community.Roles))
+		for id := range community.Roles {
+			if _, ok := community.Members[id]; !ok {
+				roleIDs = append(roleIDs, id)
+			}
+		}
+		sortUserIDs(roleIDs)
+		for _, id := range roleIDs {
+			res = res.addf(community.ID, id, "has role %s but is not a member", community.Roles[id])
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,92 @@
+package entities
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveValInSlice(t *testing.T) {
+	comms := []CommunityID{"a", "b", "c"}
+	assert.Equal(t, []CommunityID{"a", "c"}, removeValInSlice("b", comms))
+	// The original slice is left alone, and a missing value doesn't wipe it out
+	assert.Equal(t, []CommunityID{"a", "b", "c"}, comms)
+	assert.Equal(t, comms, removeValInSlice("d", comms))
+
+	user := InitUser("user_0", "handle_0")
+	assert.Nil(t, user.AddCommunity("a"))
+	assert.Nil(t, user.AddCommunity("b"))
+	assert.Nil(t, user.RemoveCommunity("a"))
+	assert.Equal(t, []CommunityID{"b"}, user.Communities)
+	assert.NotNil(t, user.RemoveCommunity("a"))
+	assert.Equal(t, []CommunityID{"b"}, user.Communities)
+}
+
+func TestAddMemberListsCommunity(t *testing.T) {
+	community := InitCommunity("community_0", "My Community", IPFS)
+	user := InitUser("user_0", "handle_0")
+	assert.Nil(t, user.AddCommunity("community_1"))
+
+	assert.Nil(t, community.AddMember(user))
+	assert.Equal(t, []CommunityID{"community_1", "community_0"}, community.Members["user_0"].Communities)
+	assert.Equal(t, []CommunityID{"community_1"}, user.Communities)
+	assert.Equal(t, 0, len(community.CheckMembership()))
+
+	// Members that already list the community aren't listed twice
+	other := InitCommunity("community_1", "Other Community", IPFS)
+	assert.Nil(t, other.AddMember(community.Members["user_0"]))
+	assert.Equal(t, []CommunityID{"community_1", "community_0"}, other.Members["user_0"].Communities)
+}
+
+func TestLinkMembers(t *testing.T) {
+	community := InitCommunity("community_0", "My Community", IPFS)
+	community.Members["user_0"] = InitUser("user_0", "handle_0")
+	assert.Equal(t, 1, len(community.CheckMembership()))
+
+	community.LinkMembers()
+	community.LinkMembers()
+	assert.Equal(t, []CommunityID{"community_0"}, community.Members["user_0"].Communities)
+	assert.Equal(t, 0, len(community.CheckMembership()))
+}
+
+func TestCheckMembership(t *testing.T) {
+	host := testHost()
+	assert.Equal(t, 0, len(host.CheckMembership()))
+
+	other := testCommunity(1)
+	other.ID = "community_1"
+	other.Members["user_0"].Communities = []CommunityID{"community_0", "community_1"}
+	host.Communities[other.ID] = other
+
+	community := host.Communities["community_0"]
+	community.Members["user_1"].Communities = []CommunityID{"community_0", "community_0", "community_1"}
+	community.Members["user_2"].Communities = []CommunityID{}
+	community.Members["user_banned"] = InitUser("user_banned", "banned")
+	community.Roles["user_9"] = Admin
+	community.Members["user_3"] = InitUser("user_4", "handle_4")
+
+	drifts := host.CheckMembership()
+	assert.Equal(t, MembershipDrifts{
+		{CommunityID: "community_0", UserID: "user_1", Reason: "community community_0 is listed more than once"},
+		{CommunityID: "community_0", UserID: "user_2", Reason: "doesn't list the community"},
+		{CommunityID: "community_0", UserID: "user_3", Reason: "member user_4 is stored under user_3"},
+		{CommunityID: "community_0", UserID: "user_3", Reason: "doesn't list the community"},
+		{CommunityID: "community_0", UserID: "user_banned", Reason: "member is banned"},
+		{CommunityID: "community_0", UserID: "user_banned", Reason: "doesn't list the community"},
+		{CommunityID: "community_0", UserID: "user_9", Reason: "has role admin but is not a member"},
+	}, drifts)
+	assert.Equal(t, drifts, community.CheckMembership())
+}
+
+func TestCheckMembershipAfterRemoval(t *testing.T) {
+	community := InitCommunity("community_0", "My Community", IPFS)
+	other := InitCommunity("community_1", "Other Community", IPFS)
+	user := InitUser("user_0", "handle_0")
+	assert.Nil(t, other.AddMember(user))
+	assert.Nil(t, community.AddMember(other.Members["user_0"]))
+
+	// Removing the member from one community can't update the copy the other community keeps, which still lists it
+	delete(other.Members, "user_0")
+	assert.Equal(t, []CommunityID{"community_1", "community_0"}, community.Members["user_0"].Communities)
+	assert.Equal(t, 0, len(CheckMembership(map[CommunityID]*Community{community.ID: community, other.ID: other})))
+}
@@ -5,3 +5,23 @@ type Peer struct {
 	Key     string `json:"key"`
 	Address string `json:"address"`
 }
+
+// Copy returns a copy of the peer
+func (p *Peer) Copy() *Peer {
+	if p == nil {
+		return nil
+	}
+	copy := *p
+	return &copy
+}
+
+// Validate checks that the peer can be reached. The format of the key is only checked when the peer is added to
+// a community, since the first peers were identified by name rather than by key.
+func (p *Peer) Validate() error {
+	v := &validator{}
+	if p.Key == "" {
+		v.addf("key", "key is required")
+	}
+	v.check("address", validateHostPort(p.Address))
+	return v.err()
+}
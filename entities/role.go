@@ -0,0 +1,28 @@
+package entities
+
+// Role is the level of control a member has over a community
+type Role string
+
+// All possible Roles, from most to least privileged
+const (
+	Owner  Role = "owner"
+	Admin  Role = "admin"
+	Member Role = "member"
+)
+
+var roleRanks = map[Role]int{
+	Owner:  3,
+	Admin:  2,
+	Member: 1,
+}
+
+// Valid checks that the role is one of the known roles
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// AtLeast checks whether the role has at least the privileges of another role
+func (r Role) AtLeast(other Role) bool {
+	return roleRanks[r] >= roleRanks[other]
+}
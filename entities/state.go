@@ -13,3 +13,27 @@ func InitState() *State {
 		HostUsers:   make(map[string]HostUser),
 	}
 }
+
+// Copy returns a deep copy of the state
+func (s *State) Copy() (*State, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	communities, err := copyCommunities(s.Communities)
+	if err != nil {
+		return nil, err
+	}
+	return &State{
+		Communities: communities,
+		HostUsers:   copyHostUsers(s.HostUsers),
+	}, nil
+}
+
+// Validate checks every community in the state, and that no two communities' backnets use the same port
+func (s *State) Validate() error {
+	v := &validator{}
+	validateCommunities(v, s.Communities)
+	validateHostUsers(v, s.HostUsers)
+	return v.err()
+}
@@ -1,8 +1,6 @@
 package transitions
 
 import (
-	"fmt"
-
 	"github.com/eagraf/habitat-node/entities"
 )
 
@@ -14,15 +12,56 @@ func (ac AddCommunityTransition) Type() TransitionType {
 	return AddCommunityTransitionType
 }
 
+func (ac AddCommunityTransition) Validate(oldHost *entities.Host) error {
+	if ac.Community == nil {
+		return newValidationError(ac.Type(), "community", "community is required")
+	}
+	if ac.Community.ID == "" {
+		return newValidationError(ac.Type(), "community.id", "community id is required")
+	}
+	err := ac.Community.Validate()
+	if err != nil {
+		return newEntityValidationError(ac.Type(), "community", err)
+	}
+	if _, ok := oldHost.Communities[ac.Community.ID]; ok {
+		return newValidationError(ac.Type(), "community.id", "community with id %s is already in host", ac.Community.ID)
+	}
+	return nil
+}
+
 func (ac AddCommunityTransition) Reduce(oldHost *entities.Host) (*entities.Host, error) {
+	err := ac.Validate(oldHost)
+	if err != nil {
+		return nil, err
+	}
+	return ac.Replay(oldHost)
+}
+
+// Replay implements HostTransition
+func (ac AddCommunityTransition) Replay(oldHost *entities.Host) (*entities.Host, error) {
 	newHost, err := oldHost.Copy()
 	if err != nil {
 		return nil, err
 	}
 
-	if _, ok := newHost.Communities[ac.Community.ID]; ok {
-		return nil, fmt.Errorf("community with id %s is already in host", ac.Community.ID)
+	newCommunity, err := ac.Community.Copy()
+	if err != nil {
+		return nil, err
 	}
-	newHost.Communities[ac.Community.ID] = ac.Community
+	newCommunity.LinkMembers()
+
+	newHost.Communities[ac.Community.ID] = newCommunity
 	return newHost, nil
 }
+
+// Inverse stops hosting the community again, keeping the data of its backnet
+func (ac AddCommunityTransition) Inverse(oldHost *entities.Host) (HostTransition, error) {
+	err := ac.Validate(oldHost)
+	if err != nil {
+		return nil, err
+	}
+
+	return DeleteCommunityTransition{
+		CommID: ac.Community.ID,
+	}, nil
+}
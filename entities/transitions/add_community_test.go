@@ -18,4 +18,34 @@ func TestAddCommunity(t *testing.T) {
 	newHost, err := transition.Reduce(host)
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(newHost.Communities))
+	assert.Equal(t, 0, len(newHost.CheckMembership()))
+
+	// The same community can't be added twice
+	err = transition.Validate(newHost)
+	assert.NotNil(t, err)
+	_, ok := err.(*ValidationError)
+	assert.True(t, ok)
+}
+
+func TestAddInvalidCommunity(t *testing.T) {
+	community := entities.InitCommunity("community/0", "My Community", entities.IPFS)
+	community.Backnet.Local.PortMap = map[string]int{"api": 4001, "swarm": 4001}
+
+	err := AddCommunityTransition{Community: community}.Validate(entities.InitHost())
+	validationErr, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "community.id", validationErr.Field)
+	assert.Equal(t, "community.backnet.local_backnet_config.port_map[swarm]", validationErr.Fields[1].Field)
+}
+
+func TestAddCommunityLinksMembers(t *testing.T) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	community.Members["user_0"] = entities.InitUser("user_0", "handle_0")
+
+	newHost, err := AddCommunityTransition{Community: community}.Reduce(entities.InitHost())
+	assert.Nil(t, err)
+	assert.Equal(t, []entities.CommunityID{"community_0"}, newHost.Communities["community_0"].Members["user_0"].Communities)
+	assert.Equal(t, 0, len(newHost.CheckMembership()))
+	// The transition's community isn't touched
+	assert.Equal(t, 0, len(community.Members["user_0"].Communities))
 }
@@ -0,0 +1,90 @@
+package transitions
+
+import (
+	"fmt"
+
+	"github.com/eagraf/habitat-node/entities"
+)
+
+// AddPeerTransition adds a node to the peers hosting a community. Peers take part in consensus from the
+// sequence number after the one the transition is committed at.
+type AddPeerTransition struct {
+	CommID entities.CommunityID `json:"community_id" mapstructure:"community_id"`
+	Peer   *entities.Peer       `json:"peer"`
+}
+
+func (ap AddPeerTransition) Type() TransitionType {
+	return AddPeerTransitionType
+}
+
+func (ap AddPeerTransition) CommunityID() entities.CommunityID {
+	return ap.CommID
+}
+
+func (ap AddPeerTransition) Validate(oldCommunity *entities.Community) error {
+	if oldCommunity == nil {
+		return newValidationError(ap.Type(), "community_id", "community %s has not been initialized", ap.CommID)
+	}
+	if oldCommunity.ID != ap.CommID {
+		return newValidationError(ap.Type(), "community_id", "transition is for community %s, not %s", ap.CommID, oldCommunity.ID)
+	}
+	if ap.Peer == nil {
+		return newValidationError(ap.Type(), "peer", "peer is required")
+	}
+
+	err := ap.Peer.Validate()
+	if err != nil {
+		return newEntityValidationError(ap.Type(), "peer", err)
+	}
+	// Peer keys are used to verify the transitions peers sign
+	_, err = DecodePublicKey(ap.Peer.Key)
+	if err != nil {
+		return newValidationError(ap.Type(), "peer.key", "peer key is not a base64 encoded Ed25519 public key: %s", err.Error())
+	}
+
+	for _, peer := range oldCommunity.Peers {
+		if peer.Key == ap.Peer.Key {
+			return newValidationError(ap.Type(), "peer.key", "peer %s is already hosting community %s", ap.Peer.Key, oldCommunity.ID)
+		}
+		if peer.Address == ap.Peer.Address {
+			return newValidationError(ap.Type(), "peer.address", "address %s is already used by peer %s", ap.Peer.Address, peer.Key)
+		}
+	}
+	return nil
+}
+
+func (ap AddPeerTransition) Reduce(oldCommunity *entities.Community) (*entities.Community, error) {
+	err := ap.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+	return ap.Replay(oldCommunity)
+}
+
+// Replay implements CommunityTransition
+func (ap AddPeerTransition) Replay(oldCommunity *entities.Community) (*entities.Community, error) {
+	newCommunity, err := oldCommunity.Copy()
+	if err != nil {
+		return nil, fmt.Errorf("error copying community: %s", err.Error())
+	}
+
+	newCommunity.Peers = append(newCommunity.Peers, &entities.Peer{
+		Key:     ap.Peer.Key,
+		Address: ap.Peer.Address,
+	})
+
+	return newCommunity, nil
+}
+
+// Inverse removes the peer again
+func (ap AddPeerTransition) Inverse(oldCommunity *entities.Community) (CommunityTransition, error) {
+	err := ap.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+
+	return RemovePeerTransition{
+		CommID: ap.CommID,
+		Key:    ap.Peer.Key,
+	}, nil
+}
@@ -0,0 +1,81 @@
+package transitions
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func testPeer(i byte, address string) *entities.Peer {
+	return &entities.Peer{
+		Key:     EncodePublicKey(testKey(i).Public().(ed25519.PublicKey)),
+		Address: address,
+	}
+}
+
+func TestAddAndRemovePeer(t *testing.T) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	first := testPeer(1, "127.0.0.1:7000")
+	community.Peers = append(community.Peers, first)
+
+	second := testPeer(2, "127.0.0.1:7001")
+	newComm, err := AddPeerTransition{
+		CommID: community.ID,
+		Peer:   second,
+	}.Reduce(community)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(newComm.Peers))
+	assert.Equal(t, 1, len(community.Peers))
+
+	newComm, err = RemovePeerTransition{
+		CommID: community.ID,
+		Key:    first.Key,
+	}.Reduce(newComm)
+	assert.Nil(t, err)
+	assert.Equal(t, []*entities.Peer{second}, newComm.Peers)
+
+	// The last peer can't leave, and peers that aren't hosting the community can't be removed
+	validationErr, ok := RemovePeerTransition{CommID: community.ID, Key: second.Key}.Validate(newComm).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "key", validationErr.Field)
+	validationErr, ok = RemovePeerTransition{CommID: community.ID, Key: first.Key}.Validate(newComm).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "key", validationErr.Field)
+}
+
+func TestAddPeerValidation(t *testing.T) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	existing := testPeer(1, "127.0.0.1:7000")
+	community.Peers = append(community.Peers, existing)
+
+	testCases := []struct {
+		peer  *entities.Peer
+		field string
+	}{
+		{nil, "peer"},
+		{&entities.Peer{Key: "peer_1", Address: "127.0.0.1:7001"}, "peer.key"},
+		{&entities.Peer{Key: EncodePublicKey(make([]byte, 16)), Address: "127.0.0.1:7001"}, "peer.key"},
+		{testPeer(2, "127.0.0.1"), "peer.address"},
+		{testPeer(2, ":7001"), "peer.address"},
+		{testPeer(2, "127.0.0.1:70000"), "peer.address"},
+		{testPeer(1, "127.0.0.1:7001"), "peer.key"},
+		{testPeer(2, "127.0.0.1:7000"), "peer.address"},
+	}
+	for _, testCase := range testCases {
+		err := AddPeerTransition{
+			CommID: community.ID,
+			Peer:   testCase.peer,
+		}.Validate(community)
+		validationErr, ok := err.(*ValidationError)
+		if assert.True(t, ok, "peer %v should be invalid", testCase.peer) {
+			assert.Equal(t, testCase.field, validationErr.Field)
+		}
+	}
+
+	assert.Nil(t, AddPeerTransition{
+		CommID: community.ID,
+		Peer:   testPeer(2, "example.com:7001"),
+	}.Validate(community))
+}
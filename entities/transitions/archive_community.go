@@ -0,0 +1,71 @@
+package transitions
+
+import (
+	"fmt"
+
+	"github.com/eagraf/habitat-node/entities"
+)
+
+// ArchiveCommunityTransition archives a community, or brings it back out of the archive. The files of an
+// archived community are read-only.
+type ArchiveCommunityTransition struct {
+	CommID   entities.CommunityID `json:"community_id" mapstructure:"community_id"`
+	Archived bool                 `json:"archived"`
+}
+
+func (ac ArchiveCommunityTransition) Type() TransitionType {
+	return ArchiveCommunityTransitionType
+}
+
+func (ac ArchiveCommunityTransition) CommunityID() entities.CommunityID {
+	return ac.CommID
+}
+
+func (ac ArchiveCommunityTransition) Validate(oldCommunity *entities.Community) error {
+	if oldCommunity == nil {
+		return newValidationError(ac.Type(), "community_id", "community %s has not been initialized", ac.CommID)
+	}
+	if oldCommunity.ID != ac.CommID {
+		return newValidationError(ac.Type(), "community_id", "transition is for community %s, not %s", ac.CommID, oldCommunity.ID)
+	}
+	if oldCommunity.Archived == ac.Archived {
+		if ac.Archived {
+			return newValidationError(ac.Type(), "archived", "community %s is already archived", ac.CommID)
+		}
+		return newValidationError(ac.Type(), "archived", "community %s is not archived", ac.CommID)
+	}
+	return nil
+}
+
+func (ac ArchiveCommunityTransition) Reduce(oldCommunity *entities.Community) (*entities.Community, error) {
+	err := ac.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+	return ac.Replay(oldCommunity)
+}
+
+// Replay implements CommunityTransition
+func (ac ArchiveCommunityTransition) Replay(oldCommunity *entities.Community) (*entities.Community, error) {
+	newCommunity, err := oldCommunity.Copy()
+	if err != nil {
+		return nil, fmt.Errorf("error copying community: %s", err.Error())
+	}
+
+	newCommunity.Archived = ac.Archived
+
+	return newCommunity, nil
+}
+
+// Inverse brings the community back out of the archive, or archives it again
+func (ac ArchiveCommunityTransition) Inverse(oldCommunity *entities.Community) (CommunityTransition, error) {
+	err := ac.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+
+	return ArchiveCommunityTransition{
+		CommID:   ac.CommID,
+		Archived: oldCommunity.Archived,
+	}, nil
+}
@@ -0,0 +1,83 @@
+package transitions
+
+import (
+	"fmt"
+
+	"github.com/eagraf/habitat-node/entities"
+)
+
+type ChangeMemberRoleTransition struct {
+	CommID entities.CommunityID `json:"community_id" mapstructure:"community_id"`
+	UserID entities.UserID      `json:"user_id" mapstructure:"user_id"`
+	Role   entities.Role        `json:"role"`
+}
+
+func (cr ChangeMemberRoleTransition) Type() TransitionType {
+	return ChangeMemberRoleTransitionType
+}
+
+func (cr ChangeMemberRoleTransition) CommunityID() entities.CommunityID {
+	return cr.CommID
+}
+
+func (cr ChangeMemberRoleTransition) Validate(oldCommunity *entities.Community) error {
+	if oldCommunity == nil {
+		return newValidationError(cr.Type(), "community_id", "community %s has not been initialized", cr.CommID)
+	}
+	if oldCommunity.ID != cr.CommID {
+		return newValidationError(cr.Type(), "community_id", "transition is for community %s, not %s", cr.CommID, oldCommunity.ID)
+	}
+	if !cr.Role.Valid() {
+		return newValidationError(cr.Type(), "role", "unknown role %s", cr.Role)
+	}
+
+	oldRole := oldCommunity.RoleOf(cr.UserID)
+	if oldRole == "" {
+		return newValidationError(cr.Type(), "user_id", "user %s is not a member of community %s", cr.UserID, oldCommunity.ID)
+	}
+	if oldRole == cr.Role {
+		return newValidationError(cr.Type(), "role", "user %s already has role %s", cr.UserID, cr.Role)
+	}
+	// A community must always have an owner that can appoint admins
+	if oldRole == entities.Owner && len(oldCommunity.Owners()) == 1 {
+		return newValidationError(cr.Type(), "role", "user %s is the last owner of community %s", cr.UserID, oldCommunity.ID)
+	}
+	return nil
+}
+
+func (cr ChangeMemberRoleTransition) Reduce(oldCommunity *entities.Community) (*entities.Community, error) {
+	err := cr.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+	return cr.Replay(oldCommunity)
+}
+
+// Replay implements CommunityTransition
+func (cr ChangeMemberRoleTransition) Replay(oldCommunity *entities.Community) (*entities.Community, error) {
+	newCommunity, err := oldCommunity.Copy()
+	if err != nil {
+		return nil, fmt.Errorf("error copying community: %s", err.Error())
+	}
+
+	err = newCommunity.SetRole(cr.UserID, cr.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCommunity, nil
+}
+
+// Inverse gives the member back the role they had before
+func (cr ChangeMemberRoleTransition) Inverse(oldCommunity *entities.Community) (CommunityTransition, error) {
+	err := cr.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+
+	return ChangeMemberRoleTransition{
+		CommID: cr.CommID,
+		UserID: cr.UserID,
+		Role:   oldCommunity.RoleOf(cr.UserID),
+	}, nil
+}
@@ -0,0 +1,109 @@
+package transitions
+
+import (
+	"testing"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeMemberRole(t *testing.T) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	owner := entities.InitUser("owner", "owner")
+	user := entities.InitUser("uniqueid", "userhandle")
+	community.Members[owner.ID] = owner
+	community.Members[user.ID] = user
+	community.Roles[owner.ID] = entities.Owner
+
+	assert.Equal(t, entities.Member, community.RoleOf(user.ID))
+	assert.Equal(t, entities.Role(""), community.RoleOf("outsider"))
+
+	transition := ChangeMemberRoleTransition{
+		CommID: community.ID,
+		UserID: user.ID,
+		Role:   entities.Admin,
+	}
+	newComm, err := transition.Reduce(community)
+	assert.Nil(t, err)
+	assert.Equal(t, entities.Admin, newComm.RoleOf(user.ID))
+	assert.Equal(t, entities.Member, community.RoleOf(user.ID))
+
+	// Giving a member the role they already have is invalid
+	validationErr, ok := transition.Validate(newComm).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "role", validationErr.Field)
+
+	// Demoting to member clears the role
+	newComm, err = ChangeMemberRoleTransition{
+		CommID: community.ID,
+		UserID: user.ID,
+		Role:   entities.Member,
+	}.Reduce(newComm)
+	assert.Nil(t, err)
+	_, ok = newComm.Roles[user.ID]
+	assert.False(t, ok)
+
+	// The last owner can't step down
+	lastOwner := ChangeMemberRoleTransition{
+		CommID: community.ID,
+		UserID: owner.ID,
+		Role:   entities.Admin,
+	}
+	validationErr, ok = lastOwner.Validate(newComm).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "role", validationErr.Field)
+
+	newComm, err = ChangeMemberRoleTransition{
+		CommID: community.ID,
+		UserID: user.ID,
+		Role:   entities.Owner,
+	}.Reduce(newComm)
+	assert.Nil(t, err)
+	newComm, err = lastOwner.Reduce(newComm)
+	assert.Nil(t, err)
+	assert.Equal(t, []entities.UserID{user.ID}, newComm.Owners())
+
+	// Non members and unknown roles
+	validationErr, ok = ChangeMemberRoleTransition{
+		CommID: community.ID,
+		UserID: "outsider",
+		Role:   entities.Admin,
+	}.Validate(newComm).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "user_id", validationErr.Field)
+	validationErr, ok = ChangeMemberRoleTransition{
+		CommID: community.ID,
+		UserID: owner.ID,
+		Role:   "superuser",
+	}.Validate(newComm).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "role", validationErr.Field)
+
+	// Owners can't be removed until they step down
+	err = ModifyCommMembersTransition{
+		Community: newComm,
+		User:      user,
+		ModType:   RemoveMember,
+	}.Validate(newComm)
+	assert.NotNil(t, err)
+}
+
+func TestUpgradeModifyCommMembersRoles(t *testing.T) {
+	// Members added before roles existed had full control of the community
+	upgraded, err := upgradeTransition(transitionUpgrades, ModifyCommMembersTransitionType, 2, map[string]interface{}{
+		"type": string(AddMember),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, string(entities.Admin), upgraded["role"])
+
+	upgraded, err = upgradeTransition(transitionUpgrades, InitCommunityTransitionType, 0, map[string]interface{}{
+		"community": map[string]interface{}{
+			"members": map[string]interface{}{
+				"alice": map[string]interface{}{},
+			},
+		},
+	})
+	assert.Nil(t, err)
+	roles := upgraded["community"].(map[string]interface{})["roles"].(map[string]interface{})
+	assert.Equal(t, string(entities.Admin), roles["alice"])
+}
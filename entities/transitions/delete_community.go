@@ -0,0 +1,65 @@
+package transitions
+
+import (
+	"github.com/eagraf/habitat-node/entities"
+)
+
+// DeleteCommunityTransition stops a node from hosting a community. The orchestrator stops the community's
+// backnet, and if Purge is set deletes the backnet's data as well.
+type DeleteCommunityTransition struct {
+	CommID entities.CommunityID `json:"community_id" mapstructure:"community_id"`
+	Purge  bool                 `json:"purge"`
+}
+
+func (dc DeleteCommunityTransition) Type() TransitionType {
+	return DeleteCommunityTransitionType
+}
+
+func (dc DeleteCommunityTransition) Validate(oldHost *entities.Host) error {
+	if dc.CommID == "" {
+		return newValidationError(dc.Type(), "community_id", "community id is required")
+	}
+	if _, ok := oldHost.Communities[dc.CommID]; !ok {
+		return newValidationError(dc.Type(), "community_id", "community with id %s is not in host", dc.CommID)
+	}
+	return nil
+}
+
+func (dc DeleteCommunityTransition) Reduce(oldHost *entities.Host) (*entities.Host, error) {
+	err := dc.Validate(oldHost)
+	if err != nil {
+		return nil, err
+	}
+	return dc.Replay(oldHost)
+}
+
+// Replay implements HostTransition
+func (dc DeleteCommunityTransition) Replay(oldHost *entities.Host) (*entities.Host, error) {
+	newHost, err := oldHost.Copy()
+	if err != nil {
+		return nil, err
+	}
+
+	delete(newHost.Communities, dc.CommID)
+	return newHost, nil
+}
+
+// Inverse adds the community back to the host. Once a community's backnet has been purged its data is gone, so
+// purging can't be undone.
+func (dc DeleteCommunityTransition) Inverse(oldHost *entities.Host) (HostTransition, error) {
+	err := dc.Validate(oldHost)
+	if err != nil {
+		return nil, err
+	}
+	if dc.Purge {
+		return nil, newNotInvertibleError(dc.Type(), "the backnet of community %s was purged", dc.CommID)
+	}
+
+	community, err := oldHost.Communities[dc.CommID].Copy()
+	if err != nil {
+		return nil, err
+	}
+	return AddCommunityTransition{
+		Community: community,
+	}, nil
+}
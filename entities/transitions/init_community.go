@@ -1,8 +1,6 @@
 package transitions
 
 import (
-	"errors"
-
 	"github.com/eagraf/habitat-node/entities"
 )
 
@@ -18,17 +16,49 @@ func (ic InitCommunityTransition) CommunityID() entities.CommunityID {
 	return ic.Community.ID
 }
 
-func (ic InitCommunityTransition) Reduce(oldCommunity *entities.Community) (*entities.Community, error) {
+func (ic InitCommunityTransition) Validate(oldCommunity *entities.Community) error {
 	// sanity check, this should always be the first transition that sets initial state for the community
 	// a not nil oldCommunity indicates a good change of something fishy going on
 	if oldCommunity != nil {
-		return nil, errors.New("oldCommunity is not nil")
+		return newValidationError(ic.Type(), "community", "community %s has already been initialized", oldCommunity.ID)
+	}
+	if ic.Community == nil {
+		return newValidationError(ic.Type(), "community", "community is required")
+	}
+	if ic.Community.ID == "" {
+		return newValidationError(ic.Type(), "community.id", "community id is required")
+	}
+	err := ic.Community.Validate()
+	if err != nil {
+		return newEntityValidationError(ic.Type(), "community", err)
+	}
+	return nil
+}
+
+func (ic InitCommunityTransition) Reduce(oldCommunity *entities.Community) (*entities.Community, error) {
+	err := ic.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
 	}
+	return ic.Replay(oldCommunity)
+}
 
+// Replay implements CommunityTransition
+func (ic InitCommunityTransition) Replay(oldCommunity *entities.Community) (*entities.Community, error) {
 	newCommunity, err := ic.Community.Copy()
 	if err != nil {
 		return nil, err
 	}
+	newCommunity.LinkMembers()
 
 	return newCommunity, nil
 }
+
+// Inverse always fails, since there is no transition that takes a community back to before it was initialized
+func (ic InitCommunityTransition) Inverse(oldCommunity *entities.Community) (CommunityTransition, error) {
+	err := ic.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+	return nil, newNotInvertibleError(ic.Type(), "community %s can't be uninitialized", ic.Community.ID)
+}
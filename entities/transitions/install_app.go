@@ -0,0 +1,83 @@
+package transitions
+
+import (
+	"fmt"
+
+	"github.com/eagraf/habitat-node/entities"
+)
+
+// InstallAppTransition adds an app to a community. Apps are installed stopped.
+type InstallAppTransition struct {
+	CommID entities.CommunityID `json:"community_id" mapstructure:"community_id"`
+	AppID  entities.AppID       `json:"app_id" mapstructure:"app_id"`
+}
+
+func (ia InstallAppTransition) Type() TransitionType {
+	return InstallAppTransitionType
+}
+
+func (ia InstallAppTransition) CommunityID() entities.CommunityID {
+	return ia.CommID
+}
+
+func (ia InstallAppTransition) Validate(oldCommunity *entities.Community) error {
+	app, err := validateAppTransition(ia.Type(), oldCommunity, ia.CommID, ia.AppID)
+	if err != nil {
+		return err
+	}
+	if app != nil {
+		return newValidationError(ia.Type(), "app_id", "app %s is already installed in community %s", ia.AppID, ia.CommID)
+	}
+	return nil
+}
+
+func (ia InstallAppTransition) Reduce(oldCommunity *entities.Community) (*entities.Community, error) {
+	err := ia.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+	return ia.Replay(oldCommunity)
+}
+
+// Replay implements CommunityTransition
+func (ia InstallAppTransition) Replay(oldCommunity *entities.Community) (*entities.Community, error) {
+	newCommunity, err := oldCommunity.Copy()
+	if err != nil {
+		return nil, fmt.Errorf("error copying community: %s", err.Error())
+	}
+
+	err = newCommunity.InstallApp(ia.AppID)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCommunity, nil
+}
+
+// validateAppTransition does the checks shared by all app transitions, and returns the app if it is installed
+func validateAppTransition(transitionType TransitionType, oldCommunity *entities.Community, commID entities.CommunityID, appID entities.AppID) (*entities.App, error) {
+	if oldCommunity == nil {
+		return nil, newValidationError(transitionType, "community_id", "community %s has not been initialized", commID)
+	}
+	if oldCommunity.ID != commID {
+		return nil, newValidationError(transitionType, "community_id", "transition is for community %s, not %s", commID, oldCommunity.ID)
+	}
+	err := appID.Validate()
+	if err != nil {
+		return nil, newValidationError(transitionType, "app_id", "%s", err.Error())
+	}
+	return oldCommunity.GetApp(appID), nil
+}
+
+// Inverse uninstalls the app again
+func (ia InstallAppTransition) Inverse(oldCommunity *entities.Community) (CommunityTransition, error) {
+	err := ia.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+
+	return UninstallAppTransition{
+		CommID: ia.CommID,
+		AppID:  ia.AppID,
+	}, nil
+}
@@ -0,0 +1,61 @@
+package transitions
+
+import (
+	"testing"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppLifecycle(t *testing.T) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+
+	newComm, err := InstallAppTransition{
+		CommID: community.ID,
+		AppID:  "chat",
+	}.Reduce(community)
+	assert.Nil(t, err)
+	assert.Equal(t, []*entities.App{{AppID: "chat"}}, newComm.Apps)
+	assert.Equal(t, 0, len(community.Apps))
+
+	// Apps can only be installed once, and stopped apps can't be stopped
+	validationErr, ok := InstallAppTransition{CommID: community.ID, AppID: "chat"}.Validate(newComm).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "app_id", validationErr.Field)
+	assert.NotNil(t, StopAppTransition{CommID: community.ID, AppID: "chat"}.Validate(newComm))
+
+	newComm, err = StartAppTransition{CommID: community.ID, AppID: "chat"}.Reduce(newComm)
+	assert.Nil(t, err)
+	assert.True(t, newComm.GetApp("chat").Running)
+	assert.NotNil(t, StartAppTransition{CommID: community.ID, AppID: "chat"}.Validate(newComm))
+
+	stopped, err := StopAppTransition{CommID: community.ID, AppID: "chat"}.Reduce(newComm)
+	assert.Nil(t, err)
+	assert.False(t, stopped.GetApp("chat").Running)
+	assert.True(t, newComm.GetApp("chat").Running)
+
+	// Running apps can be uninstalled, the orchestrator stops them
+	newComm, err = UninstallAppTransition{CommID: community.ID, AppID: "chat"}.Reduce(newComm)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(newComm.Apps))
+	assert.NotNil(t, UninstallAppTransition{CommID: community.ID, AppID: "chat"}.Validate(newComm))
+	assert.NotNil(t, StartAppTransition{CommID: community.ID, AppID: "chat"}.Validate(newComm))
+
+	validationErr, ok = InstallAppTransition{CommID: "community_1", AppID: "chat"}.Validate(newComm).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "community_id", validationErr.Field)
+	validationErr, ok = InstallAppTransition{CommID: community.ID}.Validate(newComm).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "app_id", validationErr.Field)
+}
+
+func TestUpgradeCommunityApps(t *testing.T) {
+	upgraded, err := upgradeTransition(transitionUpgrades, InitCommunityTransitionType, 3, map[string]interface{}{
+		"community": map[string]interface{}{
+			"apps": []interface{}{"chat"},
+		},
+	})
+	assert.Nil(t, err)
+	apps := upgraded["community"].(map[string]interface{})["apps"].([]interface{})
+	assert.Equal(t, map[string]interface{}{"id": "chat", "running": false}, apps[0])
+}
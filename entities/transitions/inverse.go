@@ -0,0 +1,41 @@
+package transitions
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Committed transitions are never removed from the log. A transition whose side effects couldn't be carried out
+// is undone by committing its inverse after it, which is called a compensating transition. The inverse of a
+// transition is worked out from the state right before the transition was applied, since that has the values
+// the transition overwrote.
+
+// ErrNotInvertible is returned by Inverse for transitions that can't be undone by a single transition
+var ErrNotInvertible = errors.New("transition can't be inverted")
+
+func newNotInvertibleError(transitionType TransitionType, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s: %s", ErrNotInvertible, transitionType, fmt.Sprintf(format, args...))
+}
+
+// SideEffectError is returned by a TransitionSubscriber when a committed transition couldn't be carried out,
+// and the transition should be compensated so that the state matches what the node is actually doing
+type SideEffectError struct {
+	Type TransitionType
+	Err  error
+}
+
+func (se *SideEffectError) Error() string {
+	return fmt.Sprintf("failed to carry out %s transition: %s", se.Type, se.Err.Error())
+}
+
+func (se *SideEffectError) Unwrap() error {
+	return se.Err
+}
+
+// NewSideEffectError wraps the reason a transition's side effects failed
+func NewSideEffectError(transitionType TransitionType, err error) *SideEffectError {
+	return &SideEffectError{
+		Type: transitionType,
+		Err:  err,
+	}
+}
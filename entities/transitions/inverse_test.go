@@ -0,0 +1,146 @@
+package transitions
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+// inverseTestCommunity has an owner, an admin, a regular member, a banned user, a stopped and a running app,
+// and two peers
+func inverseTestCommunity(t *testing.T) *entities.Community {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	for _, id := range []entities.UserID{"owner", "alice", "bob"} {
+		assert.Nil(t, community.AddMember(entities.InitUser(id, string(id))))
+	}
+	community.Roles["owner"] = entities.Owner
+	community.Roles["alice"] = entities.Admin
+	assert.Nil(t, community.BanMember(&entities.Ban{
+		UserID:    "carol",
+		Reason:    "spam",
+		BannedBy:  "owner",
+		Timestamp: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC),
+	}))
+	assert.Nil(t, community.InstallApp("notes"))
+	community.GetApp("notes").Running = true
+	assert.Nil(t, community.InstallApp("chat"))
+	community.Peers = append(community.Peers, testPeer(1, "127.0.0.1:7000"), testPeer(2, "127.0.0.1:7001"))
+	return community
+}
+
+func TestCommunityInverses(t *testing.T) {
+	community := inverseTestCommunity(t)
+	backnet := entities.InitBacknet(entities.IPFS)
+	backnet.Bootstrap = []string{"/ip4/10.0.0.1/tcp/4001"}
+
+	for _, transition := range []CommunityTransition{
+		UpdateBacknetTransition{CommID: community.ID, OldBacknet: community.Backnet, NewBacknet: backnet},
+		MigrateBacknetTransition{CommID: community.ID, OldBacknet: community.Backnet, NewBacknet: entities.InitBacknet(entities.Local)},
+		ChangeMemberRoleTransition{CommID: community.ID, UserID: "bob", Role: entities.Admin},
+		ChangeMemberRoleTransition{CommID: community.ID, UserID: "alice", Role: entities.Member},
+		InstallAppTransition{CommID: community.ID, AppID: "wiki"},
+		UninstallAppTransition{CommID: community.ID, AppID: "chat"},
+		StartAppTransition{CommID: community.ID, AppID: "chat"},
+		StopAppTransition{CommID: community.ID, AppID: "notes"},
+		AddPeerTransition{CommID: community.ID, Peer: testPeer(3, "127.0.0.1:7002")},
+		RemovePeerTransition{CommID: community.ID, Key: community.Peers[1].Key},
+		RenameCommunityTransition{CommID: community.ID, Name: "Renamed"},
+		ArchiveCommunityTransition{CommID: community.ID, Archived: true},
+		ModifyCommMembersTransition{Community: community, User: entities.InitUser("dave", "dave"), ModType: AddMember},
+		ModifyCommMembersTransition{Community: community, User: community.Members["alice"], ModType: RemoveMember},
+		ModifyCommMembersTransition{Community: community, User: entities.InitUser("erin", "erin"), ModType: BanMember, BannedBy: "owner", Timestamp: time.Now()},
+		ModifyCommMembersTransition{Community: community, User: entities.InitUser("carol", "carol"), ModType: UnbanMember},
+	} {
+		after, err := transition.Reduce(community)
+		assert.Nil(t, err, transition.Type())
+
+		inverse, err := transition.Inverse(community)
+		assert.Nil(t, err, transition.Type())
+		restored, err := inverse.Reduce(after)
+		assert.Nil(t, err, transition.Type())
+		assert.Equal(t, community, restored, transition.Type())
+	}
+}
+
+func TestNotInvertible(t *testing.T) {
+	community := inverseTestCommunity(t)
+
+	for _, transition := range []CommunityTransition{
+		// Unbanning wouldn't make bob a member again
+		ModifyCommMembersTransition{Community: community, User: community.Members["bob"], ModType: BanMember, BannedBy: "owner", Timestamp: time.Now()},
+		// Reinstalled apps are stopped
+		UninstallAppTransition{CommID: community.ID, AppID: "notes"},
+	} {
+		_, err := transition.Reduce(community)
+		assert.Nil(t, err)
+		_, err = transition.Inverse(community)
+		assert.True(t, errors.Is(err, ErrNotInvertible), transition.Type())
+	}
+
+	_, err := InitCommunityTransition{Community: community}.Inverse(nil)
+	assert.True(t, errors.Is(err, ErrNotInvertible))
+
+	// Inverting a transition that isn't valid against the given community fails like validation
+	_, err = StartAppTransition{CommID: community.ID, AppID: "notes"}.Inverse(community)
+	_, ok := err.(*ValidationError)
+	assert.True(t, ok)
+}
+
+func TestHostInverses(t *testing.T) {
+	host := entities.InitHost()
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	added, err := AddCommunityTransition{Community: community}.Reduce(host)
+	assert.Nil(t, err)
+
+	inverse, err := AddCommunityTransition{Community: community}.Inverse(host)
+	assert.Nil(t, err)
+	assert.Equal(t, DeleteCommunityTransition{CommID: community.ID}, inverse)
+	restored, err := inverse.Reduce(added)
+	assert.Nil(t, err)
+	assert.Equal(t, host, restored)
+
+	inverse, err = DeleteCommunityTransition{CommID: community.ID}.Inverse(added)
+	assert.Nil(t, err)
+	deleted, err := DeleteCommunityTransition{CommID: community.ID}.Reduce(added)
+	assert.Nil(t, err)
+	restored, err = inverse.Reduce(deleted)
+	assert.Nil(t, err)
+	assert.Equal(t, added, restored)
+
+	_, err = DeleteCommunityTransition{CommID: community.ID, Purge: true}.Inverse(added)
+	assert.True(t, errors.Is(err, ErrNotInvertible))
+}
+
+func TestSignedCompensation(t *testing.T) {
+	key := testKey(1)
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	peer := testPeer(1, "127.0.0.1:7000")
+	community.Peers = append(community.Peers, peer)
+
+	tw := &TransitionWrapper{
+		Type:        RenameCommunityTransitionType,
+		Transition:  RenameCommunityTransition{CommID: community.ID, Name: "Renamed"},
+		Compensates: 7,
+	}
+	err := tw.Sign(peer.Key, key)
+	assert.Nil(t, err)
+
+	marshalled, err := json.Marshal(tw)
+	assert.Nil(t, err)
+	var decoded TransitionWrapper
+	err = json.Unmarshal(marshalled, &decoded)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), decoded.Compensates)
+	assert.Nil(t, VerifyCommunityTransition(&decoded, community))
+
+	// Which transition is compensated is covered by the signature
+	decoded.Compensates = 8
+	err = VerifyCommunityTransition(&decoded, community)
+	validationErr, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "signature", validationErr.Field)
+}
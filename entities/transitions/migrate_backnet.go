@@ -0,0 +1,84 @@
+package transitions
+
+import (
+	"fmt"
+
+	"github.com/eagraf/habitat-node/entities"
+)
+
+// MigrateBacknetTransition switches a community to a different backnet implementation. Each peer's orchestrator
+// copies the community's files from the old backnet to the new one before switching over.
+type MigrateBacknetTransition struct {
+	CommID     entities.CommunityID `json:"community_id" mapstructure:"community_id"`
+	OldBacknet *entities.Backnet    `json:"old_backnet" mapstructure:"old_backnet"`
+	NewBacknet *entities.Backnet    `json:"new_backnet" mapstructure:"new_backnet"`
+}
+
+func (mb MigrateBacknetTransition) Type() TransitionType {
+	return MigrateBacknetTransitionType
+}
+
+func (mb MigrateBacknetTransition) CommunityID() entities.CommunityID {
+	return mb.CommID
+}
+
+func (mb MigrateBacknetTransition) Validate(oldCommunity *entities.Community) error {
+	if oldCommunity == nil {
+		return newValidationError(mb.Type(), "community_id", "community %s has not been initialized", mb.CommID)
+	}
+	if oldCommunity.ID != mb.CommID {
+		return newValidationError(mb.Type(), "community_id", "transition is for community %s, not %s", mb.CommID, oldCommunity.ID)
+	}
+	if mb.OldBacknet == nil {
+		return newValidationError(mb.Type(), "old_backnet", "old backnet is required")
+	}
+	if mb.NewBacknet == nil {
+		return newValidationError(mb.Type(), "new_backnet", "new backnet is required")
+	}
+	// The old backnet is what peers migrate from, and what compensating the migration restores
+	if !oldCommunity.Backnet.Equal(mb.OldBacknet) {
+		return newValidationError(mb.Type(), "old_backnet", "old backnet does not match the current backnet of community %s", mb.CommID)
+	}
+	if mb.NewBacknet.Type == mb.OldBacknet.Type {
+		return newValidationError(mb.Type(), "new_backnet.type", "community %s already has a %s backnet, use a %s transition to reconfigure it", mb.CommID, mb.NewBacknet.Type, UpdateBacknetTransitionType)
+	}
+	err := mb.NewBacknet.Validate()
+	if err != nil {
+		return newEntityValidationError(mb.Type(), "new_backnet", err)
+	}
+	return nil
+}
+
+func (mb MigrateBacknetTransition) Reduce(oldCommunity *entities.Community) (*entities.Community, error) {
+	err := mb.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+	return mb.Replay(oldCommunity)
+}
+
+// Replay implements CommunityTransition
+func (mb MigrateBacknetTransition) Replay(oldCommunity *entities.Community) (*entities.Community, error) {
+	newCommunity, err := oldCommunity.Copy()
+	if err != nil {
+		return nil, fmt.Errorf("error copying community: %s", err.Error())
+	}
+
+	newCommunity.Backnet = mb.NewBacknet
+
+	return newCommunity, nil
+}
+
+// Inverse migrates the community back to the backnet it had before
+func (mb MigrateBacknetTransition) Inverse(oldCommunity *entities.Community) (CommunityTransition, error) {
+	err := mb.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+
+	return MigrateBacknetTransition{
+		CommID:     mb.CommID,
+		OldBacknet: mb.NewBacknet.Copy(),
+		NewBacknet: oldCommunity.Backnet.Copy(),
+	}, nil
+}
@@ -0,0 +1,57 @@
+package transitions
+
+import (
+	"testing"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateBacknet(t *testing.T) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	localBacknet := entities.InitBacknet(entities.Local)
+
+	transition := MigrateBacknetTransition{
+		CommID:     community.ID,
+		OldBacknet: community.Backnet,
+		NewBacknet: localBacknet,
+	}
+	newComm, err := transition.Reduce(community)
+	assert.Nil(t, err)
+	assert.Equal(t, entities.Local, newComm.Backnet.Type)
+	assert.Equal(t, entities.IPFS, community.Backnet.Type)
+
+	// The whole old backnet has to match the community's, and the type has to change
+	validationErr, ok := transition.Validate(newComm).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "old_backnet", validationErr.Field)
+	oldBacknet := community.Backnet.Copy()
+	oldBacknet.Bootstrap = append(oldBacknet.Bootstrap, "/ip4/10.0.0.1/tcp/4001")
+	validationErr, ok = MigrateBacknetTransition{
+		CommID:     community.ID,
+		OldBacknet: oldBacknet,
+		NewBacknet: localBacknet,
+	}.Validate(community).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "old_backnet", validationErr.Field)
+	// Lists and maps that were left out match empty ones
+	assert.Nil(t, MigrateBacknetTransition{
+		CommID:     community.ID,
+		OldBacknet: &entities.Backnet{Type: entities.IPFS},
+		NewBacknet: localBacknet,
+	}.Validate(community))
+	validationErr, ok = MigrateBacknetTransition{
+		CommID:     community.ID,
+		OldBacknet: community.Backnet,
+		NewBacknet: entities.InitBacknet(entities.IPFS),
+	}.Validate(community).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "new_backnet.type", validationErr.Field)
+	validationErr, ok = MigrateBacknetTransition{
+		CommID:     community.ID,
+		OldBacknet: community.Backnet,
+		NewBacknet: entities.InitBacknet("ftp"),
+	}.Validate(community).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "new_backnet.type", validationErr.Field)
+}
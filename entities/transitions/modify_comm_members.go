@@ -1,7 +1,7 @@
 package transitions
 
 import (
-	"errors"
+	"time"
 
 	"github.com/eagraf/habitat-node/entities"
 )
@@ -13,12 +13,20 @@ const (
 	AddMember    ModifyType = "ADD_MEMBER"
 	RemoveMember ModifyType = "REMOVE_MEMBER"
 	BanMember    ModifyType = "BAN_MEMBER"
+	UnbanMember  ModifyType = "UNBAN_MEMBER"
 )
 
 type ModifyCommMembersTransition struct {
 	Community *entities.Community `json:"community"`
 	User      *entities.User      `json:"user"`
-	ModType   ModifyType          `json:"type"`
+	ModType   ModifyType          `json:"type" mapstructure:"type"`
+	// Role is given to the user by AddMember, and defaults to entities.Member
+	Role entities.Role `json:"role,omitempty"`
+
+	// Only used by BanMember. The timestamp is decided by the proposer, so that every peer records the same ban.
+	Reason    string          `json:"reason,omitempty"`
+	BannedBy  entities.UserID `json:"banned_by,omitempty" mapstructure:"banned_by"`
+	Timestamp time.Time       `json:"timestamp"`
 }
 
 func (mt ModifyCommMembersTransition) Type() TransitionType {
@@ -29,9 +37,78 @@ func (mt ModifyCommMembersTransition) CommunityID() entities.CommunityID {
 	return mt.Community.ID
 }
 
+func (mt ModifyCommMembersTransition) Validate(oldComm *entities.Community) error {
+	if oldComm == nil {
+		return newValidationError(mt.Type(), "community", "community has not been initialized")
+	}
+	if mt.Community == nil || mt.Community.ID != oldComm.ID {
+		return newValidationError(mt.Type(), "community", "transition is not for community %s", oldComm.ID)
+	}
+	if mt.User == nil {
+		return newValidationError(mt.Type(), "user", "user is required")
+	}
+
+	_, isMember := oldComm.Members[mt.User.ID]
+	switch mt.ModType {
+	case AddMember:
+		if isMember {
+			return newValidationError(mt.Type(), "user", "user %s is already a member of community %s", mt.User.ID, oldComm.ID)
+		}
+		if oldComm.IsBanned(mt.User.ID) {
+			return newValidationError(mt.Type(), "user", "user %s is banned from community %s", mt.User.ID, oldComm.ID)
+		}
+		err := mt.User.Validate()
+		if err != nil {
+			return newEntityValidationError(mt.Type(), "user", err)
+		}
+		// Only owners can make other members owners, with a ChangeMemberRoleTransition
+		if mt.Role != "" && (!mt.Role.Valid() || mt.Role == entities.Owner) {
+			return newValidationError(mt.Type(), "role", "new members can't be given role %s", mt.Role)
+		}
+	case RemoveMember:
+		if !isMember {
+			return newValidationError(mt.Type(), "user", "user %s is not a member of community %s", mt.User.ID, oldComm.ID)
+		}
+		if oldComm.RoleOf(mt.User.ID) == entities.Owner {
+			return newValidationError(mt.Type(), "user", "owners must give up their role before they are removed")
+		}
+	case BanMember:
+		if oldComm.IsBanned(mt.User.ID) {
+			return newValidationError(mt.Type(), "user", "user %s is already banned from community %s", mt.User.ID, oldComm.ID)
+		}
+		if oldComm.RoleOf(mt.User.ID) == entities.Owner {
+			return newValidationError(mt.Type(), "user", "owners must give up their role before they are banned")
+		}
+		if _, ok := oldComm.Members[mt.BannedBy]; !ok {
+			return newValidationError(mt.Type(), "banned_by", "banning user %s is not a member of community %s", mt.BannedBy, oldComm.ID)
+		}
+		if mt.BannedBy == mt.User.ID {
+			return newValidationError(mt.Type(), "banned_by", "users can't ban themselves")
+		}
+		if mt.Timestamp.IsZero() {
+			return newValidationError(mt.Type(), "timestamp", "timestamp is required")
+		}
+	case UnbanMember:
+		if !oldComm.IsBanned(mt.User.ID) {
+			return newValidationError(mt.Type(), "user", "user %s is not banned from community %s", mt.User.ID, oldComm.ID)
+		}
+	default:
+		return newValidationError(mt.Type(), "type", "unknown modify type %s", mt.ModType)
+	}
+	return nil
+}
+
 func (mt ModifyCommMembersTransition) Reduce(oldComm *entities.Community) (*entities.Community, error) {
-	newCommunity, err := mt.Community.Copy()
+	err := mt.Validate(oldComm)
+	if err != nil {
+		return nil, err
+	}
+	return mt.Replay(oldComm)
+}
 
+// Replay implements CommunityTransition
+func (mt ModifyCommMembersTransition) Replay(oldComm *entities.Community) (*entities.Community, error) {
+	newCommunity, err := oldComm.Copy()
 	if err != nil {
 		return nil, err
 	}
@@ -39,10 +116,20 @@ func (mt ModifyCommMembersTransition) Reduce(oldComm *entities.Community) (*enti
 	switch mt.ModType {
 	case AddMember:
 		err = newCommunity.AddMember(mt.User)
+		if err == nil && mt.Role != "" {
+			err = newCommunity.SetRole(mt.User.ID, mt.Role)
+		}
 	case RemoveMember:
 		err = newCommunity.RemoveMember(mt.User)
 	case BanMember:
-		err = errors.New("Banning members from communities is unimplemented!")
+		err = newCommunity.BanMember(&entities.Ban{
+			UserID:    mt.User.ID,
+			Reason:    mt.Reason,
+			BannedBy:  mt.BannedBy,
+			Timestamp: mt.Timestamp,
+		})
+	case UnbanMember:
+		err = newCommunity.UnbanMember(mt.User.ID)
 	}
 
 	if err != nil {
@@ -50,3 +137,43 @@ func (mt ModifyCommMembersTransition) Reduce(oldComm *entities.Community) (*enti
 	}
 	return newCommunity, err
 }
+
+// Inverse removes an added member, adds a removed member back with the role they had, and bans an unbanned user
+// again with the original ban. Banning a member also removes them from the community, which takes two
+// transitions to undo, so only bans of users that weren't members can be inverted.
+func (mt ModifyCommMembersTransition) Inverse(oldComm *entities.Community) (CommunityTransition, error) {
+	err := mt.Validate(oldComm)
+	if err != nil {
+		return nil, err
+	}
+
+	inverse := ModifyCommMembersTransition{
+		Community: mt.Community,
+		User:      mt.User,
+	}
+	switch mt.ModType {
+	case AddMember:
+		inverse.ModType = RemoveMember
+	case RemoveMember:
+		inverse.ModType = AddMember
+		inverse.User, err = oldComm.Members[mt.User.ID].Copy()
+		if err != nil {
+			return nil, err
+		}
+		if role := oldComm.RoleOf(mt.User.ID); role != entities.Member {
+			inverse.Role = role
+		}
+	case BanMember:
+		if _, isMember := oldComm.Members[mt.User.ID]; isMember {
+			return nil, newNotInvertibleError(mt.Type(), "user %s was a member of community %s when they were banned", mt.User.ID, oldComm.ID)
+		}
+		inverse.ModType = UnbanMember
+	case UnbanMember:
+		ban := oldComm.Bans[mt.User.ID]
+		inverse.ModType = BanMember
+		inverse.Reason = ban.Reason
+		inverse.BannedBy = ban.BannedBy
+		inverse.Timestamp = ban.Timestamp
+	}
+	return inverse, nil
+}
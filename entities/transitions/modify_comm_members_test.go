@@ -1,7 +1,9 @@
 package transitions
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/eagraf/habitat-node/entities"
 	"github.com/stretchr/testify/assert"
@@ -23,7 +25,17 @@ func TestModifyCommunityMembers(t *testing.T) {
 	val, ok := newComm.Members[user.ID]
 	assert.NotNil(t, val)
 	assert.True(t, ok)
-	assert.Equal(t, user, val)
+	assert.Equal(t, user.ID, val.ID)
+	assert.Equal(t, []entities.CommunityID{"community_0"}, val.Communities)
+	assert.Equal(t, 0, len(newComm.CheckMembership()))
+	// The transition's user isn't touched
+	assert.Equal(t, 0, len(user.Communities))
+
+	// Adding the same user again is invalid
+	err = transition.Validate(newComm)
+	validationErr, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "user", validationErr.Field)
 
 	transition = ModifyCommMembersTransition{
 		Community: newComm,
@@ -35,13 +47,157 @@ func TestModifyCommunityMembers(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 0, len(newComm.Members))
 
-	transition = ModifyCommMembersTransition{
-		Community: newComm,
+}
+
+func TestBanCommunityMember(t *testing.T) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	admin := entities.InitUser("admin", "admin")
+	user := entities.InitUser("uniqueid", "userhandle")
+	community.Members[admin.ID] = admin
+	community.Members[user.ID] = user
+
+	banned := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	transition := ModifyCommMembersTransition{
+		Community: community,
 		User:      user,
 		ModType:   BanMember,
+		Reason:    "spam",
+		BannedBy:  admin.ID,
+		Timestamp: banned,
 	}
 
-	newComm, err = transition.Reduce(newComm)
+	newComm, err := transition.Reduce(community)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(newComm.Members))
+	assert.True(t, newComm.IsBanned(user.ID))
+	assert.Equal(t, &entities.Ban{
+		UserID:    user.ID,
+		Reason:    "spam",
+		BannedBy:  admin.ID,
+		Timestamp: banned,
+	}, newComm.Bans[user.ID])
+
+	// The old community is untouched
+	assert.Equal(t, 2, len(community.Members))
+	assert.False(t, community.IsBanned(user.ID))
+
+	// Banned users can't be banned again, or added back
+	err = transition.Validate(newComm)
+	assert.NotNil(t, err)
+	err = ModifyCommMembersTransition{
+		Community: newComm,
+		User:      user,
+		ModType:   AddMember,
+	}.Validate(newComm)
+	validationErr, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "user", validationErr.Field)
+
+	// Unbanning lets them be added again
+	newComm, err = ModifyCommMembersTransition{
+		Community: newComm,
+		User:      user,
+		ModType:   UnbanMember,
+	}.Reduce(newComm)
+	assert.Nil(t, err)
+	assert.False(t, newComm.IsBanned(user.ID))
+	err = ModifyCommMembersTransition{
+		Community: newComm,
+		User:      user,
+		ModType:   UnbanMember,
+	}.Validate(newComm)
 	assert.NotNil(t, err)
 
+	newComm, err = ModifyCommMembersTransition{
+		Community: newComm,
+		User:      user,
+		ModType:   AddMember,
+	}.Reduce(newComm)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(newComm.Members))
+}
+
+func TestBanCommunityMemberValidation(t *testing.T) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	admin := entities.InitUser("admin", "admin")
+	user := entities.InitUser("uniqueid", "userhandle")
+	community.Members[admin.ID] = admin
+
+	valid := ModifyCommMembersTransition{
+		Community: community,
+		User:      user,
+		ModType:   BanMember,
+		BannedBy:  admin.ID,
+		Timestamp: time.Now(),
+	}
+	// Users that aren't members can be banned preemptively
+	assert.Nil(t, valid.Validate(community))
+
+	noBanner := valid
+	noBanner.BannedBy = "outsider"
+	validationErr, ok := noBanner.Validate(community).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "banned_by", validationErr.Field)
+
+	self := valid
+	self.User = admin
+	validationErr, ok = self.Validate(community).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "banned_by", validationErr.Field)
+
+	noTimestamp := valid
+	noTimestamp.Timestamp = time.Time{}
+	validationErr, ok = noTimestamp.Validate(community).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "timestamp", validationErr.Field)
+}
+
+func TestUnmarshalBanTransition(t *testing.T) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	banned := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	community.Bans["spammer"] = &entities.Ban{
+		UserID:    "spammer",
+		BannedBy:  "admin",
+		Timestamp: banned,
+	}
+
+	marshalled, err := json.Marshal(&TransitionWrapper{
+		Type: ModifyCommMembersTransitionType,
+		Transition: ModifyCommMembersTransition{
+			Community: community,
+			User:      entities.InitUser("uniqueid", "userhandle"),
+			ModType:   BanMember,
+			Reason:    "spam",
+			BannedBy:  "admin",
+			Timestamp: banned,
+		},
+	})
+	assert.Nil(t, err)
+
+	var tw TransitionWrapper
+	err = json.Unmarshal(marshalled, &tw)
+	assert.Nil(t, err)
+	transition, ok := tw.Transition.(*ModifyCommMembersTransition)
+	assert.True(t, ok)
+	assert.Equal(t, BanMember, transition.ModType)
+	assert.Equal(t, "spam", transition.Reason)
+	assert.True(t, banned.Equal(transition.Timestamp))
+	assert.True(t, banned.Equal(transition.Community.Bans["spammer"].Timestamp))
+}
+
+func TestAddInvalidMember(t *testing.T) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	user := entities.InitUser("alice", "alice smith")
+	user.PublicKey = "not a key"
+
+	err := ModifyCommMembersTransition{
+		Community: community,
+		User:      user,
+		ModType:   AddMember,
+	}.Validate(community)
+	validationErr, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "user.handle", validationErr.Field)
+	assert.Equal(t, 2, len(validationErr.Fields))
+	assert.Equal(t, "user.public_key", validationErr.Fields[1].Field)
 }
@@ -0,0 +1,65 @@
+package transitions
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/eagraf/habitat-node/entities"
+)
+
+// benchCommunity builds a community with the given number of members
+func benchCommunity(members int) *entities.Community {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	for i := 0; i < members; i++ {
+		user := entities.InitUser(entities.UserID(fmt.Sprintf("user_%d", i)), fmt.Sprintf("handle_%d", i))
+		user.Communities = append(user.Communities, community.ID)
+		community.Members[user.ID] = user
+	}
+	community.Roles["user_0"] = entities.Owner
+	return community
+}
+
+func benchmarkReduce(b *testing.B, transition func(community *entities.Community) CommunityTransition) {
+	for _, members := range []int{1000, 5000, 10000} {
+		community := benchCommunity(members)
+		reduced := transition(community)
+		b.Run(fmt.Sprintf("members=%d", members), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := reduced.Reduce(community)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReduceAddMember(b *testing.B) {
+	benchmarkReduce(b, func(community *entities.Community) CommunityTransition {
+		return ModifyCommMembersTransition{
+			Community: community,
+			User:      entities.InitUser("new_user", "new_handle"),
+			ModType:   AddMember,
+		}
+	})
+}
+
+func BenchmarkReduceChangeMemberRole(b *testing.B) {
+	benchmarkReduce(b, func(community *entities.Community) CommunityTransition {
+		return ChangeMemberRoleTransition{
+			CommID: community.ID,
+			UserID: "user_1",
+			Role:   entities.Admin,
+		}
+	})
+}
+
+func BenchmarkReduceInstallApp(b *testing.B) {
+	benchmarkReduce(b, func(community *entities.Community) CommunityTransition {
+		return InstallAppTransition{
+			CommID: community.ID,
+			AppID:  "chat",
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package transitions
+
+import (
+	"fmt"
+
+	"github.com/eagraf/habitat-node/entities"
+)
+
+// RemovePeerTransition stops a node from hosting a community. The peer no longer takes part in consensus
+// from the sequence number after the one the transition is committed at.
+type RemovePeerTransition struct {
+	CommID entities.CommunityID `json:"community_id" mapstructure:"community_id"`
+	Key    string               `json:"key"`
+}
+
+func (rp RemovePeerTransition) Type() TransitionType {
+	return RemovePeerTransitionType
+}
+
+func (rp RemovePeerTransition) CommunityID() entities.CommunityID {
+	return rp.CommID
+}
+
+func (rp RemovePeerTransition) Validate(oldCommunity *entities.Community) error {
+	if oldCommunity == nil {
+		return newValidationError(rp.Type(), "community_id", "community %s has not been initialized", rp.CommID)
+	}
+	if oldCommunity.ID != rp.CommID {
+		return newValidationError(rp.Type(), "community_id", "transition is for community %s, not %s", rp.CommID, oldCommunity.ID)
+	}
+
+	for _, peer := range oldCommunity.Peers {
+		if peer.Key == rp.Key {
+			// Without any peers, nothing could ever be committed again
+			if len(oldCommunity.Peers) == 1 {
+				return newValidationError(rp.Type(), "key", "peer %s is the last peer hosting community %s", rp.Key, oldCommunity.ID)
+			}
+			return nil
+		}
+	}
+	return newValidationError(rp.Type(), "key", "peer %s is not hosting community %s", rp.Key, oldCommunity.ID)
+}
+
+func (rp RemovePeerTransition) Reduce(oldCommunity *entities.Community) (*entities.Community, error) {
+	err := rp.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+	return rp.Replay(oldCommunity)
+}
+
+// Replay implements CommunityTransition
+func (rp RemovePeerTransition) Replay(oldCommunity *entities.Community) (*entities.Community, error) {
+	newCommunity, err := oldCommunity.Copy()
+	if err != nil {
+		return nil, fmt.Errorf("error copying community: %s", err.Error())
+	}
+
+	peers := make([]*entities.Peer, 0, len(newCommunity.Peers)-1)
+	for _, peer := range newCommunity.Peers {
+		if peer.Key != rp.Key {
+			peers = append(peers, peer)
+		}
+	}
+	newCommunity.Peers = peers
+
+	return newCommunity, nil
+}
+
+// Inverse adds the peer back at the address it had
+func (rp RemovePeerTransition) Inverse(oldCommunity *entities.Community) (CommunityTransition, error) {
+	err := rp.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed *entities.Peer
+	for _, peer := range oldCommunity.Peers {
+		if peer.Key == rp.Key {
+			removed = peer.Copy()
+		}
+	}
+	return AddPeerTransition{
+		CommID: rp.CommID,
+		Peer:   removed,
+	}, nil
+}
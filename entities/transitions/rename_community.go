@@ -0,0 +1,73 @@
+package transitions
+
+import (
+	"fmt"
+
+	"github.com/eagraf/habitat-node/entities"
+)
+
+type RenameCommunityTransition struct {
+	CommID entities.CommunityID `json:"community_id" mapstructure:"community_id"`
+	Name   string               `json:"name"`
+}
+
+func (rc RenameCommunityTransition) Type() TransitionType {
+	return RenameCommunityTransitionType
+}
+
+func (rc RenameCommunityTransition) CommunityID() entities.CommunityID {
+	return rc.CommID
+}
+
+func (rc RenameCommunityTransition) Validate(oldCommunity *entities.Community) error {
+	if oldCommunity == nil {
+		return newValidationError(rc.Type(), "community_id", "community %s has not been initialized", rc.CommID)
+	}
+	if oldCommunity.ID != rc.CommID {
+		return newValidationError(rc.Type(), "community_id", "transition is for community %s, not %s", rc.CommID, oldCommunity.ID)
+	}
+	if rc.Name == "" {
+		return newValidationError(rc.Type(), "name", "name is required")
+	}
+	err := entities.ValidateCommunityName(rc.Name)
+	if err != nil {
+		return newValidationError(rc.Type(), "name", "%s", err.Error())
+	}
+	if rc.Name == oldCommunity.Name {
+		return newValidationError(rc.Type(), "name", "community %s is already named %s", rc.CommID, rc.Name)
+	}
+	return nil
+}
+
+func (rc RenameCommunityTransition) Reduce(oldCommunity *entities.Community) (*entities.Community, error) {
+	err := rc.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+	return rc.Replay(oldCommunity)
+}
+
+// Replay implements CommunityTransition
+func (rc RenameCommunityTransition) Replay(oldCommunity *entities.Community) (*entities.Community, error) {
+	newCommunity, err := oldCommunity.Copy()
+	if err != nil {
+		return nil, fmt.Errorf("error copying community: %s", err.Error())
+	}
+
+	newCommunity.Name = rc.Name
+
+	return newCommunity, nil
+}
+
+// Inverse gives the community back its old name
+func (rc RenameCommunityTransition) Inverse(oldCommunity *entities.Community) (CommunityTransition, error) {
+	err := rc.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+
+	return RenameCommunityTransition{
+		CommID: rc.CommID,
+		Name:   oldCommunity.Name,
+	}, nil
+}
@@ -0,0 +1,66 @@
+package transitions
+
+import (
+	"testing"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenameCommunity(t *testing.T) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+
+	newComm, err := RenameCommunityTransition{CommID: community.ID, Name: "Our Community"}.Reduce(community)
+	assert.Nil(t, err)
+	assert.Equal(t, "Our Community", newComm.Name)
+	assert.Equal(t, "My Community", community.Name)
+
+	validationErr, ok := RenameCommunityTransition{CommID: community.ID, Name: "Our Community"}.Validate(newComm).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "name", validationErr.Field)
+	validationErr, ok = RenameCommunityTransition{CommID: community.ID}.Validate(newComm).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "name", validationErr.Field)
+	validationErr, ok = RenameCommunityTransition{CommID: "community_1", Name: "Their Community"}.Validate(newComm).(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "community_id", validationErr.Field)
+}
+
+func TestArchiveCommunity(t *testing.T) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+
+	archived, err := ArchiveCommunityTransition{CommID: community.ID, Archived: true}.Reduce(community)
+	assert.Nil(t, err)
+	assert.True(t, archived.Archived)
+	assert.False(t, community.Archived)
+
+	// Archiving has to change something
+	assert.NotNil(t, ArchiveCommunityTransition{CommID: community.ID, Archived: true}.Validate(archived))
+	assert.NotNil(t, ArchiveCommunityTransition{CommID: community.ID, Archived: false}.Validate(community))
+
+	unarchived, err := ArchiveCommunityTransition{CommID: community.ID, Archived: false}.Reduce(archived)
+	assert.Nil(t, err)
+	assert.False(t, unarchived.Archived)
+}
+
+func TestDeleteCommunity(t *testing.T) {
+	host := entities.InitHost()
+	host.Communities["community_0"] = entities.InitCommunity("community_0", "My Community", entities.IPFS)
+
+	newHost, err := DeleteCommunityTransition{CommID: "community_0", Purge: true}.Reduce(host)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(newHost.Communities))
+	assert.Equal(t, 1, len(host.Communities))
+
+	err = DeleteCommunityTransition{CommID: "community_0"}.Validate(newHost)
+	validationErr, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "community_id", validationErr.Field)
+}
+
+func TestUnmarshalDeleteCommunity(t *testing.T) {
+	var tw TransitionWrapper
+	err := tw.UnmarshalJSON([]byte(`{"type":"DELETE_COMMUNITY","version":4,"sequence_number":2,"transition":{"community_id":"community_0","purge":true}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, &DeleteCommunityTransition{CommID: "community_0", Purge: true}, tw.Transition)
+}
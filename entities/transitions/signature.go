@@ -0,0 +1,280 @@
+package transitions
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/eagraf/habitat-node/entities"
+)
+
+// FirstSignedTransitionVersion is the first schema version in which community transitions are signed. Unsigned
+// transitions written with an earlier version are only accepted when replaying a node's own log.
+const FirstSignedTransitionVersion = 2
+
+// ErrInvalidSignature is returned when a signature does not match the transition and key
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// nonceSize is the number of random bytes in a transition's nonce
+const nonceSize = 16
+
+// SignerPolicy decides who in a community is allowed to sign a type of transition
+type SignerPolicy struct {
+	MinRole entities.Role // Members with at least this role, signing with the public key of their User. Empty if members can't sign.
+	Peers   bool          // Peers hosting the community, signing with their peer key
+}
+
+// signerPolicies lists which authors can sign each type of community transition. A new community is initialized
+// by one of its peers, since it doesn't have any members yet. Admins moderate the community, while only owners
+// can change who the admins are.
+var signerPolicies = map[TransitionType]SignerPolicy{
+	InitCommunityTransitionType:     {Peers: true},
+	UpdateBacknetTransitionType:     {MinRole: entities.Admin, Peers: true},
+	ModifyCommMembersTransitionType: {MinRole: entities.Admin, Peers: true},
+	ChangeMemberRoleTransitionType:  {MinRole: entities.Owner, Peers: true},
+	InstallAppTransitionType:        {MinRole: entities.Admin, Peers: true},
+	UninstallAppTransitionType:      {MinRole: entities.Admin, Peers: true},
+	StartAppTransitionType:          {MinRole: entities.Admin, Peers: true},
+	StopAppTransitionType:           {MinRole: entities.Admin, Peers: true},
+	AddPeerTransitionType:           {MinRole: entities.Admin, Peers: true},
+	RemovePeerTransitionType:        {MinRole: entities.Admin, Peers: true},
+	RenameCommunityTransitionType:   {MinRole: entities.Admin, Peers: true},
+	ArchiveCommunityTransitionType:  {MinRole: entities.Owner, Peers: true},
+	MigrateBacknetTransitionType:    {MinRole: entities.Admin, Peers: true},
+}
+
+// signingFields is the canonical form of a transition that gets signed. The sequence number is not included,
+// because it is only known once the peers have agreed on the transition, but the base sequence number and nonce
+// are, so that a signed transition can't be committed again. Fields added after signing was introduced are left
+// out when they are empty, so that transitions signed before them still verify.
+type signingFields struct {
+	Type               TransitionType         `json:"type"`
+	Version            int                    `json:"version"`
+	Author             string                 `json:"author"`
+	Transition         map[string]interface{} `json:"transition"`
+	Compensates        uint64                 `json:"compensates,omitempty"`
+	BaseSequenceNumber uint64                 `json:"base_sequence_number,omitempty"`
+	Nonce              string                 `json:"nonce,omitempty"`
+}
+
+// SigningBytes returns the canonical encoding of the transition that is signed by its author. Going through
+// map[string]interface{} sorts the keys of every object, so the same transition always encodes to the same bytes.
+func (tw *TransitionWrapper) SigningBytes() ([]byte, error) {
+	version := CurrentTransitionVersion
+	raw := tw.signedRaw
+	if raw != nil {
+		version = tw.writtenVersion
+	} else {
+		marshalled, err := json.Marshal(tw.Transition)
+		if err != nil {
+			return nil, err
+		}
+		raw = marshalled
+	}
+
+	var transition map[string]interface{}
+	err := json.Unmarshal(raw, &transition)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&signingFields{
+		Type:               tw.Type,
+		Version:            version,
+		Author:             tw.Author,
+		Transition:         transition,
+		Compensates:        tw.Compensates,
+		BaseSequenceNumber: tw.BaseSequenceNumber,
+		Nonce:              tw.Nonce,
+	})
+}
+
+// Sign sets the author of the transition and a new nonce, and signs it with the author's private key. The base
+// sequence number has to be set before the transition is signed.
+func (tw *TransitionWrapper) Sign(author string, key ed25519.PrivateKey) error {
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	tw.Author = author
+	tw.Nonce = base64.StdEncoding.EncodeToString(nonce)
+	tw.signedRaw = nil
+
+	message, err := tw.SigningBytes()
+	if err != nil {
+		return err
+	}
+	tw.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, message))
+	return nil
+}
+
+// VerifySignature checks the transition's signature against the author's public key
+func (tw *TransitionWrapper) VerifySignature(key ed25519.PublicKey) error {
+	signature, err := base64.StdEncoding.DecodeString(tw.Signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	message, err := tw.SigningBytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, message, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// PredatesSignatures is true for unsigned transitions that were read from a log written before transitions were signed
+func (tw *TransitionWrapper) PredatesSignatures() bool {
+	return tw.fromJSON && tw.Signature == "" && tw.writtenVersion < FirstSignedTransitionVersion
+}
+
+// DecodePublicKey decodes a base64 encoded Ed25519 public key, as used for user and peer keys
+func DecodePublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key is %d bytes, should be %d", len(key), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// EncodePublicKey is the inverse of DecodePublicKey
+func EncodePublicKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// VerifyCommunityTransition checks that a community transition is signed by an author that the community allows to
+// sign transitions of its type. oldComm is the community the transition is applied to.
+func VerifyCommunityTransition(tw *TransitionWrapper, oldComm *entities.Community) error {
+	if tw.Author == "" || tw.Signature == "" {
+		return newValidationError(tw.Type, "signature", "transition is not signed")
+	}
+
+	policy, ok := signerPolicies[tw.Type]
+	if !ok {
+		return newValidationError(tw.Type, "author", "no one is allowed to sign %s transitions", tw.Type)
+	}
+
+	// A community that is being initialized is checked against itself
+	community := oldComm
+	if community == nil {
+		switch init := tw.Transition.(type) {
+		case InitCommunityTransition:
+			community = init.Community
+		case *InitCommunityTransition:
+			community = init.Community
+		}
+	}
+	if community == nil {
+		return newValidationError(tw.Type, "author", "community has not been initialized")
+	}
+
+	encodedKey, ok := authorKey(community, policy, tw.Author)
+	if !ok {
+		return newValidationError(tw.Type, "author", "%s is not allowed to sign %s transitions in community %s", tw.Author, tw.Type, community.ID)
+	}
+	key, err := DecodePublicKey(encodedKey)
+	if err != nil {
+		return newValidationError(tw.Type, "author", "bad public key for %s: %s", tw.Author, err.Error())
+	}
+
+	err = tw.VerifySignature(key)
+	if err != nil {
+		return newValidationError(tw.Type, "signature", "%s", err.Error())
+	}
+	return nil
+}
+
+// ValidateAuthorship checks that the fields of a transition that name who made it agree with its author. It
+// is only checked for new transitions, so that entries committed before it was introduced can still be replayed.
+func ValidateAuthorship(tw *TransitionWrapper, history CommitHistory) error {
+	modify, ok := Normalize(tw.Transition).(*ModifyCommMembersTransition)
+	if !ok || modify.ModType != BanMember || modify.BannedBy == entities.UserID(tw.Author) {
+		return nil
+	}
+
+	// A compensating ban restores a ban that an unban removed, along with the member who made it. It can only
+	// do that for an unban of the same user, which hasn't been compensated already.
+	if tw.Compensates != 0 && modify.User != nil {
+		if unbanned, ok := history.UnbannedAt(tw.Compensates); ok && unbanned == modify.User.ID {
+			return nil
+		}
+		return newValidationError(tw.Type, "compensates", "sequence number %d is not an unban of %s that can be compensated", tw.Compensates, modify.User.ID)
+	}
+	return newValidationError(tw.Type, "banned_by", "ban is by %s, but was signed by %s", modify.BannedBy, tw.Author)
+}
+
+// ReplayWindow is how many sequence numbers past its base sequence number a signed transition can be committed
+const ReplayWindow = 1000
+
+// CommitHistory answers questions about the transitions committed before the one being validated. Its answers
+// have to be the same on every replica, so they can't depend on what a replica happens to keep of its log.
+type CommitHistory interface {
+	// NonceCommittedAt returns the sequence number a transition with an author and nonce was committed at, if it
+	// was committed in the last ReplayWindow sequence numbers
+	NonceCommittedAt(author, nonce string) (uint64, bool)
+	// CompensatedAt returns the sequence number of the transition compensating a sequence number, if there is one
+	CompensatedAt(sequenceNumber uint64) (uint64, bool)
+	// UnbannedAt returns the user unbanned by the UnbanMember at a sequence number, unless it has been compensated
+	UnbannedAt(sequenceNumber uint64) (entities.UserID, bool)
+}
+
+// CheckReplay checks that a signed transition can be committed after sequence number curSequenceNumber, and
+// hasn't been committed already. A transition can only be committed within ReplayWindow of its base sequence
+// number, so history only has to remember the nonces committed in that window.
+func CheckReplay(tw *TransitionWrapper, curSequenceNumber uint64, history CommitHistory) error {
+	if tw.Nonce == "" {
+		return newValidationError(tw.Type, "nonce", "transition has no nonce")
+	}
+	if tw.BaseSequenceNumber > curSequenceNumber {
+		return newValidationError(tw.Type, "base_sequence_number", "transition was signed against sequence number %d, which hasn't been committed yet", tw.BaseSequenceNumber)
+	}
+	if curSequenceNumber-tw.BaseSequenceNumber >= ReplayWindow {
+		return newValidationError(tw.Type, "base_sequence_number", "transition was signed against sequence number %d, more than %d transitions ago", tw.BaseSequenceNumber, ReplayWindow)
+	}
+
+	if committed, ok := history.NonceCommittedAt(tw.Author, tw.Nonce); ok {
+		return newValidationError(tw.Type, "nonce", "transition was already committed at sequence number %d", committed)
+	}
+	return nil
+}
+
+// CheckCompensation checks that a compensating transition compensates a transition that has been committed, and
+// hasn't been compensated yet. Compensations can be proposed by several peers at once, and only one may be committed.
+func CheckCompensation(tw *TransitionWrapper, curSequenceNumber uint64, history CommitHistory) error {
+	if tw.Compensates == 0 {
+		return nil
+	}
+	if tw.Compensates > curSequenceNumber {
+		return newValidationError(tw.Type, "compensates", "sequence number %d hasn't been committed yet", tw.Compensates)
+	}
+	if compensation, ok := history.CompensatedAt(tw.Compensates); ok {
+		return newValidationError(tw.Type, "compensates", "sequence number %d was already compensated at %d", tw.Compensates, compensation)
+	}
+	return nil
+}
+
+// authorKey looks up the encoded public key of an author that the policy allows
+func authorKey(community *entities.Community, policy SignerPolicy, author string) (string, bool) {
+	if policy.MinRole != "" && community.RoleOf(entities.UserID(author)).AtLeast(policy.MinRole) {
+		if member := community.Members[entities.UserID(author)]; member != nil {
+			return member.PublicKey, true
+		}
+	}
+	if policy.Peers {
+		for _, peer := range community.Peers {
+			if peer != nil && peer.Key == author {
+				return peer.Key, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,272 @@
+package transitions
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(i byte) ed25519.PrivateKey {
+	seed := make([]byte, ed25519.SeedSize)
+	seed[0] = i
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+func TestSignedTransitionRoundTrip(t *testing.T) {
+	key := testKey(1)
+	alice := entities.InitUser("alice", "alice")
+	alice.PublicKey = EncodePublicKey(key.Public().(ed25519.PublicKey))
+
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	community.Members[alice.ID] = alice
+	community.Roles[alice.ID] = entities.Admin
+
+	backnet := entities.InitBacknet(entities.IPFS)
+	backnet.Bootstrap = []string{"/ip4/10.0.0.1/tcp/4001"}
+	tw := &TransitionWrapper{
+		Type: UpdateBacknetTransitionType,
+		Transition: UpdateBacknetTransition{
+			CommID:     community.ID,
+			OldBacknet: community.Backnet,
+			NewBacknet: backnet,
+		},
+	}
+	err := tw.Sign("alice", key)
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyCommunityTransition(tw, community))
+
+	// The sequence number isn't signed, and signed transitions survive being unmarshalled and marshalled again
+	tw.SequenceNumber = 5
+	marshalled, err := json.Marshal(tw)
+	assert.Nil(t, err)
+	var decoded TransitionWrapper
+	err = json.Unmarshal(marshalled, &decoded)
+	assert.Nil(t, err)
+	remarshalled, err := json.Marshal(&decoded)
+	assert.Nil(t, err)
+	var redecoded TransitionWrapper
+	err = json.Unmarshal(remarshalled, &redecoded)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", redecoded.Author)
+	assert.Nil(t, VerifyCommunityTransition(&redecoded, community))
+	assert.False(t, redecoded.PredatesSignatures())
+
+	// Tampering with the transition invalidates the signature
+	var raw map[string]interface{}
+	err = json.Unmarshal(marshalled, &raw)
+	assert.Nil(t, err)
+	raw["transition"].(map[string]interface{})["community_id"] = "community_1"
+	tampered, err := json.Marshal(raw)
+	assert.Nil(t, err)
+	err = json.Unmarshal(tampered, &decoded)
+	assert.Nil(t, err)
+	err = VerifyCommunityTransition(&decoded, community)
+	validationErr, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "signature", validationErr.Field)
+
+	// So does moving the transition to another base sequence number, or changing its nonce
+	for field, value := range map[string]interface{}{"base_sequence_number": 3, "nonce": "AAAAAAAAAAAAAAAAAAAAAA=="} {
+		err = json.Unmarshal(marshalled, &raw)
+		assert.Nil(t, err)
+		raw[field] = value
+		tampered, err = json.Marshal(raw)
+		assert.Nil(t, err)
+		err = json.Unmarshal(tampered, &decoded)
+		assert.Nil(t, err)
+		err = VerifyCommunityTransition(&decoded, community)
+		validationErr, ok = err.(*ValidationError)
+		assert.True(t, ok)
+		assert.Equal(t, "signature", validationErr.Field)
+	}
+
+	// Members can't initialize communities
+	initTransition := &TransitionWrapper{
+		Type: InitCommunityTransitionType,
+		Transition: InitCommunityTransition{
+			Community: community,
+		},
+	}
+	err = initTransition.Sign("alice", key)
+	assert.Nil(t, err)
+	err = VerifyCommunityTransition(initTransition, nil)
+	validationErr, ok = err.(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "author", validationErr.Field)
+}
+
+func TestLegacyTransitionsPredateSignatures(t *testing.T) {
+	var tw TransitionWrapper
+	err := json.Unmarshal([]byte(`{"type": "ADD_COMMUNITY", "version": 1, "transition": {"community": {"id": "community_0"}}, "sequence_number": 1}`), &tw)
+	assert.Nil(t, err)
+	assert.True(t, tw.PredatesSignatures())
+
+	err = json.Unmarshal([]byte(`{"type": "ADD_COMMUNITY", "version": 2, "transition": {"community": {"id": "community_0"}}, "sequence_number": 1}`), &tw)
+	assert.Nil(t, err)
+	assert.False(t, tw.PredatesSignatures())
+
+	// Transitions created in memory are never treated as legacy
+	assert.False(t, (&TransitionWrapper{}).PredatesSignatures())
+}
+
+func TestSignerRoles(t *testing.T) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	keys := make(map[entities.UserID]ed25519.PrivateKey)
+	for i, role := range []entities.Role{entities.Owner, entities.Admin, entities.Member} {
+		key := testKey(byte(i))
+		user := entities.InitUser(entities.UserID(role), string(role))
+		user.PublicKey = EncodePublicKey(key.Public().(ed25519.PublicKey))
+		community.Members[user.ID] = user
+		err := community.SetRole(user.ID, role)
+		assert.Nil(t, err)
+		keys[user.ID] = key
+	}
+
+	verify := func(transition Transition, author entities.UserID) error {
+		tw := &TransitionWrapper{
+			Type:       transition.Type(),
+			Transition: transition,
+		}
+		err := tw.Sign(string(author), keys[author])
+		assert.Nil(t, err)
+		return VerifyCommunityTransition(tw, community)
+	}
+
+	addMember := ModifyCommMembersTransition{
+		Community: community,
+		User:      entities.InitUser("new", "new"),
+		ModType:   AddMember,
+	}
+	assert.Nil(t, verify(addMember, "owner"))
+	assert.Nil(t, verify(addMember, "admin"))
+	assert.NotNil(t, verify(addMember, "member"))
+
+	// Only owners can appoint admins
+	changeRole := ChangeMemberRoleTransition{
+		CommID: community.ID,
+		UserID: "member",
+		Role:   entities.Admin,
+	}
+	assert.Nil(t, verify(changeRole, "owner"))
+	assert.NotNil(t, verify(changeRole, "admin"))
+	assert.NotNil(t, verify(changeRole, "member"))
+}
+
+// testHistory is a CommitHistory of committed nonces, keyed by author and nonce, compensations and unbans
+type testHistory struct {
+	nonces        map[string]uint64
+	compensations map[uint64]uint64
+	unbans        map[uint64]entities.UserID
+}
+
+func (h *testHistory) NonceCommittedAt(author, nonce string) (uint64, bool) {
+	sequenceNumber, ok := h.nonces[author+" "+nonce]
+	return sequenceNumber, ok
+}
+
+func (h *testHistory) CompensatedAt(sequenceNumber uint64) (uint64, bool) {
+	compensation, ok := h.compensations[sequenceNumber]
+	return compensation, ok
+}
+
+func (h *testHistory) UnbannedAt(sequenceNumber uint64) (entities.UserID, bool) {
+	user, ok := h.unbans[sequenceNumber]
+	return user, ok
+}
+
+func TestCheckReplay(t *testing.T) {
+	tw := &TransitionWrapper{
+		Type:               RenameCommunityTransitionType,
+		Transition:         RenameCommunityTransition{CommID: "community_0", Name: "Renamed"},
+		BaseSequenceNumber: 10,
+	}
+	err := tw.Sign("alice", testKey(1))
+	assert.Nil(t, err)
+	committedNonces := func(committed ...*TransitionWrapper) *testHistory {
+		history := &testHistory{nonces: make(map[string]uint64)}
+		for _, other := range committed {
+			history.nonces[other.Author+" "+other.Nonce] = other.SequenceNumber
+		}
+		return history
+	}
+	field := func(err error) string {
+		validationErr, ok := err.(*ValidationError)
+		assert.True(t, ok)
+		return validationErr.Field
+	}
+
+	assert.Nil(t, CheckReplay(tw, 10, committedNonces()))
+	assert.Nil(t, CheckReplay(tw, 10+ReplayWindow-1, committedNonces()))
+
+	// The base has to be committed, and recent
+	assert.Equal(t, "base_sequence_number", field(CheckReplay(tw, 9, committedNonces())))
+	assert.Equal(t, "base_sequence_number", field(CheckReplay(tw, 10+ReplayWindow, committedNonces())))
+
+	// The same author can't use a nonce twice
+	other := &TransitionWrapper{Author: tw.Author, Nonce: "other", SequenceNumber: 11}
+	assert.Nil(t, CheckReplay(tw, 12, committedNonces(other)))
+	assert.Equal(t, "nonce", field(CheckReplay(tw, 12, committedNonces(other, &TransitionWrapper{Author: tw.Author, Nonce: tw.Nonce, SequenceNumber: 12}))))
+	assert.Nil(t, CheckReplay(tw, 12, committedNonces(&TransitionWrapper{Author: "bob", Nonce: tw.Nonce, SequenceNumber: 12})))
+
+	unsigned := &TransitionWrapper{Type: RenameCommunityTransitionType}
+	assert.Equal(t, "nonce", field(CheckReplay(unsigned, 0, committedNonces())))
+}
+
+func TestCheckCompensation(t *testing.T) {
+	history := &testHistory{compensations: map[uint64]uint64{2: 3}}
+	tw := &TransitionWrapper{Type: RenameCommunityTransitionType, Compensates: 4}
+	field := func(err error) string {
+		validationErr, ok := err.(*ValidationError)
+		assert.True(t, ok)
+		return validationErr.Field
+	}
+
+	assert.Nil(t, CheckCompensation(tw, 4, history))
+	assert.Equal(t, "compensates", field(CheckCompensation(tw, 3, history)))
+	tw.Compensates = 2
+	assert.Equal(t, "compensates", field(CheckCompensation(tw, 4, history)))
+	tw.Compensates = 0
+	assert.Nil(t, CheckCompensation(tw, 4, history))
+}
+
+func TestValidateAuthorship(t *testing.T) {
+	ban := ModifyCommMembersTransition{
+		Community: entities.InitCommunity("community_0", "My Community", entities.IPFS),
+		User:      entities.InitUser("bob", "bob"),
+		ModType:   BanMember,
+		BannedBy:  "alice",
+		Timestamp: time.Now(),
+	}
+	history := &testHistory{unbans: map[uint64]entities.UserID{4: "bob", 5: "carol"}}
+	field := func(err error) string {
+		validationErr, ok := err.(*ValidationError)
+		assert.True(t, ok)
+		return validationErr.Field
+	}
+	tw := &TransitionWrapper{Type: ModifyCommMembersTransitionType, Transition: ban, Author: "alice"}
+	assert.Nil(t, ValidateAuthorship(tw, history))
+
+	// A ban can't be recorded under someone else's name, whether the transition is a value or a pointer
+	tw = &TransitionWrapper{Type: ModifyCommMembersTransitionType, Transition: ban, Author: "carol"}
+	assert.Equal(t, "banned_by", field(ValidateAuthorship(tw, history)))
+	tw.Transition = &ban
+	assert.Equal(t, "banned_by", field(ValidateAuthorship(tw, history)))
+
+	// Compensating bans restore the original ban, and are signed by a peer
+	tw.Compensates = 4
+	assert.Nil(t, ValidateAuthorship(tw, history))
+
+	// but only for an unban of the same user that hasn't been compensated
+	tw.Compensates = 5
+	assert.Equal(t, "compensates", field(ValidateAuthorship(tw, history)))
+	tw.Compensates = 6
+	assert.Equal(t, "compensates", field(ValidateAuthorship(tw, history)))
+
+	// Other modifications don't name who made them
+	tw = &TransitionWrapper{Type: ModifyCommMembersTransitionType, Transition: ModifyCommMembersTransition{ModType: UnbanMember}, Author: "carol"}
+	assert.Nil(t, ValidateAuthorship(tw, history))
+}
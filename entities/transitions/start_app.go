@@ -0,0 +1,68 @@
+package transitions
+
+import (
+	"fmt"
+
+	"github.com/eagraf/habitat-node/entities"
+)
+
+// StartAppTransition marks an installed app as running
+type StartAppTransition struct {
+	CommID entities.CommunityID `json:"community_id" mapstructure:"community_id"`
+	AppID  entities.AppID       `json:"app_id" mapstructure:"app_id"`
+}
+
+func (sa StartAppTransition) Type() TransitionType {
+	return StartAppTransitionType
+}
+
+func (sa StartAppTransition) CommunityID() entities.CommunityID {
+	return sa.CommID
+}
+
+func (sa StartAppTransition) Validate(oldCommunity *entities.Community) error {
+	app, err := validateAppTransition(sa.Type(), oldCommunity, sa.CommID, sa.AppID)
+	if err != nil {
+		return err
+	}
+	if app == nil {
+		return newValidationError(sa.Type(), "app_id", "app %s is not installed in community %s", sa.AppID, sa.CommID)
+	}
+	if app.Running {
+		return newValidationError(sa.Type(), "app_id", "app %s is already running", sa.AppID)
+	}
+	return nil
+}
+
+func (sa StartAppTransition) Reduce(oldCommunity *entities.Community) (*entities.Community, error) {
+	err := sa.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+	return sa.Replay(oldCommunity)
+}
+
+// Replay implements CommunityTransition
+func (sa StartAppTransition) Replay(oldCommunity *entities.Community) (*entities.Community, error) {
+	newCommunity, err := oldCommunity.Copy()
+	if err != nil {
+		return nil, fmt.Errorf("error copying community: %s", err.Error())
+	}
+
+	newCommunity.GetApp(sa.AppID).Running = true
+
+	return newCommunity, nil
+}
+
+// Inverse stops the app again
+func (sa StartAppTransition) Inverse(oldCommunity *entities.Community) (CommunityTransition, error) {
+	err := sa.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+
+	return StopAppTransition{
+		CommID: sa.CommID,
+		AppID:  sa.AppID,
+	}, nil
+}
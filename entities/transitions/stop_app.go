@@ -0,0 +1,68 @@
+package transitions
+
+import (
+	"fmt"
+
+	"github.com/eagraf/habitat-node/entities"
+)
+
+// StopAppTransition marks a running app as stopped
+type StopAppTransition struct {
+	CommID entities.CommunityID `json:"community_id" mapstructure:"community_id"`
+	AppID  entities.AppID       `json:"app_id" mapstructure:"app_id"`
+}
+
+func (so StopAppTransition) Type() TransitionType {
+	return StopAppTransitionType
+}
+
+func (so StopAppTransition) CommunityID() entities.CommunityID {
+	return so.CommID
+}
+
+func (so StopAppTransition) Validate(oldCommunity *entities.Community) error {
+	app, err := validateAppTransition(so.Type(), oldCommunity, so.CommID, so.AppID)
+	if err != nil {
+		return err
+	}
+	if app == nil {
+		return newValidationError(so.Type(), "app_id", "app %s is not installed in community %s", so.AppID, so.CommID)
+	}
+	if !app.Running {
+		return newValidationError(so.Type(), "app_id", "app %s is not running", so.AppID)
+	}
+	return nil
+}
+
+func (so StopAppTransition) Reduce(oldCommunity *entities.Community) (*entities.Community, error) {
+	err := so.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+	return so.Replay(oldCommunity)
+}
+
+// Replay implements CommunityTransition
+func (so StopAppTransition) Replay(oldCommunity *entities.Community) (*entities.Community, error) {
+	newCommunity, err := oldCommunity.Copy()
+	if err != nil {
+		return nil, fmt.Errorf("error copying community: %s", err.Error())
+	}
+
+	newCommunity.GetApp(so.AppID).Running = false
+
+	return newCommunity, nil
+}
+
+// Inverse starts the app again
+func (so StopAppTransition) Inverse(oldCommunity *entities.Community) (CommunityTransition, error) {
+	err := so.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+
+	return StartAppTransition{
+		CommID: so.CommID,
+		AppID:  so.AppID,
+	}, nil
+}
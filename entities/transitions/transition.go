@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"time"
 
 	"github.com/eagraf/habitat-node/entities"
 	"github.com/mitchellh/mapstructure"
@@ -19,6 +20,17 @@ const (
 	AddCommunityTransitionType      TransitionType = "ADD_COMMUNITY"
 	UpdateBacknetTransitionType     TransitionType = "UPDATE_BACKNET"
 	ModifyCommMembersTransitionType TransitionType = "MODIFY_COMMUNITY_MEMBERS"
+	ChangeMemberRoleTransitionType  TransitionType = "CHANGE_MEMBER_ROLE"
+	InstallAppTransitionType        TransitionType = "INSTALL_APP"
+	UninstallAppTransitionType      TransitionType = "UNINSTALL_APP"
+	StartAppTransitionType          TransitionType = "START_APP"
+	StopAppTransitionType           TransitionType = "STOP_APP"
+	AddPeerTransitionType           TransitionType = "ADD_PEER"
+	RemovePeerTransitionType        TransitionType = "REMOVE_PEER"
+	RenameCommunityTransitionType   TransitionType = "RENAME_COMMUNITY"
+	ArchiveCommunityTransitionType  TransitionType = "ARCHIVE_COMMUNITY"
+	DeleteCommunityTransitionType   TransitionType = "DELETE_COMMUNITY"
+	MigrateBacknetTransitionType    TransitionType = "MIGRATE_BACKNET"
 )
 
 var transitionReflectionTypeRegistry = map[TransitionType]reflect.Type{
@@ -26,6 +38,17 @@ var transitionReflectionTypeRegistry = map[TransitionType]reflect.Type{
 	AddCommunityTransitionType:      reflect.TypeOf(AddCommunityTransition{}),
 	UpdateBacknetTransitionType:     reflect.TypeOf(UpdateBacknetTransition{}),
 	ModifyCommMembersTransitionType: reflect.TypeOf(ModifyCommMembersTransition{}),
+	ChangeMemberRoleTransitionType:  reflect.TypeOf(ChangeMemberRoleTransition{}),
+	InstallAppTransitionType:        reflect.TypeOf(InstallAppTransition{}),
+	UninstallAppTransitionType:      reflect.TypeOf(UninstallAppTransition{}),
+	StartAppTransitionType:          reflect.TypeOf(StartAppTransition{}),
+	StopAppTransitionType:           reflect.TypeOf(StopAppTransition{}),
+	AddPeerTransitionType:           reflect.TypeOf(AddPeerTransition{}),
+	RemovePeerTransitionType:        reflect.TypeOf(RemovePeerTransition{}),
+	RenameCommunityTransitionType:   reflect.TypeOf(RenameCommunityTransition{}),
+	ArchiveCommunityTransitionType:  reflect.TypeOf(ArchiveCommunityTransition{}),
+	DeleteCommunityTransitionType:   reflect.TypeOf(DeleteCommunityTransition{}),
+	MigrateBacknetTransitionType:    reflect.TypeOf(MigrateBacknetTransition{}),
 }
 
 // TransitionSubscriptionCategory enumerates different types entities that a TransitionSubscriber could be subscribed to
@@ -43,39 +66,116 @@ var transitionSubscriptionCategories = map[TransitionType]TransitionSubscription
 	AddCommunityTransitionType:      HostCategory,
 	UpdateBacknetTransitionType:     CommunityCategory,
 	ModifyCommMembersTransitionType: CommunityCategory,
+	ChangeMemberRoleTransitionType:  CommunityCategory,
+	InstallAppTransitionType:        CommunityCategory,
+	UninstallAppTransitionType:      CommunityCategory,
+	StartAppTransitionType:          CommunityCategory,
+	StopAppTransitionType:           CommunityCategory,
+	AddPeerTransitionType:           CommunityCategory,
+	RemovePeerTransitionType:        CommunityCategory,
+	RenameCommunityTransitionType:   CommunityCategory,
+	ArchiveCommunityTransitionType:  CommunityCategory,
+	DeleteCommunityTransitionType:   HostCategory,
+	MigrateBacknetTransitionType:    CommunityCategory,
 }
 
 // A Transition transitions the state from one arrangement to another
 // Each state transition is implemented via a reducer function
+// Each transition can also be validated against the current state before it is persisted, so that invalid
+// transitions never make it into the write ahead log
 type Transition interface {
 	Type() TransitionType
 	//Reduce(*entities.State) (*entities.State, error)
-	// TODO we might need to implement rollbacks as well
-	// TODO we might need to add a validate method
 }
 
 type CommunityTransition interface {
 	Transition
+	Validate(*entities.Community) error
 	Reduce(*entities.Community) (*entities.Community, error)
-	//Rollback(*entities.Community) (*entities.Community, error)
+	// Replay applies the transition without validating it. Committed transitions were validated before they
+	// were logged, and replaying them must not fail because validation rules got stricter since then.
+	Replay(*entities.Community) (*entities.Community, error)
+	// Inverse returns the transition that undoes this one, given the community as it was before this one was
+	// applied. It returns an error wrapping ErrNotInvertible if there is no such transition.
+	Inverse(*entities.Community) (CommunityTransition, error)
 	CommunityID() entities.CommunityID
 }
 
 type HostUserTransition interface {
 	Transition
+	// Validate and Reduce receive nil if the host user does not exist yet, and Reduce returns nil if the host user should be removed
+	Validate(*entities.HostUser) error
 	Reduce(*entities.HostUser) (*entities.HostUser, error)
+	Username() string
 }
 
 type HostTransition interface {
 	Transition
+	Validate(*entities.Host) error
 	Reduce(*entities.Host) (*entities.Host, error)
+	// Replay applies the transition without validating it, like CommunityTransition.Replay
+	Replay(*entities.Host) (*entities.Host, error)
+	// Inverse returns the transition that undoes this one, given the host as it was before this one was applied
+	Inverse(*entities.Host) (HostTransition, error)
 }
 
-// TransitionWrapper adds type information to a transition in marshalled form
+// Normalize returns the pointer form of a transition. Transitions decoded from JSON are pointers, while ones
+// built in code are usually values, so subscribers normalize what they receive before asserting its type.
+func Normalize(transition Transition) Transition {
+	value := reflect.ValueOf(transition)
+	if !value.IsValid() || value.Kind() == reflect.Ptr {
+		return transition
+	}
+	pointer := reflect.New(value.Type())
+	pointer.Elem().Set(value)
+	return pointer.Interface().(Transition)
+}
+
+// TransitionWrapper adds type and schema version information to a transition in marshalled form
 type TransitionWrapper struct {
 	Type           TransitionType `json:"type"`
+	Version        int            `json:"version"`
 	Transition     Transition     `json:"transition"`
 	SequenceNumber uint64         `json:"sequence_number"`
+
+	// Author is the UserID of the member or the key of the peer that proposed the transition
+	Author string `json:"author,omitempty"`
+	// Signature is the author's base64 encoded Ed25519 signature over SigningBytes
+	Signature string `json:"signature,omitempty"`
+	// Compensates is the sequence number of the transition this one undoes, for compensating transitions
+	Compensates uint64 `json:"compensates,omitempty"`
+	// BaseSequenceNumber is the sequence number of the community state the author signed the transition against.
+	// A signed transition can only be committed after it, and within a window of it.
+	BaseSequenceNumber uint64 `json:"base_sequence_number,omitempty"`
+	// Nonce is chosen at random when the transition is signed, so that no two signed transitions are the same
+	Nonce string `json:"nonce,omitempty"`
+
+	// fromJSON and writtenVersion record where an unmarshalled transition came from. For signed transitions the
+	// transition is also kept exactly as it was signed, so that it can be verified and written back out without
+	// being re-encoded.
+	fromJSON       bool
+	writtenVersion int
+	signedRaw      json.RawMessage
+}
+
+// MarshalJSON always writes the current schema version, except for signed transitions that were unmarshalled,
+// which are written exactly as they were signed
+func (tw TransitionWrapper) MarshalJSON() ([]byte, error) {
+	type wrapper TransitionWrapper
+	versioned := wrapper(tw)
+	if tw.signedRaw == nil {
+		versioned.Version = CurrentTransitionVersion
+		return json.Marshal(versioned)
+	}
+
+	versioned.Version = tw.writtenVersion
+	return json.Marshal(struct {
+		wrapper
+		Transition json.RawMessage `json:"transition"`
+	}{
+		wrapper:    versioned,
+		Transition: tw.signedRaw,
+	})
 }
 
 // UnmarhsalJSON uses reflection to extract the proper Transition type from a TransitionWrapper JSON
@@ -93,10 +193,23 @@ func (tw *TransitionWrapper) UnmarshalJSON(bytes []byte) error {
 		return errors.New("Transitionwrapper json has no field type")
 	}
 
-	if _, ok := firstPass["transition"]; !ok {
+	rawTransition, ok := firstPass["transition"].(map[string]interface{})
+	if !ok {
 		return errors.New("TransitionWrapper json has no field transition")
 	}
 
+	// Transitions written before versioning was introduced are version 0
+	version := 0
+	if rawVersion, ok := firstPass["version"].(float64); ok {
+		version = int(rawVersion)
+	}
+
+	// Bring older transitions up to the current schema before decoding
+	rawTransition, err = upgradeTransition(transitionUpgrades, TransitionType(transitionType), version, rawTransition)
+	if err != nil {
+		return err
+	}
+
 	// Get the proper type to assert from the Transition type registry
 	reflectType, ok := transitionReflectionTypeRegistry[TransitionType(transitionType)]
 	if !ok {
@@ -107,13 +220,38 @@ func (tw *TransitionWrapper) UnmarshalJSON(bytes []byte) error {
 	// and then decode into it using mapstructure
 	transitionValue := reflect.New(reflectType)
 	transition := transitionValue.Interface()
-	err = mapstructure.Decode(firstPass["transition"], transition)
+	err = decodeTransition(rawTransition, transition)
 	if err != nil {
 		return err
 	}
 
 	// Write into the receiving structs fields
 	tw.Type = TransitionType(transitionType)
+	tw.Version = CurrentTransitionVersion
+	tw.Author, _ = firstPass["author"].(string)
+	tw.Signature, _ = firstPass["signature"].(string)
+	tw.Compensates = 0
+	if compensates, ok := firstPass["compensates"].(float64); ok {
+		tw.Compensates = uint64(compensates)
+	}
+	tw.BaseSequenceNumber = 0
+	if base, ok := firstPass["base_sequence_number"].(float64); ok {
+		tw.BaseSequenceNumber = uint64(base)
+	}
+	tw.Nonce, _ = firstPass["nonce"].(string)
+	tw.fromJSON = true
+	tw.writtenVersion = version
+	tw.signedRaw = nil
+	if tw.Signature != "" {
+		var raw struct {
+			Transition json.RawMessage `json:"transition"`
+		}
+		err = json.Unmarshal(bytes, &raw)
+		if err != nil {
+			return err
+		}
+		tw.signedRaw = raw.Transition
+	}
 	tw.Transition, ok = transition.(Transition)
 	if !ok {
 		return errors.New("unmarshalled struct is not a Transition interface")
@@ -123,6 +261,19 @@ func (tw *TransitionWrapper) UnmarshalJSON(bytes []byte) error {
 	return nil
 }
 
+// decodeTransition decodes the JSON form of a transition into its struct. Timestamps are marshalled as
+// RFC 3339 strings, which mapstructure can't decode into time.Time on its own.
+func decodeTransition(rawTransition map[string]interface{}, transition interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeHookFunc(time.RFC3339Nano),
+		Result:     transition,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(rawTransition)
+}
+
 // TransitionSubscriber receives state transitions from a state monitoring process
 type TransitionSubscriber interface {
 	Receive(transition Transition) error
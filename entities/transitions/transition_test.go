@@ -30,3 +30,14 @@ func TestUnmarshalTransitionWrapper(t *testing.T) {
 	assert.Equal(t, true, ok)
 	assert.Equal(t, "community_0", string(act.Community.ID))
 }
+
+func TestNormalize(t *testing.T) {
+	value := RenameCommunityTransition{CommID: "community_0", Name: "Renamed"}
+	normalized, ok := Normalize(value).(*RenameCommunityTransition)
+	assert.True(t, ok)
+	assert.Equal(t, value, *normalized)
+
+	pointer := &value
+	assert.True(t, Normalize(pointer) == Transition(pointer))
+	assert.Nil(t, Normalize(nil))
+}
@@ -0,0 +1,72 @@
+package transitions
+
+import (
+	"fmt"
+
+	"github.com/eagraf/habitat-node/entities"
+)
+
+// UninstallAppTransition removes an app from a community. Running apps are stopped by the orchestrator.
+type UninstallAppTransition struct {
+	CommID entities.CommunityID `json:"community_id" mapstructure:"community_id"`
+	AppID  entities.AppID       `json:"app_id" mapstructure:"app_id"`
+}
+
+func (ua UninstallAppTransition) Type() TransitionType {
+	return UninstallAppTransitionType
+}
+
+func (ua UninstallAppTransition) CommunityID() entities.CommunityID {
+	return ua.CommID
+}
+
+func (ua UninstallAppTransition) Validate(oldCommunity *entities.Community) error {
+	app, err := validateAppTransition(ua.Type(), oldCommunity, ua.CommID, ua.AppID)
+	if err != nil {
+		return err
+	}
+	if app == nil {
+		return newValidationError(ua.Type(), "app_id", "app %s is not installed in community %s", ua.AppID, ua.CommID)
+	}
+	return nil
+}
+
+func (ua UninstallAppTransition) Reduce(oldCommunity *entities.Community) (*entities.Community, error) {
+	err := ua.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+	return ua.Replay(oldCommunity)
+}
+
+// Replay implements CommunityTransition
+func (ua UninstallAppTransition) Replay(oldCommunity *entities.Community) (*entities.Community, error) {
+	newCommunity, err := oldCommunity.Copy()
+	if err != nil {
+		return nil, fmt.Errorf("error copying community: %s", err.Error())
+	}
+
+	err = newCommunity.UninstallApp(ua.AppID)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCommunity, nil
+}
+
+// Inverse installs the app again. Apps are installed stopped, so uninstalling a running app can't be undone by
+// a single transition.
+func (ua UninstallAppTransition) Inverse(oldCommunity *entities.Community) (CommunityTransition, error) {
+	err := ua.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+	if oldCommunity.GetApp(ua.AppID).Running {
+		return nil, newNotInvertibleError(ua.Type(), "app %s was running when it was uninstalled", ua.AppID)
+	}
+
+	return InstallAppTransition{
+		CommID: ua.CommID,
+		AppID:  ua.AppID,
+	}, nil
+}
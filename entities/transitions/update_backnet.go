@@ -20,17 +20,59 @@ func (ub UpdateBacknetTransition) CommunityID() entities.CommunityID {
 	return ub.CommID
 }
 
+func (ub UpdateBacknetTransition) Validate(oldCommunity *entities.Community) error {
+	if oldCommunity == nil {
+		return newValidationError(ub.Type(), "community_id", "community %s has not been initialized", ub.CommID)
+	}
+	if oldCommunity.ID != ub.CommID {
+		return newValidationError(ub.Type(), "community_id", "transition is for community %s, not %s", ub.CommID, oldCommunity.ID)
+	}
+	if ub.OldBacknet == nil {
+		return newValidationError(ub.Type(), "old_backnet", "old backnet is required")
+	}
+	if ub.NewBacknet == nil {
+		return newValidationError(ub.Type(), "new_backnet", "new backnet is required")
+	}
+	if ub.OldBacknet.Type != ub.NewBacknet.Type {
+		return newValidationError(ub.Type(), "new_backnet.type", "switching backnet implementations requires a %s transition", MigrateBacknetTransitionType)
+	}
+	err := ub.NewBacknet.Validate()
+	if err != nil {
+		return newEntityValidationError(ub.Type(), "new_backnet", err)
+	}
+	return nil
+}
+
 func (ub UpdateBacknetTransition) Reduce(oldCommunity *entities.Community) (*entities.Community, error) {
-	newCommunity, err := oldCommunity.Copy()
+	err := ub.Validate(oldCommunity)
 	if err != nil {
-		return nil, fmt.Errorf("error copying community: %s", err.Error())
+		return nil, err
 	}
+	return ub.Replay(oldCommunity)
+}
 
-	if ub.OldBacknet.Type != ub.NewBacknet.Type {
-		return nil, fmt.Errorf("switching backnet implementations is not supported")
+// Replay implements CommunityTransition
+func (ub UpdateBacknetTransition) Replay(oldCommunity *entities.Community) (*entities.Community, error) {
+	newCommunity, err := oldCommunity.Copy()
+	if err != nil {
+		return nil, fmt.Errorf("error copying community: %s", err.Error())
 	}
 
 	newCommunity.Backnet = ub.NewBacknet
 
 	return newCommunity, nil
 }
+
+// Inverse puts back the backnet configuration the community had before
+func (ub UpdateBacknetTransition) Inverse(oldCommunity *entities.Community) (CommunityTransition, error) {
+	err := ub.Validate(oldCommunity)
+	if err != nil {
+		return nil, err
+	}
+
+	return UpdateBacknetTransition{
+		CommID:     ub.CommID,
+		OldBacknet: ub.NewBacknet.Copy(),
+		NewBacknet: oldCommunity.Backnet.Copy(),
+	}, nil
+}
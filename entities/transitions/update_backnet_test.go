@@ -9,14 +9,16 @@ import (
 
 func TestUpdateBacknet(t *testing.T) {
 	oldBacknet := &entities.Backnet{
-		Bootstrap: []string{"bootstrap1", "bootstrap2"},
+		Type:      entities.IPFS,
+		Bootstrap: []string{"/ip4/10.0.0.1/tcp/4001", "/ip4/10.0.0.2/tcp/4001"},
 		Local: entities.LocalBacknetConfig{
 			PortMap: map[string]int{"swarm": 4001, "api": 4002, "gateway": 4003},
 		},
 	}
 
 	newBacknet := &entities.Backnet{
-		Bootstrap: []string{"bootstrap1", "bootstrap2", "bootstrap3"},
+		Type:      entities.IPFS,
+		Bootstrap: []string{"/ip4/10.0.0.1/tcp/4001", "/ip4/10.0.0.2/tcp/4001", "/dns4/bootstrap.example.com/tcp/4001"},
 		Local: entities.LocalBacknetConfig{
 			PortMap: map[string]int{"swarm": 4004, "api": 4005, "gateway": 4006},
 		},
@@ -42,4 +44,12 @@ func TestUpdateBacknet(t *testing.T) {
 	transition.NewBacknet.Type = entities.DAT
 	_, err = transition.Reduce(&oldCommunity)
 	assert.NotNil(t, err)
+	err = transition.Validate(&oldCommunity)
+	validationErr, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "new_backnet.type", validationErr.Field)
+
+	// The community must have been initialized
+	err = transition.Validate(nil)
+	assert.NotNil(t, err)
 }
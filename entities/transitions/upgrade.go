@@ -0,0 +1,137 @@
+package transitions
+
+import (
+	"fmt"
+
+	"github.com/eagraf/habitat-node/entities"
+)
+
+// CurrentTransitionVersion is the schema version that transitions are written with. Transitions written before
+// versioning was introduced have no version field, and are treated as version 0.
+// Bump this whenever the JSON form of any transition changes, and register an upgrade for every transition type
+// that changed.
+const CurrentTransitionVersion = 4
+
+// UpgradeFunc converts the JSON form of a transition from one version to the next
+type UpgradeFunc func(transition map[string]interface{}) (map[string]interface{}, error)
+
+// transitionUpgrades maps transition types to the upgrade from each version to the version after it.
+// A transition type without an upgrade for a version did not change in that version.
+var transitionUpgrades = map[TransitionType]map[int]UpgradeFunc{
+	InitCommunityTransitionType: {
+		2: embeddedCommunityUpgrade(UpgradeCommunityRoles),
+		3: embeddedCommunityUpgrade(UpgradeCommunityApps),
+	},
+	AddCommunityTransitionType: {
+		3: embeddedCommunityUpgrade(UpgradeCommunityApps),
+	},
+	ModifyCommMembersTransitionType: {
+		2: upgradeModifyCommMembersRoles,
+		3: embeddedCommunityUpgrade(UpgradeCommunityApps),
+	},
+}
+
+// CommunityUpgrade changes the JSON form of a community in place. Community upgrades are shared between the
+// transitions that include a community and snapshots.
+type CommunityUpgrade func(community map[string]interface{})
+
+// embeddedCommunityUpgrade applies a community upgrade to the community field of a transition
+func embeddedCommunityUpgrade(upgrade CommunityUpgrade) UpgradeFunc {
+	return func(transition map[string]interface{}) (map[string]interface{}, error) {
+		if community, ok := transition["community"].(map[string]interface{}); ok {
+			upgrade(community)
+		}
+		return transition, nil
+	}
+}
+
+// Before version 3 communities had no roles, and every member had full control over the community. Members from
+// back then are made admins, so that the transitions they signed are still authorized when they are replayed.
+
+func upgradeModifyCommMembersRoles(transition map[string]interface{}) (map[string]interface{}, error) {
+	if transition["type"] == string(AddMember) {
+		if _, ok := transition["role"]; !ok {
+			transition["role"] = string(entities.Admin)
+		}
+	}
+	return transition, nil
+}
+
+// UpgradeCommunityRoles makes every member of a community from before roles were introduced an admin
+func UpgradeCommunityRoles(community map[string]interface{}) {
+	if _, ok := community["roles"]; ok {
+		return
+	}
+	roles := make(map[string]interface{})
+	if members, ok := community["members"].(map[string]interface{}); ok {
+		for id := range members {
+			roles[id] = string(entities.Admin)
+		}
+	}
+	community["roles"] = roles
+}
+
+// UpgradeCommunityApps converts the list of app IDs that communities had before version 4 into stopped apps
+func UpgradeCommunityApps(community map[string]interface{}) {
+	apps, ok := community["apps"].([]interface{})
+	if !ok {
+		return
+	}
+	for i, app := range apps {
+		if id, ok := app.(string); ok {
+			apps[i] = map[string]interface{}{
+				"id":      id,
+				"running": false,
+			}
+		}
+	}
+}
+
+// UpgradeMemberCommunities adds the community to the Communities of every member, which communities from before
+// snapshot version 4 didn't keep up to date
+func UpgradeMemberCommunities(community map[string]interface{}) {
+	id, ok := community["id"].(string)
+	if !ok {
+		return
+	}
+	members, ok := community["members"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	for _, member := range members {
+		member, ok := member.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		communities, _ := member["Communities"].([]interface{})
+		listed := false
+		for _, other := range communities {
+			if other == id {
+				listed = true
+			}
+		}
+		if !listed {
+			member["Communities"] = append(communities, id)
+		}
+	}
+}
+
+// upgradeTransition brings the JSON form of a transition from version up to CurrentTransitionVersion
+func upgradeTransition(upgrades map[TransitionType]map[int]UpgradeFunc, transitionType TransitionType, version int, transition map[string]interface{}) (map[string]interface{}, error) {
+	if version > CurrentTransitionVersion {
+		return nil, fmt.Errorf("transition has version %d, which is newer than the supported version %d", version, CurrentTransitionVersion)
+	}
+
+	for v := version; v < CurrentTransitionVersion; v++ {
+		upgrade, ok := upgrades[transitionType][v]
+		if !ok {
+			continue
+		}
+		upgraded, err := upgrade(transition)
+		if err != nil {
+			return nil, fmt.Errorf("error upgrading %s transition from version %d: %s", transitionType, v, err.Error())
+		}
+		transition = upgraded
+	}
+	return transition, nil
+}
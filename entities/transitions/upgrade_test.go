@@ -0,0 +1,80 @@
+package transitions
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpgradeTransition(t *testing.T) {
+	// Pretend that the community field used to be called comm
+	upgrades := map[TransitionType]map[int]UpgradeFunc{
+		AddCommunityTransitionType: {
+			0: func(transition map[string]interface{}) (map[string]interface{}, error) {
+				transition["community"] = transition["comm"]
+				delete(transition, "comm")
+				return transition, nil
+			},
+		},
+	}
+
+	raw := map[string]interface{}{
+		"comm": map[string]interface{}{
+			"id": "community_0",
+		},
+	}
+	upgraded, err := upgradeTransition(upgrades, AddCommunityTransitionType, 0, raw)
+	assert.Nil(t, err)
+	assert.Nil(t, upgraded["comm"])
+	assert.NotNil(t, upgraded["community"])
+
+	// Transitions that are already current are left alone
+	current := map[string]interface{}{"comm": "unchanged"}
+	upgraded, err = upgradeTransition(upgrades, AddCommunityTransitionType, CurrentTransitionVersion, current)
+	assert.Nil(t, err)
+	assert.Equal(t, "unchanged", upgraded["comm"])
+
+	// Transitions from the future can't be read
+	_, err = upgradeTransition(upgrades, AddCommunityTransitionType, CurrentTransitionVersion+1, raw)
+	assert.NotNil(t, err)
+}
+
+func TestTransitionVersionRoundTrip(t *testing.T) {
+	// Transitions without a version are read as version 0 and upgraded
+	var tw TransitionWrapper
+	err := json.Unmarshal([]byte(`{"type": "ADD_COMMUNITY", "transition": {"community": {"id": "community_0"}}, "sequence_number": 1}`), &tw)
+	assert.Nil(t, err)
+	assert.Equal(t, CurrentTransitionVersion, tw.Version)
+
+	marshalled, err := json.Marshal(&TransitionWrapper{
+		Type:       AddCommunityTransitionType,
+		Transition: tw.Transition,
+	})
+	assert.Nil(t, err)
+
+	var firstPass map[string]interface{}
+	err = json.Unmarshal(marshalled, &firstPass)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(CurrentTransitionVersion), firstPass["version"])
+
+	err = json.Unmarshal([]byte(`{"type": "ADD_COMMUNITY", "version": 1000, "transition": {}, "sequence_number": 1}`), &tw)
+	assert.NotNil(t, err)
+}
+
+func TestUpgradeMemberCommunities(t *testing.T) {
+	community := map[string]interface{}{
+		"id": "community_0",
+		"members": map[string]interface{}{
+			"alice": map[string]interface{}{"id": "alice", "Communities": nil},
+			"bob":   map[string]interface{}{"id": "bob", "Communities": []interface{}{"community_1"}},
+			"carol": map[string]interface{}{"id": "carol", "Communities": []interface{}{"community_0"}},
+		},
+	}
+	UpgradeMemberCommunities(community)
+
+	members := community["members"].(map[string]interface{})
+	assert.Equal(t, []interface{}{"community_0"}, members["alice"].(map[string]interface{})["Communities"])
+	assert.Equal(t, []interface{}{"community_1", "community_0"}, members["bob"].(map[string]interface{})["Communities"])
+	assert.Equal(t, []interface{}{"community_0"}, members["carol"].(map[string]interface{})["Communities"])
+}
@@ -0,0 +1,52 @@
+package transitions
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/eagraf/habitat-node/entities"
+)
+
+// ValidationError describes why a transition can't be applied to the current state.
+// Transitions are validated before they are written to the write ahead log, so a ValidationError means that
+// nothing was persisted.
+type ValidationError struct {
+	Type   TransitionType `json:"type"`
+	Field  string         `json:"field"`
+	Reason string         `json:"reason"`
+	// Fields lists every invalid field when an entity in the transition fails validation. Field and Reason
+	// describe the first of them.
+	Fields entities.ValidationErrors `json:"fields,omitempty"`
+}
+
+func (ve *ValidationError) Error() string {
+	if len(ve.Fields) > 1 {
+		return fmt.Sprintf("invalid %s transition: %s", ve.Type, ve.Fields.Error())
+	}
+	return fmt.Sprintf("invalid %s transition: %s: %s", ve.Type, ve.Field, ve.Reason)
+}
+
+func newValidationError(transitionType TransitionType, field string, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{
+		Type:   transitionType,
+		Field:  field,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+// newEntityValidationError reports the invalid fields of an entity in a transition, nested under the field
+// the entity is in
+func newEntityValidationError(transitionType TransitionType, field string, err error) *ValidationError {
+	var fieldErrs entities.ValidationErrors
+	if !errors.As(err, &fieldErrs) || len(fieldErrs) == 0 {
+		return newValidationError(transitionType, field, "%s", err.Error())
+	}
+
+	fields := fieldErrs.WithPrefix(field)
+	return &ValidationError{
+		Type:   transitionType,
+		Field:  fields[0].Field,
+		Reason: fields[0].Reason,
+		Fields: fields,
+	}
+}
@@ -1,7 +1,6 @@
 package entities
 
 import (
-	"encoding/json"
 	"errors"
 )
 
@@ -12,6 +11,8 @@ type UserID string
 type User struct {
 	ID     UserID `json:"id"`
 	Handle string `json:"handle"`
+	// PublicKey is the user's base64 encoded Ed25519 key, used to verify the transitions they sign
+	PublicKey string `json:"public_key,omitempty" mapstructure:"public_key"`
 
 	Communities []CommunityID
 }
@@ -24,22 +25,21 @@ func InitUser(id UserID, handle string) *User {
 	}
 }
 
+// Copy returns a deep copy of the user
 func (u *User) Copy() (*User, error) {
-	// dirty trick for copying: just marshal and unmarshal.
-	// if performance is a huge issue, we can eventually create real copy methods
-
-	marshalled, err := json.Marshal(u)
-	if err != nil {
-		return nil, err
+	if u == nil {
+		return nil, nil
 	}
 
-	var copy User
-	err = json.Unmarshal(marshalled, &copy)
-	if err != nil {
-		return nil, err
+	copy := *u
+	if u.Communities != nil {
+		copy.Communities = make([]CommunityID, len(u.Communities))
+		for i, id := range u.Communities {
+			copy.Communities[i] = id
+		}
 	}
 
-	return &copy, err
+	return &copy, nil
 }
 
 func valInSlice(id CommunityID, comms []CommunityID) bool {
@@ -51,20 +51,19 @@ func valInSlice(id CommunityID, comms []CommunityID) bool {
 	return false
 }
 
+// removeValInSlice returns the slice without id, keeping the order of the other values. The slice passed in is
+// not modified, and is returned as is if it doesn't contain id.
 func removeValInSlice(id CommunityID, comms []CommunityID) []CommunityID {
-	idx := -1
-	for i, x := range comms {
-		if id == x {
-			idx = i
-		}
+	if !valInSlice(id, comms) {
+		return comms
 	}
-	if idx == -1 {
-		return nil
+	res := make([]CommunityID, 0, len(comms)-1)
+	for _, x := range comms {
+		if x != id {
+			res = append(res, x)
+		}
 	}
-	comms[idx] = comms[len(comms)-1] // Copy last element to index i.
-	comms[len(comms)-1] = ""         // Erase last element (write zero value).
-	comms = comms[:len(comms)-1]     // Truncate slice.
-	return comms
+	return res
 }
 
 func (u *User) AddCommunity(id CommunityID) error {
@@ -82,3 +81,15 @@ func (u *User) RemoveCommunity(id CommunityID) error {
 	u.Communities = removeValInSlice(id, u.Communities)
 	return nil
 }
+
+// Validate checks every field of the user, and reports all of the invalid ones
+func (u *User) Validate() error {
+	v := &validator{}
+	v.check("id", u.ID.Validate())
+	v.check("handle", validateHandle(u.Handle))
+	v.check("public_key", validatePublicKey(u.PublicKey))
+	for i, id := range u.Communities {
+		v.check(indexField("communities", i), id.Validate())
+	}
+	return v.err()
+}
@@ -0,0 +1,287 @@
+package entities
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// FieldError describes what is wrong with one field of an entity. Fields are named after their JSON keys, with
+// nested fields separated by dots and map keys or slice indices in brackets, e.g. members[alice].handle.
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (fe *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", fe.Field, fe.Reason)
+}
+
+// ValidationErrors is returned by Validate methods, and lists every invalid field instead of stopping at the first
+type ValidationErrors []*FieldError
+
+func (ve ValidationErrors) Error() string {
+	reasons := make([]string, len(ve))
+	for i, fe := range ve {
+		reasons[i] = fe.Error()
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// WithPrefix returns the errors with their fields nested under another field
+func (ve ValidationErrors) WithPrefix(prefix string) ValidationErrors {
+	res := make(ValidationErrors, len(ve))
+	for i, fe := range ve {
+		res[i] = &FieldError{
+			Field:  joinField(prefix, fe.Field),
+			Reason: fe.Reason,
+		}
+	}
+	return res
+}
+
+// validator collects the errors found while validating an entity
+type validator struct {
+	errs ValidationErrors
+}
+
+func (v *validator) addf(field, format string, args ...interface{}) {
+	v.errs = append(v.errs, &FieldError{
+		Field:  field,
+		Reason: fmt.Sprintf(format, args...),
+	})
+}
+
+// check records the error from validating a field. The errors of nested entities are kept separate,
+// with their fields nested under the field.
+func (v *validator) check(field string, err error) {
+	if err == nil {
+		return
+	}
+	var nested ValidationErrors
+	if errors.As(err, &nested) {
+		v.errs = append(v.errs, nested.WithPrefix(field)...)
+		return
+	}
+	v.addf(field, "%s", err.Error())
+}
+
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+func joinField(prefix, field string) string {
+	if prefix == "" {
+		return field
+	}
+	if field == "" || strings.HasPrefix(field, "[") {
+		return prefix + field
+	}
+	return prefix + "." + field
+}
+
+func indexField(field string, index interface{}) string {
+	return fmt.Sprintf("%s[%v]", field, index)
+}
+
+// identifierPattern is shared by IDs that end up in paths, URLs and filesystem paths (see fs.ParseFilePath)
+var identifierPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+const (
+	maxIdentifierLength = 64
+	maxHandleLength     = 32
+	maxNameLength       = 128
+)
+
+var handlePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+func validateIdentifier(kind, id string) error {
+	if id == "" {
+		return fmt.Errorf("%s is required", kind)
+	}
+	if len(id) > maxIdentifierLength {
+		return fmt.Errorf("%s is longer than %d characters", kind, maxIdentifierLength)
+	}
+	if !identifierPattern.MatchString(id) {
+		return fmt.Errorf("%s %q can only contain letters, digits, underscores and dashes", kind, id)
+	}
+	return nil
+}
+
+// Validate checks that the ID can be used as a directory name and in filesystem paths
+func (id CommunityID) Validate() error {
+	return validateIdentifier("community id", string(id))
+}
+
+// Validate checks the format of a user ID
+func (id UserID) Validate() error {
+	return validateIdentifier("user id", string(id))
+}
+
+// Validate checks the format of an app ID
+func (id AppID) Validate() error {
+	return validateIdentifier("app id", string(id))
+}
+
+func validateHandle(handle string) error {
+	if handle == "" {
+		return errors.New("handle is required")
+	}
+	if len(handle) > maxHandleLength {
+		return fmt.Errorf("handle is longer than %d characters", maxHandleLength)
+	}
+	if !handlePattern.MatchString(handle) {
+		return fmt.Errorf("handle %q can only contain letters, digits, dots, underscores and dashes", handle)
+	}
+	return nil
+}
+
+func validateName(name string) error {
+	if len(name) > maxNameLength {
+		return fmt.Errorf("name is longer than %d characters", maxNameLength)
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return fmt.Errorf("name %q contains unprintable characters", name)
+		}
+	}
+	return nil
+}
+
+// validatePort checks that a port number can be listened on
+func validatePort(port int) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("port %d is not between 1 and 65535", port)
+	}
+	return nil
+}
+
+// validateHostPort checks that an address is a host and port
+func validateHostPort(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("address %s has no host", address)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("address %s has an invalid port", address)
+	}
+	return validatePort(portNumber)
+}
+
+// multiaddrProtocols lists the multiaddr protocols that backnets use, and how to check the value that follows each
+// of them. Protocols that map to nil don't take a value.
+var multiaddrProtocols = map[string]func(string) error{
+	"ip4": func(value string) error {
+		if ip := net.ParseIP(value); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("%q is not an IPv4 address", value)
+		}
+		return nil
+	},
+	"ip6": func(value string) error {
+		if ip := net.ParseIP(value); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("%q is not an IPv6 address", value)
+		}
+		return nil
+	},
+	"dns":     validateMultiaddrHost,
+	"dns4":    validateMultiaddrHost,
+	"dns6":    validateMultiaddrHost,
+	"dnsaddr": validateMultiaddrHost,
+	"tcp":     validateMultiaddrPort,
+	"udp":     validateMultiaddrPort,
+	"ipfs":    validateMultiaddrPeerID,
+	"p2p":     validateMultiaddrPeerID,
+
+	"quic":        nil,
+	"ws":          nil,
+	"wss":         nil,
+	"http":        nil,
+	"https":       nil,
+	"p2p-circuit": nil,
+}
+
+func validateMultiaddrHost(value string) error {
+	if value == "" || strings.ContainsAny(value, " \t") {
+		return fmt.Errorf("%q is not a host name", value)
+	}
+	return nil
+}
+
+func validateMultiaddrPort(value string) error {
+	port, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%q is not a port", value)
+	}
+	return validatePort(port)
+}
+
+func validateMultiaddrPeerID(value string) error {
+	if value == "" {
+		return errors.New("peer id is required")
+	}
+	return nil
+}
+
+// validateMultiaddr checks that an address is a multiaddr made up of known protocols, e.g. /ip4/10.0.0.1/tcp/4001
+func validateMultiaddr(address string) error {
+	if !strings.HasPrefix(address, "/") {
+		return fmt.Errorf("%q is not a multiaddr, it should start with /", address)
+	}
+
+	parts := strings.Split(address[1:], "/")
+	for i := 0; i < len(parts); i++ {
+		protocol := parts[i]
+		validateValue, ok := multiaddrProtocols[protocol]
+		if !ok {
+			return fmt.Errorf("%q has unknown protocol %q", address, protocol)
+		}
+		if validateValue == nil {
+			continue
+		}
+		if i+1 >= len(parts) {
+			return fmt.Errorf("%q is missing a value for %s", address, protocol)
+		}
+		i++
+		err := validateValue(parts[i])
+		if err != nil {
+			return fmt.Errorf("%q has an invalid %s: %s", address, protocol, err.Error())
+		}
+	}
+	return nil
+}
+
+// validatePublicKey checks that a key is a base64 encoded Ed25519 public key. Keys are empty for users that
+// haven't published one.
+func validatePublicKey(key string) error {
+	if key == "" {
+		return nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("public key is not base64 encoded: %s", err.Error())
+	}
+	if len(decoded) != ed25519.PublicKeySize {
+		return fmt.Errorf("public key is %d bytes, should be %d", len(decoded), ed25519.PublicKeySize)
+	}
+	return nil
+}
+
+func sortUserIDs(ids []UserID) {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+}
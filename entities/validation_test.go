@@ -0,0 +1,111 @@
+package entities
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fieldsOf(t *testing.T, err error) []string {
+	var fieldErrs ValidationErrors
+	assert.True(t, errors.As(err, &fieldErrs), "%v is not a ValidationErrors", err)
+	res := make([]string, len(fieldErrs))
+	for i, fe := range fieldErrs {
+		res[i] = fe.Field
+	}
+	return res
+}
+
+func TestValidCommunity(t *testing.T) {
+	assert.Nil(t, testCommunity(3).Validate())
+	assert.Nil(t, InitCommunity("community_0", "", IPFS).Validate())
+	assert.Nil(t, testHost().Validate())
+}
+
+func TestCommunityValidationAggregatesFields(t *testing.T) {
+	community := testCommunity(2)
+	community.ID = "community 0"
+	community.Members["user_1"].Handle = ""
+	community.Members["user_1"].PublicKey = "not a key"
+	community.Peers = append(community.Peers, &Peer{Key: "peer_key", Address: "10.0.0.2"})
+	community.Backnet.Type = "ftp"
+	community.Backnet.Bootstrap = append(community.Backnet.Bootstrap, "10.0.0.1:4001")
+	community.Backnet.Local.PortMap["extra"] = 4001
+	community.Apps = append(community.Apps, &App{AppID: "chat"})
+	community.Roles["user_5"] = Admin
+
+	err := community.Validate()
+	assert.Equal(t, []string{
+		"id",
+		"members[user_1].handle",
+		"members[user_1].public_key",
+		"peers[1].address",
+		"peers[1].key",
+		"backnet.type",
+		"backnet.bootstrap[1]",
+		"backnet.local_backnet_config.port_map[swarm]",
+		"apps[1].id",
+		"roles[user_5]",
+	}, fieldsOf(t, err))
+	assert.True(t, strings.Contains(err.Error(), "port 4001 is already used for extra"))
+}
+
+func TestValidateIdentifiers(t *testing.T) {
+	assert.Nil(t, CommunityID("community-0_a").Validate())
+	assert.NotNil(t, CommunityID("").Validate())
+	assert.NotNil(t, CommunityID("../community_0").Validate())
+	assert.NotNil(t, CommunityID("community:0").Validate())
+	assert.NotNil(t, CommunityID(strings.Repeat("a", 65)).Validate())
+	assert.Nil(t, UserID("alice").Validate())
+	assert.NotNil(t, UserID("alice bob").Validate())
+
+	assert.Nil(t, validateHandle("alice.b-c_d"))
+	assert.NotNil(t, validateHandle("alice@example.com"))
+	assert.NotNil(t, validateHandle(strings.Repeat("a", 33)))
+}
+
+func TestValidateMultiaddr(t *testing.T) {
+	for _, address := range []string{
+		"/ip4/10.0.0.1/tcp/4001",
+		"/ip6/::1/tcp/4001",
+		"/ip4/10.0.0.1/udp/4001/quic",
+		"/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
+		"/dns4/example.com/tcp/443/wss",
+	} {
+		assert.Nil(t, validateMultiaddr(address), address)
+	}
+	for _, address := range []string{
+		"",
+		"/",
+		"10.0.0.1:4001",
+		"/ip4/10.0.0.256/tcp/4001",
+		"/ip4/::1/tcp/4001",
+		"/ip4/10.0.0.1/tcp/70000",
+		"/ip4/10.0.0.1/tcp",
+		"/ip4/10.0.0.1/sctp/4001",
+	} {
+		assert.NotNil(t, validateMultiaddr(address), address)
+	}
+}
+
+func TestValidatePortMap(t *testing.T) {
+	assert.Nil(t, LocalBacknetConfig{}.Validate())
+	err := LocalBacknetConfig{PortMap: map[string]int{"api": 0, "gateway": 65536, "swarm": 4001, "": 4002}}.Validate()
+	assert.Equal(t, []string{"port_map[]", "port_map[api]", "port_map[gateway]"}, fieldsOf(t, err))
+}
+
+func TestHostPortConflicts(t *testing.T) {
+	host := testHost()
+	other := InitCommunity("community_1", "Other Community", IPFS)
+	other.Backnet.Local.PortMap = map[string]int{"swarm": 4004, "api": 4002, "gateway": 4006}
+	host.Communities[other.ID] = other
+
+	err := host.Validate()
+	assert.Equal(t, []string{"communities[community_1].backnet.local_backnet_config.port_map[api]"}, fieldsOf(t, err))
+
+	host.Communities["community_2"] = InitCommunity("community_1", "Misfiled Community", IPFS)
+	err = host.Validate()
+	assert.Contains(t, fieldsOf(t, err), "communities[community_2].id")
+}
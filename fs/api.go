@@ -2,11 +2,13 @@ package fs
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/eagraf/habitat-node/client"
 	"github.com/eagraf/habitat-node/entities"
@@ -54,6 +56,14 @@ type FilesystemService struct {
 	state       *entities.State
 	// i want this to be the receiver, not auth service, although that might be all we need (for now)
 	nets map[entities.CommunityID]Backnet
+
+	// communities that have been archived since the service started, kept up to date by Receive
+	archived map[entities.CommunityID]bool
+	// communities whose files are being copied to a new backnet
+	migrating map[entities.CommunityID]bool
+	// writes to a community's files hold its lock shared, and BeginMigration holds it exclusively
+	writeLocks map[entities.CommunityID]*sync.RWMutex
+	mutex      sync.RWMutex
 }
 
 // NewFilesystemService initializes the FS service given an auth service
@@ -63,6 +73,14 @@ func NewFilesystemService(as *client.AuthService, s *entities.State, n map[entit
 		authService: as,
 		state:       s,
 		nets:        n,
+		archived:    make(map[entities.CommunityID]bool),
+		migrating:   make(map[entities.CommunityID]bool),
+		writeLocks:  make(map[entities.CommunityID]*sync.RWMutex),
+	}
+	for id, community := range s.Communities {
+		if community.Archived {
+			res.archived[id] = true
+		}
 	}
 	return res, nil
 
@@ -191,7 +209,78 @@ func CommunityFromID(state *entities.State, comm entities.CommunityID) *entities
 	return nil
 }
 
+// checkWritable returns an error if the files of a community can't be changed
+func (fs *FilesystemService) checkWritable(comm entities.CommunityID) error {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	if fs.archived[comm] {
+		return fmt.Errorf("community %s is archived and read-only", comm)
+	}
+	if fs.migrating[comm] {
+		return fmt.Errorf("community %s is read-only while its files are migrated to a new backnet", comm)
+	}
+	return nil
+}
+
+// beginWrite checks that the files of a community can be changed, and holds off migrations until the returned
+// function is called once the write is done
+func (fs *FilesystemService) beginWrite(comm entities.CommunityID) (func(), error) {
+	lock := fs.writeLock(comm)
+	lock.RLock()
+	err := fs.checkWritable(comm)
+	if err != nil {
+		lock.RUnlock()
+		return nil, err
+	}
+	return lock.RUnlock, nil
+}
+
+// writeLock returns the lock writes to a community's files hold
+func (fs *FilesystemService) writeLock(comm entities.CommunityID) *sync.RWMutex {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	lock, ok := fs.writeLocks[comm]
+	if !ok {
+		lock = &sync.RWMutex{}
+		fs.writeLocks[comm] = lock
+	}
+	return lock
+}
+
+// BeginMigration makes a community read-only while its files are copied to a new backnet. It waits for writes
+// that were allowed before it to finish, so that every write either makes it into the copy or is rejected.
+func (fs *FilesystemService) BeginMigration(comm entities.CommunityID) {
+	lock := fs.writeLock(comm)
+	lock.Lock()
+	defer lock.Unlock()
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.migrating[comm] = true
+}
+
+// FinishMigration makes a community writable again. If the migration succeeded, net is the community's new
+// backnet, otherwise it is nil and the old backnet keeps being used.
+func (fs *FilesystemService) FinishMigration(comm entities.CommunityID, net Backnet) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	delete(fs.migrating, comm)
+	if net != nil {
+		fs.nets[comm] = net
+	}
+}
+
+// Backnet returns the backnet the filesystem uses for a community
+func (fs *FilesystemService) Backnet(comm entities.CommunityID) (Backnet, error) {
+	return fs.backnetFromCommID(comm)
+}
+
 func (fs *FilesystemService) backnetFromCommID(sessID entities.CommunityID) (Backnet, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
 	var net Backnet
 	for id, backnet := range fs.nets {
 		if id == sessID {
@@ -269,6 +358,16 @@ func (fs *FilesystemService) ParseWrites(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// archived communities are read-only, and migrations wait for the write to finish
+	release, err := fs.beginWrite(commid)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		w.WriteHeader(200)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer release()
+
 	// how to get community backnet from user
 	net, err := fs.backnetFromCommID(commid)
 	if err != nil {
@@ -362,6 +461,16 @@ func (fs *FilesystemService) ParseRemoves(w http.ResponseWriter, r *http.Request
 		isdir = true
 	}
 
+	// archived communities are read-only, and migrations wait for the write to finish
+	release, err := fs.beginWrite(commid)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		w.WriteHeader(200)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer release()
+
 	// how to get community backnet from user
 	net, err := fs.backnetFromCommID(commid)
 	if err != nil {
@@ -468,6 +577,16 @@ func (fs *FilesystemService) ParseMoves(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// archived communities are read-only, and migrations wait for the write to finish
+	release, err := fs.beginWrite(oldcommID)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		w.WriteHeader(200)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer release()
+
 	// how to get community backnet from user
 	net, err := fs.backnetFromCommID(oldcommID)
 	if err != nil {
@@ -533,6 +652,16 @@ func (fs *FilesystemService) ParseCopys(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// archived communities are read-only, and migrations wait for the write to finish
+	release, err := fs.beginWrite(oldcommID)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		w.WriteHeader(200)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer release()
+
 	// how to get community backnet from user
 	net, err := fs.backnetFromCommID(oldcommID)
 	if err != nil {
@@ -564,6 +693,16 @@ func (fs *FilesystemService) ParseMkdirs(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// archived communities are read-only, and migrations wait for the write to finish
+	release, err := fs.beginWrite(commid)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		w.WriteHeader(200)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer release()
+
 	// how to get community backnet from user
 	net, err := fs.backnetFromCommID(commid)
 	if err != nil {
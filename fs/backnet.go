@@ -26,12 +26,14 @@ type Backnet interface {
 	Unpin(string) ([]byte, error)
 
 	ListFiles(string) ([]byte, error)
+	ListNames(string) ([]string, error)  // names of the entries in a directory, which ListFiles joins with ", "
 	Remove(string, bool) ([]byte, error) // bool = indicator of directory or file
 	Cat(string) ([]byte, error)
 	Write(string, *os.File) ([]byte, error)
 	Move(string, string) ([]byte, error)
 	Copy(string, string) ([]byte, error)
 	MakeDir(string) ([]byte, error)
+	IsDir(string) (bool, error)
 }
 
 // IPFSBacknet implements these methods for an IPFS node
@@ -146,6 +148,40 @@ func (net *IPFSBacknet) getHash(path string) (string, error) {
 	return resBodyJSON.Hash, nil
 }
 
+// IsDir implements stat for IPFSBacknets
+func (net *IPFSBacknet) IsDir(path string) (bool, error) {
+
+	q := url.Values{}
+	q.Set("arg", path)
+
+	res, err := IPFSAPICall(
+		net.api,
+		"/api/v0/files/stat",
+		q,
+		nil,
+	)
+
+	if err != nil {
+		return false, err
+	}
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return false, err
+	}
+
+	var resBodyJSON FileInfoResponse
+	err = json.Unmarshal(resBody, &resBodyJSON)
+	if err != nil {
+		return false, err
+	}
+	if resBodyJSON.Type == "" {
+		return false, fmt.Errorf("could not stat %s: %s", path, string(resBody))
+	}
+
+	return resBodyJSON.Type == "directory", nil
+}
+
 // Type is
 type Type struct {
 	Type string `json:"Type"`
@@ -341,6 +377,16 @@ type LsResponse struct {
 
 // ListFiles implements ls for IPFSBacknets
 func (net *IPFSBacknet) ListFiles(filepath string) ([]byte, error) {
+	entries, err := net.ListNames(filepath)
+	if err != nil {
+		return nil, err
+	}
+	restr := strings.Join(entries, ", ")
+	return []byte(restr), nil
+}
+
+// ListNames implements ls for IPFSBacknets, returning the name of each entry
+func (net *IPFSBacknet) ListNames(filepath string) ([]string, error) {
 
 	argmap := map[string]string{}
 	if filepath != "" {
@@ -376,12 +422,11 @@ func (net *IPFSBacknet) ListFiles(filepath string) ([]byte, error) {
 
 	// bytes, err := ioutil.ReadAll(res.Body)
 	log.Debug().Str("response body", string(resBody)).Msg("List")
-	var entries []string
+	entries := make([]string, 0, len(resBodyJSON.Entries))
 	for _, e := range resBodyJSON.Entries {
 		entries = append(entries, string(e.Name))
 	}
-	restr := strings.Join(entries, ", ")
-	return []byte(restr), nil
+	return entries, nil
 }
 
 // Remove implements rm for IPFSBacknets
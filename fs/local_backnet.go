@@ -0,0 +1,182 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/eagraf/habitat-node/entities"
+)
+
+// LocalBacknetDir is where a local backnet keeps a community's files
+func LocalBacknetDir(id entities.CommunityID) string {
+	return filepath.Join(os.Getenv("LOCAL_BACKNET_DIR"), string(id))
+}
+
+// LocalBacknet implements Backnet on top of a directory on this node. Its files are not shared with any peers.
+type LocalBacknet struct {
+	communityID entities.CommunityID
+	root        string
+}
+
+// InitLocalBacknet creates a filesystem-specific local backnet rooted at dir
+func InitLocalBacknet(id entities.CommunityID, dir string) *LocalBacknet {
+	return &LocalBacknet{
+		communityID: id,
+		root:        dir,
+	}
+}
+
+// resolve turns a path in the backnet into a path on disk, without letting it escape the backnet's root
+func (net *LocalBacknet) resolve(path string) string {
+	return filepath.Join(net.root, filepath.Clean("/"+path))
+}
+
+// IsPinned is always true, since all files in a local backnet are stored on this node
+func (net *LocalBacknet) IsPinned(path string) (bool, error) {
+	_, err := os.Stat(net.resolve(path))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Pin is a no-op for local backnets
+func (net *LocalBacknet) Pin(path string) ([]byte, error) {
+	_, err := os.Stat(net.resolve(path))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(path), nil
+}
+
+// Unpin is not possible for local backnets, because this node has the only copy of the files
+func (net *LocalBacknet) Unpin(path string) ([]byte, error) {
+	return nil, errors.New("files in a local backnet can't be unpinned")
+}
+
+// ListFiles implements ls for LocalBacknets, in the same format as IPFSBacknets
+func (net *LocalBacknet) ListFiles(path string) ([]byte, error) {
+	entries, err := net.ListNames(path)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.Join(entries, ", ")), nil
+}
+
+// ListNames implements ls for LocalBacknets, returning the name of each entry
+func (net *LocalBacknet) ListNames(path string) ([]string, error) {
+	infos, err := ioutil.ReadDir(net.resolve(path))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]string, len(infos))
+	for i, info := range infos {
+		entries[i] = info.Name()
+	}
+	return entries, nil
+}
+
+// Remove implements rm for LocalBacknets
+func (net *LocalBacknet) Remove(path string, isdir bool) ([]byte, error) {
+	target := net.resolve(path)
+	if target == filepath.Clean(net.root) {
+		return nil, errors.New("can't remove the root of a backnet")
+	}
+
+	var err error
+	if isdir {
+		err = os.RemoveAll(target)
+	} else {
+		err = os.Remove(target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte{}, nil
+}
+
+// Cat implements cat for LocalBacknets
+func (net *LocalBacknet) Cat(path string) ([]byte, error) {
+	return ioutil.ReadFile(net.resolve(path))
+}
+
+// Write implements writing/updating files for LocalBacknets
+func (net *LocalBacknet) Write(path string, f *os.File) ([]byte, error) {
+	target := net.resolve(path)
+	err := os.MkdirAll(filepath.Dir(target), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, f)
+	if err != nil {
+		return nil, err
+	}
+	return []byte{}, nil
+}
+
+// Move implements mv for LocalBacknets
+func (net *LocalBacknet) Move(oldpath string, newpath string) ([]byte, error) {
+	err := os.Rename(net.resolve(oldpath), net.resolve(newpath))
+	if err != nil {
+		return nil, err
+	}
+	return []byte{}, nil
+}
+
+// Copy implements cp for LocalBacknets. Directories are copied recursively.
+func (net *LocalBacknet) Copy(oldpath string, newpath string) ([]byte, error) {
+	src, dst := net.resolve(oldpath), net.resolve(newpath)
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, buf, 0600)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []byte{}, nil
+}
+
+// MakeDir implements mkdir for LocalBacknets
+func (net *LocalBacknet) MakeDir(dirpath string) ([]byte, error) {
+	err := os.MkdirAll(net.resolve(dirpath), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return []byte{}, nil
+}
+
+// IsDir implements stat for LocalBacknets
+func (net *LocalBacknet) IsDir(path string) (bool, error) {
+	info, err := os.Stat(net.resolve(path))
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
+}
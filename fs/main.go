@@ -14,6 +14,15 @@ import (
 
 // RunFilesystem exported to be called by orchestrator
 func RunFilesystem(as *client.AuthService, state *entities.State, ports map[entities.CommunityID]string, enets map[entities.CommunityID]entities.Backnet) {
+	fs, err := InitFilesystem(as, state, ports, enets)
+	if err != nil {
+		panic(err)
+	}
+	fs.Serve()
+}
+
+// InitFilesystem sets up the filesystem service without serving it, so that the orchestrator can pass it transitions
+func InitFilesystem(as *client.AuthService, state *entities.State, ports map[entities.CommunityID]string, enets map[entities.CommunityID]entities.Backnet) (*FilesystemService, error) {
 
 	backnets := make(map[entities.CommunityID]Backnet)
 	for id, api := range ports {
@@ -24,12 +33,18 @@ func RunFilesystem(as *client.AuthService, state *entities.State, ports map[enti
 			backnets[id] = InitIPFSBacknet(id, enet, "127.0.0.1:"+port)
 		}
 	}
-
-	fs, err := NewFilesystemService(as, state, backnets)
-	if err != nil {
-		panic(err)
+	// Local backnets don't have an API to wait for
+	for id, enet := range enets {
+		if enet.Type == entities.Local {
+			backnets[id] = InitLocalBacknet(id, LocalBacknetDir(id))
+		}
 	}
 
+	return NewFilesystemService(as, state, backnets)
+}
+
+// Serve runs the filesystem API until it fails
+func (fs *FilesystemService) Serve() {
 	router := mux.NewRouter()
 	router.PathPrefix("/api/fs/ls").Handler(http.HandlerFunc(fs.ParseListFiles))
 	router.PathPrefix("/api/fs/write").Handler(http.HandlerFunc(fs.ParseWrites))
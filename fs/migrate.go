@@ -0,0 +1,129 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/eagraf/habitat-node/entities"
+)
+
+// BacknetFor creates the filesystem side of a community's backnet from its configuration
+func BacknetFor(id entities.CommunityID, net entities.Backnet) (Backnet, error) {
+	switch net.Type {
+	case entities.IPFS:
+		port, ok := net.Local.PortMap["api"]
+		if !ok {
+			return nil, fmt.Errorf("ipfs backnet for community %s has no api port", id)
+		}
+		return InitIPFSBacknet(id, net, "127.0.0.1:"+strconv.Itoa(port)), nil
+	case entities.Local:
+		return InitLocalBacknet(id, LocalBacknetDir(id)), nil
+	default:
+		return nil, fmt.Errorf("backnet type %s is not supported", net.Type)
+	}
+}
+
+// MigrateFiles copies every file in a backnet to another backnet, and then checks that the new backnet
+// returns the same contents for each of them. The paths of the copied files are returned.
+func MigrateFiles(from, to Backnet) ([]string, error) {
+	files, err := copyDir(from, to, "/")
+	if err != nil {
+		return nil, err
+	}
+
+	err = VerifyFiles(from, to, files)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// VerifyFiles checks that both backnets have the same contents for each of the files
+func VerifyFiles(from, to Backnet, files []string) error {
+	for _, file := range files {
+		expected, err := from.Cat(file)
+		if err != nil {
+			return fmt.Errorf("error reading %s from old backnet: %s", file, err.Error())
+		}
+		actual, err := to.Cat(file)
+		if err != nil {
+			return fmt.Errorf("error reading %s from new backnet: %s", file, err.Error())
+		}
+
+		expectedSum, actualSum := sha256.Sum256(expected), sha256.Sum256(actual)
+		if !bytes.Equal(expectedSum[:], actualSum[:]) {
+			return fmt.Errorf("%s has checksum %x in the new backnet, expected %x", file, actualSum, expectedSum)
+		}
+	}
+	return nil
+}
+
+// copyDir recursively copies a directory between backnets
+func copyDir(from, to Backnet, dir string) ([]string, error) {
+	names, err := from.ListNames(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0)
+	for _, name := range names {
+		child := path.Join(dir, name)
+		isDir, err := from.IsDir(child)
+		if err != nil {
+			return nil, err
+		}
+
+		if isDir {
+			_, err = to.MakeDir(child)
+			if err != nil {
+				return nil, fmt.Errorf("error making dir %s: %s", child, err.Error())
+			}
+			children, err := copyDir(from, to, child)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, children...)
+			continue
+		}
+
+		err = copyFile(from, to, child)
+		if err != nil {
+			return nil, fmt.Errorf("error copying %s: %s", child, err.Error())
+		}
+		files = append(files, child)
+	}
+	return files, nil
+}
+
+// copyFile copies a single file between backnets. Backnets write from files on disk, so the contents are
+// staged in a temp file.
+func copyFile(from, to Backnet, file string) error {
+	contents, err := from.Cat(file)
+	if err != nil {
+		return err
+	}
+
+	temp, err := ioutil.TempFile("", "habitat-migrate-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	_, err = temp.Write(contents)
+	if err != nil {
+		return err
+	}
+	_, err = temp.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = to.Write(file, temp)
+	return err
+}
@@ -0,0 +1,98 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eagraf/habitat-node/entities"
+	"gotest.tools/assert"
+)
+
+func writeLocalFile(t *testing.T, net *LocalBacknet, path, contents string) {
+	file, err := ioutil.TempFile(t.TempDir(), "contents")
+	assert.NilError(t, err)
+	defer file.Close()
+	_, err = file.WriteString(contents)
+	assert.NilError(t, err)
+	_, err = file.Seek(0, 0)
+	assert.NilError(t, err)
+
+	_, err = net.Write(path, file)
+	assert.NilError(t, err)
+}
+
+func TestMigrateFiles(t *testing.T) {
+	from := InitLocalBacknet("community_0", t.TempDir())
+	to := InitLocalBacknet("community_0", t.TempDir())
+
+	writeLocalFile(t, from, "/readme.txt", "hello")
+	writeLocalFile(t, from, "/photos/cat.jpg", "meow")
+	writeLocalFile(t, from, "/notes, draft.txt", "draft")
+	_, err := from.MakeDir("/photos/empty")
+	assert.NilError(t, err)
+
+	files, err := MigrateFiles(from, to)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"/notes, draft.txt", "/photos/cat.jpg", "/readme.txt"}, files)
+
+	contents, err := to.Cat("/photos/cat.jpg")
+	assert.NilError(t, err)
+	assert.Equal(t, "meow", string(contents))
+	isDir, err := to.IsDir("/photos/empty")
+	assert.NilError(t, err)
+	assert.Equal(t, true, isDir)
+
+	// Files that don't match are caught by verification
+	writeLocalFile(t, to, "/readme.txt", "goodbye")
+	err = VerifyFiles(from, to, files)
+	assert.ErrorContains(t, err, "/readme.txt")
+}
+
+func TestLocalBacknetStaysInRoot(t *testing.T) {
+	root := t.TempDir()
+	net := InitLocalBacknet("community_0", filepath.Join(root, "community_0"))
+	_, err := net.MakeDir("/")
+	assert.NilError(t, err)
+
+	writeLocalFile(t, net, "../../escaped.txt", "nope")
+	_, err = os.Stat(filepath.Join(root, "escaped.txt"))
+	assert.Assert(t, os.IsNotExist(err))
+	contents, err := net.Cat("/escaped.txt")
+	assert.NilError(t, err)
+	assert.Equal(t, "nope", string(contents))
+
+	_, err = net.Remove("/", true)
+	assert.Assert(t, err != nil)
+}
+
+func TestBeginMigrationWaitsForWrites(t *testing.T) {
+	fs, err := NewFilesystemService(nil, entities.InitState(), map[entities.CommunityID]Backnet{})
+	assert.NilError(t, err)
+
+	// A write that was allowed before the migration began has to finish before the files are copied
+	release, err := fs.beginWrite("community_0")
+	assert.NilError(t, err)
+	begun := make(chan struct{})
+	go func() {
+		fs.BeginMigration("community_0")
+		close(begun)
+	}()
+	select {
+	case <-begun:
+		t.Fatal("migration began while a write was in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Writes after that are rejected until the migration is finished
+	release()
+	<-begun
+	_, err = fs.beginWrite("community_0")
+	assert.ErrorContains(t, err, "read-only")
+	fs.FinishMigration("community_0", nil)
+	release, err = fs.beginWrite("community_0")
+	assert.NilError(t, err)
+	release()
+}
@@ -0,0 +1,43 @@
+package fs
+
+import (
+	"errors"
+
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/rs/zerolog/log"
+)
+
+// Receive implements TransitionSubscriber, keeping track of which communities the filesystem can serve
+// and which of them are read-only. Transitions are accepted in value and pointer form.
+func (fs *FilesystemService) Receive(transition transitions.Transition) error {
+	transition = transitions.Normalize(transition)
+	switch transition.Type() {
+	case transitions.ArchiveCommunityTransitionType:
+		archiveCommunityTransition, ok := transition.(*transitions.ArchiveCommunityTransition)
+		if !ok {
+			return errors.New("transition is not type ArchiveCommunityTransition")
+		}
+
+		fs.mutex.Lock()
+		defer fs.mutex.Unlock()
+		if archiveCommunityTransition.Archived {
+			fs.archived[archiveCommunityTransition.CommID] = true
+		} else {
+			delete(fs.archived, archiveCommunityTransition.CommID)
+		}
+	case transitions.DeleteCommunityTransitionType:
+		deleteCommunityTransition, ok := transition.(*transitions.DeleteCommunityTransition)
+		if !ok {
+			return errors.New("transition is not type DeleteCommunityTransition")
+		}
+
+		fs.mutex.Lock()
+		defer fs.mutex.Unlock()
+		delete(fs.nets, deleteCommunityTransition.CommID)
+		delete(fs.archived, deleteCommunityTransition.CommID)
+		delete(fs.writeLocks, deleteCommunityTransition.CommID)
+	default:
+		log.Debug().Msgf("filesystem ignoring %s transition", transition.Type())
+	}
+	return nil
+}
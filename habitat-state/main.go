@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/eagraf/habitat-node/state"
+)
+
+const usage = `usage: habitat-state <command> [flags] <community>
+
+Inspects the WAL and snapshots in $STATE_DIR/<community>, without writing to them. Use "host" for the host state.
+
+commands:
+  dump      print log entries, one per line or as JSON
+  verify    check log line checksums, sequence number continuity and snapshots
+  snapshot  decode a snapshot to JSON
+
+Run habitat-state <command> -h for the flags of each command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "dump":
+		err = dump(os.Args[2:])
+	case "verify":
+		err = verify(os.Args[2:])
+	case "snapshot":
+		err = snapshot(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "habitat-state: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// stateDirFlags parses a command's flags, and finds the state dir of the community named by the only argument
+func stateDirFlags(flags *flag.FlagSet, args []string) (string, error) {
+	err := flags.Parse(args)
+	if err != nil {
+		return "", err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return "", errors.New("expected a single community")
+	}
+
+	stateBaseDir, ok := os.LookupEnv("STATE_DIR")
+	if !ok {
+		return "", errors.New("STATE_DIR is not set")
+	}
+	communityID := entities.CommunityID(flags.Arg(0))
+	err = communityID.Validate()
+	if err != nil {
+		return "", err
+	}
+
+	stateDir := filepath.Join(stateBaseDir, string(communityID))
+	info, err := os.Stat(stateDir)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", stateDir)
+	}
+	return stateDir, nil
+}
+
+func archiveFlag(flags *flag.FlagSet) *string {
+	return flags.String("archive", "", "directory that compacted segments were archived to (default <state dir>/archive)")
+}
+
+func archiveDir(flagValue, stateDir string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return filepath.Join(stateDir, "archive")
+}
+
+func dump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	transitionType := flags.String("type", "", "only print entries with this transition type, e.g. MODIFY_COMMUNITY_MEMBERS")
+	from := flags.Uint64("from", 0, "only print entries with at least this sequence number")
+	to := flags.Uint64("to", 0, "only print entries with at most this sequence number (default no limit)")
+	asJSON := flags.Bool("json", false, "print every entry as indented JSON, exactly as it was written")
+	archive := archiveFlag(flags)
+	stateDir, err := stateDirFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	segments, err := state.StateDirSegments(stateDir, archiveDir(*archive, stateDir))
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		err := state.ScanSegment(segment.Path, func(line *state.SegmentLine) error {
+			// Corrupt lines are always shown, since they can't be filtered
+			if line.Err != nil {
+				fmt.Printf("%s:%d: corrupt entry: %s\n", line.Path, line.Number, line.Err.Error())
+				return nil
+			}
+
+			entry := line.Entry
+			if entry.SequenceNumber < *from || (*to != 0 && entry.SequenceNumber > *to) {
+				return nil
+			}
+			if *transitionType != "" && entry.Transition.Type != transitions.TransitionType(*transitionType) {
+				return nil
+			}
+
+			if !*asJSON {
+				fmt.Printf("%d\t%s\t%s\t%s\n", entry.SequenceNumber, entry.Committed.Format(time.RFC3339Nano), entry.Transition.Type, entry.Transition.Author)
+				return nil
+			}
+			data, err := line.Data()
+			if err != nil {
+				return err
+			}
+			return printJSON(data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	archive := archiveFlag(flags)
+	stateDir, err := stateDirFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	verification, err := state.VerifyStateDir(stateDir, archiveDir(*archive, stateDir))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("entries: %d (sequence numbers %d to %d, %d without checksums)\n", verification.Entries, verification.FirstSequenceNumber, verification.LastSequenceNumber, verification.Unchecksummed)
+	fmt.Printf("snapshots: %d (current snapshot at sequence number %d)\n", verification.Snapshots, verification.SnapshotSequenceNumber)
+	for _, problem := range verification.Problems {
+		fmt.Println(problem.String())
+	}
+
+	if len(verification.Problems) > 0 {
+		return fmt.Errorf("found %d problems in %s", len(verification.Problems), stateDir)
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func snapshot(args []string) error {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	sequenceNumber := flags.Uint64("seq", 0, "decode the archived snapshot taken at this sequence number (default the current snapshot)")
+	list := flags.Bool("list", false, "list the archived snapshots instead")
+	stateDir, err := stateDirFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	archived, err := state.ArchivedSnapshots(stateDir)
+	if err != nil {
+		return err
+	}
+	if *list {
+		for _, snapshot := range archived {
+			fmt.Printf("%d\t%s\t%s\n", snapshot.SequenceNumber, snapshot.ModTime.Format(time.RFC3339), snapshot.Path)
+		}
+		return nil
+	}
+
+	path := filepath.Join(stateDir, "snapshot")
+	if *sequenceNumber != 0 {
+		path = ""
+		for _, snapshot := range archived {
+			if snapshot.SequenceNumber == *sequenceNumber {
+				path = snapshot.Path
+			}
+		}
+		if path == "" {
+			return fmt.Errorf("there is no archived snapshot at sequence number %d", *sequenceNumber)
+		}
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var sn state.Snapshot
+	err = json.Unmarshal(buf, &sn)
+	if err != nil {
+		return err
+	}
+	data, err := base64.StdEncoding.DecodeString(sn.DataB64)
+	if err != nil {
+		return err
+	}
+
+	// The state is shown as it was written, without upgrading it to the current schema version
+	decoded, err := json.Marshal(struct {
+		Type           transitions.TransitionSubscriptionCategory `json:"type"`
+		Version        int                                        `json:"version"`
+		SequenceNumber uint64                                     `json:"sequence_number"`
+		Timestamp      time.Time                                  `json:"timestamp"`
+		Data           json.RawMessage                            `json:"data"`
+	}{
+		Type:           sn.Type,
+		Version:        sn.Version,
+		SequenceNumber: sn.SequenceNumber,
+		Timestamp:      sn.Timestamp,
+		Data:           data,
+	})
+	if err != nil {
+		return err
+	}
+	return printJSON(decoded)
+}
+
+func printJSON(data []byte) error {
+	var buf bytes.Buffer
+	err := json.Indent(&buf, data, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err = buf.WriteTo(os.Stdout)
+	return err
+}
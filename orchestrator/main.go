@@ -1,7 +1,7 @@
 package main
 
 import (
-	"time"
+	"os"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -9,63 +9,76 @@ import (
 	"github.com/eagraf/habitat-node/entities"
 	"github.com/eagraf/habitat-node/entities/transitions"
 	"github.com/eagraf/habitat-node/orchestrator/processes"
+	"github.com/eagraf/habitat-node/state"
 )
 
+// snapshotInterval is the number of transitions between snapshots of host and community state
+const snapshotInterval = 100
+
 func main() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	log.Info().Msg("orchestrator starting")
 
-	state := &entities.State{
-		Communities: map[entities.CommunityID]*entities.Community{
-			entities.CommunityID("community_0"): {
-				ID: entities.CommunityID("community_0"),
-				Backnet: &entities.Backnet{
-					Type: entities.IPFS,
-					Local: entities.LocalBacknetConfig{
-						PortMap: map[string]int{
-							"swarm":   4001,
-							"api":     4002,
-							"gateway": 4003,
-						},
-					},
-				},
-			},
-			entities.CommunityID("community_1"): {
-				ID: entities.CommunityID("community_1"),
-				Backnet: &entities.Backnet{
-					Type: entities.IPFS,
-					Local: entities.LocalBacknetConfig{
-						PortMap: map[string]int{
-							"swarm":   4004,
-							"api":     4005,
-							"gateway": 4006,
-						},
-					},
-				},
-			},
-		},
+	stateDir := os.Getenv("STATE_DIR")
+	subscriptions := state.NewSubscriptionRegistry()
+	go func() {
+		for err := range subscriptions.Errors() {
+			log.Err(err).Msg("")
+		}
+	}()
+
+	// Restore the host's state, and publish every host transition it commits
+	host, err := state.InitHostStateMachine(stateDir, snapshotInterval)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open host state")
+	}
+	defer host.Close()
+	err = host.Restart()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to restore host state")
 	}
+	host.Subscriptions = subscriptions
+	subscriptions.AddSource(host)
 
-	m := processes.InitManager()
-	m.Start(state)
+	// Restore the state of every community hosted on this node. The registry starts and stops community state
+	// machines as communities are added to and deleted from the host.
+	communities := state.NewCommunityRegistry(stateDir, snapshotInterval)
+	communities.Subscriptions = subscriptions
+	communities.Hosted = func(communityID entities.CommunityID) bool {
+		_, ok := host.State.Communities[communityID]
+		return ok
+	}
+	err = communities.Start()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to restore community state")
+	}
+	defer communities.Close()
+	_, err = subscriptions.Subscribe("community_registry", transitions.HostCategory, communities, nil)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to subscribe community registry")
+	}
 
-	time.Sleep(10 * time.Second)
+	// The process manager starts from the restored state, and then receives all committed host and community
+	// transitions
+	restored := entities.InitState()
+	restored.HostUsers = host.State.HostUsers
+	for _, communityID := range communities.Communities() {
+		if sm, ok := communities.Get(communityID); ok && sm.State != nil {
+			restored.Communities[communityID] = sm.State
+		}
+	}
 
-	m.Receive(transitions.AddCommunityTransition{
-		Community: &entities.Community{
-			ID: entities.CommunityID("community_2"),
-			Backnet: &entities.Backnet{
-				Type: entities.IPFS,
-				Local: entities.LocalBacknetConfig{
-					PortMap: map[string]int{
-						"swarm":   4007,
-						"api":     4008,
-						"gateway": 4009,
-					},
-				},
-			},
-		},
-	})
+	m := processes.InitManager()
+	err = m.Start(restored)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to start process manager")
+	}
+	for _, category := range []transitions.TransitionSubscriptionCategory{transitions.HostCategory, transitions.CommunityCategory} {
+		_, err := subscriptions.Subscribe("process_manager", category, m, nil)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to subscribe process manager")
+		}
+	}
 
 	select {}
 }
@@ -0,0 +1,98 @@
+package processes
+
+import (
+	"fmt"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/rs/zerolog/log"
+)
+
+// AppStatus is the process manager's view of an installed app
+type AppStatus struct {
+	AppID   entities.AppID
+	Running bool
+}
+
+// TODO apps don't have a runtime yet, so the process manager only keeps track of which apps should be running
+
+// receiveAppTransition updates the apps that are installed and running in a community
+func (pm *ProcessManager) receiveAppTransition(transition transitions.CommunityTransition, appID entities.AppID) error {
+	pm.appMutex.Lock()
+	defer pm.appMutex.Unlock()
+
+	communityID := transition.CommunityID()
+	apps, ok := pm.apps[communityID]
+	if !ok {
+		apps = make(map[entities.AppID]*AppStatus)
+		pm.apps[communityID] = apps
+	}
+	app, installed := apps[appID]
+
+	switch transition.Type() {
+	case transitions.InstallAppTransitionType:
+		if installed {
+			return fmt.Errorf("app %s is already installed in community %s", appID, communityID)
+		}
+		apps[appID] = &AppStatus{
+			AppID: appID,
+		}
+		log.Info().Msgf("app %s installed in community %s", appID, communityID)
+		return nil
+	}
+
+	if !installed {
+		return fmt.Errorf("app %s is not installed in community %s", appID, communityID)
+	}
+
+	switch transition.Type() {
+	case transitions.UninstallAppTransitionType:
+		if app.Running {
+			log.Info().Msgf("stopping app %s in community %s", appID, communityID)
+		}
+		delete(apps, appID)
+		log.Info().Msgf("app %s uninstalled from community %s", appID, communityID)
+	case transitions.StartAppTransitionType:
+		app.Running = true
+		log.Info().Msgf("app %s started in community %s", appID, communityID)
+	case transitions.StopAppTransitionType:
+		app.Running = false
+		log.Info().Msgf("app %s stopped in community %s", appID, communityID)
+	default:
+		return fmt.Errorf("transition type %s is not an app transition", transition.Type())
+	}
+	return nil
+}
+
+// restoreApps picks up the apps installed in a community's restored state, and starts the ones that were running
+func (pm *ProcessManager) restoreApps(community *entities.Community) {
+	pm.appMutex.Lock()
+	defer pm.appMutex.Unlock()
+
+	apps := make(map[entities.AppID]*AppStatus, len(community.Apps))
+	for _, app := range community.Apps {
+		apps[app.AppID] = &AppStatus{
+			AppID:   app.AppID,
+			Running: app.Running,
+		}
+		if app.Running {
+			log.Info().Msgf("app %s started in community %s", app.AppID, community.ID)
+		}
+	}
+	pm.apps[community.ID] = apps
+}
+
+// Apps returns the status of the apps installed in a community
+func (pm *ProcessManager) Apps(communityID entities.CommunityID) []*AppStatus {
+	pm.appMutex.Lock()
+	defer pm.appMutex.Unlock()
+
+	res := make([]*AppStatus, 0, len(pm.apps[communityID]))
+	for _, app := range pm.apps[communityID] {
+		res = append(res, &AppStatus{
+			AppID:   app.AppID,
+			Running: app.Running,
+		})
+	}
+	return res
+}
@@ -0,0 +1,73 @@
+package processes
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"gotest.tools/assert"
+)
+
+func TestReceiveAppTransitions(t *testing.T) {
+	pm := InitManager()
+
+	err := pm.Receive(&transitions.InstallAppTransition{CommID: "community_0", AppID: "chat"})
+	assert.NilError(t, err)
+	err = pm.Receive(&transitions.StartAppTransition{CommID: "community_0", AppID: "chat"})
+	assert.NilError(t, err)
+
+	apps := pm.Apps("community_0")
+	assert.Equal(t, 1, len(apps))
+	assert.Equal(t, true, apps[0].Running)
+
+	// Transitions that were applied directly arrive as values rather than pointers
+	err = pm.Receive(transitions.StopAppTransition{CommID: "community_0", AppID: "chat"})
+	assert.NilError(t, err)
+	assert.Equal(t, false, pm.Apps("community_0")[0].Running)
+
+	err = pm.Receive(transitions.UninstallAppTransition{CommID: "community_0", AppID: "chat"})
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(pm.Apps("community_0")))
+
+	// Apps have to be installed before they can be started
+	err = pm.Receive(&transitions.StartAppTransition{CommID: "community_0", AppID: "chat"})
+	assert.Assert(t, err != nil)
+}
+
+func TestRestoreApps(t *testing.T) {
+	os.Setenv("LOCAL_BACKNET_DIR", t.TempDir())
+	defer os.Unsetenv("LOCAL_BACKNET_DIR")
+
+	community := entities.InitCommunity("community_0", "My Community", entities.Local)
+	community.Apps = []*entities.App{{AppID: "chat", Running: true}, {AppID: "notes"}}
+	state := entities.InitState()
+	state.Communities[community.ID] = community
+
+	pm := InitManager()
+	pm.restore(state)
+	apps := make(map[entities.AppID]bool)
+	for _, app := range pm.Apps(community.ID) {
+		apps[app.AppID] = app.Running
+	}
+	assert.DeepEqual(t, map[entities.AppID]bool{"chat": true, "notes": false}, apps)
+
+	// Apps installed before the restart can be updated and uninstalled
+	err := pm.Receive(&transitions.StopAppTransition{CommID: community.ID, AppID: "chat"})
+	assert.NilError(t, err)
+	err = pm.Receive(&transitions.UninstallAppTransition{CommID: community.ID, AppID: "notes"})
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(pm.Apps(community.ID)))
+
+	// The backnet is started in the background
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		pm.processMutex.Lock()
+		_, ok := pm.backnets[community.ID]
+		pm.processMutex.Unlock()
+		if ok {
+			return
+		}
+	}
+	t.Fatal("backnet was not started")
+}
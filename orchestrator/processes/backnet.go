@@ -14,6 +14,7 @@ import (
 
 type Backnet interface {
 	ProcessID() ProcessID
+	Type() entities.BacknetType
 	Configure(backnet *entities.Backnet) error
 	StartProcess() (*Process, error)
 }
@@ -56,15 +57,22 @@ func (ib *IPFSBacknet) ProcessID() ProcessID {
 	return ib.process.ID
 }
 
+func (ib *IPFSBacknet) Type() entities.BacknetType {
+	return entities.IPFS
+}
+
 func (ib *IPFSBacknet) Configure(newBacknet *entities.Backnet) error {
 	if newBacknet.Type != entities.IPFS {
 		return errors.New("backnet should be of type IPFS")
 	}
 
-	// TODO validate LocalBacknetConfig
+	err := newBacknet.Validate()
+	if err != nil {
+		return err
+	}
 
 	ipfsConfigPath := filepath.Join(os.Getenv("IPFS_DIR"), string(ib.communityID), "config")
-	_, err := os.Stat(ipfsConfigPath)
+	_, err = os.Stat(ipfsConfigPath)
 	isNew := os.IsNotExist(err)
 
 	ipfsDir := filepath.Join(os.Getenv("IPFS_DIR"), string(ib.communityID))
@@ -166,7 +174,11 @@ func (ib *IPFSBacknet) StartProcess() (*Process, error) {
 		fmt.Sprintf("IPFS_PATH=%s", ib.ipfsDir),
 	}
 
-	errChan := make(chan error)
+	// A restarted process keeps its error channel, which the process manager is already listening to
+	if ib.process.errChan == nil {
+		ib.process.errChan = make(chan error)
+	}
+	errChan := ib.process.errChan
 
 	ctx, cancel := context.WithCancel(context.Background())
 	cmd := exec.CommandContext(ctx, "ipfs", "daemon")
@@ -175,7 +187,6 @@ func (ib *IPFSBacknet) StartProcess() (*Process, error) {
 	// initialize process variables
 	ib.process.context = ctx
 	ib.process.cancel = cancel
-	ib.process.errChan = errChan
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -211,6 +222,10 @@ func (ib *IPFSBacknet) StartProcess() (*Process, error) {
 }
 
 func buildConfig(builder *IPFSConfigBuilder, backnet *entities.Backnet) (*IPFSConfig, error) {
+	err := backnet.Local.Validate()
+	if err != nil {
+		return nil, err
+	}
 	swarmPort, ok := backnet.Local.PortMap["swarm"]
 	if !ok {
 		return nil, errors.New("no swarm port included in port map")
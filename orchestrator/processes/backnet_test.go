@@ -29,4 +29,8 @@ func TestBacknetInterface(t *testing.T) {
 	ipfsBacknet := interface{}(&IPFSBacknet{})
 	_, ok := ipfsBacknet.(Backnet)
 	assert.Equal(t, true, ok)
+
+	localBacknet := interface{}(&LocalBacknet{})
+	_, ok = localBacknet.(Backnet)
+	assert.Equal(t, true, ok)
 }
@@ -94,8 +94,8 @@ func (cb *IPFSConfigBuilder) SetIdentity(identity config.Identity) {
 // 4001: Swarm
 // 5001: API
 // 8080: Gateway
+// The ports should have been checked with entities.LocalBacknetConfig.Validate
 func (cb *IPFSConfigBuilder) SetAddresses(swarm, api, gateway int) {
-	// TODO Validate port numbers
 	addresses := config.Addresses{
 		Swarm: []string{
 			fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", swarm),
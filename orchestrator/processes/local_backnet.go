@@ -0,0 +1,69 @@
+package processes
+
+import (
+	"errors"
+	"os"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/fs"
+	"golang.org/x/net/context"
+)
+
+// LocalBacknet keeps a community's files in a directory on this node. There is no daemon to run, so its
+// process only exists to be cancelled like any other backnet's.
+type LocalBacknet struct {
+	communityID entities.CommunityID
+	backnet     *entities.Backnet
+	process     *Process
+
+	dir string
+}
+
+func InitLocalBacknet(community *entities.Community, process *Process) (*LocalBacknet, error) {
+	process.CommunityID = community.ID
+
+	return &LocalBacknet{
+		communityID: community.ID,
+		backnet:     community.Backnet,
+		process:     process,
+		dir:         fs.LocalBacknetDir(community.ID),
+	}, nil
+}
+
+func (lb *LocalBacknet) ProcessID() ProcessID {
+	return lb.process.ID
+}
+
+func (lb *LocalBacknet) Type() entities.BacknetType {
+	return entities.Local
+}
+
+func (lb *LocalBacknet) Configure(newBacknet *entities.Backnet) error {
+	if newBacknet.Type != entities.Local {
+		return errors.New("backnet should be of type local")
+	}
+
+	err := os.MkdirAll(lb.dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	lb.backnet = newBacknet
+	return nil
+}
+
+func (lb *LocalBacknet) StartProcess() (*Process, error) {
+	if lb.backnet.Type != entities.Local {
+		return nil, errors.New("backnet should be of type local")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lb.process.context = ctx
+	lb.process.cancel = cancel
+	// A restarted process keeps its error channel, which the process manager is already listening to
+	if lb.process.errChan == nil {
+		lb.process.errChan = make(chan error)
+	}
+
+	return lb.process, nil
+}
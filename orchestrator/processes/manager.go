@@ -3,6 +3,8 @@ package processes
 import (
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 
@@ -15,16 +17,25 @@ import (
 )
 
 type ProcessManager struct {
-	processes map[ProcessID]*Process
-	backnets  map[entities.CommunityID]Backnet
-	fs        ProcessID
-	auth      ProcessID
-	errChan   chan processError
+	// processMutex guards processes and backnets. Host and community transitions are received concurrently, and
+	// backnets are started in the background on Start.
+	processMutex sync.Mutex
+	processes    map[ProcessID]*Process
+	backnets     map[entities.CommunityID]Backnet
+
+	fs      ProcessID
+	auth    ProcessID
+	errChan chan processError
 
 	portMutex  sync.Mutex
 	portAllocs map[int]ProcessID
 	startPort  int
 	portCount  int
+
+	appMutex sync.Mutex
+	apps     map[entities.CommunityID]map[entities.AppID]*AppStatus
+
+	filesystem *fs.FilesystemService
 }
 
 type processError struct {
@@ -42,22 +53,57 @@ func InitManager() *ProcessManager {
 		portAllocs: make(map[int]ProcessID),
 		startPort:  4000,
 		portCount:  0,
+		apps:       make(map[entities.CommunityID]map[entities.AppID]*AppStatus),
 	}
 }
 
 func (pm *ProcessManager) Start(state *entities.State) error {
 	go pm.errorListener()
 
+	nets, apiports := pm.restore(state)
+
+	// add ports here?
+	cli := client.InitClient()
+
+	// is go the right way to kick off these processes?
+	go cli.RunClient()
+	filesystem, err := fs.InitFilesystem(cli.GetAuthService(), state, apiports, nets)
+	if err != nil {
+		return err
+	}
+	pm.filesystem = filesystem
+	go filesystem.Serve()
+	go app.RunCLI("127.0.0.1:6000", "")
+
+	return nil
+}
+
+// restore starts the backnet and the apps of every community in a restored state. Backnets are started in the
+// background. The backnet config and API port of every community are returned for the filesystem.
+func (pm *ProcessManager) restore(state *entities.State) (map[entities.CommunityID]entities.Backnet, map[entities.CommunityID]string) {
 	nets := make(map[entities.CommunityID]entities.Backnet)
 	apiports := make(map[entities.CommunityID]string)
 
+	// Communities that fail validation are not started, but don't stop the rest of the node from starting
+	err := state.Validate()
+	if err != nil {
+		log.Err(err).Msg("invalid state")
+	}
+
 	for _, community := range state.Communities {
+		err := community.Validate()
+		if err != nil {
+			log.Err(err).Msgf("not starting invalid community %s", community.ID)
+			continue
+		}
 		nets[community.ID] = *community.Backnet
+		pm.restoreApps(community)
 
 		go func(community *entities.Community) {
 			backnet, err := pm.startBacknet(community)
 			if err != nil {
 				log.Err(fmt.Errorf("error starting %s process for community %s: %s", community.Backnet.Type, community.ID, err.Error())).Msg("")
+				return
 			}
 			// TODO clean this up later (fs needs to implement TransitionSubscriber)
 			if community.Backnet.Type == entities.IPFS {
@@ -66,18 +112,13 @@ func (pm *ProcessManager) Start(state *entities.State) error {
 		}(community)
 	}
 
-	// add ports here?
-	cli := client.InitClient()
-
-	// is go the right way to kick off these processes?
-	go cli.RunClient()
-	go fs.RunFilesystem(cli.GetAuthService(), state, apiports, nets)
-	go app.RunCLI("127.0.0.1:6000", "")
-
-	return nil
+	return nets, apiports
 }
 
 func (pm *ProcessManager) Stop() {
+	pm.processMutex.Lock()
+	defer pm.processMutex.Unlock()
+
 	for _, process := range pm.processes {
 		process.cancel()
 	}
@@ -102,42 +143,160 @@ func (pm *ProcessManager) processErrorListener(process *Process) {
 }
 
 func (pm *ProcessManager) startBacknet(community *entities.Community) (Backnet, error) {
+	backnet, process, err := pm.launchBacknet(community)
+	if err != nil {
+		return nil, err
+	}
+	pm.processMutex.Lock()
+	pm.processes[process.ID] = process
+	pm.backnets[community.ID] = backnet
+	pm.processMutex.Unlock()
+
+	go pm.processErrorListener(process)
+	log.Info().Msgf("process %s started", process.ID)
+
+	return backnet, nil
+}
+
+// launchBacknet configures and starts a community's backnet, without registering it with the manager
+func (pm *ProcessManager) launchBacknet(community *entities.Community) (Backnet, *Process, error) {
 	var backnet Backnet
 
+	// Community IDs are used as directory names, so they have to be valid before anything is written
+	err := community.ID.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+	if community.Backnet == nil {
+		return nil, nil, fmt.Errorf("community %s has no backnet", community.ID)
+	}
+	err = community.Backnet.Validate()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid backnet for community %s: %s", community.ID, err.Error())
+	}
+
 	process := InitProcess(ProcessTypeBacknet)
 
 	switch community.Backnet.Type {
 	case entities.IPFS:
 		myBacknet, err := InitIPFSBacknet(community, process)
 		if err != nil {
-			log.Err(err).Msg("error initializing backnet")
+			return nil, nil, fmt.Errorf("error initializing backnet: %s", err.Error())
+		}
+		backnet = myBacknet
+	case entities.Local:
+		myBacknet, err := InitLocalBacknet(community, process)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error initializing backnet: %s", err.Error())
 		}
 		backnet = myBacknet
 	case entities.DAT:
 		fallthrough
 	default:
-		log.Err(fmt.Errorf("backnet type %s is not supported", community.Backnet.Type)).Msg("")
+		return nil, nil, fmt.Errorf("backnet type %s is not supported", community.Backnet.Type)
 	}
 
-	err := backnet.Configure(community.Backnet)
+	err = backnet.Configure(community.Backnet)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	process, err = backnet.StartProcess()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return backnet, process, nil
+}
+
+// migrateBacknet stands up a community's new backnet next to the old one, copies and verifies the community's
+// files, and then switches over to the new backnet and stops the old one. The community's files are read-only
+// while they are being copied.
+func (pm *ProcessManager) migrateBacknet(transition *transitions.MigrateBacknetTransition) error {
+	communityID := transition.CommID
+	pm.processMutex.Lock()
+	oldBacknet, ok := pm.backnets[communityID]
+	pm.processMutex.Unlock()
+	if !ok {
+		return fmt.Errorf("community %s has no running backnet to migrate from", communityID)
+	}
+	// A failed migration leaves the community on its old backnet, so there is nothing to do when the
+	// migration is compensated
+	if oldBacknet.Type() == transition.NewBacknet.Type {
+		log.Info().Msgf("community %s is already running a %s backnet", communityID, transition.NewBacknet.Type)
+		return nil
+	}
+
+	// The transition has already been committed, so failures are side effect errors that get it compensated
+	newBacknet, newProcess, err := pm.launchBacknet(&entities.Community{
+		ID:      communityID,
+		Backnet: transition.NewBacknet,
+	})
+	if err != nil {
+		return transitions.NewSideEffectError(transition.Type(), fmt.Errorf("failed to start %s backnet for community %s: %s", transition.NewBacknet.Type, communityID, err.Error()))
+	}
+
+	var migrated fs.Backnet
+	if pm.filesystem != nil {
+		pm.filesystem.BeginMigration(communityID)
+		defer func() {
+			pm.filesystem.FinishMigration(communityID, migrated)
+		}()
+	}
+
+	files, err := pm.migrateFiles(communityID, transition.OldBacknet, transition.NewBacknet)
+	if err != nil {
+		newProcess.cancel()
+		return transitions.NewSideEffectError(transition.Type(), fmt.Errorf("failed to migrate files for community %s: %s", communityID, err.Error()))
+	}
+
+	// Switch over to the new backnet, and decommission the old one. The files were copied without holding
+	// processMutex, so the community may have been removed in the meantime.
+	pm.processMutex.Lock()
+	defer pm.processMutex.Unlock()
+	if pm.backnets[communityID] != oldBacknet {
+		newProcess.cancel()
+		return fmt.Errorf("community %s was removed while its backnet was being migrated", communityID)
+	}
+	migrated = files
+	pm.processes[newProcess.ID] = newProcess
+	pm.backnets[communityID] = newBacknet
+	go pm.processErrorListener(newProcess)
+
+	if oldProcess, ok := pm.processes[oldBacknet.ProcessID()]; ok {
+		if oldProcess.cancel != nil {
+			oldProcess.cancel()
+		}
+		delete(pm.processes, oldProcess.ID)
+	}
+
+	log.Info().Msgf("migrated community %s from %s to %s backnet", communityID, transition.OldBacknet.Type, transition.NewBacknet.Type)
+	return nil
+}
+
+// migrateFiles copies a community's files between backnets through the filesystem, and returns the filesystem's
+// view of the new backnet
+func (pm *ProcessManager) migrateFiles(communityID entities.CommunityID, from, to *entities.Backnet) (fs.Backnet, error) {
+	oldFiles, err := fs.BacknetFor(communityID, *from)
+	if err != nil {
+		return nil, err
+	}
+	newFiles, err := fs.BacknetFor(communityID, *to)
 	if err != nil {
 		return nil, err
 	}
-	pm.processes[process.ID] = process
-	pm.backnets[community.ID] = backnet
 
-	go pm.processErrorListener(process)
-	log.Info().Msgf("process %s started", process.ID)
+	copied, err := fs.MigrateFiles(oldFiles, newFiles)
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Msgf("copied and verified %d files for community %s", len(copied), communityID)
 
-	return backnet, nil
+	return newFiles, nil
 }
 
-// Receive implements TransitionSubscriber
+// Receive implements TransitionSubscriber. Transitions are accepted in value and pointer form.
 func (pm *ProcessManager) Receive(transition transitions.Transition) error {
+	transition = transitions.Normalize(transition)
 	switch transition.Type() {
 	case transitions.AddCommunityTransitionType:
 		log.Info().Msgf("received ADD_COMMUNITY transition")
@@ -149,7 +308,7 @@ func (pm *ProcessManager) Receive(transition transitions.Transition) error {
 		// start communities backnet
 		_, err := pm.startBacknet(addCommunityTransition.Community)
 		if err != nil {
-			return err
+			return transitions.NewSideEffectError(transition.Type(), err)
 		}
 	case transitions.UpdateBacknetTransitionType:
 		log.Info().Msgf("received UPDATE_BACKNET transition")
@@ -160,24 +319,125 @@ func (pm *ProcessManager) Receive(transition transitions.Transition) error {
 
 		// stop current backnet process if it is running
 		communityID := updateBacknetTransition.CommunityID()
-		backnet := pm.backnets[communityID]
-		pm.processes[backnet.ProcessID()].cancel()
+		pm.processMutex.Lock()
+		defer pm.processMutex.Unlock()
+		backnet, ok := pm.backnets[communityID]
+		if !ok {
+			return fmt.Errorf("community %s has no running backnet to update", communityID)
+		}
+		if process, ok := pm.processes[backnet.ProcessID()]; ok && process.cancel != nil {
+			process.cancel()
+		}
 
-		// reconfigure backnet
+		// reconfigure backnet. If that fails, the transition is compensated, which restarts the backnet with
+		// its old configuration.
 		err := backnet.Configure(updateBacknetTransition.NewBacknet)
 		if err != nil {
-			// TODO restart with old configuration? or rollback?
-			return fmt.Errorf("failed to reconfigure process: %s", err.Error())
+			return transitions.NewSideEffectError(transition.Type(), fmt.Errorf("failed to reconfigure process: %s", err.Error()))
 		}
 
 		// restart backnet
 		_, err = backnet.StartProcess()
 		if err != nil {
-			return err
+			return transitions.NewSideEffectError(transition.Type(), err)
+		}
+
+	case transitions.InstallAppTransitionType:
+		installAppTransition, ok := transition.(*transitions.InstallAppTransition)
+		if !ok {
+			return errors.New("transition is not type InstallAppTransition")
 		}
+		return pm.receiveAppTransition(installAppTransition, installAppTransition.AppID)
+	case transitions.UninstallAppTransitionType:
+		uninstallAppTransition, ok := transition.(*transitions.UninstallAppTransition)
+		if !ok {
+			return errors.New("transition is not type UninstallAppTransition")
+		}
+		return pm.receiveAppTransition(uninstallAppTransition, uninstallAppTransition.AppID)
+	case transitions.StartAppTransitionType:
+		startAppTransition, ok := transition.(*transitions.StartAppTransition)
+		if !ok {
+			return errors.New("transition is not type StartAppTransition")
+		}
+		return pm.receiveAppTransition(startAppTransition, startAppTransition.AppID)
+	case transitions.StopAppTransitionType:
+		stopAppTransition, ok := transition.(*transitions.StopAppTransition)
+		if !ok {
+			return errors.New("transition is not type StopAppTransition")
+		}
+		return pm.receiveAppTransition(stopAppTransition, stopAppTransition.AppID)
+
+	case transitions.MigrateBacknetTransitionType:
+		log.Info().Msgf("received MIGRATE_BACKNET transition")
+		migrateBacknetTransition, ok := transition.(*transitions.MigrateBacknetTransition)
+		if !ok {
+			return errors.New("transition is not type MigrateBacknetTransition")
+		}
+		return pm.migrateBacknet(migrateBacknetTransition)
+	case transitions.RenameCommunityTransitionType:
+		log.Info().Msgf("received RENAME_COMMUNITY transition")
+	case transitions.ArchiveCommunityTransitionType:
+		log.Info().Msgf("received ARCHIVE_COMMUNITY transition")
+		if pm.filesystem != nil {
+			return pm.filesystem.Receive(transition)
+		}
+	case transitions.DeleteCommunityTransitionType:
+		log.Info().Msgf("received DELETE_COMMUNITY transition")
+		deleteCommunityTransition, ok := transition.(*transitions.DeleteCommunityTransition)
+		if !ok {
+			return errors.New("transition is not type DeleteCommunityTransition")
+		}
+
+		if pm.filesystem != nil {
+			err := pm.filesystem.Receive(transition)
+			if err != nil {
+				return err
+			}
+		}
+		return pm.removeCommunity(deleteCommunityTransition.CommID, deleteCommunityTransition.Purge)
 
 	default:
 		return fmt.Errorf("transition type %s not supported", transition.Type())
 	}
 	return nil
 }
+
+// removeCommunity stops a community's backnet process. If purge is set, the backnet's data under IPFS_DIR is deleted too.
+func (pm *ProcessManager) removeCommunity(communityID entities.CommunityID, purge bool) error {
+	pm.processMutex.Lock()
+	if backnet, ok := pm.backnets[communityID]; ok {
+		if process, ok := pm.processes[backnet.ProcessID()]; ok {
+			if process.cancel != nil {
+				process.cancel()
+			}
+			delete(pm.processes, process.ID)
+		}
+		delete(pm.backnets, communityID)
+	}
+	pm.processMutex.Unlock()
+
+	pm.appMutex.Lock()
+	delete(pm.apps, communityID)
+	pm.appMutex.Unlock()
+
+	if !purge {
+		return nil
+	}
+
+	// Make sure that nothing outside of the community's own dir can be deleted
+	ipfsBaseDir := os.Getenv("IPFS_DIR")
+	if ipfsBaseDir == "" {
+		return errors.New("IPFS_DIR is not set, can't purge backnet")
+	}
+	ipfsDir := filepath.Join(ipfsBaseDir, string(communityID))
+	if communityID.Validate() != nil || filepath.Dir(ipfsDir) != filepath.Clean(ipfsBaseDir) {
+		return fmt.Errorf("community id %s is not a valid backnet dir name", communityID)
+	}
+
+	err := os.RemoveAll(ipfsDir)
+	if err != nil {
+		return fmt.Errorf("failed to purge backnet for community %s: %s", communityID, err.Error())
+	}
+	log.Info().Msgf("purged backnet data for community %s", communityID)
+	return nil
+}
@@ -0,0 +1,143 @@
+package processes
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"gotest.tools/assert"
+)
+
+func TestReceiveDeleteCommunity(t *testing.T) {
+	ipfsDir := t.TempDir()
+	os.Setenv("IPFS_DIR", ipfsDir)
+	defer os.Unsetenv("IPFS_DIR")
+
+	for _, id := range []string{"community_0", "community_1"} {
+		err := os.MkdirAll(filepath.Join(ipfsDir, id), 0700)
+		assert.NilError(t, err)
+		err = ioutil.WriteFile(filepath.Join(ipfsDir, id, "config"), []byte("{}"), 0600)
+		assert.NilError(t, err)
+	}
+
+	pm := InitManager()
+	err := pm.Receive(&transitions.InstallAppTransition{CommID: "community_0", AppID: "chat"})
+	assert.NilError(t, err)
+
+	// Without purging, the backnet's data is kept
+	err = pm.Receive(&transitions.DeleteCommunityTransition{CommID: "community_1"})
+	assert.NilError(t, err)
+	_, err = os.Stat(filepath.Join(ipfsDir, "community_1"))
+	assert.NilError(t, err)
+
+	err = pm.Receive(&transitions.DeleteCommunityTransition{CommID: "community_0", Purge: true})
+	assert.NilError(t, err)
+	_, err = os.Stat(filepath.Join(ipfsDir, "community_0"))
+	assert.Assert(t, os.IsNotExist(err))
+	assert.Equal(t, 0, len(pm.Apps("community_0")))
+
+	// Purging can't escape IPFS_DIR
+	err = pm.Receive(&transitions.DeleteCommunityTransition{CommID: "..", Purge: true})
+	assert.Assert(t, err != nil)
+	_, err = os.Stat(ipfsDir)
+	assert.NilError(t, err)
+}
+
+func TestMigrateBacknetFailure(t *testing.T) {
+	os.Setenv("LOCAL_BACKNET_DIR", t.TempDir())
+	defer os.Unsetenv("LOCAL_BACKNET_DIR")
+
+	pm := InitManager()
+	community := entities.InitCommunity("community_0", "My Community", entities.Local)
+	oldBacknet, err := pm.startBacknet(community)
+	assert.NilError(t, err)
+
+	// DAT backnets aren't implemented, so the community keeps its local backnet
+	err = pm.Receive(&transitions.MigrateBacknetTransition{
+		CommID:     community.ID,
+		OldBacknet: community.Backnet,
+		NewBacknet: entities.InitBacknet(entities.DAT),
+	})
+	assert.ErrorContains(t, err, "not supported")
+	var sideEffectErr *transitions.SideEffectError
+	assert.Assert(t, errors.As(err, &sideEffectErr))
+	assert.Equal(t, oldBacknet, pm.backnets[community.ID])
+	_, ok := pm.processes[oldBacknet.ProcessID()]
+	assert.Assert(t, ok)
+
+	// The compensating migration back to the local backnet leaves it running
+	err = pm.Receive(&transitions.MigrateBacknetTransition{
+		CommID:     community.ID,
+		OldBacknet: entities.InitBacknet(entities.DAT),
+		NewBacknet: community.Backnet,
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, oldBacknet, pm.backnets[community.ID])
+	assert.Equal(t, 1, len(pm.processes))
+}
+
+func TestStartInvalidBacknet(t *testing.T) {
+	os.Setenv("LOCAL_BACKNET_DIR", t.TempDir())
+	defer os.Unsetenv("LOCAL_BACKNET_DIR")
+
+	pm := InitManager()
+	community := entities.InitCommunity("community_0", "My Community", entities.Local)
+	community.Backnet.Local.PortMap = map[string]int{"api": 70000}
+
+	_, err := pm.startBacknet(community)
+	assert.ErrorContains(t, err, "port_map[api]")
+	assert.Equal(t, 0, len(pm.processes))
+}
+
+// TestReceiveConcurrently is run with -race. Host and community transitions are delivered by separate
+// subscriptions, so they reach the manager at the same time.
+func TestReceiveConcurrently(t *testing.T) {
+	os.Setenv("LOCAL_BACKNET_DIR", t.TempDir())
+	defer os.Unsetenv("LOCAL_BACKNET_DIR")
+
+	pm := InitManager()
+	existing := make([]*entities.Community, 5)
+	for i := range existing {
+		existing[i] = entities.InitCommunity(entities.CommunityID(fmt.Sprintf("community_%d", i)), "My Community", entities.Local)
+		_, err := pm.startBacknet(existing[i])
+		assert.NilError(t, err)
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := len(existing); i < 2*len(existing); i++ {
+			community := entities.InitCommunity(entities.CommunityID(fmt.Sprintf("community_%d", i)), "My Community", entities.Local)
+			err := pm.Receive(&transitions.AddCommunityTransition{Community: community})
+			assert.NilError(t, err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for _, community := range existing {
+			err := pm.Receive(&transitions.UpdateBacknetTransition{
+				CommID:     community.ID,
+				OldBacknet: community.Backnet,
+				NewBacknet: entities.InitBacknet(entities.Local),
+			})
+			assert.NilError(t, err)
+			err = pm.Receive(&transitions.DeleteCommunityTransition{CommID: community.ID})
+			assert.NilError(t, err)
+		}
+	}()
+	wg.Wait()
+
+	assert.Equal(t, len(existing), len(pm.backnets))
+	assert.Equal(t, len(existing), len(pm.processes))
+	for _, community := range existing {
+		_, ok := pm.backnets[community.ID]
+		assert.Assert(t, !ok)
+	}
+}
@@ -0,0 +1,161 @@
+package state
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/stretchr/testify/assert"
+)
+
+var writeCorpus = flag.Bool("write-corpus", false, "write the corpus for the current transition schema version to testdata")
+
+// Every directory in testdata holds a WAL and snapshot written by an older version of the state machine. All of
+// them encode the same four transitions, and have to keep replaying to the same state as the schema evolves.
+
+func copyCorpusFile(t *testing.T, corpusDir, stateDir, name string) {
+	buf, err := ioutil.ReadFile(filepath.Join(corpusDir, name))
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(stateDir, name), buf, 0644)
+	assert.Nil(t, err)
+}
+
+func TestReplayCorpus(t *testing.T) {
+	corpora, err := filepath.Glob("testdata/v*")
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, len(corpora))
+
+	for _, corpusDir := range corpora {
+		for _, withSnapshot := range []bool{false, true} {
+			stateBaseDir := t.TempDir()
+			sm, err := InitCommunityStateMachine("community_0", stateBaseDir, 10)
+			assert.Nil(t, err)
+
+			copyCorpusFile(t, corpusDir, sm.Path, "wal")
+			if withSnapshot {
+				copyCorpusFile(t, corpusDir, sm.Path, "snapshot")
+			}
+
+			err = sm.Restart()
+			if !assert.Nil(t, err, "corpus %s, snapshot: %t", corpusDir, withSnapshot) {
+				continue
+			}
+
+			assert.Equal(t, uint64(4), sm.CurSequenceNumber)
+			assert.Equal(t, entities.CommunityID("community_0"), sm.State.ID)
+			assert.Equal(t, 2, len(sm.State.Members))
+			assert.NotNil(t, sm.State.Members["alice"])
+			assert.NotNil(t, sm.State.Members["bob"])
+			assert.Equal(t, []string{"/ip4/10.0.0.1/tcp/4001"}, sm.State.Backnet.Bootstrap)
+			assert.Equal(t, 4005, sm.State.Backnet.Local.PortMap["api"])
+			assert.Equal(t, 1, len(sm.State.Peers))
+			// Members from before roles were introduced are admins
+			assert.Equal(t, entities.Admin, sm.State.RoleOf("alice"))
+			// Members from before snapshot version 4 didn't list their community
+			assert.Equal(t, []entities.CommunityID{"community_0"}, sm.State.Members["alice"].Communities)
+			assert.Equal(t, 0, len(sm.State.CheckMembership()))
+		}
+	}
+}
+
+// testUser generates a user with a deterministic Ed25519 key
+func testUser(id entities.UserID, i int) (*entities.User, ed25519.PrivateKey) {
+	seed := make([]byte, ed25519.SeedSize)
+	seed[0] = byte(i)
+	seed[1] = 1
+	key := ed25519.NewKeyFromSeed(seed)
+	user := entities.InitUser(id, string(id))
+	user.PublicKey = transitions.EncodePublicKey(key.Public().(ed25519.PublicKey))
+	return user, key
+}
+
+// TestWriteCorpus adds the corpus for a new schema version, run it with
+// go test ./state -run TestWriteCorpus -write-corpus
+func TestWriteCorpus(t *testing.T) {
+	if !*writeCorpus {
+		t.Skip("corpus is only written with -write-corpus")
+	}
+
+	corpusDir := filepath.Join("testdata", fmt.Sprintf("v%d", transitions.CurrentTransitionVersion))
+	_, err := os.Stat(corpusDir)
+	if !os.IsNotExist(err) {
+		t.Fatalf("%s already exists, corpora must never be modified", corpusDir)
+	}
+
+	stateDir := t.TempDir()
+	sm, err := InitCommunityStateMachine("community_0", stateDir, 2)
+	assert.Nil(t, err)
+	sm.ArchiveDir = filepath.Join(stateDir, "archive")
+
+	community, peer, peerKey := testCommunity()
+	community.Backnet.Local.PortMap = map[string]int{"swarm": 4001, "api": 4002, "gateway": 4003}
+	alice, aliceKey := testUser("alice", 1)
+	bob, _ := testUser("bob", 2)
+
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type: transitions.InitCommunityTransitionType,
+		Transition: transitions.InitCommunityTransition{
+			Community: community,
+		},
+		SequenceNumber: 1,
+	}, peer.Key, peerKey))
+	assert.Nil(t, err)
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type: transitions.ModifyCommMembersTransitionType,
+		Transition: transitions.ModifyCommMembersTransition{
+			Community: sm.State,
+			User:      alice,
+			ModType:   transitions.AddMember,
+			Role:      entities.Admin,
+		},
+		SequenceNumber: 2,
+	}, peer.Key, peerKey))
+	assert.Nil(t, err)
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type: transitions.ModifyCommMembersTransitionType,
+		Transition: transitions.ModifyCommMembersTransition{
+			Community: sm.State,
+			User:      bob,
+			ModType:   transitions.AddMember,
+		},
+		SequenceNumber: 3,
+	}, "alice", aliceKey))
+	assert.Nil(t, err)
+
+	backnet := entities.InitBacknet(entities.IPFS)
+	backnet.Bootstrap = []string{"/ip4/10.0.0.1/tcp/4001"}
+	backnet.Local.PortMap = map[string]int{"swarm": 4004, "api": 4005, "gateway": 4006}
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type: transitions.UpdateBacknetTransitionType,
+		Transition: transitions.UpdateBacknetTransition{
+			CommID:     community.ID,
+			OldBacknet: sm.State.Backnet,
+			NewBacknet: backnet,
+		},
+		SequenceNumber: 4,
+	}, "alice", aliceKey))
+	assert.Nil(t, err)
+
+	// Put the whole log back together, and keep the snapshot taken after the second transition
+	wal := make([]byte, 0)
+	for _, segment := range []string{"wal-00000000000000000001", "wal-00000000000000000003"} {
+		buf, err := ioutil.ReadFile(filepath.Join(sm.ArchiveDir, segment))
+		assert.Nil(t, err)
+		wal = append(wal, buf...)
+	}
+	snapshot, err := ioutil.ReadFile(filepath.Join(sm.Path, "snapshot-00000000000000000002"))
+	assert.Nil(t, err)
+
+	err = os.MkdirAll(corpusDir, 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(corpusDir, "wal"), wal, 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(corpusDir, "snapshot"), snapshot, 0644)
+	assert.Nil(t, err)
+}
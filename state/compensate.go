@@ -0,0 +1,152 @@
+package state
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+
+	"github.com/eagraf/habitat-node/entities/transitions"
+)
+
+// A committed transition can't be taken back out of the log, so when a subscriber fails to carry it out, the
+// transition is undone by committing its inverse as a compensating transition. Compensating transitions record
+// the sequence number they compensate, which keeps a transition from being compensated twice. Compensating
+// transitions are never compensated themselves, so that a side effect that fails both ways can't loop.
+
+// Signer signs the transitions a state machine commits on its own, such as compensating transitions. Peers sign
+// with their peer key.
+type Signer struct {
+	Author string
+	Key    ed25519.PrivateKey
+}
+
+// Compensator is a TransitionSource that can compensate transitions it has committed
+type Compensator interface {
+	Compensate(sequenceNumber uint64) (uint64, error)
+}
+
+// Compensate commits the inverse of the transition at a sequence number, and returns the sequence number the
+// compensating transition was committed at. If the transition has already been compensated, the sequence number
+// of the existing compensating transition is returned. With consensus, the compensating transition is proposed
+// to the community's peers like any other.
+func (sm *CommunityStateMachine) Compensate(sequenceNumber uint64) (uint64, error) {
+	if sm.Signer == nil {
+		return 0, fmt.Errorf("no signer configured for community %s", sm.CommunityID)
+	}
+
+	sm.commitMutex.Lock()
+	compensation, existing, err := sm.compensation(sequenceNumber)
+	if err != nil || existing != 0 {
+		sm.commitMutex.Unlock()
+		return existing, err
+	}
+
+	if sm.Consensus != nil {
+		sm.commitMutex.Unlock()
+		return sm.Propose(compensation)
+	}
+	defer sm.commitMutex.Unlock()
+
+	compensation.SequenceNumber = sm.CurSequenceNumber + 1
+	err = sm.apply(compensation)
+	if err != nil {
+		return 0, err
+	}
+	return compensation.SequenceNumber, nil
+}
+
+// compensation builds the signed compensating transition for a sequence number, or returns the sequence number
+// of the transition that already compensates it
+func (sm *CommunityStateMachine) compensation(sequenceNumber uint64) (*transitions.TransitionWrapper, uint64, error) {
+	entry, existing, err := findCompensation(sequenceNumber, sm.CurSequenceNumber, sm.TransitionsBetween)
+	if err != nil || existing != 0 {
+		return nil, existing, err
+	}
+
+	transition, ok := entry.Transition.Transition.(transitions.CommunityTransition)
+	if !ok {
+		return nil, 0, errors.New("transition in log entry was not a CommunityTransition")
+	}
+	before, err := sm.StateAt(sequenceNumber - 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	inverse, err := transition.Inverse(before)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	compensation := &transitions.TransitionWrapper{
+		Type:               inverse.Type(),
+		Transition:         inverse,
+		Compensates:        sequenceNumber,
+		BaseSequenceNumber: sm.CurSequenceNumber,
+	}
+	err = compensation.Sign(sm.Signer.Author, sm.Signer.Key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return compensation, 0, nil
+}
+
+// Compensate commits the inverse of the host transition at a sequence number, and returns the sequence number
+// the compensating transition was committed at. Host transitions aren't signed.
+func (sm *HostStateMachine) Compensate(sequenceNumber uint64) (uint64, error) {
+	sm.applyMutex.Lock()
+	defer sm.applyMutex.Unlock()
+
+	entry, existing, err := findCompensation(sequenceNumber, sm.CurSequenceNumber, sm.TransitionsBetween)
+	if err != nil || existing != 0 {
+		return existing, err
+	}
+
+	transition, ok := entry.Transition.Transition.(transitions.HostTransition)
+	if !ok {
+		return 0, fmt.Errorf("transition of type %s is not a HostTransition", entry.Transition.Type)
+	}
+	before, err := sm.StateAt(sequenceNumber - 1)
+	if err != nil {
+		return 0, err
+	}
+	inverse, err := transition.Inverse(before)
+	if err != nil {
+		return 0, err
+	}
+
+	compensation := &transitions.TransitionWrapper{
+		Type:           inverse.Type(),
+		Transition:     inverse,
+		SequenceNumber: sm.CurSequenceNumber + 1,
+		Compensates:    sequenceNumber,
+	}
+	err = sm.apply(compensation)
+	if err != nil {
+		return 0, err
+	}
+	return compensation.SequenceNumber, nil
+}
+
+// findCompensation looks up the entry to compensate, and any transition committed since that compensates it
+func findCompensation(sequenceNumber, current uint64, transitionsBetween func(from, to uint64) ([]*Entry, error)) (*Entry, uint64, error) {
+	if sequenceNumber == 0 {
+		return nil, 0, errors.New("sequence number 0 can't be compensated")
+	}
+	if sequenceNumber > current {
+		return nil, 0, fmt.Errorf("sequence number %d has not been committed yet, the latest is %d", sequenceNumber, current)
+	}
+	entries, err := transitionsBetween(sequenceNumber-1, current)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entry := entries[0]
+	if entry.Transition.Compensates != 0 {
+		return nil, 0, fmt.Errorf("transition %d compensates transition %d, and can't be compensated itself", sequenceNumber, entry.Transition.Compensates)
+	}
+	for _, later := range entries[1:] {
+		if later.Transition.Compensates == sequenceNumber {
+			return nil, later.SequenceNumber, nil
+		}
+	}
+	return entry, 0, nil
+}
@@ -0,0 +1,291 @@
+package state
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompensate(t *testing.T) {
+	stateDir := t.TempDir()
+	community, peer, key := testCommunity()
+	sm, err := InitCommunityStateMachine(community.ID, stateDir, 2)
+	assert.Nil(t, err)
+
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.InitCommunityTransitionType,
+		Transition:     transitions.InitCommunityTransition{Community: community},
+		SequenceNumber: 1,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.RenameCommunityTransitionType,
+		Transition:     transitions.RenameCommunityTransition{CommID: community.ID, Name: "Renamed"},
+		SequenceNumber: 2,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+
+	// Compensating takes a signer
+	_, err = sm.Compensate(2)
+	assert.NotNil(t, err)
+	sm.Signer = &Signer{Author: peer.Key, Key: key}
+
+	sequenceNumber, err := sm.Compensate(2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), sequenceNumber)
+	assert.Equal(t, "My Community", sm.State.Name)
+
+	// Compensating again finds the existing compensation
+	sequenceNumber, err = sm.Compensate(2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), sequenceNumber)
+	assert.Equal(t, uint64(3), sm.CurSequenceNumber)
+
+	// Compensations aren't compensated, and there is no undoing an init
+	_, err = sm.Compensate(3)
+	assert.NotNil(t, err)
+	_, err = sm.Compensate(1)
+	assert.True(t, errors.Is(err, transitions.ErrNotInvertible))
+	_, err = sm.Compensate(4)
+	assert.NotNil(t, err)
+
+	// The compensating transition is logged like any other, with the sequence number it compensates
+	assert.Nil(t, sm.Close())
+	sm, err = InitCommunityStateMachine(community.ID, stateDir, 2)
+	assert.Nil(t, err)
+	defer sm.Close()
+	err = sm.Restart()
+	assert.Nil(t, err)
+	assert.Equal(t, "My Community", sm.State.Name)
+	entries, err := sm.TransitionsBetween(2, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), entries[0].Transition.Compensates)
+	assert.Equal(t, transitions.RenameCommunityTransitionType, entries[0].Transition.Type)
+}
+
+func TestApplyDuplicateCompensation(t *testing.T) {
+	community, peer, key := testCommunity()
+	sm, err := InitCommunityStateMachine(community.ID, t.TempDir(), 2)
+	assert.Nil(t, err)
+	defer sm.Close()
+	sm.Signer = &Signer{Author: peer.Key, Key: key}
+
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.InitCommunityTransitionType,
+		Transition:     transitions.InitCommunityTransition{Community: community},
+		SequenceNumber: 1,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.RenameCommunityTransitionType,
+		Transition:     transitions.RenameCommunityTransition{CommID: community.ID, Name: "Renamed"},
+		SequenceNumber: 2,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+
+	// Two peers can build a compensation for the same transition before either is committed
+	duplicate, existing, err := sm.compensation(2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), existing)
+	_, err = sm.Compensate(2)
+	assert.Nil(t, err)
+
+	// Only the first one committed is valid
+	duplicate.SequenceNumber = sm.CurSequenceNumber + 1
+	err = sm.Apply(duplicate)
+	validationErr, ok := err.(*transitions.ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "compensates", validationErr.Field)
+	assert.Equal(t, uint64(3), sm.CurSequenceNumber)
+}
+
+func TestApplyForgedCompensatingBan(t *testing.T) {
+	community, peer, key := testCommunity()
+	alice, aliceKey := testUser("alice", 1)
+	carol, _ := testUser("carol", 3)
+	sm, err := InitCommunityStateMachine(community.ID, t.TempDir(), 10)
+	assert.Nil(t, err)
+	defer sm.Close()
+	sm.Signer = &Signer{Author: peer.Key, Key: key}
+
+	ban := func(compensates uint64) *transitions.TransitionWrapper {
+		return &transitions.TransitionWrapper{
+			Type: transitions.ModifyCommMembersTransitionType,
+			Transition: transitions.ModifyCommMembersTransition{
+				Community: community,
+				User:      carol,
+				ModType:   transitions.BanMember,
+				BannedBy:  alice.ID,
+				Timestamp: time.Now(),
+			},
+			SequenceNumber: sm.CurSequenceNumber + 1,
+			Compensates:    compensates,
+		}
+	}
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.InitCommunityTransitionType,
+		Transition:     transitions.InitCommunityTransition{Community: community},
+		SequenceNumber: 1,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.ModifyCommMembersTransitionType,
+		Transition:     transitions.ModifyCommMembersTransition{Community: community, User: alice, ModType: transitions.AddMember, Role: entities.Admin},
+		SequenceNumber: 2,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+	err = sm.Apply(signed(t, ban(0), string(alice.ID), aliceKey))
+	assert.Nil(t, err)
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.RenameCommunityTransitionType,
+		Transition:     transitions.RenameCommunityTransition{CommID: community.ID, Name: "Renamed"},
+		SequenceNumber: 4,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.ModifyCommMembersTransitionType,
+		Transition:     transitions.ModifyCommMembersTransition{Community: community, User: carol, ModType: transitions.UnbanMember},
+		SequenceNumber: 5,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+
+	// A peer can't ban carol in alice's name by claiming to compensate something other than her unban
+	field := func(err error) string {
+		validationErr, ok := err.(*transitions.ValidationError)
+		assert.True(t, ok)
+		return validationErr.Field
+	}
+	assert.Equal(t, "banned_by", field(sm.Apply(signed(t, ban(0), peer.Key, key))))
+	assert.Equal(t, "compensates", field(sm.Apply(signed(t, ban(4), peer.Key, key))))
+	assert.Equal(t, uint64(5), sm.CurSequenceNumber)
+
+	// Compensating the unban restores alice's ban
+	sequenceNumber, err := sm.Compensate(5)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6), sequenceNumber)
+	assert.Equal(t, alice.ID, sm.State.Bans[carol.ID].BannedBy)
+}
+
+func TestHostCompensate(t *testing.T) {
+	sm, err := InitHostStateMachine(t.TempDir(), 2)
+	assert.Nil(t, err)
+	defer sm.Close()
+
+	for i, id := range []entities.CommunityID{"community_0", "community_1", "community_2"} {
+		err = sm.Apply(addCommunityTransition(id, uint64(i+1)))
+		assert.Nil(t, err)
+	}
+
+	// The host before transition 2 is rebuilt from the archived snapshot at 2 and the log
+	sequenceNumber, err := sm.Compensate(2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), sequenceNumber)
+	_, ok := sm.State.Communities["community_1"]
+	assert.False(t, ok)
+	assert.Equal(t, 2, len(sm.State.Communities))
+}
+
+// sideEffectSubscriber fails to carry out every AddCommunityTransition it receives
+type sideEffectSubscriber struct {
+	recordingSubscriber
+}
+
+func (ss *sideEffectSubscriber) Receive(transition transitions.Transition) error {
+	err := ss.recordingSubscriber.Receive(transition)
+	if err != nil {
+		return err
+	}
+	if transition.Type() == transitions.AddCommunityTransitionType {
+		return transitions.NewSideEffectError(transition.Type(), errors.New("backnet failed to start"))
+	}
+	return nil
+}
+
+func TestSubscriptionCompensation(t *testing.T) {
+	registry := NewSubscriptionRegistry()
+	sm, err := InitHostStateMachine(t.TempDir(), 10)
+	assert.Nil(t, err)
+	defer sm.Close()
+	sm.Subscriptions = registry
+	registry.AddSource(sm)
+
+	subscriber := &sideEffectSubscriber{recordingSubscriber{mutex: &sync.Mutex{}}}
+	_, err = registry.Subscribe("failing", transitions.HostCategory, subscriber, nil)
+	assert.Nil(t, err)
+
+	err = sm.Apply(addCommunityTransition("community_0", 1))
+	assert.Nil(t, err)
+
+	select {
+	case subErr := <-registry.Errors():
+		assert.Equal(t, uint64(1), subErr.SequenceNumber)
+		assert.Equal(t, uint64(2), subErr.Compensation)
+		assert.Nil(t, subErr.CompensationErr)
+		var sideEffectErr *transitions.SideEffectError
+		assert.True(t, errors.As(subErr, &sideEffectErr))
+	case <-time.After(time.Second):
+		t.Error("timed out waiting for subscription error")
+	}
+
+	// The subscriber is told to undo whatever it managed to do
+	assert.Eventually(t, func() bool {
+		return subscriber.count() == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, transitions.DeleteCommunityTransitionType, subscriber.received[1].Type())
+	assert.Equal(t, 0, len(sm.State.Communities))
+}
+
+func TestCompensateConcurrentApply(t *testing.T) {
+	community, peer, key := testCommunity()
+	sm, err := InitCommunityStateMachine(community.ID, t.TempDir(), 10)
+	assert.Nil(t, err)
+	defer sm.Close()
+	sm.Signer = &Signer{Author: peer.Key, Key: key}
+
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.InitCommunityTransitionType,
+		Transition:     transitions.InitCommunityTransition{Community: community},
+		SequenceNumber: 1,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.RenameCommunityTransitionType,
+		Transition:     transitions.RenameCommunityTransition{CommID: community.ID, Name: "Renamed"},
+		SequenceNumber: 2,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+
+	// Whichever of the two gets to sequence number 3 first, the other one either follows it or is rejected,
+	// and the log and the state machine agree
+	newBacknet := entities.InitBacknet(entities.IPFS)
+	newBacknet.Bootstrap = []string{"/ip4/10.0.0.1/tcp/4001"}
+	update := signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.UpdateBacknetTransitionType,
+		Transition:     transitions.UpdateBacknetTransition{CommID: community.ID, OldBacknet: community.Backnet, NewBacknet: newBacknet},
+		SequenceNumber: 3,
+	}, peer.Key, key)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := sm.Compensate(2)
+		assert.Nil(t, err)
+	}()
+	applyErr := sm.Apply(update)
+	wg.Wait()
+
+	entries, err := sm.WriteAheadLog.GetEntries()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(len(entries)), sm.CurSequenceNumber)
+	assert.Equal(t, "My Community", sm.State.Name)
+	if applyErr == nil {
+		assert.Equal(t, uint64(4), sm.CurSequenceNumber)
+	} else {
+		assert.Equal(t, uint64(3), sm.CurSequenceNumber)
+	}
+}
@@ -0,0 +1,166 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/eagraf/habitat-node/state/paxos"
+)
+
+// Consensus agrees on the value for each sequence number with the community's peers.
+// paxos.Node is the default implementation.
+type Consensus interface {
+	Propose(sequenceNumber uint64, value []byte) ([]byte, error)
+	// Reconfigure changes the participants from a sequence number onwards, and is called by the state machine
+	// whenever a committed transition changes the community's peers
+	Reconfigure(fromSequenceNumber uint64, peers []paxos.NodeID)
+	// CatchUp learns the values chosen from a sequence number onwards that the state machine missed, and
+	// delivers them to Commit. It is called on restart.
+	CatchUp(fromSequenceNumber uint64) error
+	// Learn returns the value chosen for a sequence number, asking the peers if it hasn't been learned. It is
+	// used to check a peer's state before installing it.
+	Learn(sequenceNumber uint64) ([]byte, error)
+	// Forget is called once a sequence number has been applied, so that the values chosen up to it can be dropped
+	Forget(sequenceNumber uint64)
+}
+
+// PeerNodeIDs returns the consensus participants for a community, identified by their peer keys
+func PeerNodeIDs(community *entities.Community) []paxos.NodeID {
+	if community == nil {
+		return []paxos.NodeID{}
+	}
+	res := make([]paxos.NodeID, len(community.Peers))
+	for i, peer := range community.Peers {
+		res[i] = paxos.NodeID(peer.Key)
+	}
+	return res
+}
+
+// peersChanged checks whether a transition changed who takes part in consensus
+func peersChanged(oldCommunity, newCommunity *entities.Community) bool {
+	oldPeers, newPeers := PeerNodeIDs(oldCommunity), PeerNodeIDs(newCommunity)
+	if len(oldPeers) != len(newPeers) {
+		return true
+	}
+	for i := range oldPeers {
+		if oldPeers[i] != newPeers[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// Propose gets the peers to agree on a transition and applies it. If another peer's transition wins the next
+// sequence number, that transition is applied instead and the proposal is revalidated and retried at the following one.
+// The sequence number the transition was committed at is returned.
+func (sm *CommunityStateMachine) Propose(transition *transitions.TransitionWrapper) (uint64, error) {
+	if sm.Consensus == nil {
+		return 0, fmt.Errorf("no consensus module configured for community %s", sm.CommunityID)
+	}
+
+	for {
+		// Validating against the latest state before every attempt guarantees that only transitions that are
+		// valid at their sequence number get chosen
+		sm.commitMutex.Lock()
+		sequenceNumber := sm.CurSequenceNumber + 1
+		err := sm.Validate(transition)
+		sm.commitMutex.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
+		transition.SequenceNumber = sequenceNumber
+		value, err := json.Marshal(transition)
+		if err != nil {
+			return 0, err
+		}
+
+		chosen, err := sm.Consensus.Propose(sequenceNumber, value)
+		if err != nil {
+			return 0, err
+		}
+
+		// The chosen value is normally delivered by the learner already, in which case this is a no-op
+		err = sm.Commit(sequenceNumber, chosen)
+		if err != nil {
+			return 0, err
+		}
+
+		if bytes.Equal(chosen, value) {
+			return sequenceNumber, nil
+		}
+	}
+}
+
+// Commit receives values chosen by the consensus module. Values can arrive out of order, so they are buffered
+// until every preceding sequence number has been applied. They are buffered before taking commitMutex, so values
+// chosen while a batch is being applied are all applied together, with a single write to the log, by whichever
+// call takes it next.
+func (sm *CommunityStateMachine) Commit(sequenceNumber uint64, value []byte) error {
+	sm.pendingMutex.Lock()
+	sm.pending[sequenceNumber] = value
+	sm.pendingMutex.Unlock()
+
+	sm.commitMutex.Lock()
+	defer sm.commitMutex.Unlock()
+
+	if sequenceNumber <= sm.CurSequenceNumber {
+		sm.pendingMutex.Lock()
+		delete(sm.pending, sequenceNumber)
+		sm.pendingMutex.Unlock()
+		return nil
+	}
+	return sm.applyPending()
+}
+
+// applyPending applies buffered values for as long as the next sequence number has been chosen
+func (sm *CommunityStateMachine) applyPending() error {
+	for {
+		batch, err := sm.nextPending()
+		if err != nil || len(batch) == 0 {
+			return err
+		}
+
+		// A chosen value that fails to apply stays pending, so that applying it can be retried
+		applied, err := sm.applyBatch(batch)
+		sm.pendingMutex.Lock()
+		for _, transition := range batch[:applied] {
+			delete(sm.pending, transition.SequenceNumber)
+		}
+		sm.pendingMutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// nextPending decodes the buffered values from the next sequence number up to the first one that hasn't been
+// chosen yet
+func (sm *CommunityStateMachine) nextPending() ([]*transitions.TransitionWrapper, error) {
+	sm.pendingMutex.Lock()
+	defer sm.pendingMutex.Unlock()
+
+	batch := make([]*transitions.TransitionWrapper, 0)
+	for sequenceNumber := sm.CurSequenceNumber + 1; ; sequenceNumber++ {
+		next, ok := sm.pending[sequenceNumber]
+		if !ok {
+			return batch, nil
+		}
+
+		var transition transitions.TransitionWrapper
+		err := json.Unmarshal(next, &transition)
+		if err == nil && transition.SequenceNumber != sequenceNumber {
+			err = fmt.Errorf("chosen transition has sequence number %d, expected %d", transition.SequenceNumber, sequenceNumber)
+		}
+		// The values before a bad one are still applied, and the bad one is reported once they are
+		if err != nil && len(batch) > 0 {
+			return batch, nil
+		} else if err != nil {
+			return nil, err
+		}
+		batch = append(batch, &transition)
+	}
+}
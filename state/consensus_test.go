@@ -0,0 +1,370 @@
+package state
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/eagraf/habitat-node/state/paxos"
+	"github.com/stretchr/testify/assert"
+)
+
+func initReplicas(t *testing.T, community *entities.Community) ([]*CommunityStateMachine, *paxos.LocalTransport) {
+	transport := paxos.NewLocalTransport()
+	peers := PeerNodeIDs(community)
+
+	replicas := make([]*CommunityStateMachine, len(peers))
+	for i, peer := range peers {
+		sm, err := InitCommunityStateMachine(community.ID, t.TempDir(), 100)
+		assert.Nil(t, err)
+
+		node := paxos.NewNode(peer, peers, transport, sm.Commit)
+		transport.Register(node)
+		sm.Consensus = node
+
+		replicas[i] = sm
+	}
+	return replicas, transport
+}
+
+func TestReplicatedCommunityStateMachine(t *testing.T) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	keys := make([]ed25519.PrivateKey, 3)
+	for i := 0; i < 3; i++ {
+		peer, key := testPeer(i)
+		community.Peers = append(community.Peers, peer)
+		keys[i] = key
+	}
+	replicas, _ := initReplicas(t, community)
+
+	seq, err := replicas[0].Propose(signed(t, &transitions.TransitionWrapper{
+		Type: transitions.InitCommunityTransitionType,
+		Transition: transitions.InitCommunityTransition{
+			Community: community,
+		},
+	}, community.Peers[0].Key, keys[0]))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), seq)
+
+	// Every replica proposes at the same time, and each proposal should end up with its own sequence number
+	wg := &sync.WaitGroup{}
+	for i, replica := range replicas {
+		wg.Add(1)
+		go func(i int, replica *CommunityStateMachine) {
+			defer wg.Done()
+			backnet := entities.InitBacknet(entities.IPFS)
+			backnet.Bootstrap = []string{fmt.Sprintf("/ip4/10.0.0.%d/tcp/4001", i)}
+			_, err := replica.Propose(signed(t, &transitions.TransitionWrapper{
+				Type: transitions.UpdateBacknetTransitionType,
+				Transition: transitions.UpdateBacknetTransition{
+					CommID:     community.ID,
+					OldBacknet: community.Backnet,
+					NewBacknet: backnet,
+				},
+			}, community.Peers[i].Key, keys[i]))
+			assert.Nil(t, err)
+		}(i, replica)
+	}
+	wg.Wait()
+
+	for _, replica := range replicas {
+		assert.Equal(t, uint64(4), replica.CurSequenceNumber)
+		assert.Equal(t, replicas[0].State, replica.State)
+	}
+}
+
+func TestPeerReconfiguration(t *testing.T) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	keys := make([]ed25519.PrivateKey, 3)
+	for i := 0; i < 3; i++ {
+		peer, key := testPeer(i)
+		community.Peers = append(community.Peers, peer)
+		keys[i] = key
+	}
+	replicas, transport := initReplicas(t, community)
+	leader := replicas[0]
+	author, key := community.Peers[0].Key, keys[0]
+
+	_, err := leader.Propose(signed(t, &transitions.TransitionWrapper{
+		Type: transitions.InitCommunityTransitionType,
+		Transition: transitions.InitCommunityTransition{
+			Community: community,
+		},
+	}, author, key))
+	assert.Nil(t, err)
+
+	// Remove the other two peers, one at a time
+	for _, removed := range community.Peers[1:] {
+		_, err = leader.Propose(signed(t, &transitions.TransitionWrapper{
+			Type: transitions.RemovePeerTransitionType,
+			Transition: transitions.RemovePeerTransition{
+				CommID: community.ID,
+				Key:    removed.Key,
+			},
+		}, author, key))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 1, len(leader.State.Peers))
+	assert.Equal(t, []paxos.NodeID{paxos.NodeID(author)}, leader.Consensus.(*paxos.Node).PeersAt(leader.CurSequenceNumber+1))
+
+	// A quorum of the original peers is no longer needed
+	transport.Disconnect(paxos.NodeID(community.Peers[1].Key))
+	transport.Disconnect(paxos.NodeID(community.Peers[2].Key))
+	backnet := entities.InitBacknet(entities.IPFS)
+	backnet.Bootstrap = []string{"/ip4/10.0.0.0/tcp/4001"}
+	seq, err := leader.Propose(signed(t, &transitions.TransitionWrapper{
+		Type: transitions.UpdateBacknetTransitionType,
+		Transition: transitions.UpdateBacknetTransition{
+			CommID:     community.ID,
+			OldBacknet: community.Backnet,
+			NewBacknet: backnet,
+		},
+	}, author, key))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), seq)
+
+	// The committed peer set is restored on restart
+	err = leader.Close()
+	assert.Nil(t, err)
+	restarted, err := InitCommunityStateMachine(community.ID, filepath.Dir(leader.Path), 100)
+	assert.Nil(t, err)
+	node := paxos.NewNode(paxos.NodeID(author), PeerNodeIDs(community), transport, restarted.Commit)
+	restarted.Consensus = node
+	err = restarted.Restart()
+	assert.Nil(t, err)
+	assert.Equal(t, []paxos.NodeID{paxos.NodeID(author)}, node.PeersAt(5))
+}
+
+func TestRestartCatchUp(t *testing.T) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	keys := make([]ed25519.PrivateKey, 3)
+	for i := 0; i < 3; i++ {
+		peer, key := testPeer(i)
+		community.Peers = append(community.Peers, peer)
+		keys[i] = key
+	}
+	replicas, transport := initReplicas(t, community)
+	author, key := community.Peers[0].Key, keys[0]
+
+	_, err := replicas[0].Propose(signed(t, &transitions.TransitionWrapper{
+		Type:       transitions.InitCommunityTransitionType,
+		Transition: transitions.InitCommunityTransition{Community: community},
+	}, author, key))
+	assert.Nil(t, err)
+
+	// The last replica goes down, and misses a rename
+	down := replicas[2]
+	id := paxos.NodeID(community.Peers[2].Key)
+	transport.Disconnect(id)
+	assert.Nil(t, down.Close())
+	_, err = replicas[0].Propose(signed(t, &transitions.TransitionWrapper{
+		Type:       transitions.RenameCommunityTransitionType,
+		Transition: transitions.RenameCommunityTransition{CommID: community.ID, Name: "Renamed"},
+	}, author, key))
+	assert.Nil(t, err)
+
+	// It learns about the rename from the others when it comes back
+	restarted, err := InitCommunityStateMachine(community.ID, filepath.Dir(down.Path), 100)
+	assert.Nil(t, err)
+	defer restarted.Close()
+	node := paxos.NewNode(id, PeerNodeIDs(community), transport, restarted.Commit)
+	transport.Register(node)
+	transport.Reconnect(id)
+	restarted.Consensus = node
+	err = restarted.Restart()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), restarted.CurSequenceNumber)
+	assert.Equal(t, "Renamed", restarted.State.Name)
+	_, ok := node.Chosen(2)
+	assert.False(t, ok)
+}
+
+func TestCommitKeepsFailedValue(t *testing.T) {
+	community, peer, key := testCommunity()
+	sm, err := InitCommunityStateMachine(community.ID, t.TempDir(), 100)
+	assert.Nil(t, err)
+	defer sm.Close()
+
+	// A rename before the community is initialized can't be applied, but it was chosen, so it isn't dropped
+	value, err := json.Marshal(signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.RenameCommunityTransitionType,
+		Transition:     transitions.RenameCommunityTransition{CommID: community.ID, Name: "Renamed"},
+		SequenceNumber: 1,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+	err = sm.Commit(1, value)
+	assert.NotNil(t, err)
+	_, ok := sm.pending[1]
+	assert.True(t, ok)
+}
+
+func TestCommitBatch(t *testing.T) {
+	community, peer, key := testCommunity()
+	sm, err := InitCommunityStateMachine(community.ID, t.TempDir(), 100)
+	assert.Nil(t, err)
+	defer sm.Close()
+	writer := &syncingWriter{}
+	sm.WriteAheadLog.logWriter = writer
+
+	rename := func(name string, sequenceNumber uint64) *transitions.TransitionWrapper {
+		return signed(t, &transitions.TransitionWrapper{
+			Type:           transitions.RenameCommunityTransitionType,
+			Transition:     transitions.RenameCommunityTransition{CommID: community.ID, Name: name},
+			SequenceNumber: sequenceNumber,
+		}, peer.Key, key)
+	}
+	original := rename("Replayed", 2)
+	replayed := *original
+	replayed.SequenceNumber = 4
+	values := make([][]byte, 0)
+	for _, transition := range []*transitions.TransitionWrapper{
+		signed(t, &transitions.TransitionWrapper{
+			Type:           transitions.InitCommunityTransitionType,
+			Transition:     transitions.InitCommunityTransition{Community: community},
+			SequenceNumber: 1,
+		}, peer.Key, key),
+		original,
+		rename("Renamed", 3),
+		&replayed,
+	} {
+		value, err := json.Marshal(transition)
+		assert.Nil(t, err)
+		values = append(values, value)
+	}
+
+	// Values chosen out of order wait for the ones before them
+	for i := len(values) - 1; i > 0; i-- {
+		assert.Nil(t, sm.Commit(uint64(i+1), values[i]))
+	}
+	assert.Equal(t, uint64(0), sm.CurSequenceNumber)
+	assert.Equal(t, 0, writer.writes)
+
+	// They are then applied together with a single write. Each one is validated against the ones before it, so
+	// the replayed transition is rejected and stays pending.
+	err = sm.Commit(1, values[0])
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(3), sm.CurSequenceNumber)
+	assert.Equal(t, "Renamed", sm.State.Name)
+	assert.Equal(t, 1, writer.writes)
+	assert.Equal(t, 3, strings.Count(writer.buf.String(), "\n"))
+	assert.Equal(t, 1, len(sm.pending))
+	_, ok := sm.pending[4]
+	assert.True(t, ok)
+}
+
+// countingWriter counts the writes to a log, each of which is fsynced by the writer it wraps
+type countingWriter struct {
+	io.WriteCloser
+	writes uint64
+}
+
+func (cw *countingWriter) Write(buf []byte) (int, error) {
+	atomic.AddUint64(&cw.writes, 1)
+	return cw.WriteCloser.Write(buf)
+}
+
+// benchmarkPropose proposes renames from concurrent proposers on every replica of a community, and reports how
+// many writes each replica's log needed per committed transition
+func benchmarkPropose(b *testing.B, replicaCount int) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	keys := make([]ed25519.PrivateKey, replicaCount)
+	for i := 0; i < replicaCount; i++ {
+		peer, key := testPeer(i)
+		community.Peers = append(community.Peers, peer)
+		keys[i] = key
+	}
+	transport := paxos.NewLocalTransport()
+	replicas := make([]*CommunityStateMachine, replicaCount)
+	writers := make([]*countingWriter, replicaCount)
+	for i, peer := range PeerNodeIDs(community) {
+		// Snapshots are never taken, since compacting the log replaces its writer
+		sm, err := InitCommunityStateMachine(community.ID, b.TempDir(), math.MaxInt32)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer sm.Close()
+		writers[i] = &countingWriter{WriteCloser: sm.WriteAheadLog.logWriter.(*WALWriter)}
+		sm.WriteAheadLog.logWriter = writers[i]
+		node := paxos.NewNode(peer, PeerNodeIDs(community), transport, sm.Commit)
+		transport.Register(node)
+		sm.Consensus = node
+		replicas[i] = sm
+	}
+
+	init := &transitions.TransitionWrapper{
+		Type:       transitions.InitCommunityTransitionType,
+		Transition: transitions.InitCommunityTransition{Community: community},
+	}
+	err := init.Sign(community.Peers[0].Key, keys[0])
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, err = replicas[0].Propose(init)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, writer := range writers {
+		atomic.StoreUint64(&writer.writes, 0)
+	}
+
+	var proposer, renames uint64
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint64(&proposer, 1)) % replicaCount
+		replica := replicas[i]
+		for pb.Next() {
+			// A proposer that keeps losing to the others re-signs its transition once its base is too old
+			name := fmt.Sprintf("Community %d", atomic.AddUint64(&renames, 1))
+			for {
+				replica.commitMutex.Lock()
+				base := replica.CurSequenceNumber
+				replica.commitMutex.Unlock()
+
+				rename := &transitions.TransitionWrapper{
+					Type:               transitions.RenameCommunityTransitionType,
+					Transition:         transitions.RenameCommunityTransition{CommID: community.ID, Name: name},
+					BaseSequenceNumber: base,
+				}
+				err := rename.Sign(community.Peers[i].Key, keys[i])
+				if err == nil {
+					_, err = replica.Propose(rename)
+				}
+				var validationErr *transitions.ValidationError
+				if errors.As(err, &validationErr) && validationErr.Field == "base_sequence_number" {
+					continue
+				} else if err != nil {
+					b.Error(err)
+					return
+				}
+				break
+			}
+		}
+	})
+	b.StopTimer()
+
+	var writes uint64
+	for _, writer := range writers {
+		writes += atomic.LoadUint64(&writer.writes)
+	}
+	b.ReportMetric(float64(writes)/float64(replicaCount*b.N), "writes/op")
+}
+
+func BenchmarkPropose(b *testing.B) {
+	b.Run("one replica", func(b *testing.B) {
+		benchmarkPropose(b, 1)
+	})
+	b.Run("three replicas", func(b *testing.B) {
+		benchmarkPropose(b, 3)
+	})
+}
@@ -0,0 +1,277 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/eagraf/habitat-node/entities"
+)
+
+// A community's history is made up of the archived WAL segments, the segments still in the state dir, and the
+// archived snapshots. The community at any sequence number is rebuilt by replaying the log on top of the newest
+// archived snapshot at or before it, and points in time are resolved to the last transition committed by then,
+// using the Committed timestamps in the log. Like Log.Iterator, history queries shouldn't run while the log is
+// being rotated or compacted. The host's history is kept the same way, and can be queried by sequence number.
+
+// ErrHistoryUnavailable is returned when the part of the history a query needs has been deleted, because the
+// state machine has no ArchiveDir or archived snapshots were pruned
+var ErrHistoryUnavailable = errors.New("history is no longer available")
+
+// historyIterator streams the entries in the archived segments and the log, starting at sequence number from
+func (sm *CommunityStateMachine) historyIterator(from uint64) (*LogIterator, error) {
+	return historyIterator(sm.WriteAheadLog, sm.ArchiveDir, from)
+}
+
+func historyIterator(wal *Log, archiveDir string, from uint64) (*LogIterator, error) {
+	segments := make([]*Segment, 0)
+	if archiveDir != "" {
+		archived, err := listSegments(archiveDir)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, archived...)
+	}
+
+	live, err := wal.Segments()
+	if err != nil {
+		return nil, err
+	}
+	segments = append(segments, live...)
+
+	return newLogIterator(segments, from), nil
+}
+
+// StateAt rebuilds the community as it was right after the transition with the given sequence number was
+// applied. The community is nil at sequence number 0, before it was initialized.
+func (sm *CommunityStateMachine) StateAt(sequenceNumber uint64) (*entities.Community, error) {
+	if sequenceNumber > sm.CurSequenceNumber {
+		return nil, fmt.Errorf("sequence number %d has not been committed yet, the latest is %d", sequenceNumber, sm.CurSequenceNumber)
+	}
+	if sequenceNumber == sm.CurSequenceNumber {
+		return sm.State.Copy()
+	}
+
+	var community *entities.Community
+	current, err := newestArchivedSnapshot(sm.Path, sequenceNumber, &community)
+	if err != nil {
+		return nil, err
+	}
+
+	it, err := sm.historyIterator(current + 1)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	err = replayHistory(sm.SourceID(), it, current, sequenceNumber, func(entry *Entry) error {
+		community, err = reduceCommunityEntry(community, entry)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return community, nil
+}
+
+// StateAtTime rebuilds the community as it was at a point in time, and returns the sequence number of the last
+// transition committed by then
+func (sm *CommunityStateMachine) StateAtTime(t time.Time) (*entities.Community, uint64, error) {
+	sequenceNumber, err := sm.SequenceNumberAt(t)
+	if err != nil {
+		return nil, 0, err
+	}
+	community, err := sm.StateAt(sequenceNumber)
+	if err != nil {
+		return nil, 0, err
+	}
+	return community, sequenceNumber, nil
+}
+
+// SequenceNumberAt finds the last transition committed at or before a point in time, or 0 if the community had
+// not been initialized yet
+func (sm *CommunityStateMachine) SequenceNumberAt(t time.Time) (uint64, error) {
+	it, err := sm.historyIterator(0)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+
+	var res uint64
+	for {
+		entry, err := it.Next()
+		if err == io.EOF {
+			if res == 0 && sm.CurSequenceNumber > 0 {
+				return 0, fmt.Errorf("%w: the log of community %s has been compacted", ErrHistoryUnavailable, sm.CommunityID)
+			}
+			return res, nil
+		} else if err != nil {
+			return 0, err
+		}
+
+		if entry.Committed.After(t) {
+			// Without the start of the log there is no telling what happened before the first entry that's left
+			if res == 0 && entry.SequenceNumber > 1 {
+				return 0, fmt.Errorf("%w: the log of community %s starts at sequence number %d, committed at %s", ErrHistoryUnavailable, sm.CommunityID, entry.SequenceNumber, entry.Committed)
+			}
+			return res, nil
+		}
+		res = entry.SequenceNumber
+	}
+}
+
+// TransitionsBetween returns the log entries that take the community from its state at sequence number from to
+// its state at sequence number to, which are the entries from+1 through to
+func (sm *CommunityStateMachine) TransitionsBetween(from, to uint64) ([]*Entry, error) {
+	if from > to {
+		return nil, fmt.Errorf("sequence number %d is after %d", from, to)
+	}
+	if to > sm.CurSequenceNumber {
+		return nil, fmt.Errorf("sequence number %d has not been committed yet, the latest is %d", to, sm.CurSequenceNumber)
+	}
+
+	it, err := sm.historyIterator(from + 1)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	res := make([]*Entry, 0, to-from)
+	err = replayHistory(sm.SourceID(), it, from, to, func(entry *Entry) error {
+		res = append(res, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// TransitionsBetweenTimes returns the log entries that take the community from its state at one point in time to
+// its state at another, which are the entries committed after from, up to and including to
+func (sm *CommunityStateMachine) TransitionsBetweenTimes(from, to time.Time) ([]*Entry, error) {
+	if from.After(to) {
+		return nil, fmt.Errorf("%s is after %s", from, to)
+	}
+	fromSequenceNumber, err := sm.SequenceNumberAt(from)
+	if err != nil {
+		return nil, err
+	}
+	toSequenceNumber, err := sm.SequenceNumberAt(to)
+	if err != nil {
+		return nil, err
+	}
+	return sm.TransitionsBetween(fromSequenceNumber, toSequenceNumber)
+}
+
+// newestArchivedSnapshot reads the newest archived snapshot that isn't past a sequence number into dest, and
+// returns its sequence number. If there is none, 0 is returned and dest is untouched.
+func newestArchivedSnapshot(stateDir string, sequenceNumber uint64, dest interface{}) (uint64, error) {
+	archived, err := ArchivedSnapshots(stateDir)
+	if err != nil {
+		return 0, err
+	}
+	for i := len(archived) - 1; i >= 0; i-- {
+		if archived[i].SequenceNumber > sequenceNumber {
+			continue
+		}
+		snapshot, err := readArchivedSnapshot(archived[i].Path, dest)
+		if err != nil {
+			return 0, err
+		}
+		return snapshot.SequenceNumber, nil
+	}
+	return 0, nil
+}
+
+// replayHistory passes the entries after sequence number from, up to and including to, to apply. Every one of
+// them has to still be in the history.
+func replayHistory(sourceID string, it *LogIterator, from, to uint64, apply func(*Entry) error) error {
+	for current := from; current < to; current++ {
+		entry, err := it.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%w: log of %s ends at sequence number %d", ErrHistoryUnavailable, sourceID, current)
+		} else if err != nil {
+			return err
+		}
+		if entry.SequenceNumber != current+1 {
+			return fmt.Errorf("%w: sequence number %d of %s has been compacted", ErrHistoryUnavailable, current+1, sourceID)
+		}
+
+		err = apply(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readArchivedSnapshot reads an archived snapshot into dest
+func readArchivedSnapshot(path string, dest interface{}) (*Snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadSnapshot(file, dest)
+}
+
+// StateAt rebuilds the host as it was right after the transition with the given sequence number was applied
+func (sm *HostStateMachine) StateAt(sequenceNumber uint64) (*entities.Host, error) {
+	if sequenceNumber > sm.CurSequenceNumber {
+		return nil, fmt.Errorf("sequence number %d has not been committed yet, the latest is %d", sequenceNumber, sm.CurSequenceNumber)
+	}
+	if sequenceNumber == sm.CurSequenceNumber {
+		return sm.State.Copy()
+	}
+
+	host := entities.InitHost()
+	current, err := newestArchivedSnapshot(sm.Path, sequenceNumber, host)
+	if err != nil {
+		return nil, err
+	}
+
+	it, err := historyIterator(sm.WriteAheadLog, sm.ArchiveDir, current+1)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	err = replayHistory(sm.SourceID(), it, current, sequenceNumber, func(entry *Entry) error {
+		host, err = reduceHost(host, entry.Transition)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return host, nil
+}
+
+// TransitionsBetween returns the log entries from+1 through to, like CommunityStateMachine.TransitionsBetween
+func (sm *HostStateMachine) TransitionsBetween(from, to uint64) ([]*Entry, error) {
+	if from > to {
+		return nil, fmt.Errorf("sequence number %d is after %d", from, to)
+	}
+	if to > sm.CurSequenceNumber {
+		return nil, fmt.Errorf("sequence number %d has not been committed yet, the latest is %d", to, sm.CurSequenceNumber)
+	}
+
+	it, err := historyIterator(sm.WriteAheadLog, sm.ArchiveDir, from+1)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	res := make([]*Entry, 0, to-from)
+	err = replayHistory(sm.SourceID(), it, from, to, func(entry *Entry) error {
+		res = append(res, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
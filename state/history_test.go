@@ -0,0 +1,160 @@
+package state
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/stretchr/testify/assert"
+)
+
+// historyStateMachine commits an init and then adds or removes a member with each transition, snapshotting every
+// other one. The time right after each sequence number is returned.
+func historyStateMachine(t *testing.T, snapshotInterval int) (*CommunityStateMachine, []time.Time) {
+	community, peer, key := testCommunity()
+	sm, err := InitCommunityStateMachine(community.ID, t.TempDir(), snapshotInterval)
+	assert.Nil(t, err)
+
+	marks := []time.Time{time.Now()}
+	mark := func() {
+		marks = append(marks, time.Now())
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(time.Millisecond)
+
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.InitCommunityTransitionType,
+		Transition:     transitions.InitCommunityTransition{Community: community},
+		SequenceNumber: 1,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+	mark()
+
+	alice, _ := testUser("alice", 1)
+	bob, _ := testUser("bob", 2)
+	changes := []struct {
+		user    *entities.User
+		modType transitions.ModifyType
+	}{
+		{alice, transitions.AddMember},
+		{bob, transitions.AddMember},
+		{alice, transitions.RemoveMember},
+		{alice, transitions.AddMember},
+	}
+	for i, change := range changes {
+		err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+			Type: transitions.ModifyCommMembersTransitionType,
+			Transition: transitions.ModifyCommMembersTransition{
+				Community: sm.State,
+				User:      change.user,
+				ModType:   change.modType,
+			},
+			SequenceNumber: uint64(i + 2),
+		}, peer.Key, key))
+		assert.Nil(t, err)
+		mark()
+	}
+
+	return sm, marks
+}
+
+func memberIDs(community *entities.Community) []entities.UserID {
+	res := make([]entities.UserID, 0)
+	for _, id := range []entities.UserID{"alice", "bob"} {
+		if _, ok := community.Members[id]; ok {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+func TestStateAt(t *testing.T) {
+	sm, marks := historyStateMachine(t, 2)
+	expected := [][]entities.UserID{
+		nil,
+		{},
+		{"alice"},
+		{"alice", "bob"},
+		{"bob"},
+		{"alice", "bob"},
+	}
+
+	for sequenceNumber, members := range expected {
+		community, err := sm.StateAt(uint64(sequenceNumber))
+		assert.Nil(t, err)
+		community2, at, err := sm.StateAtTime(marks[sequenceNumber])
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(sequenceNumber), at)
+
+		if members == nil {
+			assert.Nil(t, community)
+			assert.Nil(t, community2)
+			continue
+		}
+		assert.Equal(t, members, memberIDs(community), "sequence number %d", sequenceNumber)
+		assert.Equal(t, community, community2)
+	}
+
+	// The current state isn't handed out
+	current, err := sm.StateAt(5)
+	assert.Nil(t, err)
+	delete(current.Members, "bob")
+	assert.Equal(t, 2, len(sm.State.Members))
+
+	_, err = sm.StateAt(6)
+	assert.NotNil(t, err)
+}
+
+func TestStateAtWithoutArchive(t *testing.T) {
+	sm, _ := historyStateMachine(t, 2)
+	sm.ArchiveDir = ""
+
+	// Sequence numbers covered by an archived snapshot can still be rebuilt, the ones before it can't
+	community, err := sm.StateAt(4)
+	assert.Nil(t, err)
+	assert.Equal(t, []entities.UserID{"bob"}, memberIDs(community))
+	_, err = sm.StateAt(1)
+	assert.True(t, errors.Is(err, ErrHistoryUnavailable))
+
+	_, err = sm.SequenceNumberAt(time.Now().Add(-time.Hour))
+	assert.True(t, errors.Is(err, ErrHistoryUnavailable))
+}
+
+func TestTransitionsBetween(t *testing.T) {
+	sm, marks := historyStateMachine(t, 2)
+
+	entries, err := sm.TransitionsBetween(1, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(entries))
+	for i, entry := range entries {
+		assert.Equal(t, uint64(i+2), entry.SequenceNumber)
+		assert.Equal(t, transitions.ModifyCommMembersTransitionType, entry.Transition.Type)
+	}
+
+	entries, err = sm.TransitionsBetween(5, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+	_, err = sm.TransitionsBetween(4, 1)
+	assert.NotNil(t, err)
+	_, err = sm.TransitionsBetween(0, 6)
+	assert.NotNil(t, err)
+
+	// Replaying the transitions between two points in time gets from one state to the other
+	from, _, err := sm.StateAtTime(marks[2])
+	assert.Nil(t, err)
+	entries, err = sm.TransitionsBetweenTimes(marks[2], marks[4])
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+	for _, entry := range entries {
+		from, err = reduceCommunityEntry(from, entry)
+		assert.Nil(t, err)
+	}
+	to, _, err := sm.StateAtTime(marks[4])
+	assert.Nil(t, err)
+	assert.Equal(t, to, from)
+
+	_, err = sm.TransitionsBetweenTimes(marks[4], marks[2])
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,243 @@
+package state
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+)
+
+// HostStateDir is the directory under the base state dir where host state is kept
+const HostStateDir = "host"
+
+// HostStateMachine keeps track of state that is local to this node, such as which communities it hosts
+// and which users can configure it. Host state is not replicated, but it is just as durable as community state.
+type HostStateMachine struct {
+	WriteAheadLog     *Log
+	CurSequenceNumber uint64
+	State             *entities.Host
+	Path              string
+	SnapshotInterval  int
+	SnapshotRetention SnapshotRetentionPolicy
+	// ArchiveDir is where WAL segments covered by a snapshot are moved. If empty, they are deleted.
+	ArchiveDir string
+
+	// Subscriptions is optional, if it is set every applied transition is published to it
+	Subscriptions *SubscriptionRegistry
+
+	applyMutex *sync.Mutex
+	lock       *dirLock
+}
+
+// InitHostStateMachine gets ready for a restart or for a clean start
+func InitHostStateMachine(stateBaseDir string, snapshotInterval int) (*HostStateMachine, error) {
+	stateDir := filepath.Join(stateBaseDir, HostStateDir)
+	err := initStateDir(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing else may touch the state dir until the state machine is closed
+	lock, err := lockStateDir(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize log
+	log, err := NewLog(filepath.Join(stateDir, "wal"))
+	if err != nil {
+		lock.release()
+		return nil, err
+	}
+
+	// Until Restart is called, the host is assumed to be brand new
+	return &HostStateMachine{
+		WriteAheadLog:     log,
+		State:             entities.InitHost(),
+		Path:              stateDir,
+		SnapshotInterval:  snapshotInterval,
+		SnapshotRetention: DefaultSnapshotRetention,
+		ArchiveDir:        filepath.Join(stateDir, "archive"),
+
+		applyMutex: &sync.Mutex{},
+		lock:       lock,
+	}, nil
+}
+
+// Close closes the log and releases the lock on the state dir, so that another state machine can use it
+func (sm *HostStateMachine) Close() error {
+	err := sm.WriteAheadLog.Close()
+	lockErr := sm.lock.release()
+	if err != nil {
+		return err
+	}
+	return lockErr
+}
+
+func (sm *HostStateMachine) Restart() error {
+	// Clean up after a crash in the middle of writing to the log
+	err := sm.WriteAheadLog.Recover()
+	if err != nil {
+		return err
+	}
+
+	// Reconstitute state from snapshot
+	snapshotState := entities.InitHost()
+	snapshot, err := readSnapshotFile(sm.Path, snapshotState)
+	if err != nil {
+		return err
+	}
+
+	// Roll up logs with sequence number higher than snapshot
+	intermediateState := snapshotState
+	sequenceNumber, err := replayLog(sm.WriteAheadLog, snapshot, func(entry *Entry) error {
+		tempState, err := reduceHost(intermediateState, entry.Transition)
+		if err != nil {
+			return err
+		}
+		intermediateState = tempState
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sm.State = intermediateState
+	sm.CurSequenceNumber = sequenceNumber
+	warnMembershipDrift(sm.State.CheckMembership())
+
+	return nil
+}
+
+// Validate checks that a transition can be applied to the current state, without persisting anything.
+// Invalid transitions are reported with a *transitions.ValidationError.
+func (sm *HostStateMachine) Validate(transition *transitions.TransitionWrapper) error {
+	// Validate that the transition is a host or host user transition
+	category, err := transitions.GetSubscriptionCategory(transition.Type)
+	if err != nil {
+		return err
+	} else if category != transitions.HostCategory && category != transitions.HostUserCategory {
+		return fmt.Errorf("transition category is %s, should be %s or %s", category, transitions.HostCategory, transitions.HostUserCategory)
+	}
+
+	switch t := transition.Transition.(type) {
+	case transitions.HostTransition:
+		return t.Validate(sm.State)
+	case transitions.HostUserTransition:
+		var user *entities.HostUser
+		if u, ok := sm.State.HostUsers[t.Username()]; ok {
+			user = &u
+		}
+		return t.Validate(user)
+	default:
+		return fmt.Errorf("transition of type %s is not a HostTransition or HostUserTransition", transition.Type)
+	}
+}
+
+func (sm *HostStateMachine) Apply(transition *transitions.TransitionWrapper) error {
+	sm.applyMutex.Lock()
+	defer sm.applyMutex.Unlock()
+
+	return sm.apply(transition)
+}
+
+// apply is Apply without taking applyMutex
+func (sm *HostStateMachine) apply(transition *transitions.TransitionWrapper) error {
+	// Validate sequence number for new transition
+	if transition.SequenceNumber != sm.CurSequenceNumber+1 {
+		return fmt.Errorf("sequence number %d is off, should be %d", transition.SequenceNumber, sm.CurSequenceNumber+1)
+	}
+
+	// Nothing can be persisted until the transition is known to be valid
+	err := sm.Validate(transition)
+	if err != nil {
+		return err
+	}
+
+	// Write to write ahead log
+	err = sm.WriteAheadLog.WriteAhead(transition)
+	if err != nil {
+		return err
+	}
+
+	// Very important that this is incremented immediately after write to write ahead log succeeds
+	sm.CurSequenceNumber += 1
+
+	// Apply reducer to state
+	newState, err := reduceHost(sm.State, transition)
+	if err != nil {
+		return err
+	}
+
+	sm.State = newState
+
+	// Copy snapshot file
+	if sm.CurSequenceNumber%uint64(sm.SnapshotInterval) == 0 {
+		err := writeSnapshotFile(sm.Path, sm.SnapshotRetention, sm.State, sm.CurSequenceNumber, nil)
+		if err != nil {
+			return err
+		}
+		err = compactLog(sm.WriteAheadLog, sm.CurSequenceNumber, sm.ArchiveDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Notify all transition subscribers
+	if sm.Subscriptions != nil {
+		err := sm.Subscriptions.Publish(sm.SourceID(), transition)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sm *HostStateMachine) GetState() interface{} {
+	return sm.State
+}
+
+// SourceID implements TransitionSource
+func (sm *HostStateMachine) SourceID() string {
+	return HostStateDir
+}
+
+// EntriesFrom implements TransitionSource
+func (sm *HostStateMachine) EntriesFrom(sequenceNumber uint64) ([]*Entry, error) {
+	return entriesFrom(sm.WriteAheadLog, sequenceNumber)
+}
+
+// reduceHost applies either a HostTransition or a HostUserTransition to the host. Host transitions are replayed
+// without validating them, so callers validate transitions that haven't been logged yet.
+func reduceHost(host *entities.Host, wrapper *transitions.TransitionWrapper) (*entities.Host, error) {
+	switch transition := wrapper.Transition.(type) {
+	case transitions.HostTransition:
+		return transition.Replay(host)
+	case transitions.HostUserTransition:
+		var oldUser *entities.HostUser
+		if user, ok := host.HostUsers[transition.Username()]; ok {
+			oldUser = &user
+		}
+
+		newUser, err := transition.Reduce(oldUser)
+		if err != nil {
+			return nil, err
+		}
+
+		newHost, err := host.Copy()
+		if err != nil {
+			return nil, err
+		}
+		if newUser == nil {
+			delete(newHost.HostUsers, transition.Username())
+		} else {
+			newHost.HostUsers[transition.Username()] = *newUser
+		}
+		return newHost, nil
+	default:
+		return nil, fmt.Errorf("transition of type %s is not a HostTransition or HostUserTransition", wrapper.Type)
+	}
+}
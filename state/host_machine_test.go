@@ -0,0 +1,58 @@
+package state
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/stretchr/testify/assert"
+)
+
+func addCommunityTransition(id entities.CommunityID, sequenceNumber uint64) *transitions.TransitionWrapper {
+	return &transitions.TransitionWrapper{
+		Type: transitions.AddCommunityTransitionType,
+		Transition: transitions.AddCommunityTransition{
+			Community: entities.InitCommunity(id, string(id), entities.IPFS),
+		},
+		SequenceNumber: sequenceNumber,
+	}
+}
+
+func TestHostStateMachineRestart(t *testing.T) {
+	stateDir := t.TempDir()
+
+	sm, err := InitHostStateMachine(stateDir, 2)
+	assert.Nil(t, err)
+	err = sm.Restart()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), sm.CurSequenceNumber)
+
+	// The third transition is only in the WAL, and not in the snapshot
+	for i := 1; i <= 3; i++ {
+		err = sm.Apply(addCommunityTransition(entities.CommunityID(fmt.Sprintf("community_%d", i)), uint64(i)))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 3, len(sm.State.Communities))
+
+	// Community transitions can't be applied to the host
+	err = sm.Apply(&transitions.TransitionWrapper{
+		Type:           transitions.UpdateBacknetTransitionType,
+		Transition:     transitions.UpdateBacknetTransition{},
+		SequenceNumber: 4,
+	})
+	assert.NotNil(t, err)
+
+	err = sm.Close()
+	assert.Nil(t, err)
+	restarted, err := InitHostStateMachine(stateDir, 2)
+	assert.Nil(t, err)
+	err = restarted.Restart()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), restarted.CurSequenceNumber)
+	assert.Equal(t, 3, len(restarted.State.Communities))
+	assert.Equal(t, "community_2", restarted.State.Communities["community_2"].Name)
+
+	err = restarted.Apply(addCommunityTransition("community_4", 4))
+	assert.Nil(t, err)
+}
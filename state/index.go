@@ -0,0 +1,121 @@
+package state
+
+import (
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+)
+
+// CommitIndex records what validating a community transition needs to know about the transitions committed
+// before it. It is built from the log alone, and snapshotted along with the state, so every replica at a sequence
+// number has the same index no matter how much of its log it has compacted or archived.
+type CommitIndex struct {
+	// Nonces are the nonces of the transitions committed in the last ReplayWindow sequence numbers, in order.
+	// A transition signed against an older base sequence number can't be committed, so older nonces are dropped.
+	Nonces []*CommittedNonce `json:"nonces"`
+	// Unbans maps the sequence number of every UnbanMember that hasn't been compensated to the user it unbanned
+	Unbans map[uint64]entities.UserID `json:"unbans"`
+	// Compensations maps compensated sequence numbers to the sequence number of the transition compensating them
+	Compensations map[uint64]uint64 `json:"compensations"`
+
+	nonces map[string]uint64
+}
+
+// CommittedNonce is the nonce of a committed transition
+type CommittedNonce struct {
+	SequenceNumber uint64 `json:"sequence_number"`
+	Author         string `json:"author"`
+	Nonce          string `json:"nonce"`
+}
+
+func NewCommitIndex() *CommitIndex {
+	return &CommitIndex{
+		Nonces:        make([]*CommittedNonce, 0),
+		Unbans:        make(map[uint64]entities.UserID),
+		Compensations: make(map[uint64]uint64),
+	}
+}
+
+// clone copies the index, so that transitions can be added to the copy without changing the original
+func (ci *CommitIndex) clone() *CommitIndex {
+	res := &CommitIndex{
+		Nonces:        append(make([]*CommittedNonce, 0, len(ci.Nonces)), ci.Nonces...),
+		Unbans:        make(map[uint64]entities.UserID, len(ci.Unbans)),
+		Compensations: make(map[uint64]uint64, len(ci.Compensations)),
+	}
+	for sequenceNumber, user := range ci.Unbans {
+		res.Unbans[sequenceNumber] = user
+	}
+	for sequenceNumber, compensation := range ci.Compensations {
+		res.Compensations[sequenceNumber] = compensation
+	}
+	return res
+}
+
+// nonceKey identifies a nonce by who signed it, since nonces are only unique per author
+func nonceKey(author, nonce string) string {
+	return author + " " + nonce
+}
+
+// lookup builds the nonce lookup, which isn't snapshotted
+func (ci *CommitIndex) lookup() map[string]uint64 {
+	if ci.nonces == nil {
+		ci.nonces = make(map[string]uint64, len(ci.Nonces))
+		for _, committed := range ci.Nonces {
+			ci.nonces[nonceKey(committed.Author, committed.Nonce)] = committed.SequenceNumber
+		}
+	}
+	return ci.nonces
+}
+
+// Add indexes a transition committed at its sequence number
+func (ci *CommitIndex) Add(tw *transitions.TransitionWrapper) {
+	// Maps are missing from indexes snapshotted by older versions
+	if ci.Unbans == nil {
+		ci.Unbans = make(map[uint64]entities.UserID)
+	}
+	if ci.Compensations == nil {
+		ci.Compensations = make(map[uint64]uint64)
+	}
+
+	nonces := ci.lookup()
+	for len(ci.Nonces) > 0 && ci.Nonces[0].SequenceNumber+transitions.ReplayWindow <= tw.SequenceNumber {
+		delete(nonces, nonceKey(ci.Nonces[0].Author, ci.Nonces[0].Nonce))
+		ci.Nonces = ci.Nonces[1:]
+	}
+	if tw.Nonce != "" {
+		ci.Nonces = append(ci.Nonces, &CommittedNonce{
+			SequenceNumber: tw.SequenceNumber,
+			Author:         tw.Author,
+			Nonce:          tw.Nonce,
+		})
+		nonces[nonceKey(tw.Author, tw.Nonce)] = tw.SequenceNumber
+	}
+
+	if tw.Compensates != 0 {
+		ci.Compensations[tw.Compensates] = tw.SequenceNumber
+		delete(ci.Unbans, tw.Compensates)
+	}
+
+	modify, ok := transitions.Normalize(tw.Transition).(*transitions.ModifyCommMembersTransition)
+	if ok && modify.ModType == transitions.UnbanMember && modify.User != nil {
+		ci.Unbans[tw.SequenceNumber] = modify.User.ID
+	}
+}
+
+// NonceCommittedAt implements transitions.CommitHistory
+func (ci *CommitIndex) NonceCommittedAt(author, nonce string) (uint64, bool) {
+	sequenceNumber, ok := ci.lookup()[nonceKey(author, nonce)]
+	return sequenceNumber, ok
+}
+
+// CompensatedAt implements transitions.CommitHistory
+func (ci *CommitIndex) CompensatedAt(sequenceNumber uint64) (uint64, bool) {
+	compensation, ok := ci.Compensations[sequenceNumber]
+	return compensation, ok
+}
+
+// UnbannedAt implements transitions.CommitHistory
+func (ci *CommitIndex) UnbannedAt(sequenceNumber uint64) (entities.UserID, bool) {
+	user, ok := ci.Unbans[sequenceNumber]
+	return user, ok
+}
@@ -0,0 +1,42 @@
+package state
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommitIndexNonces(t *testing.T) {
+	index := NewCommitIndex()
+	index.Add(&transitions.TransitionWrapper{SequenceNumber: 1, Author: "alice", Nonce: "a"})
+	index.Add(&transitions.TransitionWrapper{SequenceNumber: 2, Author: "bob", Nonce: "b"})
+
+	seq, ok := index.NonceCommittedAt("alice", "a")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), seq)
+	_, ok = index.NonceCommittedAt("bob", "a")
+	assert.False(t, ok)
+
+	// Nonces fall out of the index once nothing signed against a base before them can be committed
+	index.Add(&transitions.TransitionWrapper{SequenceNumber: 1 + transitions.ReplayWindow})
+	_, ok = index.NonceCommittedAt("alice", "a")
+	assert.False(t, ok)
+	_, ok = index.NonceCommittedAt("bob", "b")
+	assert.True(t, ok)
+
+	// The index is snapshotted along with the state
+	buf := &bytes.Buffer{}
+	err := writeSnapshot(buf, &entities.Community{Name: "My Community"}, 1+transitions.ReplayWindow, index)
+	assert.Nil(t, err)
+	var community *entities.Community
+	snapshot, err := ReadSnapshot(buf, &community)
+	assert.Nil(t, err)
+	seq, ok = snapshotIndex(snapshot).NonceCommittedAt("bob", "b")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), seq)
+	_, ok = snapshotIndex(snapshot).NonceCommittedAt("alice", "a")
+	assert.False(t, ok)
+}
@@ -0,0 +1,220 @@
+package state
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Inspection reads a state dir without opening its log for writing, so it can be pointed at the state dir of a
+// running node, or at one that is too broken to restart. It is used by the habitat-state command.
+
+// StateDirSegments lists the WAL segments of a state dir in order: the segments that were compacted into
+// archiveDir, the rotated segments, and the active segment
+func StateDirSegments(stateDir, archiveDir string) ([]*Segment, error) {
+	res := make([]*Segment, 0)
+	if archiveDir != "" {
+		archived, err := listSegments(archiveDir)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, archived...)
+	}
+
+	rotated, err := listSegments(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	res = append(res, rotated...)
+
+	activePath := filepath.Join(stateDir, "wal")
+	firstSequenceNumber, _, err := firstSequenceNumber(activePath)
+	if err != nil {
+		return nil, err
+	}
+	return append(res, &Segment{
+		Path:                activePath,
+		FirstSequenceNumber: firstSequenceNumber,
+		Active:              true,
+	}), nil
+}
+
+// SegmentLine is a line of a WAL segment read by ScanSegment. Entry is nil and Err is set if the line couldn't
+// be decoded.
+type SegmentLine struct {
+	Path   string
+	Number int
+	Raw    []byte
+	Entry  *Entry
+	Err    error
+}
+
+// Checksummed is false for lines written before log lines had checksums
+func (sl *SegmentLine) Checksummed() bool {
+	return len(strings.Split(string(sl.Raw), " ")) == 3
+}
+
+// Data returns the JSON encoded entry, exactly as it was written
+func (sl *SegmentLine) Data() ([]byte, error) {
+	parts := strings.Split(string(sl.Raw), " ")
+	return base64.StdEncoding.DecodeString(parts[len(parts)-1])
+}
+
+// ScanSegment calls fn with every line of a segment, including the ones that can't be decoded
+func ScanSegment(path string, fn func(*SegmentLine) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := newLogScanner(file)
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		entry, err := DecodeLogEntry(line)
+		err = fn(&SegmentLine{
+			Path:   path,
+			Number: number,
+			Raw:    append([]byte{}, line...),
+			Entry:  entry,
+			Err:    err,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// InspectionProblem is something wrong with a state dir, found by VerifyStateDir. Line is 0 for problems that
+// aren't about a single line.
+type InspectionProblem struct {
+	Path   string
+	Line   int
+	Reason string
+}
+
+func (ip *InspectionProblem) String() string {
+	if ip.Line == 0 {
+		return fmt.Sprintf("%s: %s", ip.Path, ip.Reason)
+	}
+	return fmt.Sprintf("%s:%d: %s", ip.Path, ip.Line, ip.Reason)
+}
+
+// Verification summarizes a state dir checked by VerifyStateDir
+type Verification struct {
+	Entries             int
+	Unchecksummed       int // Entries written before log lines had checksums
+	FirstSequenceNumber uint64
+	LastSequenceNumber  uint64
+	Snapshots           int
+	// SnapshotSequenceNumber is the sequence number of the current snapshot, or 0 if there is none
+	SnapshotSequenceNumber uint64
+	Problems               []*InspectionProblem
+}
+
+func (v *Verification) addf(path string, line int, format string, args ...interface{}) {
+	v.Problems = append(v.Problems, &InspectionProblem{
+		Path:   path,
+		Line:   line,
+		Reason: fmt.Sprintf(format, args...),
+	})
+}
+
+// VerifyStateDir checks that every line of the WAL decodes and matches its checksum, that sequence numbers follow
+// each other without gaps across segments, and that segments are named after their first sequence number. Every
+// snapshot has to decode and be named after its sequence number, and the log has to pick up where the current
+// snapshot leaves off. Problems are reported in the Verification rather than as an error, which is only returned
+// if the state dir can't be read at all.
+func VerifyStateDir(stateDir, archiveDir string) (*Verification, error) {
+	res := &Verification{
+		Problems: make([]*InspectionProblem, 0),
+	}
+
+	segments, err := StateDirSegments(stateDir, archiveDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var previous uint64
+	for _, segment := range segments {
+		first := true
+		err := ScanSegment(segment.Path, func(line *SegmentLine) error {
+			if line.Err != nil {
+				res.addf(line.Path, line.Number, "corrupt entry after sequence number %d: %s", previous, line.Err.Error())
+				return nil
+			}
+
+			res.Entries++
+			if !line.Checksummed() {
+				res.Unchecksummed++
+			}
+			sequenceNumber := line.Entry.SequenceNumber
+			if first && !segment.Active && sequenceNumber != segment.FirstSequenceNumber {
+				res.addf(line.Path, line.Number, "segment starts at sequence number %d, but is named after %d", sequenceNumber, segment.FirstSequenceNumber)
+			}
+			if res.Entries == 1 {
+				res.FirstSequenceNumber = sequenceNumber
+			} else if sequenceNumber != previous+1 {
+				res.addf(line.Path, line.Number, "sequence number %d follows %d", sequenceNumber, previous)
+			}
+			first = false
+			previous = sequenceNumber
+			res.LastSequenceNumber = sequenceNumber
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	archived, err := ArchivedSnapshots(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range archived {
+		res.Snapshots++
+		sn, err := verifySnapshotFile(snapshot.Path)
+		if err != nil {
+			res.addf(snapshot.Path, 0, "%s", err.Error())
+		} else if sn.SequenceNumber != snapshot.SequenceNumber {
+			res.addf(snapshot.Path, 0, "snapshot is at sequence number %d, but is named after %d", sn.SequenceNumber, snapshot.SequenceNumber)
+		}
+	}
+
+	snapshotPath := filepath.Join(stateDir, "snapshot")
+	if _, err := os.Stat(snapshotPath); err == nil {
+		res.Snapshots++
+		sn, err := verifySnapshotFile(snapshotPath)
+		if err != nil {
+			res.addf(snapshotPath, 0, "%s", err.Error())
+		} else {
+			res.SnapshotSequenceNumber = sn.SequenceNumber
+		}
+	}
+
+	// Entries after the snapshot are needed to restart, the ones before it may have been compacted away
+	if res.Entries > 0 && res.FirstSequenceNumber > res.SnapshotSequenceNumber+1 {
+		res.addf(stateDir, 0, "log starts at sequence number %d, but the snapshot only goes up to %d", res.FirstSequenceNumber, res.SnapshotSequenceNumber)
+	}
+	if res.Entries > 0 && res.LastSequenceNumber < res.SnapshotSequenceNumber {
+		res.addf(stateDir, 0, "log ends at sequence number %d, before the snapshot at %d", res.LastSequenceNumber, res.SnapshotSequenceNumber)
+	}
+
+	return res, nil
+}
+
+// verifySnapshotFile checks that a snapshot decodes, including the state in it
+func verifySnapshotFile(path string) (*Snapshot, error) {
+	var data interface{}
+	return readArchivedSnapshot(path, &data)
+}
@@ -0,0 +1,62 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyStateDir(t *testing.T) {
+	sm, _ := historyStateMachine(t, 2)
+
+	verification, err := VerifyStateDir(sm.Path, sm.ArchiveDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(verification.Problems))
+	assert.Equal(t, 5, verification.Entries)
+	assert.Equal(t, uint64(1), verification.FirstSequenceNumber)
+	assert.Equal(t, uint64(5), verification.LastSequenceNumber)
+	assert.Equal(t, uint64(4), verification.SnapshotSequenceNumber)
+	assert.Equal(t, 3, verification.Snapshots)
+
+	// Without the archive, the log still picks up right after the snapshot
+	verification, err = VerifyStateDir(sm.Path, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(verification.Problems))
+	assert.Equal(t, 1, verification.Entries)
+
+	appendToFile(t, sm.WriteAheadLog.Path, "6 1234abcd eyJUcmFuc2l0aW9uIjp7\n")
+	err = os.Remove(filepath.Join(sm.ArchiveDir, "wal-00000000000000000003"))
+	assert.Nil(t, err)
+
+	verification, err = VerifyStateDir(sm.Path, sm.ArchiveDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(verification.Problems))
+	assert.Equal(t, sm.WriteAheadLog.Path, verification.Problems[0].Path)
+	assert.Equal(t, 1, verification.Problems[0].Line)
+	assert.Equal(t, "sequence number 5 follows 2", verification.Problems[0].Reason)
+	assert.Equal(t, 2, verification.Problems[1].Line)
+	assert.Contains(t, verification.Problems[1].Reason, "corrupt entry after sequence number 5")
+}
+
+func TestScanSegment(t *testing.T) {
+	sm, _ := historyStateMachine(t, 10)
+
+	lines := make([]*SegmentLine, 0)
+	err := ScanSegment(sm.WriteAheadLog.Path, func(line *SegmentLine) error {
+		lines = append(lines, line)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(lines))
+	for i, line := range lines {
+		assert.Nil(t, line.Err)
+		assert.Equal(t, i+1, line.Number)
+		assert.Equal(t, uint64(i+1), line.Entry.SequenceNumber)
+		assert.True(t, line.Checksummed())
+		data, err := line.Data()
+		assert.Nil(t, err)
+		assert.Contains(t, string(data), `"sequence_number":`)
+	}
+}
@@ -0,0 +1,538 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/eagraf/habitat-node/state/paxos"
+	"github.com/rs/zerolog/log"
+)
+
+// A peer that joins a community, or falls behind further than the other peers keep their WAL, catches up by
+// installing another peer's state. The sending peer prepares a transfer of its latest snapshot followed by the
+// WAL entries committed since, and the receiving peer downloads it in chunks. The transfer is identified by
+// the sha256 of its payload, so a download that is interrupted resumes where it left off as long as the sender
+// still serves the same payload, and the whole payload is checked before anything is installed.
+//
+// The payload is the snapshot file on its first line, which is empty if the sender hasn't taken a snapshot yet,
+// followed by one checksummed log line per entry.
+
+// DefaultSnapshotChunkSize is the amount of payload sent per chunk, unless the receiver asks for another size
+const DefaultSnapshotChunkSize = 64 * 1024
+
+// maxSnapshotTransfers is the number of prepared payloads a state machine keeps in memory for peers to download
+const maxSnapshotTransfers = 4
+
+// installDir is the directory in a state dir that a snapshot transfer is downloaded to
+const installDir = "install"
+
+// ErrTransferExpired is returned for chunks of a transfer the sender no longer has. The receiver should start
+// over with a new manifest.
+var ErrTransferExpired = errors.New("snapshot transfer has expired")
+
+// ErrTransferCorrupt is returned when a downloaded chunk or payload doesn't match its checksum
+var ErrTransferCorrupt = errors.New("snapshot transfer is corrupt")
+
+// ErrSnapshotNotChosen is returned when a payload doesn't agree with the transitions consensus chose. The peer
+// that sent it can't be caught up from.
+var ErrSnapshotNotChosen = errors.New("snapshot payload doesn't match the chosen transitions")
+
+// SnapshotManifest describes a prepared snapshot transfer. SnapshotSequenceNumber is the sequence number of the
+// snapshot in the payload, and SequenceNumber the one the receiver is at once the payload is installed.
+type SnapshotManifest struct {
+	TransferID             string               `json:"transfer_id"`
+	CommunityID            entities.CommunityID `json:"community_id"`
+	SnapshotSequenceNumber uint64               `json:"snapshot_sequence_number"`
+	SequenceNumber         uint64               `json:"sequence_number"`
+	Size                   int64                `json:"size"`
+}
+
+// SnapshotChunkRequest asks for the part of a transfer's payload starting at Offset. Length is optional.
+type SnapshotChunkRequest struct {
+	CommunityID entities.CommunityID
+	TransferID  string
+	Offset      int64
+	Length      int
+}
+
+// SnapshotChunk is a part of a transfer's payload, with the crc32c of its data
+type SnapshotChunk struct {
+	TransferID string
+	Offset     int64
+	Data       []byte
+	Checksum   uint32
+}
+
+// SnapshotTransport carries snapshot transfers between peers, like paxos.Transport carries consensus messages
+type SnapshotTransport interface {
+	PrepareSnapshotTransfer(to paxos.NodeID, communityID entities.CommunityID) (*SnapshotManifest, error)
+	SnapshotChunk(to paxos.NodeID, req *SnapshotChunkRequest) (*SnapshotChunk, error)
+}
+
+// snapshotTransfers keeps the most recently prepared payloads, by transfer ID
+type snapshotTransfers struct {
+	payloads map[string][]byte
+	order    []string
+	mutex    *sync.Mutex
+}
+
+func newSnapshotTransfers() *snapshotTransfers {
+	return &snapshotTransfers{
+		payloads: make(map[string][]byte),
+		order:    make([]string, 0),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// add keeps a payload, evicting the oldest one if there are too many
+func (st *snapshotTransfers) add(transferID string, payload []byte) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if _, ok := st.payloads[transferID]; ok {
+		return
+	}
+	if len(st.order) == maxSnapshotTransfers {
+		delete(st.payloads, st.order[0])
+		st.order = st.order[1:]
+	}
+	st.payloads[transferID] = payload
+	st.order = append(st.order, transferID)
+}
+
+func (st *snapshotTransfers) get(transferID string) ([]byte, bool) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	payload, ok := st.payloads[transferID]
+	return payload, ok
+}
+
+// PrepareSnapshotTransfer builds the payload for a peer to catch up from the current state, and returns its
+// manifest. Preparing again without new transitions gives the same transfer.
+func (sm *CommunityStateMachine) PrepareSnapshotTransfer() (*SnapshotManifest, error) {
+	sm.commitMutex.Lock()
+	defer sm.commitMutex.Unlock()
+
+	snapshotData, err := ioutil.ReadFile(filepath.Join(sm.Path, "snapshot"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var snapshotSequenceNumber uint64
+	if len(snapshotData) > 0 {
+		var snapshot Snapshot
+		err = json.Unmarshal(snapshotData, &snapshot)
+		if err != nil {
+			return nil, err
+		}
+		snapshotSequenceNumber = snapshot.SequenceNumber
+	}
+
+	entries, err := entriesFrom(sm.WriteAheadLog, snapshotSequenceNumber+1)
+	if err != nil {
+		return nil, err
+	}
+	if snapshotSequenceNumber+uint64(len(entries)) != sm.CurSequenceNumber {
+		return nil, fmt.Errorf("snapshot at %d and %d log entries don't add up to sequence number %d", snapshotSequenceNumber, len(entries), sm.CurSequenceNumber)
+	}
+
+	payload := append(snapshotData, '\n')
+	for _, entry := range entries {
+		logLine, err := encodeEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		payload = append(payload, logLine...)
+	}
+
+	sum := sha256.Sum256(payload)
+	manifest := &SnapshotManifest{
+		TransferID:             hex.EncodeToString(sum[:]),
+		CommunityID:            sm.CommunityID,
+		SnapshotSequenceNumber: snapshotSequenceNumber,
+		SequenceNumber:         sm.CurSequenceNumber,
+		Size:                   int64(len(payload)),
+	}
+	sm.transfers.add(manifest.TransferID, payload)
+	return manifest, nil
+}
+
+// SnapshotChunk serves part of a prepared transfer's payload
+func (sm *CommunityStateMachine) SnapshotChunk(req *SnapshotChunkRequest) (*SnapshotChunk, error) {
+	payload, ok := sm.transfers.get(req.TransferID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTransferExpired, req.TransferID)
+	}
+	if req.Offset < 0 || req.Offset > int64(len(payload)) {
+		return nil, fmt.Errorf("offset %d is out of range for a payload of %d bytes", req.Offset, len(payload))
+	}
+
+	length := req.Length
+	if length <= 0 {
+		length = DefaultSnapshotChunkSize
+	}
+	end := req.Offset + int64(length)
+	if end > int64(len(payload)) {
+		end = int64(len(payload))
+	}
+
+	data := payload[req.Offset:end]
+	return &SnapshotChunk{
+		TransferID: req.TransferID,
+		Offset:     req.Offset,
+		Data:       data,
+		Checksum:   crc32.Checksum(data, crcTable),
+	}, nil
+}
+
+// CatchUp installs a peer's state if it is ahead of this state machine. The transfer is downloaded into the
+// state dir first, so that if it is interrupted, calling CatchUp again resumes it. Transitions committed during
+// the download are left for consensus to deliver once the peer's state is installed.
+func (sm *CommunityStateMachine) CatchUp(transport SnapshotTransport, peer paxos.NodeID) error {
+	manifest, err := transport.PrepareSnapshotTransfer(peer, sm.CommunityID)
+	if err != nil {
+		return err
+	}
+	if manifest.CommunityID != sm.CommunityID {
+		return fmt.Errorf("peer %s sent a snapshot of community %s, expected %s", peer, manifest.CommunityID, sm.CommunityID)
+	}
+
+	sm.commitMutex.Lock()
+	behind := manifest.SequenceNumber > sm.CurSequenceNumber
+	sm.commitMutex.Unlock()
+	if !behind {
+		return nil
+	}
+
+	payloadPath, err := sm.downloadSnapshot(transport, peer, manifest)
+	if err != nil {
+		return err
+	}
+
+	payload, err := os.Open(payloadPath)
+	if err != nil {
+		return err
+	}
+	err = sm.InstallSnapshot(payload)
+	payload.Close()
+	if errors.Is(err, ErrSnapshotNotChosen) {
+		os.RemoveAll(filepath.Join(sm.Path, installDir))
+		return err
+	} else if err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(sm.Path, installDir))
+}
+
+// downloadSnapshot downloads a transfer's payload, picking up after whatever was downloaded of the same transfer
+// before, and returns the path of the verified payload
+func (sm *CommunityStateMachine) downloadSnapshot(transport SnapshotTransport, peer paxos.NodeID, manifest *SnapshotManifest) (string, error) {
+	dir := filepath.Join(sm.Path, installDir)
+	manifestPath := filepath.Join(dir, "manifest")
+	payloadPath := filepath.Join(dir, "payload")
+
+	// A partial download of another transfer is of no use
+	var previous SnapshotManifest
+	buf, err := ioutil.ReadFile(manifestPath)
+	if err == nil {
+		err = json.Unmarshal(buf, &previous)
+	}
+	if err != nil || previous.TransferID != manifest.TransferID {
+		err = os.RemoveAll(dir)
+		if err != nil {
+			return "", err
+		}
+		err = os.MkdirAll(dir, 0744)
+		if err != nil {
+			return "", err
+		}
+		buf, err = json.Marshal(manifest)
+		if err != nil {
+			return "", err
+		}
+		err = atomicWriteFile(manifestPath, buf)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	file, err := os.OpenFile(payloadPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := info.Size()
+	if offset > manifest.Size {
+		offset = 0
+	}
+	err = file.Truncate(offset)
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	for offset < manifest.Size {
+		chunk, err := transport.SnapshotChunk(peer, &SnapshotChunkRequest{
+			CommunityID: sm.CommunityID,
+			TransferID:  manifest.TransferID,
+			Offset:      offset,
+			Length:      DefaultSnapshotChunkSize,
+		})
+		if err != nil {
+			return "", err
+		}
+		err = verifyChunk(chunk, manifest, offset)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = file.Write(chunk.Data)
+		if err != nil {
+			return "", err
+		}
+		err = file.Sync()
+		if err != nil {
+			return "", err
+		}
+		offset += int64(len(chunk.Data))
+	}
+
+	// Chunks that passed their checksums can still add up to the wrong payload, for example if the download was
+	// resumed on top of a corrupt file. There is nothing to salvage then.
+	err = verifyPayload(payloadPath, manifest.TransferID)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return payloadPath, nil
+}
+
+// verifyChunk checks that a chunk is the expected part of a transfer's payload, and arrived intact
+func verifyChunk(chunk *SnapshotChunk, manifest *SnapshotManifest, offset int64) error {
+	if chunk.TransferID != manifest.TransferID || chunk.Offset != offset {
+		return fmt.Errorf("got chunk at offset %d of transfer %s, expected offset %d of %s", chunk.Offset, chunk.TransferID, offset, manifest.TransferID)
+	}
+	if len(chunk.Data) == 0 || offset+int64(len(chunk.Data)) > manifest.Size {
+		return fmt.Errorf("chunk of %d bytes at offset %d doesn't fit a payload of %d bytes", len(chunk.Data), offset, manifest.Size)
+	}
+	if crc32.Checksum(chunk.Data, crcTable) != chunk.Checksum {
+		return fmt.Errorf("%w: chunk at offset %d failed its checksum", ErrTransferCorrupt, offset)
+	}
+	return nil
+}
+
+// verifyPayload checks that a downloaded payload hashes to its transfer ID
+func verifyPayload(path, transferID string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != transferID {
+		return fmt.Errorf("%w: payload doesn't match transfer %s", ErrTransferCorrupt, transferID)
+	}
+	return nil
+}
+
+// InstallSnapshot replaces the local state with a transfer's payload, which must be ahead of it. Every entry in
+// the payload is checked and applied to the snapshot before anything is persisted, and with consensus, the
+// payload has to end with the transition chosen for its sequence number. The installed entries are appended to
+// the log before the snapshot covering them is written, so a crash at any point leaves a log that replays, and
+// they are published to subscriptions like any other committed transitions.
+func (sm *CommunityStateMachine) InstallSnapshot(payload io.Reader) error {
+	reader := bufio.NewReader(payload)
+	snapshotLine, err := reader.ReadBytes('\n')
+	if err == io.EOF {
+		return errors.New("snapshot payload has no snapshot line")
+	} else if err != nil {
+		return err
+	}
+
+	var community *entities.Community
+	var snapshotData []byte
+	var snapshotSequenceNumber uint64
+	index := NewCommitIndex()
+	if len(snapshotLine) > 1 {
+		snapshotData = snapshotLine[:len(snapshotLine)-1]
+		snapshot, err := ReadSnapshot(bytes.NewReader(snapshotData), &community)
+		if err != nil {
+			return err
+		}
+		snapshotSequenceNumber = snapshot.SequenceNumber
+		index = snapshotIndex(snapshot)
+	}
+
+	sequenceNumber := snapshotSequenceNumber
+	entries := make([]*Entry, 0)
+	scanner := newLogScanner(reader)
+	for scanner.Scan() {
+		entry, err := DecodeLogEntry(scanner.Bytes())
+		if err != nil {
+			return err
+		}
+		if entry.SequenceNumber != sequenceNumber+1 {
+			return fmt.Errorf("sequence number mismatch: %d expected, got %d", sequenceNumber+1, entry.SequenceNumber)
+		}
+		// Unsigned entries are only trusted from our own log
+		if entry.Transition.PredatesSignatures() {
+			return fmt.Errorf("entry %d from a snapshot payload is not signed", entry.SequenceNumber)
+		}
+		community, err = reduceCommunityEntry(community, entry)
+		if err != nil {
+			return err
+		}
+		index.Add(entry.Transition)
+		entries = append(entries, entry)
+		sequenceNumber = entry.SequenceNumber
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if community == nil || community.ID != sm.CommunityID {
+		return fmt.Errorf("snapshot payload doesn't hold the state of community %s", sm.CommunityID)
+	}
+
+	// The peer could send any state, so it has to agree with what consensus chose. Learning the chosen value may
+	// commit it, so this is done before taking commitMutex.
+	if sm.Consensus != nil {
+		err = sm.checkChosen(sequenceNumber, entries, index)
+		if err != nil {
+			return err
+		}
+	}
+
+	sm.commitMutex.Lock()
+	defer sm.commitMutex.Unlock()
+
+	if sequenceNumber <= sm.CurSequenceNumber {
+		return fmt.Errorf("snapshot payload at sequence number %d is not ahead of %d", sequenceNumber, sm.CurSequenceNumber)
+	}
+
+	// The local log may already have some of the entries after the peer's snapshot, which were chosen by the same
+	// consensus, so only the entries past its end are appended and every sequence number stays in the log once
+	missing := entries
+	for len(missing) > 0 && missing[0].SequenceNumber <= sm.CurSequenceNumber {
+		missing = missing[1:]
+	}
+
+	// The peer's snapshot is archived, so that history between it and the installed state can be rebuilt. If it
+	// is past the end of the local log, it becomes the local snapshot first, so that the appended entries follow on
+	// from it.
+	if snapshotData != nil {
+		err = atomicWriteFile(filepath.Join(sm.Path, fmt.Sprintf("%s%020d", snapshotArchivePrefix, snapshotSequenceNumber)), snapshotData)
+		if err != nil {
+			return err
+		}
+		if snapshotSequenceNumber > sm.CurSequenceNumber {
+			err = atomicWriteFile(filepath.Join(sm.Path, "snapshot"), snapshotData)
+			if err != nil {
+				return err
+			}
+			err = compactLog(sm.WriteAheadLog, snapshotSequenceNumber, sm.ArchiveDir)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = sm.WriteAheadLog.appendEntries(missing)
+	if err != nil {
+		return err
+	}
+	err = writeSnapshotFile(sm.Path, sm.SnapshotRetention, community, sequenceNumber, index)
+	if err != nil {
+		return err
+	}
+	err = compactLog(sm.WriteAheadLog, sequenceNumber, sm.ArchiveDir)
+	if err != nil {
+		return err
+	}
+
+	if sm.Consensus != nil {
+		if peersChanged(sm.State, community) {
+			sm.Consensus.Reconfigure(sequenceNumber+1, PeerNodeIDs(community))
+		}
+		sm.Consensus.Forget(sequenceNumber)
+	}
+	if snapshotSequenceNumber > sm.CurSequenceNumber {
+		log.Warn().Msgf("transitions %d to %d of community %s were installed from a snapshot, and aren't published", sm.CurSequenceNumber+1, snapshotSequenceNumber, sm.CommunityID)
+	}
+	sm.State = community
+	sm.CurSequenceNumber = sequenceNumber
+	sm.index = index
+
+	if sm.Subscriptions != nil {
+		for _, entry := range missing {
+			err := sm.Subscriptions.Publish(sm.SourceID(), entry.Transition)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Values chosen while we were behind are either covered by the installed state or can be applied now
+	sm.pendingMutex.Lock()
+	for pending := range sm.pending {
+		if pending <= sequenceNumber {
+			delete(sm.pending, pending)
+		}
+	}
+	sm.pendingMutex.Unlock()
+	return sm.applyPending()
+}
+
+// checkChosen checks that a snapshot payload ends with the transition consensus chose for its sequence number.
+// The transition is identified by its author and nonce, which its signature covers. They are taken from the
+// commit index if the payload has no entries after its snapshot.
+func (sm *CommunityStateMachine) checkChosen(sequenceNumber uint64, entries []*Entry, index *CommitIndex) error {
+	var author, nonce string
+	if len(entries) > 0 {
+		last := entries[len(entries)-1].Transition
+		author, nonce = last.Author, last.Nonce
+	} else if len(index.Nonces) > 0 && index.Nonces[len(index.Nonces)-1].SequenceNumber == sequenceNumber {
+		last := index.Nonces[len(index.Nonces)-1]
+		author, nonce = last.Author, last.Nonce
+	}
+	if nonce == "" {
+		return fmt.Errorf("%w: the transition at sequence number %d has no nonce to check", ErrSnapshotNotChosen, sequenceNumber)
+	}
+
+	value, err := sm.Consensus.Learn(sequenceNumber)
+	if err != nil {
+		return err
+	}
+	var chosen transitions.TransitionWrapper
+	err = json.Unmarshal(value, &chosen)
+	if err != nil {
+		return err
+	}
+	if chosen.SequenceNumber != sequenceNumber || chosen.Author != author || chosen.Nonce != nonce {
+		return fmt.Errorf("%w: payload doesn't end with the transition chosen for sequence number %d", ErrSnapshotNotChosen, sequenceNumber)
+	}
+	return nil
+}
@@ -0,0 +1,381 @@
+package state
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/eagraf/habitat-node/state/paxos"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSnapshotTransport serves transfers from state machines in the same process. Chunks are kept small so
+// that payloads take several of them, and the transport can be made to fail or corrupt chunks.
+type testSnapshotTransport struct {
+	peers     map[paxos.NodeID]*CommunityStateMachine
+	chunkSize int
+	requests  []int64
+
+	// failAfter fails every chunk request after that many have been served, if it is not 0
+	failAfter int
+	// corrupt is applied to every chunk before it is returned, if it is set
+	corrupt func(*SnapshotChunk)
+}
+
+func (tt *testSnapshotTransport) PrepareSnapshotTransfer(to paxos.NodeID, communityID entities.CommunityID) (*SnapshotManifest, error) {
+	return tt.peers[to].PrepareSnapshotTransfer()
+}
+
+func (tt *testSnapshotTransport) SnapshotChunk(to paxos.NodeID, req *SnapshotChunkRequest) (*SnapshotChunk, error) {
+	if tt.failAfter != 0 && len(tt.requests) >= tt.failAfter {
+		return nil, fmt.Errorf("peer %s is unreachable", to)
+	}
+	tt.requests = append(tt.requests, req.Offset)
+
+	req.Length = tt.chunkSize
+	chunk, err := tt.peers[to].SnapshotChunk(req)
+	if err != nil {
+		return nil, err
+	}
+	if tt.corrupt != nil {
+		chunk.Data = append([]byte{}, chunk.Data...)
+		tt.corrupt(chunk)
+	}
+	return chunk, nil
+}
+
+// initSnapshotSender starts a state machine with an initialized community that has been renamed a few times,
+// with a snapshot at 4 and entries after it
+func initSnapshotSender(t *testing.T) (*CommunityStateMachine, *entities.Peer) {
+	community, peer, key := testCommunity()
+	sm, err := InitCommunityStateMachine(community.ID, t.TempDir(), 4)
+	assert.Nil(t, err)
+
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.InitCommunityTransitionType,
+		Transition:     transitions.InitCommunityTransition{Community: community},
+		SequenceNumber: 1,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+	for i := uint64(2); i <= 6; i++ {
+		err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+			Type:           transitions.RenameCommunityTransitionType,
+			Transition:     transitions.RenameCommunityTransition{CommID: community.ID, Name: fmt.Sprintf("Name %d", i)},
+			SequenceNumber: i,
+		}, peer.Key, key))
+		assert.Nil(t, err)
+	}
+	return sm, peer
+}
+
+func TestCatchUp(t *testing.T) {
+	sender, peer := initSnapshotSender(t)
+	defer sender.Close()
+	transport := &testSnapshotTransport{
+		peers:     map[paxos.NodeID]*CommunityStateMachine{paxos.NodeID(peer.Key): sender},
+		chunkSize: 256,
+	}
+
+	manifest, err := sender.PrepareSnapshotTransfer()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), manifest.SnapshotSequenceNumber)
+	assert.Equal(t, uint64(6), manifest.SequenceNumber)
+	again, err := sender.PrepareSnapshotTransfer()
+	assert.Nil(t, err)
+	assert.Equal(t, manifest, again)
+
+	stateDir := t.TempDir()
+	sm, err := InitCommunityStateMachine(sender.CommunityID, stateDir, 4)
+	assert.Nil(t, err)
+	err = sm.Restart()
+	assert.Nil(t, err)
+
+	err = sm.CatchUp(transport, paxos.NodeID(peer.Key))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6), sm.CurSequenceNumber)
+	assert.Equal(t, sender.State, sm.State)
+	assert.True(t, len(transport.requests) > 1)
+	_, err = os.Stat(filepath.Join(sm.Path, installDir))
+	assert.True(t, os.IsNotExist(err))
+
+	// Catching up with a peer that isn't ahead does nothing
+	transport.requests = nil
+	err = sm.CatchUp(transport, paxos.NodeID(peer.Key))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(transport.requests))
+
+	// The installed state survives a restart, and the log carries on after it
+	assert.Nil(t, sm.Close())
+	sm, err = InitCommunityStateMachine(sender.CommunityID, stateDir, 4)
+	assert.Nil(t, err)
+	defer sm.Close()
+	err = sm.Restart()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6), sm.CurSequenceNumber)
+	assert.Equal(t, "Name 6", sm.State.Name)
+
+	_, key := testPeer(0)
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.RenameCommunityTransitionType,
+		Transition:     transitions.RenameCommunityTransition{CommID: sm.CommunityID, Name: "Name 7"},
+		SequenceNumber: 7,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+
+	// The entries after the peer's snapshot were installed along with it
+	entries, err := sm.TransitionsBetween(4, 7)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(entries))
+	state, err := sm.StateAt(5)
+	assert.Nil(t, err)
+	assert.Equal(t, "Name 5", state.Name)
+}
+
+func TestCatchUpResume(t *testing.T) {
+	sender, peer := initSnapshotSender(t)
+	defer sender.Close()
+	transport := &testSnapshotTransport{
+		peers:     map[paxos.NodeID]*CommunityStateMachine{paxos.NodeID(peer.Key): sender},
+		chunkSize: 256,
+		failAfter: 2,
+	}
+
+	sm, err := InitCommunityStateMachine(sender.CommunityID, t.TempDir(), 4)
+	assert.Nil(t, err)
+	defer sm.Close()
+
+	err = sm.CatchUp(transport, paxos.NodeID(peer.Key))
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(0), sm.CurSequenceNumber)
+	info, err := os.Stat(filepath.Join(sm.Path, installDir, "payload"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(512), info.Size())
+
+	// The download picks up where it left off
+	transport.failAfter = 0
+	transport.requests = nil
+	err = sm.CatchUp(transport, paxos.NodeID(peer.Key))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(512), transport.requests[0])
+	assert.Equal(t, sender.State, sm.State)
+}
+
+func TestCatchUpCorrupt(t *testing.T) {
+	sender, peer := initSnapshotSender(t)
+	defer sender.Close()
+	transport := &testSnapshotTransport{
+		peers:     map[paxos.NodeID]*CommunityStateMachine{paxos.NodeID(peer.Key): sender},
+		chunkSize: 256,
+	}
+
+	sm, err := InitCommunityStateMachine(sender.CommunityID, t.TempDir(), 4)
+	assert.Nil(t, err)
+	defer sm.Close()
+
+	// A chunk that was damaged on the way fails its checksum
+	transport.corrupt = func(chunk *SnapshotChunk) {
+		chunk.Data[0] ^= 0xff
+	}
+	err = sm.CatchUp(transport, paxos.NodeID(peer.Key))
+	assert.True(t, errors.Is(err, ErrTransferCorrupt))
+
+	// Chunks that pass their checksums still have to add up to the payload, or the download is thrown away
+	transport.corrupt = func(chunk *SnapshotChunk) {
+		chunk.Data[0] ^= 0xff
+		chunk.Checksum = crc32.Checksum(chunk.Data, crcTable)
+	}
+	err = sm.CatchUp(transport, paxos.NodeID(peer.Key))
+	assert.True(t, errors.Is(err, ErrTransferCorrupt))
+	_, err = os.Stat(filepath.Join(sm.Path, installDir))
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, sm.State)
+
+	transport.corrupt = nil
+	err = sm.CatchUp(transport, paxos.NodeID(peer.Key))
+	assert.Nil(t, err)
+	assert.Equal(t, sender.State, sm.State)
+
+	// Transfers the sender no longer has can't be downloaded
+	_, err = sender.SnapshotChunk(&SnapshotChunkRequest{CommunityID: sender.CommunityID, TransferID: "missing"})
+	assert.True(t, errors.Is(err, ErrTransferExpired))
+}
+
+func TestInstallSnapshot(t *testing.T) {
+	sender, _ := initSnapshotSender(t)
+	defer sender.Close()
+	manifest, err := sender.PrepareSnapshotTransfer()
+	assert.Nil(t, err)
+	payload, _ := sender.transfers.get(manifest.TransferID)
+
+	// Only the state of the state machine's own community can be installed
+	other, err := InitCommunityStateMachine("community_1", t.TempDir(), 4)
+	assert.Nil(t, err)
+	defer other.Close()
+	err = other.InstallSnapshot(bytes.NewReader(payload))
+	assert.NotNil(t, err)
+
+	sm, err := InitCommunityStateMachine(sender.CommunityID, t.TempDir(), 4)
+	assert.Nil(t, err)
+	defer sm.Close()
+	registry := NewSubscriptionRegistry()
+	sm.Subscriptions = registry
+	subscriber := &recordingSubscriber{mutex: &sync.Mutex{}}
+	sub, err := registry.Subscribe("installer", transitions.CommunityCategory, subscriber, nil)
+	assert.Nil(t, err)
+
+	// Entries are checked before anything is persisted
+	tampered := bytes.Replace(payload, []byte("\n6 "), []byte("\n7 "), 1)
+	err = sm.InstallSnapshot(bytes.NewReader(tampered))
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(0), sm.CurSequenceNumber)
+	_, err = os.Stat(filepath.Join(sm.Path, "snapshot"))
+	assert.True(t, os.IsNotExist(err))
+
+	err = sm.InstallSnapshot(bytes.NewReader(payload))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6), sm.CurSequenceNumber)
+
+	// The entries after the peer's snapshot are published, the transitions it covers can't be
+	assert.Eventually(t, func() bool {
+		return sub.LastDelivered(string(sm.CommunityID)) == 6
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 2, subscriber.count())
+
+	// Installing the same state again would go backwards
+	err = sm.InstallSnapshot(bytes.NewReader(payload))
+	assert.NotNil(t, err)
+
+	archived, err := ArchivedSnapshots(sm.Path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(archived))
+	snapshot, err := ioutil.ReadFile(archived[0].Path)
+	assert.Nil(t, err)
+	assert.True(t, bytes.HasPrefix(payload, snapshot))
+}
+
+func TestInstallSnapshotOverlappingLog(t *testing.T) {
+	sender, peer := initSnapshotSender(t)
+	defer sender.Close()
+	manifest, err := sender.PrepareSnapshotTransfer()
+	assert.Nil(t, err)
+	payload, _ := sender.transfers.get(manifest.TransferID)
+	assert.Equal(t, uint64(4), manifest.SnapshotSequenceNumber)
+
+	// The local log already goes past the peer's snapshot, up to 5
+	community, _, key := testCommunity()
+	sm, err := InitCommunityStateMachine(sender.CommunityID, t.TempDir(), 10)
+	assert.Nil(t, err)
+	defer sm.Close()
+	sm.ArchiveDir = t.TempDir()
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.InitCommunityTransitionType,
+		Transition:     transitions.InitCommunityTransition{Community: community},
+		SequenceNumber: 1,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+	for i := uint64(2); i <= 5; i++ {
+		err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+			Type:           transitions.RenameCommunityTransitionType,
+			Transition:     transitions.RenameCommunityTransition{CommID: community.ID, Name: fmt.Sprintf("Name %d", i)},
+			SequenceNumber: i,
+		}, peer.Key, key))
+		assert.Nil(t, err)
+	}
+
+	registry := NewSubscriptionRegistry()
+	sm.Subscriptions = registry
+	subscriber := &recordingSubscriber{mutex: &sync.Mutex{}}
+	sub, err := registry.Subscribe("installer", transitions.CommunityCategory, subscriber, nil)
+	assert.Nil(t, err)
+
+	err = sm.InstallSnapshot(bytes.NewReader(payload))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6), sm.CurSequenceNumber)
+	assert.Equal(t, "Name 6", sm.State.Name)
+
+	// Only the entry the local log didn't have is published
+	assert.Eventually(t, func() bool {
+		return sub.LastDelivered(string(sm.CommunityID)) == 6
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 1, subscriber.count())
+
+	// Every sequence number is in the log once, either in the archive or in the active segment
+	verification, err := VerifyStateDir(sm.Path, sm.ArchiveDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(verification.Problems))
+	assert.Equal(t, 6, verification.Entries)
+	entries, err := sm.TransitionsBetween(0, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(entries))
+	for i, entry := range entries {
+		assert.Equal(t, uint64(i+1), entry.SequenceNumber)
+	}
+}
+
+func TestInstallSnapshotChecksChosen(t *testing.T) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	keys := make([]ed25519.PrivateKey, 3)
+	for i := 0; i < 3; i++ {
+		peer, key := testPeer(i)
+		community.Peers = append(community.Peers, peer)
+		keys[i] = key
+	}
+	replicas, transport := initReplicas(t, community)
+	author, key := community.Peers[0].Key, keys[0]
+
+	// The last replica misses everything
+	behind := replicas[2]
+	id := paxos.NodeID(community.Peers[2].Key)
+	transport.Disconnect(id)
+	_, err := replicas[0].Propose(signed(t, &transitions.TransitionWrapper{
+		Type:       transitions.InitCommunityTransitionType,
+		Transition: transitions.InitCommunityTransition{Community: community},
+	}, author, key))
+	assert.Nil(t, err)
+	_, err = replicas[0].Propose(signed(t, &transitions.TransitionWrapper{
+		Type:       transitions.RenameCommunityTransitionType,
+		Transition: transitions.RenameCommunityTransition{CommID: community.ID, Name: "Renamed"},
+	}, author, key))
+	assert.Nil(t, err)
+	transport.Reconnect(id)
+
+	// A peer can sign a rename that was never chosen, and send it along with the real history
+	entries, err := replicas[0].EntriesFrom(1)
+	assert.Nil(t, err)
+	forged := &Entry{
+		SequenceNumber: 2,
+		Transition: signed(t, &transitions.TransitionWrapper{
+			Type:           transitions.RenameCommunityTransitionType,
+			Transition:     transitions.RenameCommunityTransition{CommID: community.ID, Name: "Forged"},
+			SequenceNumber: 2,
+		}, author, key),
+	}
+	payload := "\n"
+	for _, entry := range []*Entry{entries[0], forged} {
+		logLine, err := encodeEntry(entry)
+		assert.Nil(t, err)
+		payload += logLine
+	}
+	err = behind.InstallSnapshot(bytes.NewReader([]byte(payload)))
+	assert.True(t, errors.Is(err, ErrSnapshotNotChosen))
+	assert.Equal(t, uint64(0), behind.CurSequenceNumber)
+
+	// The real history is installed
+	manifest, err := replicas[0].PrepareSnapshotTransfer()
+	assert.Nil(t, err)
+	honest, _ := replicas[0].transfers.get(manifest.TransferID)
+	err = behind.InstallSnapshot(bytes.NewReader(honest))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), behind.CurSequenceNumber)
+	assert.Equal(t, "Renamed", behind.State.Name)
+}
@@ -0,0 +1,105 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// A state dir can only be used by one state machine at a time, otherwise their WAL lines would be interleaved.
+// The state machine holds an advisory flock on the LOCK file in its state dir, which also records its PID so that
+// whoever is locked out knows which process to look at. The lock is released by the kernel if the process dies,
+// so a LOCK file left behind by a crash doesn't need to be cleaned up. Locking is platform specific, see
+// lock_unix.go, and on platforms without flock state dirs aren't locked.
+
+const lockFileName = "LOCK"
+
+// StateDirLockedError is returned when another state machine is using a state dir. PID is 0 if the process
+// holding the lock couldn't be determined.
+type StateDirLockedError struct {
+	Path string
+	PID  int
+}
+
+func (se *StateDirLockedError) Error() string {
+	if se.PID == 0 {
+		return fmt.Sprintf("state dir %s is locked by another process", se.Path)
+	}
+	return fmt.Sprintf("state dir %s is locked by process %d", se.Path, se.PID)
+}
+
+// errLockHeld is returned by lockFile when another process holds the lock
+var errLockHeld = errors.New("lock is held by another process")
+
+// dirLock is an exclusive lock on a state dir
+type dirLock struct {
+	file *os.File
+}
+
+// lockStateDir takes the lock on a state dir, without waiting for another process to release it
+func lockStateDir(stateDir string) (*dirLock, error) {
+	file, err := os.OpenFile(filepath.Join(stateDir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(file)
+	if err == errLockHeld {
+		pid := readLockPID(file)
+		file.Close()
+		return nil, &StateDirLockedError{
+			Path: stateDir,
+			PID:  pid,
+		}
+	} else if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// The PID is only informational, so the lock is kept even if it can't be written
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		log.Warn().Msgf("failed to record PID in %s: %s", file.Name(), err.Error())
+	}
+
+	return &dirLock{
+		file: file,
+	}, nil
+}
+
+// readLockPID reads the PID recorded by the process holding the lock
+func readLockPID(file *os.File) int {
+	buf, err := ioutil.ReadAll(file)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// release gives up the lock. The LOCK file is left in place, since removing it could race with another process
+// that has just opened it.
+func (dl *dirLock) release() error {
+	if dl == nil || dl.file == nil {
+		return nil
+	}
+	err := unlockFile(dl.file)
+	closeErr := dl.file.Close()
+	dl.file = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
@@ -0,0 +1,41 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateDirLock(t *testing.T) {
+	stateBaseDir := t.TempDir()
+	sm, err := InitCommunityStateMachine("community_0", stateBaseDir, 10)
+	assert.Nil(t, err)
+
+	// A second state machine is locked out, and told who holds the lock
+	_, err = InitCommunityStateMachine("community_0", stateBaseDir, 10)
+	var lockedErr *StateDirLockedError
+	assert.True(t, errors.As(err, &lockedErr))
+	assert.Equal(t, sm.Path, lockedErr.Path)
+	assert.Equal(t, os.Getpid(), lockedErr.PID)
+
+	// Other communities and the host have their own locks
+	other, err := InitCommunityStateMachine("community_1", stateBaseDir, 10)
+	assert.Nil(t, err)
+	host, err := InitHostStateMachine(stateBaseDir, 10)
+	assert.Nil(t, err)
+	_, err = InitHostStateMachine(stateBaseDir, 10)
+	assert.True(t, errors.As(err, &lockedErr))
+
+	err = sm.Close()
+	assert.Nil(t, err)
+	reopened, err := InitCommunityStateMachine("community_0", stateBaseDir, 10)
+	assert.Nil(t, err)
+	err = reopened.Restart()
+	assert.Nil(t, err)
+
+	for _, closer := range []interface{ Close() error }{reopened, other, host} {
+		assert.Nil(t, closer.Close())
+	}
+}
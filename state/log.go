@@ -4,31 +4,45 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/eagraf/habitat-node/entities"
 	"github.com/eagraf/habitat-node/entities/transitions"
 )
 
 // The log is a sequence of serialized base64 encoded JSON objects, with each line being one object
 // There is no top level JSON object wrapping it, making it easy to append without scanning all of the data
+// Each line is "<sequence number> <crc32c> <base64 entry>", where the checksum covers the sequence number and
+// the encoded entry. Lines written before checksums were added only have the sequence number and entry.
 
-type LogCollection struct {
-	CommunityLogs map[entities.CommunityID]*Log
-	NodeLog       *Log
-}
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
 
 type Log struct {
 	Path string
+	// GroupCommit coalesces concurrent WriteAhead calls into a single write and fsync. It should be set before the
+	// log is written to. State machines serialize their writes, and coalesce the transitions chosen while a write
+	// is in progress themselves, so it only helps writers that append to the log directly from several goroutines.
+	GroupCommit bool
 
 	logWriter io.Writer
 	mutex     *sync.Mutex
+
+	// batchMutex guards the batch that WriteAhead calls are currently joining in group commit mode
+	batchMutex sync.Mutex
+	batch      *commitBatch
+}
+
+// commitBatch is a group of log lines that are written and synced together. The first caller to join a batch
+// writes it, and the others wait for it to be done.
+type commitBatch struct {
+	lines []byte
+	done  chan struct{}
+	err   error
 }
 
 type Entry struct {
@@ -52,32 +66,35 @@ func NewLog(path string) (*Log, error) {
 	}, nil
 }
 
-// WriteAhead appends to the log file. This method should be called before anything else is done to process state
-func (l *Log) WriteAhead(transition *transitions.TransitionWrapper) error {
+// WriteAhead appends transitions to the log file in a single write. This method should be called before anything
+// else is done to process state
+func (l *Log) WriteAhead(batch ...*transitions.TransitionWrapper) error {
+	committed := time.Now()
+	lines := &strings.Builder{}
+	for _, transition := range batch {
+		// Wrap transition in log entry
+		entry := &Entry{
+			Transition:     transition,
+			SequenceNumber: transition.SequenceNumber,
+			Committed:      committed,
+		}
 
-	// Wrap transition in log entry
-	entry := &Entry{
-		Transition:     transition,
-		SequenceNumber: transition.SequenceNumber,
-		Committed:      time.Now(),
+		logLine, err := encodeEntry(entry)
+		if err != nil {
+			return err
+		}
+		lines.WriteString(logLine)
 	}
 
-	// Marshal JSON
-	buf, err := json.Marshal(entry)
-	if err != nil {
-		return err
+	if l.GroupCommit {
+		return l.groupCommit(lines.String())
 	}
 
-	// Base64 encode
-	encoding := base64.StdEncoding.EncodeToString(buf)
-
-	logLine := fmt.Sprintf("%d %s\n", entry.SequenceNumber, encoding)
-
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
 	// Append to log file
-	_, err = l.logWriter.Write([]byte(logLine))
+	_, err := l.logWriter.Write([]byte(lines.String()))
 	if err != nil {
 		return err
 	}
@@ -85,37 +102,131 @@ func (l *Log) WriteAhead(transition *transitions.TransitionWrapper) error {
 	return nil
 }
 
-func (l *Log) GetEntries() ([]*Entry, error) {
+// appendEntries appends entries that were committed elsewhere, such as on the peer a snapshot was installed
+// from, in a single write. Their commit times are kept.
+func (l *Log) appendEntries(entries []*Entry) error {
+	lines := &strings.Builder{}
+	for _, entry := range entries {
+		logLine, err := encodeEntry(entry)
+		if err != nil {
+			return err
+		}
+		lines.WriteString(logLine)
+	}
+
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	bytes, err := ioutil.ReadFile(l.Path)
+	_, err := l.logWriter.Write([]byte(lines.String()))
+	return err
+}
+
+// groupCommit adds log lines to the open batch, and returns once the batch has been written and synced. The
+// caller that opens a batch writes it as soon as the previous batch is done, and every caller that arrives while
+// it waits for its turn is written along with it.
+func (l *Log) groupCommit(logLines string) error {
+	l.batchMutex.Lock()
+	batch := l.batch
+	leader := batch == nil
+	if leader {
+		batch = &commitBatch{
+			done: make(chan struct{}),
+		}
+		l.batch = batch
+	}
+	batch.lines = append(batch.lines, logLines...)
+	l.batchMutex.Unlock()
+
+	if !leader {
+		<-batch.done
+		return batch.err
+	}
+
+	l.mutex.Lock()
+	// Close the batch, callers from here on start the next one
+	l.batchMutex.Lock()
+	l.batch = nil
+	l.batchMutex.Unlock()
+
+	_, batch.err = l.logWriter.Write(batch.lines)
+	l.mutex.Unlock()
+
+	close(batch.done)
+	return batch.err
+}
+
+// Close closes the active segment. The log can't be written to afterwards.
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if closer, ok := l.logWriter.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// GetEntries reads every entry in the log into memory. Prefer Iterator for large logs.
+func (l *Log) GetEntries() ([]*Entry, error) {
+	it, err := l.Iterator(0)
 	if err != nil {
 		return nil, err
 	}
-
-	encodedEntries := strings.Split(string(bytes), "\n")
-	res := make([]*Entry, len(encodedEntries))
-	for i, encodedEntry := range encodedEntries {
-		entry, err := DecodeLogEntry([]byte(encodedEntry))
-		if err != nil {
+	defer it.Close()
+
+	res := make([]*Entry, 0)
+	for {
+		entry, err := it.Next()
+		if err == io.EOF {
+			return res, nil
+		} else if err != nil {
 			return nil, err
 		}
-		res[i] = entry
+		res = append(res, entry)
 	}
-
-	return res, nil
 }
 
 // Helper functions for dealing with the WAL
 
+// encodeEntry marshals an entry and base64 encodes it into a log line
+func encodeEntry(entry *Entry) (string, error) {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	return encodeLogLine(entry.SequenceNumber, base64.StdEncoding.EncodeToString(buf)), nil
+}
+
+func encodeLogLine(sequenceNumber uint64, encoding string) string {
+	sequenceString := strconv.FormatUint(sequenceNumber, 10)
+	return fmt.Sprintf("%s %08x %s\n", sequenceString, logLineChecksum(sequenceString, encoding), encoding)
+}
+
+func logLineChecksum(sequenceString, encoding string) uint32 {
+	return crc32.Checksum([]byte(sequenceString+" "+encoding), crcTable)
+}
+
 func DecodeLogEntry(entry []byte) (*Entry, error) {
 	parts := strings.Split(string(entry), " ")
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("there should be 2 parts in log line, got %d instead", len(parts))
+
+	var encoding string
+	switch len(parts) {
+	case 2:
+		encoding = parts[1]
+	case 3:
+		encoding = parts[2]
+		checksum, err := strconv.ParseUint(parts[1], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed checksum: %s", err.Error())
+		}
+		if uint32(checksum) != logLineChecksum(parts[0], encoding) {
+			return nil, ErrChecksumMismatch
+		}
+	default:
+		return nil, fmt.Errorf("there should be 2 or 3 parts in log line, got %d instead", len(parts))
 	}
 
-	decoded, err := base64.StdEncoding.DecodeString(parts[1])
+	decoded, err := base64.StdEncoding.DecodeString(encoding)
 	if err != nil {
 		return nil, err
 	}
@@ -157,9 +268,14 @@ func (ww *WALWriter) Write(buf []byte) (int, error) {
 	return n, nil
 }
 
+// Close closes the underlying log file
+func (ww *WALWriter) Close() error {
+	return ww.logFile.Close()
+}
+
 func NewWALWriter(path string) (*WALWriter, error) {
-	// The WAL is kept as a persistently open append and write only file
-	// TODO look into getting a system level lock on this file
+	// The WAL is kept as a persistently open append and write only file. Only one process writes to it at a time,
+	// since state machines lock their state dir.
 	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return nil, err
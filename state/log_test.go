@@ -2,9 +2,14 @@ package state
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/eagraf/habitat-node/entities"
 	"github.com/eagraf/habitat-node/entities/transitions"
@@ -75,3 +80,118 @@ func TestWriteAhead(t *testing.T) {
 		}
 	}
 }
+
+// syncingWriter stands in for a WALWriter, taking a while to sync every write
+type syncingWriter struct {
+	buf    bytes.Buffer
+	writes int
+	err    error
+}
+
+func (sw *syncingWriter) Write(buf []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	sw.writes++
+	return sw.buf.Write(buf)
+}
+
+func communityTransition(sequenceNumber uint64) *transitions.TransitionWrapper {
+	return &transitions.TransitionWrapper{
+		Type: transitions.AddCommunityTransitionType,
+		Transition: transitions.AddCommunityTransition{
+			Community: entities.InitCommunity(entities.CommunityID(fmt.Sprintf("community_%d", sequenceNumber)), "My Community", entities.IPFS),
+		},
+		SequenceNumber: sequenceNumber,
+	}
+}
+
+func writeConcurrently(log *Log, n int) []error {
+	errs := make([]error, n)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = log.WriteAhead(communityTransition(uint64(i + 1)))
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestGroupCommit(t *testing.T) {
+	writer := &syncingWriter{}
+	log := &Log{
+		GroupCommit: true,
+		logWriter:   writer,
+		mutex:       &sync.Mutex{},
+	}
+
+	for _, err := range writeConcurrently(log, 50) {
+		assert.Nil(t, err)
+	}
+
+	// Every entry is written exactly once, in far fewer writes
+	seen := make(map[uint64]bool)
+	for _, line := range strings.Split(strings.TrimSuffix(writer.buf.String(), "\n"), "\n") {
+		entry, err := DecodeLogEntry([]byte(line))
+		assert.Nil(t, err)
+		assert.False(t, seen[entry.SequenceNumber])
+		seen[entry.SequenceNumber] = true
+	}
+	assert.Equal(t, 50, len(seen))
+	assert.Less(t, writer.writes, 50)
+
+	// A single writer still gets its own batch
+	err := log.WriteAhead(communityTransition(51))
+	assert.Nil(t, err)
+	assert.Equal(t, 51, strings.Count(writer.buf.String(), "\n"))
+}
+
+func TestGroupCommitError(t *testing.T) {
+	writer := &syncingWriter{err: errors.New("disk full")}
+	log := &Log{
+		GroupCommit: true,
+		logWriter:   writer,
+		mutex:       &sync.Mutex{},
+	}
+
+	// Every caller in a failed batch gets the error
+	for _, err := range writeConcurrently(log, 10) {
+		assert.Equal(t, writer.err, err)
+	}
+	assert.Equal(t, 0, writer.buf.Len())
+}
+
+// benchmarkWriteAhead appends to a real WAL file from concurrent writers, so every write is fsynced
+func benchmarkWriteAhead(b *testing.B, groupCommit bool) {
+	log, err := NewLog(filepath.Join(b.TempDir(), "wal"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	log.GroupCommit = groupCommit
+
+	var sequenceNumber uint64
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			err := log.WriteAhead(communityTransition(atomic.AddUint64(&sequenceNumber, 1)))
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkWriteAhead(b *testing.B) {
+	b.Run("fsync per entry", func(b *testing.B) {
+		benchmarkWriteAhead(b, false)
+	})
+	b.Run("group commit", func(b *testing.B) {
+		benchmarkWriteAhead(b, true)
+	})
+}
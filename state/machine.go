@@ -1,13 +1,17 @@
 package state
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/eagraf/habitat-node/entities"
 	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/eagraf/habitat-node/state/paxos"
 	"github.com/rs/zerolog/log"
 )
 
@@ -15,6 +19,7 @@ type StateMachine interface {
 	Restart() error
 	Apply(transition *transitions.TransitionWrapper) error
 	GetState() interface{}
+	Close() error
 	// TODO snapshot
 }
 
@@ -25,97 +30,157 @@ type CommunityStateMachine struct {
 	State             *entities.Community
 	Path              string
 	SnapshotInterval  int
-}
+	SnapshotRetention SnapshotRetentionPolicy
+	// ArchiveDir is where WAL segments covered by a snapshot are moved. If empty, they are deleted.
+	ArchiveDir string
 
-type HostStateMachine struct {
-}
+	// Consensus is optional, if it is not set transitions can only be applied locally
+	Consensus Consensus
+	// Subscriptions is optional, if it is set every applied transition is published to it
+	Subscriptions *SubscriptionRegistry
+	// Signer is optional, without it the state machine can't compensate transitions
+	Signer *Signer
 
-// InitCommunityStateMachine gets ready for a restart or for a clean start
-func InitCommunityStateMachine(communityID entities.CommunityID, stateBaseDir string, snapshotInterval int) (*CommunityStateMachine, error) {
-	stateDir := filepath.Join(stateBaseDir, string(communityID))
+	// pending holds chosen values that haven't been applied yet, and is guarded by pendingMutex, which is taken
+	// after commitMutex when both are held
+	pending      map[uint64][]byte
+	pendingMutex *sync.Mutex
+	index        *CommitIndex
+	commitMutex  *sync.Mutex
+	lock         *dirLock
+	transfers    *snapshotTransfers
+}
 
+// initStateDir creates the directory for a state machine if it does not exist yet
+func initStateDir(stateDir string) error {
 	// Check if state machine dir exists
 	_, err := os.Stat(stateDir)
 	if err != nil && !os.IsNotExist(err) {
-		return nil, err
+		return err
 	}
 
 	// Start new state machine dir
 	if os.IsNotExist(err) {
 		err := os.MkdirAll(stateDir, 0744)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
+	return nil
+}
+
+// InitCommunityStateMachine gets ready for a restart or for a clean start
+func InitCommunityStateMachine(communityID entities.CommunityID, stateBaseDir string, snapshotInterval int) (*CommunityStateMachine, error) {
+	stateDir := filepath.Join(stateBaseDir, string(communityID))
+	err := initStateDir(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing else may touch the state dir until the state machine is closed
+	lock, err := lockStateDir(stateDir)
+	if err != nil {
+		return nil, err
+	}
 
 	// Initialize log
 	log, err := NewLog(filepath.Join(stateDir, "wal"))
 	if err != nil {
+		lock.release()
 		return nil, err
 	}
 
 	// The state variable is not reconstituted just yet
 	return &CommunityStateMachine{
-		CommunityID:      communityID,
-		WriteAheadLog:    log,
-		Path:             stateDir,
-		SnapshotInterval: snapshotInterval,
+		CommunityID:       communityID,
+		WriteAheadLog:     log,
+		Path:              stateDir,
+		SnapshotInterval:  snapshotInterval,
+		SnapshotRetention: DefaultSnapshotRetention,
+		ArchiveDir:        filepath.Join(stateDir, "archive"),
+
+		pending:      make(map[uint64][]byte),
+		pendingMutex: &sync.Mutex{},
+		index:        NewCommitIndex(),
+		commitMutex:  &sync.Mutex{},
+		lock:         lock,
+		transfers:    newSnapshotTransfers(),
 	}, nil
 }
 
-func (sm *CommunityStateMachine) Restart() error {
-	// Reconstitute state from snapshot
-	snapshotFile, err := os.OpenFile(filepath.Join(sm.Path, "snapshot"), os.O_RDONLY, 0644)
-	if err != nil && !os.IsNotExist(err) {
+// Close closes the log and releases the lock on the state dir, so that another state machine can use it
+func (sm *CommunityStateMachine) Close() error {
+	err := sm.WriteAheadLog.Close()
+	lockErr := sm.lock.release()
+	if err != nil {
 		return err
 	}
-	defer snapshotFile.Close()
-
-	var snapshotState entities.Community
-	var snapshot *Snapshot
-	if !os.IsNotExist(err) {
-		s, err := ReadSnapshot(snapshotFile, &snapshotState)
-		if err != nil {
-			return err
-		}
-		snapshot = s
-	}
+	return lockErr
+}
 
-	// Roll up logs with sequence number higher than snapshot
-	entries, err := sm.WriteAheadLog.GetEntries()
+func (sm *CommunityStateMachine) Restart() error {
+	// Clean up after a crash in the middle of writing to the log
+	err := sm.WriteAheadLog.Recover()
 	if err != nil {
 		return err
 	}
 
-	// Validate that sequence numbers match
-	expectedSequenceNumber := snapshot.SequenceNumber + uint64(len(entries))
-	actualSequenceNumber := entries[len(entries)-1].SequenceNumber
-	if expectedSequenceNumber != actualSequenceNumber {
-		return fmt.Errorf("sequence number mismatch: %d expected, got %d", expectedSequenceNumber, actualSequenceNumber)
+	// Reconstitute state from snapshot
+	var snapshotState *entities.Community
+	snapshot, err := readSnapshotFile(sm.Path, &snapshotState)
+	if err != nil {
+		return err
 	}
 
-	intermediateState := &snapshotState
-	for _, entry := range entries {
-		transition, ok := entry.Transition.Transition.(transitions.CommunityTransition)
-		if !ok {
-			return errors.New("transition in log entry was not a CommunityTransition")
-		}
-		tempState, err := transition.Reduce(intermediateState)
+	// Roll up logs with sequence number higher than snapshot
+	intermediateState := snapshotState
+	index := snapshotIndex(snapshot)
+	sequenceNumber, err := replayLog(sm.WriteAheadLog, snapshot, func(entry *Entry) error {
+		tempState, err := reduceCommunityEntry(intermediateState, entry)
 		if err != nil {
 			return err
 		}
 		intermediateState = tempState
+		index.Add(entry.Transition)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	sm.State = intermediateState
-	sm.CurSequenceNumber = actualSequenceNumber
+	sm.CurSequenceNumber = sequenceNumber
+	sm.index = index
+
+	if sm.Consensus != nil {
+		// Quorums are computed from the committed peer set, which may have changed since consensus was set up
+		if sm.State != nil {
+			sm.Consensus.Reconfigure(sm.CurSequenceNumber+1, PeerNodeIDs(sm.State))
+		}
 
-	// TODO restart consensus algorithm
+		// Learn the transitions committed by the other peers while we were down. Without a quorum there is
+		// nothing to learn from, and the state machine starts with what it has. Peers that fell behind further
+		// than the others remember their slots can use CatchUp.
+		err = sm.Consensus.CatchUp(sm.CurSequenceNumber + 1)
+		if errors.Is(err, paxos.ErrNoQuorum) || errors.Is(err, paxos.ErrSlotForgotten) {
+			log.Warn().Msgf("could not catch up with the peers of community %s: %s", sm.CommunityID, err.Error())
+		} else if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func (sm *CommunityStateMachine) Apply(transition *transitions.TransitionWrapper) error {
+// Validate checks that a transition is signed by an author the community allows, and that it can be applied
+// to the current state, without persisting anything. Invalid transitions are reported with a *transitions.ValidationError.
+func (sm *CommunityStateMachine) Validate(transition *transitions.TransitionWrapper) error {
+	return validateCommunityTransition(transition, sm.State, sm.CurSequenceNumber, sm.index)
+}
+
+// validateCommunityTransition validates a transition against a community's state at a sequence number, and the
+// index of the transitions committed up to it
+func validateCommunityTransition(transition *transitions.TransitionWrapper, state *entities.Community, sequenceNumber uint64, index *CommitIndex) error {
 	// Validate that the transition is a community transition
 	category, err := transitions.GetSubscriptionCategory(transition.Type)
 	if err != nil {
@@ -124,50 +189,294 @@ func (sm *CommunityStateMachine) Apply(transition *transitions.TransitionWrapper
 		return fmt.Errorf("transition category is %s, should be %s", category, transitions.CommunityCategory)
 	}
 
-	// Validate sequence number for new transition
-	if transition.SequenceNumber != sm.CurSequenceNumber+1 {
-		return fmt.Errorf("sequence number %d is off, should be %d", transition.SequenceNumber, sm.CurSequenceNumber+1)
+	communityTransition, ok := transition.Transition.(transitions.CommunityTransition)
+	if !ok {
+		return fmt.Errorf("transition of type %s is not a CommunityTransition", transition.Type)
 	}
 
-	// Write to write ahead log
-	err = sm.WriteAheadLog.WriteAhead(transition)
+	err = transitions.VerifyCommunityTransition(transition, state)
+	if err != nil {
+		return err
+	}
+	err = transitions.ValidateAuthorship(transition, index)
 	if err != nil {
 		return err
 	}
+	err = transitions.CheckReplay(transition, sequenceNumber, index)
+	if err != nil {
+		return err
+	}
+	err = transitions.CheckCompensation(transition, sequenceNumber, index)
+	if err != nil {
+		return err
+	}
+	return communityTransition.Validate(state)
+}
+
+// Apply validates a transition and applies it at the next sequence number. It is serialized with Commit and
+// Compensate, which apply transitions too.
+func (sm *CommunityStateMachine) Apply(transition *transitions.TransitionWrapper) error {
+	sm.commitMutex.Lock()
+	defer sm.commitMutex.Unlock()
 
-	// Very important that this is incremented immediately after write to write ahead log succeeds
-	sm.CurSequenceNumber += 1
+	return sm.apply(transition)
+}
+
+// apply is Apply without taking commitMutex
+func (sm *CommunityStateMachine) apply(transition *transitions.TransitionWrapper) error {
+	_, err := sm.applyBatch([]*transitions.TransitionWrapper{transition})
+	return err
+}
 
-	// Apply reducer to state
-	newState, err := transition.Transition.(transitions.CommunityTransition).Reduce(sm.State)
+// applyBatch applies transitions at consecutive sequence numbers with a single write to the log. Each one is
+// validated against the state the ones before it leave. If one of them is invalid, the ones before it are still
+// applied and its error is returned. The number of transitions applied is returned.
+func (sm *CommunityStateMachine) applyBatch(batch []*transitions.TransitionWrapper) (int, error) {
+	// Transitions are validated and reduced before anything is persisted, against a copy of the index if there
+	// are transitions after them that need to see them in it
+	index := sm.index
+	if len(batch) > 1 {
+		index = sm.index.clone()
+	}
+	state := sm.State
+	states := make([]*entities.Community, 0, len(batch))
+	var invalid error
+	for i, transition := range batch {
+		// Validate sequence number for new transition
+		sequenceNumber := sm.CurSequenceNumber + uint64(len(states))
+		if transition.SequenceNumber != sequenceNumber+1 {
+			invalid = fmt.Errorf("sequence number %d is off, should be %d", transition.SequenceNumber, sequenceNumber+1)
+			break
+		}
+
+		invalid = validateCommunityTransition(transition, state, sequenceNumber, index)
+		if invalid != nil {
+			break
+		}
+		newState, err := transition.Transition.(transitions.CommunityTransition).Replay(state)
+		if err != nil {
+			invalid = err
+			break
+		}
+		if i < len(batch)-1 {
+			index.Add(transition)
+		}
+		states = append(states, newState)
+		state = newState
+	}
+	batch = batch[:len(states)]
+	if len(batch) == 0 {
+		return 0, invalid
+	}
+
+	// Write to write ahead log
+	err := sm.WriteAheadLog.WriteAhead(batch...)
+	if err != nil {
+		return 0, err
+	}
+
+	// Every transition in the batch is logged now, so all of them are applied even if snapshotting or publishing
+	// one of them fails, and the first error is returned
+	var failed error
+	for i, transition := range batch {
+		// Very important that this is incremented immediately after write to write ahead log succeeds
+		sm.CurSequenceNumber += 1
+
+		if sm.Consensus != nil {
+			// A change to the peers is a change in consensus membership, which takes effect at the next sequence number
+			if peersChanged(sm.State, states[i]) {
+				sm.Consensus.Reconfigure(sm.CurSequenceNumber+1, PeerNodeIDs(states[i]))
+			}
+			sm.Consensus.Forget(sm.CurSequenceNumber)
+		}
+
+		sm.State = states[i]
+		sm.index.Add(transition)
+
+		// Copy snapshot file
+		if sm.CurSequenceNumber%uint64(sm.SnapshotInterval) == 0 {
+			err := writeSnapshotFile(sm.Path, sm.SnapshotRetention, sm.State, sm.CurSequenceNumber, sm.index)
+			if err == nil {
+				err = compactLog(sm.WriteAheadLog, sm.CurSequenceNumber, sm.ArchiveDir)
+			}
+			if err != nil && failed == nil {
+				failed = err
+			}
+		}
+
+		// Notify all transition subscribers
+		if sm.Subscriptions != nil {
+			err := sm.Subscriptions.Publish(sm.SourceID(), transition)
+			if err != nil && failed == nil {
+				failed = err
+			}
+		}
+	}
+
+	if failed != nil {
+		return len(batch), failed
+	}
+	return len(batch), invalid
+}
+
+func (sm *CommunityStateMachine) GetState() interface{} {
+	return sm.State
+}
+
+// SourceID implements TransitionSource
+func (sm *CommunityStateMachine) SourceID() string {
+	return string(sm.CommunityID)
+}
+
+// EntriesFrom implements TransitionSource
+func (sm *CommunityStateMachine) EntriesFrom(sequenceNumber uint64) ([]*Entry, error) {
+	return entriesFrom(sm.WriteAheadLog, sequenceNumber)
+}
+
+// readSnapshotFile reads the latest snapshot in a state dir into dest. If no snapshot has been taken yet,
+// a nil snapshot is returned and dest is untouched.
+func readSnapshotFile(stateDir string, dest interface{}) (*Snapshot, error) {
+	snapshotFile, err := os.OpenFile(filepath.Join(stateDir, "snapshot"), os.O_RDONLY, 0644)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer snapshotFile.Close()
+
+	return ReadSnapshot(snapshotFile, dest)
+}
+
+// snapshotIndex returns the commit index in a snapshot. A state machine without a snapshot starts from an empty
+// index. So does one with a snapshot from before indexes were introduced, which only matters if a transition
+// committed within ReplayWindow before the snapshot is replayed after it.
+func snapshotIndex(snapshot *Snapshot) *CommitIndex {
+	if snapshot == nil || snapshot.Index == nil {
+		return NewCommitIndex()
+	}
+	return snapshot.Index
+}
+
+// writeSnapshotFile atomically replaces the snapshot in a state dir, archives it, and prunes old archives. Only
+// community snapshots have a commit index.
+func writeSnapshotFile(stateDir string, retention SnapshotRetentionPolicy, data interface{}, sequenceNumber uint64, index *CommitIndex) error {
+	buf := &bytes.Buffer{}
+	err := writeSnapshot(buf, data, sequenceNumber, index)
 	if err != nil {
 		return err
 	}
 
-	sm.State = newState
+	err = atomicWriteFile(filepath.Join(stateDir, "snapshot"), buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	// Failing to archive doesn't affect the current state, so these errors are only logged
+	err = ArchiveSnapshotFile(stateDir, sequenceNumber)
+	if err != nil {
+		log.Error().Msg(err.Error())
+	}
+	err = PruneSnapshots(stateDir, retention)
+	if err != nil {
+		log.Error().Msg(err.Error())
+	}
+
+	return nil
+}
+
+// warnMembershipDrift reports members that disagree with their communities. Transitions keep both sides
+// consistent, so drift points at a bug or a state dir that was edited, but it doesn't stop anything from starting.
+func warnMembershipDrift(drifts entities.MembershipDrifts) {
+	for _, drift := range drifts {
+		log.Warn().Msgf("membership drift in %s", drift)
+	}
+}
 
-	// Copy snapshot file
-	if sm.CurSequenceNumber%uint64(sm.SnapshotInterval) == 0 {
-		err := ArchiveSnapshotFile(sm.Path, sm.SnapshotInterval)
+// reduceCommunityEntry applies a log entry to a community, after checking its signature. Entries were validated
+// before they were logged, so they are replayed without validating them again.
+func reduceCommunityEntry(community *entities.Community, entry *Entry) (*entities.Community, error) {
+	transition, ok := entry.Transition.Transition.(transitions.CommunityTransition)
+	if !ok {
+		return nil, errors.New("transition in log entry was not a CommunityTransition")
+	}
+	if community == nil && entry.Transition.Type != transitions.InitCommunityTransitionType {
+		return nil, fmt.Errorf("log entry %d of type %s comes before the community was initialized", entry.SequenceNumber, entry.Transition.Type)
+	}
+	// Entries written before transitions were signed can only be trusted because they come from our own log
+	if !entry.Transition.PredatesSignatures() {
+		err := transitions.VerifyCommunityTransition(entry.Transition, community)
 		if err != nil {
-			log.Error().Msg(err.Error())
+			return nil, err
 		}
-		snapshotPath := filepath.Join(sm.Path, "snapshot")
-		snapshotFile, err := os.OpenFile(snapshotPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Error().Msg(err.Error())
+	}
+	return transition.Replay(community)
+}
+
+// replayLog streams the log entries that still need to be applied on top of a snapshot to apply, and returns
+// the sequence number of the last entry
+func replayLog(wal *Log, snapshot *Snapshot, apply func(*Entry) error) (uint64, error) {
+	var sequenceNumber uint64
+	if snapshot != nil {
+		sequenceNumber = snapshot.SequenceNumber
+	}
+
+	it, err := wal.Iterator(sequenceNumber + 1)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+
+	for {
+		entry, err := it.Next()
+		if err == io.EOF {
+			return sequenceNumber, nil
+		} else if err != nil {
+			return 0, err
 		}
-		err = WriteSnapshot(snapshotFile, sm.State, sm.CurSequenceNumber)
+
+		// Validate that sequence numbers match
+		if entry.SequenceNumber != sequenceNumber+1 {
+			return 0, fmt.Errorf("sequence number mismatch: %d expected, got %d", sequenceNumber+1, entry.SequenceNumber)
+		}
+
+		err = apply(entry)
 		if err != nil {
-			return err
+			return 0, err
 		}
+		sequenceNumber = entry.SequenceNumber
 	}
+}
 
-	// TODO notify all transition subscribers
+// entriesFrom returns all log entries with a sequence number of at least sequenceNumber
+func entriesFrom(wal *Log, sequenceNumber uint64) ([]*Entry, error) {
+	it, err := wal.Iterator(sequenceNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
 
-	return nil
+	res := make([]*Entry, 0)
+	for {
+		entry, err := it.Next()
+		if err == io.EOF {
+			return res, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		// Entries that have been compacted out of the log can't be returned
+		if len(res) == 0 && sequenceNumber > 0 && entry.SequenceNumber > sequenceNumber {
+			return nil, fmt.Errorf("entries before sequence number %d have been compacted", entry.SequenceNumber)
+		}
+		res = append(res, entry)
+	}
 }
 
-func (sm *CommunityStateMachine) GetState() interface{} {
-	return sm.State
+// compactLog starts a new WAL segment after a snapshot, and gets rid of the segments the snapshot covers
+func compactLog(wal *Log, snapshotSequenceNumber uint64, archiveDir string) error {
+	err := wal.Rotate()
+	if err != nil {
+		return err
+	}
+	return wal.Compact(snapshotSequenceNumber, archiveDir)
 }
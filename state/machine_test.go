@@ -1,6 +1,14 @@
 package state
 
-import "testing"
+import (
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/stretchr/testify/assert"
+)
 
 func TestStateMachineImpls(t *testing.T) {
 	csm := interface{}(&CommunityStateMachine{})
@@ -8,4 +16,272 @@ func TestStateMachineImpls(t *testing.T) {
 	if !ok {
 		t.Error("not a valid impl of StateMachine interface")
 	}
+
+	hsm := interface{}(&HostStateMachine{})
+	_, ok = hsm.(StateMachine)
+	if !ok {
+		t.Error("not a valid impl of StateMachine interface")
+	}
+}
+
+// testPeer generates a peer with a deterministic Ed25519 key
+func testPeer(i int) (*entities.Peer, ed25519.PrivateKey) {
+	seed := make([]byte, ed25519.SeedSize)
+	seed[0] = byte(i)
+	key := ed25519.NewKeyFromSeed(seed)
+	return &entities.Peer{
+		Key:     transitions.EncodePublicKey(key.Public().(ed25519.PublicKey)),
+		Address: fmt.Sprintf("127.0.0.1:%d", 7000+i),
+	}, key
+}
+
+// testCommunity initializes a community hosted by a single test peer, whose key is returned to sign transitions with
+func testCommunity() (*entities.Community, *entities.Peer, ed25519.PrivateKey) {
+	community := entities.InitCommunity("community_0", "My Community", entities.IPFS)
+	peer, key := testPeer(0)
+	community.Peers = append(community.Peers, peer)
+	return community, peer, key
+}
+
+// signed signs a transition as its author would, against the state just before its sequence number if it has one
+func signed(t *testing.T, transition *transitions.TransitionWrapper, author string, key ed25519.PrivateKey) *transitions.TransitionWrapper {
+	if transition.SequenceNumber > 0 {
+		transition.BaseSequenceNumber = transition.SequenceNumber - 1
+	}
+	err := transition.Sign(author, key)
+	assert.Nil(t, err)
+	return transition
+}
+
+func TestCommunityStateMachineRestart(t *testing.T) {
+	stateDir := t.TempDir()
+	community, peer, key := testCommunity()
+
+	sm, err := InitCommunityStateMachine(community.ID, stateDir, 2)
+	assert.Nil(t, err)
+	err = sm.Restart()
+	assert.Nil(t, err)
+	assert.Nil(t, sm.State)
+
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type: transitions.InitCommunityTransitionType,
+		Transition: transitions.InitCommunityTransition{
+			Community: community,
+		},
+		SequenceNumber: 1,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+
+	for i := 2; i <= 3; i++ {
+		newBacknet := entities.InitBacknet(entities.IPFS)
+		newBacknet.Bootstrap = []string{fmt.Sprintf("/ip4/10.0.0.%d/tcp/4001", i)}
+		err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+			Type: transitions.UpdateBacknetTransitionType,
+			Transition: transitions.UpdateBacknetTransition{
+				CommID:     community.ID,
+				OldBacknet: sm.State.Backnet,
+				NewBacknet: newBacknet,
+			},
+			SequenceNumber: uint64(i),
+		}, peer.Key, key))
+		assert.Nil(t, err)
+	}
+
+	err = sm.Close()
+	assert.Nil(t, err)
+	restarted, err := InitCommunityStateMachine(community.ID, stateDir, 2)
+	assert.Nil(t, err)
+	err = restarted.Restart()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), restarted.CurSequenceNumber)
+	assert.Equal(t, []string{"/ip4/10.0.0.3/tcp/4001"}, restarted.State.Backnet.Bootstrap)
+}
+
+func TestApplyInvalidTransition(t *testing.T) {
+	community, peer, key := testCommunity()
+	sm, err := InitCommunityStateMachine(community.ID, t.TempDir(), 10)
+	assert.Nil(t, err)
+
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type: transitions.InitCommunityTransitionType,
+		Transition: transitions.InitCommunityTransition{
+			Community: community,
+		},
+		SequenceNumber: 1,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+
+	// Switching backnet types fails validation, and must not touch the log or the sequence number
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type: transitions.UpdateBacknetTransitionType,
+		Transition: transitions.UpdateBacknetTransition{
+			CommID:     community.ID,
+			OldBacknet: community.Backnet,
+			NewBacknet: entities.InitBacknet(entities.DAT),
+		},
+		SequenceNumber: 2,
+	}, peer.Key, key))
+	validationErr, ok := err.(*transitions.ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, transitions.UpdateBacknetTransitionType, validationErr.Type)
+	assert.Equal(t, uint64(1), sm.CurSequenceNumber)
+
+	entries, err := sm.WriteAheadLog.GetEntries()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+}
+
+func TestApplyUnauthorizedTransition(t *testing.T) {
+	community, peer, key := testCommunity()
+	sm, err := InitCommunityStateMachine(community.ID, t.TempDir(), 10)
+	assert.Nil(t, err)
+
+	initTransition := func() *transitions.TransitionWrapper {
+		return &transitions.TransitionWrapper{
+			Type: transitions.InitCommunityTransitionType,
+			Transition: transitions.InitCommunityTransition{
+				Community: community,
+			},
+			SequenceNumber: 1,
+		}
+	}
+
+	// Unsigned
+	err = sm.Apply(initTransition())
+	validationErr, ok := err.(*transitions.ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "signature", validationErr.Field)
+
+	// Signed by someone who isn't a peer of the community
+	outsider, outsiderKey := testPeer(1)
+	err = sm.Apply(signed(t, initTransition(), outsider.Key, outsiderKey))
+	validationErr, ok = err.(*transitions.ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "author", validationErr.Field)
+
+	// Signed by a peer's name, but with the wrong key
+	err = sm.Apply(signed(t, initTransition(), peer.Key, outsiderKey))
+	validationErr, ok = err.(*transitions.ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "signature", validationErr.Field)
+
+	assert.Equal(t, uint64(0), sm.CurSequenceNumber)
+	err = sm.Apply(signed(t, initTransition(), peer.Key, key))
+	assert.Nil(t, err)
+}
+
+func TestRestartRejectsUnsignedTransition(t *testing.T) {
+	stateDir := t.TempDir()
+	community, _, _ := testCommunity()
+	sm, err := InitCommunityStateMachine(community.ID, stateDir, 10)
+	assert.Nil(t, err)
+
+	// Bypass the state machine to write an unsigned entry with the current version
+	err = sm.WriteAheadLog.WriteAhead(&transitions.TransitionWrapper{
+		Type: transitions.InitCommunityTransitionType,
+		Transition: transitions.InitCommunityTransition{
+			Community: community,
+		},
+		SequenceNumber: 1,
+	})
+	assert.Nil(t, err)
+
+	err = sm.Close()
+	assert.Nil(t, err)
+	restarted, err := InitCommunityStateMachine(community.ID, stateDir, 10)
+	assert.Nil(t, err)
+	err = restarted.Restart()
+	_, ok := err.(*transitions.ValidationError)
+	assert.True(t, ok)
+}
+
+func TestRestartReplaysWithoutValidating(t *testing.T) {
+	stateDir := t.TempDir()
+	community, peer, key := testCommunity()
+	sm, err := InitCommunityStateMachine(community.ID, stateDir, 10)
+	assert.Nil(t, err)
+
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type: transitions.InitCommunityTransitionType,
+		Transition: transitions.InitCommunityTransition{
+			Community: community,
+		},
+		SequenceNumber: 1,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+
+	// A rename that was committed before names were validated is no longer valid, but it is part of the log
+	rename := signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.RenameCommunityTransitionType,
+		Transition:     transitions.RenameCommunityTransition{CommID: community.ID, Name: "Old\x01Name"},
+		SequenceNumber: 2,
+	}, peer.Key, key)
+	assert.NotNil(t, sm.Validate(rename))
+	err = sm.WriteAheadLog.WriteAhead(rename)
+	assert.Nil(t, err)
+
+	err = sm.Close()
+	assert.Nil(t, err)
+	restarted, err := InitCommunityStateMachine(community.ID, stateDir, 10)
+	assert.Nil(t, err)
+	defer restarted.Close()
+	err = restarted.Restart()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), restarted.CurSequenceNumber)
+	assert.Equal(t, "Old\x01Name", restarted.State.Name)
+
+	state, err := restarted.StateAt(2)
+	assert.Nil(t, err)
+	assert.Equal(t, "Old\x01Name", state.Name)
+}
+
+func TestApplyReplayedTransition(t *testing.T) {
+	community, peer, key := testCommunity()
+	stateDir := t.TempDir()
+	sm, err := InitCommunityStateMachine(community.ID, stateDir, 2)
+	assert.Nil(t, err)
+	// The check can't depend on what is left of the log, so compacted entries are deleted
+	sm.ArchiveDir = ""
+
+	err = sm.Apply(signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.InitCommunityTransitionType,
+		Transition:     transitions.InitCommunityTransition{Community: community},
+		SequenceNumber: 1,
+	}, peer.Key, key))
+	assert.Nil(t, err)
+
+	rename := func(name string) *transitions.TransitionWrapper {
+		return signed(t, &transitions.TransitionWrapper{
+			Type:           transitions.RenameCommunityTransitionType,
+			Transition:     transitions.RenameCommunityTransition{CommID: community.ID, Name: name},
+			SequenceNumber: sm.CurSequenceNumber + 1,
+		}, peer.Key, key)
+	}
+	first := rename("Renamed")
+	err = sm.Apply(first)
+	assert.Nil(t, err)
+	err = sm.Apply(rename("My Community"))
+	assert.Nil(t, err)
+
+	// Committing the same signed transition again would rename the community back, but its nonce was used
+	first.SequenceNumber = sm.CurSequenceNumber + 1
+	err = sm.Apply(first)
+	validationErr, ok := err.(*transitions.ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "nonce", validationErr.Field)
+	assert.Equal(t, uint64(3), sm.CurSequenceNumber)
+	assert.Equal(t, "My Community", sm.State.Name)
+
+	// The first rename was compacted into the snapshot, which remembers its nonce across a restart
+	err = sm.Close()
+	assert.Nil(t, err)
+	sm, err = InitCommunityStateMachine(community.ID, stateDir, 2)
+	assert.Nil(t, err)
+	defer sm.Close()
+	err = sm.Restart()
+	assert.Nil(t, err)
+	err = sm.Apply(first)
+	validationErr, ok = err.(*transitions.ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "nonce", validationErr.Field)
 }
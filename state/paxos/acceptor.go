@@ -0,0 +1,350 @@
+package paxos
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Acceptor holds the promises and accepted proposals for every slot. An acceptor that forgets what it promised
+// or accepted can let two different values be chosen for a slot, so acceptors of nodes that can crash and come
+// back should be persistent, see NewPersistentAcceptor. Slots that have been applied can be forgotten, after which
+// the acceptor refuses to take part in them.
+type Acceptor struct {
+	slots map[uint64]*acceptorSlot
+	mutex *sync.Mutex
+
+	// forgotten is the highest slot that was forgotten
+	forgotten uint64
+
+	// path and file are where changes are recorded before they are replied to, if the acceptor is persistent.
+	// records counts the lines in the file, which is rewritten with only the remaining slots once most of them
+	// are about slots that were forgotten.
+	path    string
+	file    *os.File
+	records int
+}
+
+type acceptorSlot struct {
+	promised ProposalID
+	accepted ProposalID
+	value    []byte
+}
+
+// acceptorRecord is a line of a persistent acceptor's file, with either the state of a slot after a change, or
+// the highest slot forgotten so far
+type acceptorRecord struct {
+	Slot      uint64     `json:"slot"`
+	Promised  ProposalID `json:"promised"`
+	Accepted  ProposalID `json:"accepted"`
+	Value     []byte     `json:"value"`
+	Forgotten uint64     `json:"forgotten,omitempty"`
+}
+
+// compactMinRecords is how many records a persistent acceptor's file has to have before it is compacted
+const compactMinRecords = 1000
+
+// NewAcceptor creates an acceptor that only keeps its state in memory
+func NewAcceptor() *Acceptor {
+	return &Acceptor{
+		slots: make(map[uint64]*acceptorSlot),
+		mutex: &sync.Mutex{},
+	}
+}
+
+// NewPersistentAcceptor creates an acceptor that records every promise and accepted proposal in a file, and
+// syncs it before replying. The state recorded in the file is restored, so a restarted node keeps its promises.
+func NewPersistentAcceptor(path string) (*Acceptor, error) {
+	a := NewAcceptor()
+	a.path = path
+	err := a.load()
+	if err != nil {
+		return nil, err
+	}
+
+	a.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// load restores the slots recorded in an acceptor's file. A torn last line was never synced, so nothing was
+// replied to based on it, and it is truncated so that the next record starts on a line of its own.
+func (a *Acceptor) load() error {
+	file, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var offset int64
+	var goodOffset int64
+	var torn error
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(line) == 0 {
+			break
+		}
+		offset += int64(len(line))
+		if torn != nil {
+			return torn
+		}
+
+		var record acceptorRecord
+		if line[len(line)-1] != '\n' {
+			torn = fmt.Errorf("acceptor record in %s was cut off", a.path)
+			continue
+		}
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			torn = fmt.Errorf("corrupt acceptor record in %s: %s", a.path, err.Error())
+			continue
+		}
+		goodOffset = offset
+		a.records++
+
+		if record.Forgotten != 0 {
+			a.forget(record.Forgotten)
+			continue
+		}
+		if record.Slot <= a.forgotten {
+			continue
+		}
+		a.slots[record.Slot] = &acceptorSlot{
+			promised: record.Promised,
+			accepted: record.Accepted,
+			value:    record.Value,
+		}
+	}
+
+	if torn != nil {
+		log.Warn().Msgf("truncating torn acceptor record of %d bytes at the end of %s", offset-goodOffset, a.path)
+		return os.Truncate(a.path, goodOffset)
+	}
+	return nil
+}
+
+// persist records the state of a slot, if the acceptor is persistent
+func (a *Acceptor) persist(record *acceptorRecord) error {
+	if a.file == nil {
+		return nil
+	}
+
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = a.file.Write(append(buf, '\n'))
+	if err != nil {
+		return err
+	}
+	a.records++
+	return a.file.Sync()
+}
+
+// slotRecord is the record of a slot's current state
+func slotRecord(slot uint64, s *acceptorSlot) *acceptorRecord {
+	return &acceptorRecord{
+		Slot:     slot,
+		Promised: s.promised,
+		Accepted: s.accepted,
+		Value:    s.value,
+	}
+}
+
+// Forget drops every slot up to and including slot, once they have been applied. The acceptor refuses prepare
+// and accept requests for forgotten slots from then on, which is always safe, and keeps a proposer that fell
+// behind from getting a value chosen for them again.
+func (a *Acceptor) Forget(slot uint64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if slot <= a.forgotten {
+		return
+	}
+	a.forget(slot)
+
+	if a.file != nil && a.records >= compactMinRecords && a.records > 2*(len(a.slots)+1) {
+		err := a.compact()
+		if err != nil {
+			log.Error().Msgf("failed to compact acceptor file %s: %s", a.path, err.Error())
+		}
+	}
+}
+
+func (a *Acceptor) forget(slot uint64) {
+	for s := range a.slots {
+		if s <= slot {
+			delete(a.slots, s)
+		}
+	}
+	if slot > a.forgotten {
+		a.forgotten = slot
+	}
+}
+
+// compact rewrites the acceptor's file with just the slots that haven't been forgotten, after a record of what
+// has been forgotten. Slots are only left out of the file together with that record, so a restarted acceptor
+// still refuses the slots it can no longer answer for. If compacting fails, the old file is kept as it is.
+func (a *Acceptor) compact() error {
+	tmpPath := a.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	writer := bufio.NewWriter(tmp)
+	records := []*acceptorRecord{{Forgotten: a.forgotten}}
+	for slot, s := range a.slots {
+		records = append(records, slotRecord(slot, s))
+	}
+	for _, record := range records {
+		buf, err := json.Marshal(record)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		writer.Write(append(buf, '\n'))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, a.path)
+	if err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(a.path))
+	if err == nil {
+		err = dir.Sync()
+		dir.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	// The old file was replaced, so records have to go to the new one from here on
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	a.file.Close()
+	a.file = file
+	a.records = len(records)
+	return nil
+}
+
+// Close closes a persistent acceptor's file
+func (a *Acceptor) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+func (a *Acceptor) getSlot(slot uint64) *acceptorSlot {
+	s, ok := a.slots[slot]
+	if !ok {
+		s = &acceptorSlot{}
+		a.slots[slot] = s
+	}
+	return s
+}
+
+// Prepare promises not to accept any proposal lower than the requested one, and returns the highest
+// proposal accepted so far for the slot
+func (a *Acceptor) Prepare(req *PrepareRequest) *PrepareResponse {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if req.Slot <= a.forgotten {
+		return &PrepareResponse{Forgotten: true}
+	}
+	s := a.getSlot(req.Slot)
+	if s.promised.GreaterThan(req.Proposal) {
+		return &PrepareResponse{
+			OK:       false,
+			Promised: s.promised,
+		}
+	}
+
+	// A promise that wasn't recorded can't be made
+	previous := s.promised
+	s.promised = req.Proposal
+	err := a.persist(slotRecord(req.Slot, s))
+	if err != nil {
+		log.Error().Msgf("failed to record promise for slot %d: %s", req.Slot, err.Error())
+		s.promised = previous
+		return &PrepareResponse{
+			OK:       false,
+			Promised: s.promised,
+		}
+	}
+
+	return &PrepareResponse{
+		OK:       true,
+		Promised: s.promised,
+		Accepted: s.accepted,
+		Value:    s.value,
+	}
+}
+
+// Accept accepts the proposal unless a higher one has been promised
+func (a *Acceptor) Accept(req *AcceptRequest) *AcceptResponse {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if req.Slot <= a.forgotten {
+		return &AcceptResponse{Forgotten: true}
+	}
+	s := a.getSlot(req.Slot)
+	if s.promised.GreaterThan(req.Proposal) {
+		return &AcceptResponse{
+			OK:       false,
+			Promised: s.promised,
+		}
+	}
+
+	previous := *s
+	s.promised = req.Proposal
+	s.accepted = req.Proposal
+	s.value = req.Value
+	err := a.persist(slotRecord(req.Slot, s))
+	if err != nil {
+		log.Error().Msgf("failed to record accepted proposal for slot %d: %s", req.Slot, err.Error())
+		*s = previous
+		return &AcceptResponse{
+			OK:       false,
+			Promised: s.promised,
+		}
+	}
+
+	return &AcceptResponse{
+		OK:       true,
+		Promised: s.promised,
+	}
+}
@@ -0,0 +1,126 @@
+package paxos
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptorPromises(t *testing.T) {
+	acceptor := NewAcceptor()
+
+	low := ProposalID{Round: 1, NodeID: "a"}
+	high := ProposalID{Round: 2, NodeID: "a"}
+
+	res := acceptor.Prepare(&PrepareRequest{Slot: 1, Proposal: high})
+	assert.True(t, res.OK)
+	assert.True(t, res.Accepted.IsZero())
+
+	// Lower proposals are rejected after a promise
+	res = acceptor.Prepare(&PrepareRequest{Slot: 1, Proposal: low})
+	assert.False(t, res.OK)
+	assert.Equal(t, high, res.Promised)
+
+	acceptRes := acceptor.Accept(&AcceptRequest{Slot: 1, Proposal: low, Value: []byte("low")})
+	assert.False(t, acceptRes.OK)
+
+	acceptRes = acceptor.Accept(&AcceptRequest{Slot: 1, Proposal: high, Value: []byte("high")})
+	assert.True(t, acceptRes.OK)
+
+	// A later prepare must learn about the accepted value
+	higher := ProposalID{Round: 2, NodeID: "b"}
+	res = acceptor.Prepare(&PrepareRequest{Slot: 1, Proposal: higher})
+	assert.True(t, res.OK)
+	assert.Equal(t, high, res.Accepted)
+	assert.Equal(t, []byte("high"), res.Value)
+
+	// Slots are independent
+	res = acceptor.Prepare(&PrepareRequest{Slot: 2, Proposal: low})
+	assert.True(t, res.OK)
+}
+
+func TestPersistentAcceptor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acceptor")
+	acceptor, err := NewPersistentAcceptor(path)
+	assert.Nil(t, err)
+
+	low := ProposalID{Round: 1, NodeID: "a"}
+	high := ProposalID{Round: 2, NodeID: "a"}
+	assert.True(t, acceptor.Prepare(&PrepareRequest{Slot: 1, Proposal: low}).OK)
+	assert.True(t, acceptor.Accept(&AcceptRequest{Slot: 1, Proposal: low, Value: []byte("low")}).OK)
+	assert.True(t, acceptor.Prepare(&PrepareRequest{Slot: 2, Proposal: high}).OK)
+	assert.Nil(t, acceptor.Close())
+
+	// A crash in the middle of recording a change leaves a torn line, which was never replied to
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte(`{"slot":3,"prom`))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	// Promises and accepted values survive a restart
+	acceptor, err = NewPersistentAcceptor(path)
+	assert.Nil(t, err)
+	defer acceptor.Close()
+	res := acceptor.Prepare(&PrepareRequest{Slot: 1, Proposal: high})
+	assert.True(t, res.OK)
+	assert.Equal(t, low, res.Accepted)
+	assert.Equal(t, []byte("low"), res.Value)
+	res = acceptor.Prepare(&PrepareRequest{Slot: 2, Proposal: low})
+	assert.False(t, res.OK)
+	assert.Equal(t, high, res.Promised)
+
+	// The torn line was truncated, so the records written after it can be read after another crash
+	assert.True(t, acceptor.Accept(&AcceptRequest{Slot: 3, Proposal: high, Value: []byte("three")}).OK)
+	assert.Nil(t, acceptor.Close())
+	acceptor, err = NewPersistentAcceptor(path)
+	assert.Nil(t, err)
+	res = acceptor.Prepare(&PrepareRequest{Slot: 3, Proposal: higher(high)})
+	assert.True(t, res.OK)
+	assert.Equal(t, []byte("three"), res.Value)
+}
+
+func higher(p ProposalID) ProposalID {
+	return ProposalID{Round: p.Round + 1, NodeID: p.NodeID}
+}
+
+func TestAcceptorForget(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acceptor")
+	acceptor, err := NewPersistentAcceptor(path)
+	assert.Nil(t, err)
+
+	proposal := ProposalID{Round: 1, NodeID: "a"}
+	for slot := uint64(1); slot <= compactMinRecords; slot++ {
+		assert.True(t, acceptor.Accept(&AcceptRequest{Slot: slot, Proposal: proposal, Value: []byte("value")}).OK)
+	}
+	before, err := os.Stat(path)
+	assert.Nil(t, err)
+
+	// Forgotten slots are refused, and the file is rewritten without them
+	acceptor.Forget(compactMinRecords - 1)
+	res := acceptor.Prepare(&PrepareRequest{Slot: 1, Proposal: higher(proposal)})
+	assert.False(t, res.OK)
+	assert.True(t, res.Forgotten)
+	assert.True(t, acceptor.Accept(&AcceptRequest{Slot: compactMinRecords + 1, Proposal: proposal, Value: []byte("next")}).OK)
+	after, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.True(t, after.Size() < before.Size()/100)
+	assert.Nil(t, acceptor.Close())
+
+	// A restarted acceptor still refuses the forgotten slots, and remembers the rest
+	acceptor, err = NewPersistentAcceptor(path)
+	assert.Nil(t, err)
+	defer acceptor.Close()
+	res = acceptor.Prepare(&PrepareRequest{Slot: compactMinRecords - 1, Proposal: higher(proposal)})
+	assert.True(t, res.Forgotten)
+	acceptRes := acceptor.Accept(&AcceptRequest{Slot: 1, Proposal: higher(proposal), Value: []byte("other")})
+	assert.False(t, acceptRes.OK)
+	assert.True(t, acceptRes.Forgotten)
+	for slot, value := range map[uint64]string{compactMinRecords: "value", compactMinRecords + 1: "next"} {
+		res = acceptor.Prepare(&PrepareRequest{Slot: slot, Proposal: higher(proposal)})
+		assert.True(t, res.OK)
+		assert.Equal(t, []byte(value), res.Value)
+	}
+}
@@ -0,0 +1,80 @@
+package paxos
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// ChosenHandler is called exactly once for every slot that a learner finds out has been chosen.
+// Slots are not necessarily delivered in order.
+type ChosenHandler func(slot uint64, value []byte) error
+
+// Learner records which values have been chosen, until they are forgotten
+type Learner struct {
+	chosen   map[uint64][]byte
+	onChosen ChosenHandler
+	mutex    *sync.Mutex
+
+	// forgotten is the highest slot that was forgotten. Slots up to it are no longer delivered.
+	forgotten uint64
+}
+
+func NewLearner(onChosen ChosenHandler) *Learner {
+	return &Learner{
+		chosen:   make(map[uint64][]byte),
+		onChosen: onChosen,
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// Learn records a chosen value, and notifies the ChosenHandler if it is the first time the slot was learned
+func (l *Learner) Learn(req *LearnRequest) error {
+	l.mutex.Lock()
+	if req.Slot <= l.forgotten {
+		l.mutex.Unlock()
+		return nil
+	}
+	existing, ok := l.chosen[req.Slot]
+	if ok {
+		l.mutex.Unlock()
+		// Paxos guarantees this can never happen, so something is very wrong if it does
+		if !bytes.Equal(existing, req.Value) {
+			return fmt.Errorf("conflicting values learned for slot %d", req.Slot)
+		}
+		return nil
+	}
+	l.chosen[req.Slot] = req.Value
+	l.mutex.Unlock()
+
+	if l.onChosen != nil {
+		return l.onChosen(req.Slot, req.Value)
+	}
+	return nil
+}
+
+// Chosen returns the value chosen for a slot, if the learner knows of one
+func (l *Learner) Chosen(slot uint64) ([]byte, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	value, ok := l.chosen[slot]
+	return value, ok
+}
+
+// Forget drops the values chosen for every slot up to and including slot, once they have been applied. Values
+// learned for those slots later on are ignored.
+func (l *Learner) Forget(slot uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if slot <= l.forgotten {
+		return
+	}
+	for chosen := range l.chosen {
+		if chosen <= slot {
+			delete(l.chosen, chosen)
+		}
+	}
+	l.forgotten = slot
+}
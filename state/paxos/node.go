@@ -0,0 +1,377 @@
+package paxos
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultMaxAttempts is the number of rounds a proposer will try before giving up on a slot
+const DefaultMaxAttempts = 10
+
+// DefaultAcceptorRetention is the number of slots an acceptor keeps after they have been forgotten by its node
+const DefaultAcceptorRetention = 1000
+
+// Node plays all three Paxos roles (proposer, acceptor, learner) for a single participant
+type Node struct {
+	ID          NodeID
+	MaxAttempts int
+	// AcceptorRetention is how many of the latest forgotten slots the acceptor keeps, so that peers that were
+	// down for a while can still learn them with CatchUp
+	AcceptorRetention uint64
+
+	acceptor  *Acceptor
+	learner   *Learner
+	transport Transport
+
+	configurations []*Configuration
+	round          uint64
+	mutex          *sync.Mutex
+}
+
+// Configuration is the set of nodes participating in consensus from a slot onwards. Quorums for a slot are
+// computed from the configuration in effect for it.
+type Configuration struct {
+	FromSlot uint64
+	Peers    []NodeID
+}
+
+// NewNode creates a node with an acceptor that only keeps its state in memory. The peer list should include
+// the node itself.
+func NewNode(id NodeID, peers []NodeID, transport Transport, onChosen ChosenHandler) *Node {
+	return NewNodeWithAcceptor(id, peers, transport, NewAcceptor(), onChosen)
+}
+
+// NewNodeWithAcceptor creates a node with the given acceptor, which should be persistent for nodes that are
+// restarted
+func NewNodeWithAcceptor(id NodeID, peers []NodeID, transport Transport, acceptor *Acceptor, onChosen ChosenHandler) *Node {
+	return &Node{
+		ID:                id,
+		MaxAttempts:       DefaultMaxAttempts,
+		AcceptorRetention: DefaultAcceptorRetention,
+
+		acceptor:  acceptor,
+		learner:   NewLearner(onChosen),
+		transport: transport,
+
+		configurations: []*Configuration{
+			{
+				FromSlot: 0,
+				Peers:    peers,
+			},
+		},
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Peers returns the set of nodes participating in consensus for the latest configuration
+func (n *Node) Peers() []NodeID {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return copyPeers(n.configurations[len(n.configurations)-1].Peers)
+}
+
+// PeersAt returns the set of nodes participating in consensus for a slot
+func (n *Node) PeersAt(slot uint64) []NodeID {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for i := len(n.configurations) - 1; i >= 0; i-- {
+		if n.configurations[i].FromSlot <= slot {
+			return copyPeers(n.configurations[i].Peers)
+		}
+	}
+	return copyPeers(n.configurations[0].Peers)
+}
+
+// Reconfigure changes the set of nodes participating in consensus for fromSlot and every slot after it.
+// Every node has to switch configurations at the same slot, so the peers should be derived from values that
+// have already been chosen. Configurations starting at or after fromSlot are replaced.
+func (n *Node) Reconfigure(fromSlot uint64, peers []NodeID) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	i := len(n.configurations)
+	for i > 0 && n.configurations[i-1].FromSlot >= fromSlot {
+		i--
+	}
+	n.configurations = append(n.configurations[:i], &Configuration{
+		FromSlot: fromSlot,
+		Peers:    copyPeers(peers),
+	})
+}
+
+func copyPeers(peers []NodeID) []NodeID {
+	res := make([]NodeID, len(peers))
+	copy(res, peers)
+	return res
+}
+
+// Chosen returns the value chosen for a slot, if this node has learned it
+func (n *Node) Chosen(slot uint64) ([]byte, bool) {
+	return n.learner.Chosen(slot)
+}
+
+// Forget lets the learner drop every slot up to and including slot, once they have been applied. The acceptor
+// drops them once they are AcceptorRetention slots behind.
+func (n *Node) Forget(slot uint64) {
+	n.learner.Forget(slot)
+	if slot > n.AcceptorRetention {
+		n.acceptor.Forget(slot - n.AcceptorRetention)
+	}
+}
+
+// Close closes the node's acceptor
+func (n *Node) Close() error {
+	return n.acceptor.Close()
+}
+
+// CatchUp learns the values chosen for fromSlot and the slots after it that this node missed, for example
+// while it was down, until it reaches a slot that no value has been chosen for yet. Learned values are
+// delivered to the ChosenHandler like any other.
+func (n *Node) CatchUp(fromSlot uint64) error {
+	for slot := fromSlot; ; slot++ {
+		if _, ok := n.learner.Chosen(slot); ok {
+			continue
+		}
+		_, learned, err := n.recoverSlot(slot)
+		if err != nil {
+			return err
+		}
+		if !learned {
+			return nil
+		}
+	}
+}
+
+// Learn returns the value chosen for a slot, recovering it from the acceptors if this node hasn't learned it.
+// It fails if no value has been chosen for the slot yet.
+func (n *Node) Learn(slot uint64) ([]byte, error) {
+	if chosen, ok := n.learner.Chosen(slot); ok {
+		return chosen, nil
+	}
+	value, learned, err := n.recoverSlot(slot)
+	if err != nil {
+		return nil, err
+	}
+	if !learned {
+		return nil, fmt.Errorf("no value has been chosen for slot %d", slot)
+	}
+	return value, nil
+}
+
+// recoverSlot finds out whether a value may have been chosen for a slot, and gets it chosen if so. A chosen
+// value has been accepted by a quorum, which overlaps every other quorum, so if none of a quorum of acceptors
+// has accepted anything, nothing has been chosen yet. The chosen value is returned.
+func (n *Node) recoverSlot(slot uint64) ([]byte, bool, error) {
+	var err error
+	for attempt := 0; attempt < n.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(rand.Intn(attempt*10)+1) * time.Millisecond)
+		}
+
+		peers := n.PeersAt(slot)
+		proposal := n.nextProposal()
+		var value []byte
+		var accepted bool
+		value, accepted, err = n.prepare(slot, peers, proposal)
+		if errors.Is(err, ErrSlotForgotten) {
+			return nil, false, err
+		} else if err != nil {
+			continue
+		}
+		if !accepted {
+			return nil, false, nil
+		}
+		err = n.accept(slot, peers, proposal, value)
+		if err == nil {
+			return value, true, nil
+		} else if errors.Is(err, ErrSlotForgotten) {
+			return nil, false, err
+		}
+	}
+	return nil, false, fmt.Errorf("failed to recover slot %d after %d attempts: %w", slot, n.MaxAttempts, err)
+}
+
+// Propose attempts to get value chosen for the slot. The value that is actually chosen is returned, which
+// might be a different proposer's value if it got there first.
+func (n *Node) Propose(slot uint64, value []byte) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt < n.MaxAttempts; attempt++ {
+		if chosen, ok := n.learner.Chosen(slot); ok {
+			return chosen, nil
+		}
+
+		// Randomized backoff keeps dueling proposers from preempting each other forever
+		if attempt > 0 {
+			time.Sleep(time.Duration(rand.Intn(attempt*10)+1) * time.Millisecond)
+		}
+
+		var chosen []byte
+		chosen, err = n.runRound(slot, value)
+		if err == nil {
+			return chosen, nil
+		} else if errors.Is(err, ErrSlotForgotten) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("failed to reach consensus on slot %d after %d attempts: %s", slot, n.MaxAttempts, err.Error())
+}
+
+func (n *Node) runRound(slot uint64, value []byte) ([]byte, error) {
+	peers := n.PeersAt(slot)
+	proposal := n.nextProposal()
+
+	// If some acceptor has already accepted a value, we are bound to propose it instead of our own
+	accepted, ok, err := n.prepare(slot, peers, proposal)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		value = accepted
+	}
+
+	err = n.accept(slot, peers, proposal, value)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// prepare runs phase 1: it gets a quorum of promises, and finds out if any value may have already been chosen.
+// The value of the highest accepted proposal is returned, if there is one.
+func (n *Node) prepare(slot uint64, peers []NodeID, proposal ProposalID) ([]byte, bool, error) {
+	promises := 0
+	var highestAccepted ProposalID
+	var highestValue []byte
+	for _, peer := range peers {
+		res, err := n.sendPrepare(peer, &PrepareRequest{
+			Slot:     slot,
+			Proposal: proposal,
+		})
+		if err != nil {
+			continue
+		}
+		if res.Forgotten {
+			return nil, false, fmt.Errorf("%w: slot %d, by %s", ErrSlotForgotten, slot, peer)
+		}
+		if !res.OK {
+			n.observe(res.Promised)
+			continue
+		}
+		promises++
+		if res.Accepted.GreaterThan(highestAccepted) {
+			highestAccepted = res.Accepted
+			highestValue = res.Value
+		}
+	}
+	if promises < quorum(peers) {
+		return nil, false, ErrNoQuorum
+	}
+	return highestValue, !highestAccepted.IsZero(), nil
+}
+
+// accept runs phase 2: it gets a quorum of acceptors to accept the value, and lets everyone know it was chosen
+func (n *Node) accept(slot uint64, peers []NodeID, proposal ProposalID, value []byte) error {
+	accepts := 0
+	for _, peer := range peers {
+		res, err := n.sendAccept(peer, &AcceptRequest{
+			Slot:     slot,
+			Proposal: proposal,
+			Value:    value,
+		})
+		if err != nil {
+			continue
+		}
+		if res.Forgotten {
+			return fmt.Errorf("%w: slot %d, by %s", ErrSlotForgotten, slot, peer)
+		}
+		if !res.OK {
+			n.observe(res.Promised)
+			continue
+		}
+		accepts++
+	}
+	if accepts < quorum(peers) {
+		return ErrNoQuorum
+	}
+
+	// The value is chosen, let everyone know
+	for _, peer := range peers {
+		err := n.sendLearn(peer, &LearnRequest{
+			Slot:  slot,
+			Value: value,
+		})
+		if err != nil {
+			log.Error().Msgf("failed to notify %s of chosen value for slot %d: %s", peer, slot, err.Error())
+		}
+	}
+	return nil
+}
+
+// nextProposal returns a proposal id higher than any this node has seen
+func (n *Node) nextProposal() ProposalID {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.round++
+	return ProposalID{
+		Round:  n.round,
+		NodeID: n.ID,
+	}
+}
+
+// observe bumps the local round so the next proposal will beat a competing proposer
+func (n *Node) observe(promised ProposalID) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if promised.Round > n.round {
+		n.round = promised.Round
+	}
+}
+
+// Messages to self skip the transport
+
+func (n *Node) sendPrepare(to NodeID, req *PrepareRequest) (*PrepareResponse, error) {
+	if to == n.ID {
+		return n.HandlePrepare(req), nil
+	}
+	return n.transport.Prepare(to, req)
+}
+
+func (n *Node) sendAccept(to NodeID, req *AcceptRequest) (*AcceptResponse, error) {
+	if to == n.ID {
+		return n.HandleAccept(req), nil
+	}
+	return n.transport.Accept(to, req)
+}
+
+func (n *Node) sendLearn(to NodeID, req *LearnRequest) error {
+	if to == n.ID {
+		return n.HandleLearn(req)
+	}
+	return n.transport.Learn(to, req)
+}
+
+// Handlers for incoming messages, to be called by Transport implementations
+
+// HandlePrepare handles a phase 1a message from a proposer
+func (n *Node) HandlePrepare(req *PrepareRequest) *PrepareResponse {
+	return n.acceptor.Prepare(req)
+}
+
+// HandleAccept handles a phase 2a message from a proposer
+func (n *Node) HandleAccept(req *AcceptRequest) *AcceptResponse {
+	return n.acceptor.Accept(req)
+}
+
+// HandleLearn handles notification of a chosen value
+func (n *Node) HandleLearn(req *LearnRequest) error {
+	return n.learner.Learn(req)
+}
@@ -0,0 +1,234 @@
+package paxos
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type chosenRecorder struct {
+	chosen map[NodeID]map[uint64][]byte
+	mutex  *sync.Mutex
+}
+
+func (cr *chosenRecorder) handler(id NodeID) ChosenHandler {
+	return func(slot uint64, value []byte) error {
+		cr.mutex.Lock()
+		defer cr.mutex.Unlock()
+		cr.chosen[id][slot] = value
+		return nil
+	}
+}
+
+func initCluster(size int) ([]*Node, *LocalTransport, *chosenRecorder) {
+	transport := NewLocalTransport()
+	recorder := &chosenRecorder{
+		chosen: make(map[NodeID]map[uint64][]byte),
+		mutex:  &sync.Mutex{},
+	}
+
+	peers := make([]NodeID, size)
+	for i := 0; i < size; i++ {
+		peers[i] = NodeID(fmt.Sprintf("node_%d", i))
+	}
+
+	nodes := make([]*Node, size)
+	for i, id := range peers {
+		recorder.chosen[id] = make(map[uint64][]byte)
+		nodes[i] = NewNode(id, peers, transport, recorder.handler(id))
+		transport.Register(nodes[i])
+	}
+	return nodes, transport, recorder
+}
+
+func TestSingleProposer(t *testing.T) {
+	nodes, _, recorder := initCluster(3)
+
+	chosen, err := nodes[0].Propose(1, []byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), chosen)
+
+	for _, node := range nodes {
+		assert.Equal(t, []byte("hello"), recorder.chosen[node.ID][1])
+	}
+
+	// Once chosen, a slot's value can't change
+	chosen, err = nodes[1].Propose(1, []byte("goodbye"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), chosen)
+}
+
+func TestConcurrentProposers(t *testing.T) {
+	nodes, _, recorder := initCluster(5)
+
+	results := make([][]byte, len(nodes))
+	wg := &sync.WaitGroup{}
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node *Node) {
+			defer wg.Done()
+			chosen, err := node.Propose(1, []byte(node.ID))
+			assert.Nil(t, err)
+			results[i] = chosen
+		}(i, node)
+	}
+	wg.Wait()
+
+	// Every proposer and learner must agree on the same value
+	for _, result := range results {
+		assert.Equal(t, results[0], result)
+	}
+	for _, node := range nodes {
+		assert.Equal(t, results[0], recorder.chosen[node.ID][1])
+	}
+}
+
+func TestMinorityFailure(t *testing.T) {
+	nodes, transport, recorder := initCluster(3)
+	transport.Disconnect(nodes[2].ID)
+
+	chosen, err := nodes[0].Propose(1, []byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), chosen)
+	assert.Equal(t, []byte("hello"), recorder.chosen[nodes[1].ID][1])
+	_, ok := recorder.chosen[nodes[2].ID][1]
+	assert.False(t, ok)
+
+	// The disconnected node comes back, and must not be able to get a different value chosen
+	transport.Reconnect(nodes[2].ID)
+	transport.Disconnect(nodes[0].ID)
+	chosen, err = nodes[2].Propose(1, []byte("goodbye"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), chosen)
+}
+
+func TestMajorityFailure(t *testing.T) {
+	nodes, transport, _ := initCluster(3)
+	transport.Disconnect(nodes[1].ID)
+	transport.Disconnect(nodes[2].ID)
+
+	nodes[0].MaxAttempts = 2
+	_, err := nodes[0].Propose(1, []byte("hello"))
+	assert.NotNil(t, err)
+}
+
+func TestReconfigure(t *testing.T) {
+	nodes, transport, recorder := initCluster(3)
+
+	_, err := nodes[0].Propose(1, []byte("hello"))
+	assert.Nil(t, err)
+
+	// Shrink the cluster to a single node from slot 2, after which it doesn't need anyone else for a quorum
+	for _, node := range nodes {
+		node.Reconfigure(2, []NodeID{nodes[0].ID})
+	}
+	transport.Disconnect(nodes[1].ID)
+	transport.Disconnect(nodes[2].ID)
+
+	chosen, err := nodes[0].Propose(2, []byte("alone"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("alone"), chosen)
+	assert.Equal(t, []byte("alone"), recorder.chosen[nodes[0].ID][2])
+
+	// Slot 1 still uses the original configuration
+	assert.Equal(t, 3, len(nodes[0].PeersAt(1)))
+	assert.Equal(t, []NodeID{nodes[0].ID}, nodes[0].Peers())
+
+	// Growing the cluster again means a quorum of the new configuration is needed
+	nodes[0].Reconfigure(3, []NodeID{nodes[0].ID, nodes[1].ID})
+	nodes[0].MaxAttempts = 2
+	_, err = nodes[0].Propose(3, []byte("not enough"))
+	assert.NotNil(t, err)
+
+	transport.Reconnect(nodes[1].ID)
+	chosen, err = nodes[0].Propose(3, []byte("together"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("together"), chosen)
+}
+
+func TestCatchUp(t *testing.T) {
+	nodes, transport, recorder := initCluster(3)
+
+	// A node that was down misses the values chosen in the meantime
+	transport.Disconnect(nodes[2].ID)
+	for slot := uint64(1); slot <= 3; slot++ {
+		_, err := nodes[0].Propose(slot, []byte(fmt.Sprintf("value %d", slot)))
+		assert.Nil(t, err)
+	}
+	// A proposal that only reached one acceptor before its proposer went away may still be chosen
+	res := nodes[1].HandleAccept(&AcceptRequest{Slot: 4, Proposal: ProposalID{Round: 1, NodeID: nodes[1].ID}, Value: []byte("value 4")})
+	assert.True(t, res.OK)
+	transport.Reconnect(nodes[2].ID)
+
+	err := nodes[2].CatchUp(1)
+	assert.Nil(t, err)
+	for slot := uint64(1); slot <= 4; slot++ {
+		assert.Equal(t, []byte(fmt.Sprintf("value %d", slot)), recorder.chosen[nodes[2].ID][slot])
+	}
+	_, ok := nodes[2].Chosen(5)
+	assert.False(t, ok)
+
+	// Without a quorum there is no telling what was chosen
+	transport.Disconnect(nodes[0].ID)
+	transport.Disconnect(nodes[1].ID)
+	nodes[2].MaxAttempts = 2
+	err = nodes[2].CatchUp(5)
+	assert.True(t, errors.Is(err, ErrNoQuorum))
+}
+
+func TestLearn(t *testing.T) {
+	nodes, transport, _ := initCluster(3)
+
+	transport.Disconnect(nodes[2].ID)
+	_, err := nodes[0].Propose(1, []byte("hello"))
+	assert.Nil(t, err)
+	transport.Reconnect(nodes[2].ID)
+
+	// The value is recovered from the acceptors by a node that missed it
+	value, err := nodes[2].Learn(1)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), value)
+	value, err = nodes[0].Learn(1)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), value)
+
+	_, err = nodes[2].Learn(2)
+	assert.NotNil(t, err)
+}
+
+func TestForget(t *testing.T) {
+	nodes, transport, recorder := initCluster(3)
+	nodes[0].AcceptorRetention = 0
+
+	// node_2 misses slot 1
+	transport.Disconnect(nodes[2].ID)
+	_, err := nodes[0].Propose(1, []byte("hello"))
+	assert.Nil(t, err)
+	transport.Reconnect(nodes[2].ID)
+	nodes[0].Forget(1)
+	_, ok := nodes[0].Chosen(1)
+	assert.False(t, ok)
+
+	// Forgotten slots aren't delivered again, and can't change, since the acceptor that forgot them refuses to
+	// take part in them. A node that fell behind is told to catch up from a snapshot instead.
+	delete(recorder.chosen[nodes[0].ID], 1)
+	_, err = nodes[0].Propose(1, []byte("goodbye"))
+	assert.True(t, errors.Is(err, ErrSlotForgotten))
+	_, ok = recorder.chosen[nodes[0].ID][1]
+	assert.False(t, ok)
+	err = nodes[2].CatchUp(1)
+	assert.True(t, errors.Is(err, ErrSlotForgotten))
+	_, err = nodes[2].Propose(1, []byte("goodbye"))
+	assert.True(t, errors.Is(err, ErrSlotForgotten))
+
+	// Nodes that learned the slot still know it, and later slots carry on as usual
+	chosen, err := nodes[1].Propose(1, []byte("goodbye"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), chosen)
+	chosen, err = nodes[2].Propose(2, []byte("goodbye"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("goodbye"), chosen)
+}
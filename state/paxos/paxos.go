@@ -0,0 +1,87 @@
+package paxos
+
+import (
+	"errors"
+)
+
+// Multi-decree Paxos. Each slot corresponds to a sequence number in a replicated state machine, and an
+// independent instance of single-decree Paxos is run for every slot. Values are opaque bytes, so the package
+// has no knowledge of transitions or communities.
+
+// NodeID identifies a participant in consensus. For communities this is the peer's key.
+type NodeID string
+
+// ProposalID totally orders proposals. Ties between rounds are broken by NodeID so that every proposer
+// generates unique proposal ids.
+type ProposalID struct {
+	Round  uint64 `json:"round"`
+	NodeID NodeID `json:"node_id"`
+}
+
+// GreaterThan returns true if p is ordered after other
+func (p ProposalID) GreaterThan(other ProposalID) bool {
+	if p.Round != other.Round {
+		return p.Round > other.Round
+	}
+	return p.NodeID > other.NodeID
+}
+
+// IsZero returns true if this is the null proposal, which no proposer ever sends
+func (p ProposalID) IsZero() bool {
+	return p.Round == 0 && p.NodeID == ""
+}
+
+// PrepareRequest is the phase 1a message
+type PrepareRequest struct {
+	Slot     uint64     `json:"slot"`
+	Proposal ProposalID `json:"proposal"`
+}
+
+// PrepareResponse is the phase 1b message. If the promise was refused, Promised holds the proposal
+// that the acceptor has already promised to, or Forgotten is set if the acceptor has forgotten the slot.
+type PrepareResponse struct {
+	OK        bool       `json:"ok"`
+	Promised  ProposalID `json:"promised"`
+	Accepted  ProposalID `json:"accepted"`
+	Value     []byte     `json:"value"`
+	Forgotten bool       `json:"forgotten,omitempty"`
+}
+
+// AcceptRequest is the phase 2a message
+type AcceptRequest struct {
+	Slot     uint64     `json:"slot"`
+	Proposal ProposalID `json:"proposal"`
+	Value    []byte     `json:"value"`
+}
+
+// AcceptResponse is the phase 2b message
+type AcceptResponse struct {
+	OK        bool       `json:"ok"`
+	Promised  ProposalID `json:"promised"`
+	Forgotten bool       `json:"forgotten,omitempty"`
+}
+
+// LearnRequest notifies learners of a chosen value
+type LearnRequest struct {
+	Slot  uint64 `json:"slot"`
+	Value []byte `json:"value"`
+}
+
+// Transport delivers messages between nodes. Implementations can be in process (for tests) or over the network.
+type Transport interface {
+	Prepare(to NodeID, req *PrepareRequest) (*PrepareResponse, error)
+	Accept(to NodeID, req *AcceptRequest) (*AcceptResponse, error)
+	Learn(to NodeID, req *LearnRequest) error
+}
+
+// ErrNoQuorum is returned when a proposer could not get a majority of peers to participate in a round
+var ErrNoQuorum = errors.New("could not reach a quorum of peers")
+
+// ErrSlotForgotten is returned when an acceptor has forgotten a slot. Acceptors only forget slots that were
+// chosen and applied, so the value has to be learned from a snapshot of a peer's state instead.
+var ErrSlotForgotten = errors.New("slot has been forgotten by a peer")
+
+// quorum returns the number of nodes needed for a majority
+func quorum(peers []NodeID) int {
+	return len(peers)/2 + 1
+}
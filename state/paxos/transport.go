@@ -0,0 +1,84 @@
+package paxos
+
+import (
+	"fmt"
+	"sync"
+)
+
+// LocalTransport connects nodes running in the same process. Nodes can be disconnected to simulate
+// crashes and network partitions.
+type LocalTransport struct {
+	nodes        map[NodeID]*Node
+	disconnected map[NodeID]bool
+	mutex        *sync.RWMutex
+}
+
+func NewLocalTransport() *LocalTransport {
+	return &LocalTransport{
+		nodes:        make(map[NodeID]*Node),
+		disconnected: make(map[NodeID]bool),
+		mutex:        &sync.RWMutex{},
+	}
+}
+
+// Register makes a node reachable through the transport
+func (lt *LocalTransport) Register(node *Node) {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+
+	lt.nodes[node.ID] = node
+}
+
+// Disconnect makes a node unreachable until Reconnect is called
+func (lt *LocalTransport) Disconnect(id NodeID) {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+
+	lt.disconnected[id] = true
+}
+
+// Reconnect makes a disconnected node reachable again
+func (lt *LocalTransport) Reconnect(id NodeID) {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+
+	delete(lt.disconnected, id)
+}
+
+func (lt *LocalTransport) getNode(id NodeID) (*Node, error) {
+	lt.mutex.RLock()
+	defer lt.mutex.RUnlock()
+
+	node, ok := lt.nodes[id]
+	if !ok {
+		return nil, fmt.Errorf("node %s is not registered", id)
+	}
+	if lt.disconnected[id] {
+		return nil, fmt.Errorf("node %s is unreachable", id)
+	}
+	return node, nil
+}
+
+func (lt *LocalTransport) Prepare(to NodeID, req *PrepareRequest) (*PrepareResponse, error) {
+	node, err := lt.getNode(to)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandlePrepare(req), nil
+}
+
+func (lt *LocalTransport) Accept(to NodeID, req *AcceptRequest) (*AcceptResponse, error) {
+	node, err := lt.getNode(to)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleAccept(req), nil
+}
+
+func (lt *LocalTransport) Learn(to NodeID, req *LearnRequest) error {
+	node, err := lt.getNode(to)
+	if err != nil {
+		return err
+	}
+	return node.HandleLearn(req)
+}
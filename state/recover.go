@@ -0,0 +1,124 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrChecksumMismatch is returned when a log line's checksum does not match its contents
+var ErrChecksumMismatch = errors.New("log line checksum mismatch")
+
+// CorruptEntryError is returned when an entry in the middle of the log can't be decoded. Unlike a torn write at
+// the end of the log, this can't be fixed automatically, because entries after it have already been committed.
+type CorruptEntryError struct {
+	Path           string
+	SequenceNumber uint64
+	Err            error
+}
+
+func (ce *CorruptEntryError) Error() string {
+	return fmt.Sprintf("corrupt log entry with sequence number %d in %s: %s", ce.SequenceNumber, ce.Path, ce.Err.Error())
+}
+
+func (ce *CorruptEntryError) Unwrap() error {
+	return ce.Err
+}
+
+// newCorruptEntryError guesses the sequence number of a corrupt line. The sequence number at the start of the line
+// is used if it is readable, otherwise it is assumed to follow the last good entry.
+func newCorruptEntryError(path string, line []byte, previous uint64, err error) *CorruptEntryError {
+	sequenceNumber, ok, parseErr := parseSequenceNumber(string(line))
+	if parseErr != nil || !ok {
+		sequenceNumber = previous + 1
+	}
+	return &CorruptEntryError{
+		Path:           path,
+		SequenceNumber: sequenceNumber,
+		Err:            err,
+	}
+}
+
+// Recover checks the active segment for a torn write, which happens when the node crashes while appending an
+// entry. If the log ends with an incomplete or corrupt entry, it is truncated back to the last good entry.
+// Corruption followed by good entries is returned as a *CorruptEntryError.
+func (l *Log) Recover() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	file, err := os.Open(l.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var offset int64
+	var goodOffset int64
+	var previous uint64
+	var corruptErr *CorruptEntryError
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(line) == 0 {
+			break
+		}
+		lineOffset := offset
+		offset += int64(len(line))
+
+		// A line without a newline at the end of the file was cut off partway through writing
+		if line[len(line)-1] != '\n' {
+			if corruptErr == nil {
+				goodOffset = lineOffset
+			}
+			break
+		}
+
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		if len(line) == 0 {
+			continue
+		}
+		entry, decodeErr := DecodeLogEntry(line)
+		if decodeErr != nil {
+			if corruptErr == nil {
+				corruptErr = newCorruptEntryError(l.Path, line, previous, decodeErr)
+				goodOffset = lineOffset
+			}
+			continue
+		}
+
+		// A good entry after a bad one means the corruption is not just a torn write
+		if corruptErr != nil {
+			return corruptErr
+		}
+		previous = entry.SequenceNumber
+		goodOffset = offset
+	}
+
+	if goodOffset == offset {
+		return nil
+	}
+
+	log.Warn().Msgf("truncating torn write of %d bytes at the end of %s", offset-goodOffset, l.Path)
+	err = os.Truncate(l.Path, goodOffset)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the truncation is persisted before any new entries are appended
+	walFile, err := os.OpenFile(l.Path, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer walFile.Close()
+	return walFile.Sync()
+}
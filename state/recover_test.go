@@ -0,0 +1,123 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func appendToFile(t *testing.T, path, data string) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	defer file.Close()
+	_, err = file.WriteString(data)
+	assert.Nil(t, err)
+}
+
+func TestRecoverTornWrite(t *testing.T) {
+	stateDir := t.TempDir()
+	sm, err := InitHostStateMachine(stateDir, 10)
+	assert.Nil(t, err)
+	for i := 1; i <= 3; i++ {
+		err = sm.Apply(addCommunityTransition(entities.CommunityID(fmt.Sprintf("community_%d", i)), uint64(i)))
+		assert.Nil(t, err)
+	}
+
+	// Simulate a crash partway through writing the fourth entry
+	walPath := sm.WriteAheadLog.Path
+	before, err := ioutil.ReadFile(walPath)
+	assert.Nil(t, err)
+	appendToFile(t, walPath, "4 1234abcd eyJUcmFuc2l0aW9uIjp7")
+
+	err = sm.Close()
+	assert.Nil(t, err)
+	restarted, err := InitHostStateMachine(stateDir, 10)
+	assert.Nil(t, err)
+	err = restarted.Restart()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), restarted.CurSequenceNumber)
+
+	after, err := ioutil.ReadFile(walPath)
+	assert.Nil(t, err)
+	assert.Equal(t, before, after)
+
+	// New entries can be appended after recovery
+	err = restarted.Apply(addCommunityTransition("community_4", 4))
+	assert.Nil(t, err)
+	entries, err := restarted.WriteAheadLog.GetEntries()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(entries))
+}
+
+func TestRecoverCorruptTail(t *testing.T) {
+	dir := t.TempDir()
+	log, err := NewLog(filepath.Join(dir, "wal"))
+	assert.Nil(t, err)
+	writeEntries(t, log, 1, 2)
+	before, err := ioutil.ReadFile(log.Path)
+	assert.Nil(t, err)
+
+	// A complete line with a bad checksum at the end of the log is also treated as a torn write
+	appendToFile(t, log.Path, "3 00000000 eyJUcmFuc2l0aW9uIjp7\n")
+	err = log.Recover()
+	assert.Nil(t, err)
+	after, err := ioutil.ReadFile(log.Path)
+	assert.Nil(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestCorruptEntryInMiddle(t *testing.T) {
+	dir := t.TempDir()
+	log, err := NewLog(filepath.Join(dir, "wal"))
+	assert.Nil(t, err)
+	writeEntries(t, log, 1, 3)
+
+	// Flip a character in the second entry
+	buf, err := ioutil.ReadFile(log.Path)
+	assert.Nil(t, err)
+	lines := strings.Split(string(buf), "\n")
+	corrupted := []byte(lines[1])
+	corrupted[len(corrupted)-5] ^= 1
+	lines[1] = string(corrupted)
+	err = ioutil.WriteFile(log.Path, []byte(strings.Join(lines, "\n")), 0644)
+	assert.Nil(t, err)
+
+	err = log.Recover()
+	var corruptErr *CorruptEntryError
+	assert.True(t, errors.As(err, &corruptErr))
+	assert.Equal(t, uint64(2), corruptErr.SequenceNumber)
+	assert.True(t, errors.Is(err, ErrChecksumMismatch))
+
+	// The log must not have been truncated
+	after, err := ioutil.ReadFile(log.Path)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Join(lines, "\n"), string(after))
+
+	_, err = log.GetEntries()
+	assert.True(t, errors.As(err, &corruptErr))
+	assert.Equal(t, uint64(2), corruptErr.SequenceNumber)
+}
+
+func TestDecodeLegacyLogLine(t *testing.T) {
+	dir := t.TempDir()
+	log, err := NewLog(filepath.Join(dir, "wal"))
+	assert.Nil(t, err)
+	writeEntries(t, log, 1, 1)
+
+	// Strip the checksum to get a line in the original format
+	buf, err := ioutil.ReadFile(log.Path)
+	assert.Nil(t, err)
+	parts := strings.Split(strings.TrimSpace(string(buf)), " ")
+	assert.Equal(t, 3, len(parts))
+
+	entry, err := DecodeLogEntry([]byte(parts[0] + " " + parts[2]))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), entry.SequenceNumber)
+}
@@ -0,0 +1,391 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/rs/zerolog/log"
+)
+
+// CommunityStatus is the health of a community's state machine in a CommunityRegistry
+type CommunityStatus string
+
+// All possible CommunityStatuses
+const (
+	CommunityStarting CommunityStatus = "STARTING"
+	CommunityRunning  CommunityStatus = "RUNNING"
+	// CommunityFailed state machines couldn't be restarted, and don't accept transitions
+	CommunityFailed CommunityStatus = "FAILED"
+)
+
+// CommunityHealth reports on a community's state machine. Err is why a failed state machine couldn't be
+// restarted, and LastTransitionErr is the last error a running state machine returned for a routed transition.
+type CommunityHealth struct {
+	CommunityID       entities.CommunityID
+	Status            CommunityStatus
+	SequenceNumber    uint64
+	RestartDuration   time.Duration
+	Err               error
+	LastTransitionErr error
+}
+
+// ErrCommunityNotHosted is returned for transitions routed to a community that has no state machine in the registry
+var ErrCommunityNotHosted = errors.New("community is not hosted on this node")
+
+// CommunityRegistry owns the state machines of every community this node hosts. Each community's state is kept
+// in its own directory under the base state dir, next to the host's. The registry subscribes to host transitions
+// to start a state machine for every community that is added to the host, and stop it when the community is
+// deleted. Community transitions are routed to the right state machine by their CommunityID.
+type CommunityRegistry struct {
+	StateBaseDir     string
+	SnapshotInterval int
+	// Subscriptions is optional, if it is set it is given to every state machine, which is added as a source
+	Subscriptions *SubscriptionRegistry
+	// Configure is optional, it is called with every state machine before it is restarted, to set up things
+	// like consensus and the signer
+	Configure func(*CommunityStateMachine) error
+	// Hosted is optional, it reports whether the host still has a community. Deleted communities leave their
+	// state dir behind, so without it Start restarts them too.
+	Hosted func(entities.CommunityID) bool
+
+	machines map[entities.CommunityID]*CommunityStateMachine
+	health   map[entities.CommunityID]*CommunityHealth
+	mutex    *sync.Mutex
+}
+
+func NewCommunityRegistry(stateBaseDir string, snapshotInterval int) *CommunityRegistry {
+	return &CommunityRegistry{
+		StateBaseDir:     stateBaseDir,
+		SnapshotInterval: snapshotInterval,
+
+		machines: make(map[entities.CommunityID]*CommunityStateMachine),
+		health:   make(map[entities.CommunityID]*CommunityHealth),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// DiscoverCommunities lists the communities that have a state dir under the base state dir, in order. Anything
+// that isn't a directory named after a valid community ID is skipped, like the host's state dir.
+func DiscoverCommunities(stateBaseDir string) ([]entities.CommunityID, error) {
+	files, err := ioutil.ReadDir(stateBaseDir)
+	if os.IsNotExist(err) {
+		return []entities.CommunityID{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	res := make([]entities.CommunityID, 0)
+	for _, file := range files {
+		if !file.IsDir() || file.Name() == HostStateDir {
+			continue
+		}
+		communityID := entities.CommunityID(file.Name())
+		if communityID.Validate() != nil {
+			log.Warn().Msgf("skipping %s in state dir, it is not named after a community", file.Name())
+			continue
+		}
+		res = append(res, communityID)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res, nil
+}
+
+// Start restarts the state machines of all communities discovered in the base state dir that are still hosted, in
+// parallel. A community that fails to restart is reported as CommunityFailed in its health, but doesn't keep the
+// others from starting. An error is only returned if the base state dir can't be read.
+func (r *CommunityRegistry) Start() error {
+	communityIDs, err := DiscoverCommunities(r.StateBaseDir)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, communityID := range communityIDs {
+		if r.Hosted != nil && !r.Hosted(communityID) {
+			log.Info().Msgf("not starting community %s, it was deleted from the host", communityID)
+			continue
+		}
+		if !r.reserve(communityID) {
+			continue
+		}
+		wg.Add(1)
+		go func(communityID entities.CommunityID) {
+			defer wg.Done()
+			r.start(communityID)
+		}(communityID)
+	}
+	wg.Wait()
+
+	warnMembershipDrift(r.CheckMembership())
+
+	return nil
+}
+
+// CheckMembership checks the members of every running community against their community, in its latest state
+func (r *CommunityRegistry) CheckMembership() entities.MembershipDrifts {
+	communities := make(map[entities.CommunityID]*entities.Community)
+	for _, communityID := range r.Communities() {
+		sm, ok := r.Get(communityID)
+		if !ok {
+			continue
+		}
+		sm.commitMutex.Lock()
+		communities[communityID] = sm.State
+		sm.commitMutex.Unlock()
+	}
+	return entities.CheckMembership(communities)
+}
+
+// Create starts a state machine for a community that is new to this node. Its state stays nil until an
+// InitCommunityTransition is applied to it, or it catches up with the community's peers.
+func (r *CommunityRegistry) Create(communityID entities.CommunityID) (*CommunityStateMachine, error) {
+	err := communityID.Validate()
+	if err != nil {
+		return nil, err
+	}
+	// The community's state dir would be the host's
+	if communityID == HostStateDir {
+		return nil, fmt.Errorf("community ID %s is reserved for the host's state", communityID)
+	}
+	if !r.reserve(communityID) {
+		return nil, fmt.Errorf("community %s already has a state machine", communityID)
+	}
+
+	err = r.start(communityID)
+	if err != nil {
+		return nil, err
+	}
+	sm, _ := r.Get(communityID)
+	return sm, nil
+}
+
+// reserve marks a community as starting, unless it already has a state machine
+func (r *CommunityRegistry) reserve(communityID entities.CommunityID) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if health, ok := r.health[communityID]; ok && health.Status != CommunityFailed {
+		return false
+	}
+	r.health[communityID] = &CommunityHealth{
+		CommunityID: communityID,
+		Status:      CommunityStarting,
+	}
+	return true
+}
+
+// start initializes and restarts a community's state machine, and records how that went in its health
+func (r *CommunityRegistry) start(communityID entities.CommunityID) error {
+	started := time.Now()
+	sm, err := r.restart(communityID)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	health := r.health[communityID]
+	health.RestartDuration = time.Since(started)
+	if err != nil {
+		log.Err(err).Msgf("failed to restart state machine of community %s", communityID)
+		health.Status = CommunityFailed
+		health.Err = err
+		return err
+	}
+
+	health.Status = CommunityRunning
+	r.machines[communityID] = sm
+	if r.Subscriptions != nil {
+		r.Subscriptions.AddSource(sm)
+	}
+	return nil
+}
+
+func (r *CommunityRegistry) restart(communityID entities.CommunityID) (*CommunityStateMachine, error) {
+	sm, err := InitCommunityStateMachine(communityID, r.StateBaseDir, r.SnapshotInterval)
+	if err != nil {
+		return nil, err
+	}
+	sm.Subscriptions = r.Subscriptions
+
+	if r.Configure != nil {
+		err = r.Configure(sm)
+		if err != nil {
+			sm.Close()
+			return nil, err
+		}
+	}
+	err = sm.Restart()
+	if err != nil {
+		sm.Close()
+		return nil, err
+	}
+	return sm, nil
+}
+
+// Remove closes a community's state machine and stops routing transitions to it. Its state dir is left in place,
+// and skipped by Start once Hosted reports the community as deleted.
+func (r *CommunityRegistry) Remove(communityID entities.CommunityID) error {
+	r.mutex.Lock()
+	sm, ok := r.machines[communityID]
+	delete(r.machines, communityID)
+	delete(r.health, communityID)
+	r.mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+	if r.Subscriptions != nil {
+		r.Subscriptions.RemoveSource(sm.SourceID())
+	}
+	return sm.Close()
+}
+
+// Close closes every state machine in the registry
+func (r *CommunityRegistry) Close() error {
+	var res error
+	for _, communityID := range r.Communities() {
+		err := r.Remove(communityID)
+		if err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
+
+// Get returns a community's state machine, if it is running
+func (r *CommunityRegistry) Get(communityID entities.CommunityID) (*CommunityStateMachine, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	sm, ok := r.machines[communityID]
+	return sm, ok
+}
+
+// Communities lists the communities with a running state machine, in order
+func (r *CommunityRegistry) Communities() []entities.CommunityID {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	res := make([]entities.CommunityID, 0, len(r.machines))
+	for communityID := range r.machines {
+		res = append(res, communityID)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res
+}
+
+// Health reports on every community in the registry, including the ones that failed to restart
+func (r *CommunityRegistry) Health() map[entities.CommunityID]CommunityHealth {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	res := make(map[entities.CommunityID]CommunityHealth, len(r.health))
+	for communityID, health := range r.health {
+		report := *health
+		if sm, ok := r.machines[communityID]; ok {
+			sm.commitMutex.Lock()
+			report.SequenceNumber = sm.CurSequenceNumber
+			sm.commitMutex.Unlock()
+		}
+		res[communityID] = report
+	}
+	return res
+}
+
+// route finds the state machine for a community transition. Transitions haven't been validated yet, so the ones
+// that take their CommunityID from an embedded community are checked for one first.
+func (r *CommunityRegistry) route(transition *transitions.TransitionWrapper) (*CommunityStateMachine, error) {
+	communityTransition, ok := transition.Transition.(transitions.CommunityTransition)
+	if !ok {
+		return nil, fmt.Errorf("transition of type %s is not a CommunityTransition", transition.Type)
+	}
+
+	var community *entities.Community
+	embedsCommunity := true
+	switch t := transitions.Normalize(communityTransition).(type) {
+	case *transitions.InitCommunityTransition:
+		if t != nil {
+			community = t.Community
+		}
+	case *transitions.ModifyCommMembersTransition:
+		if t != nil {
+			community = t.Community
+		}
+	default:
+		embedsCommunity = false
+	}
+	if embedsCommunity && community == nil {
+		return nil, fmt.Errorf("transition of type %s has no community", transition.Type)
+	}
+
+	communityID := communityTransition.CommunityID()
+	sm, ok := r.Get(communityID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrCommunityNotHosted, communityID)
+	}
+	return sm, nil
+}
+
+// recordTransitionErr keeps the last error a community's state machine returned for a routed transition
+func (r *CommunityRegistry) recordTransitionErr(sm *CommunityStateMachine, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if health, ok := r.health[sm.CommunityID]; ok {
+		health.LastTransitionErr = err
+	}
+}
+
+// Apply applies a transition that has already been committed to the state machine of its community
+func (r *CommunityRegistry) Apply(transition *transitions.TransitionWrapper) error {
+	sm, err := r.route(transition)
+	if err != nil {
+		return err
+	}
+
+	sm.commitMutex.Lock()
+	err = sm.apply(transition)
+	sm.commitMutex.Unlock()
+	r.recordTransitionErr(sm, err)
+	return err
+}
+
+// Propose proposes a transition to the state machine of its community, and returns the sequence number it was
+// committed at
+func (r *CommunityRegistry) Propose(transition *transitions.TransitionWrapper) (uint64, error) {
+	sm, err := r.route(transition)
+	if err != nil {
+		return 0, err
+	}
+
+	sequenceNumber, err := sm.Propose(transition)
+	r.recordTransitionErr(sm, err)
+	return sequenceNumber, err
+}
+
+// Receive implements TransitionSubscriber for the host category, starting and stopping state machines as
+// communities are added to and deleted from the host
+func (r *CommunityRegistry) Receive(transition transitions.Transition) error {
+	switch t := transitions.Normalize(transition).(type) {
+	case *transitions.AddCommunityTransition:
+		if _, ok := r.Get(t.Community.ID); ok {
+			return nil
+		}
+		_, err := r.Create(t.Community.ID)
+		return err
+	case *transitions.DeleteCommunityTransition:
+		return r.Remove(t.CommID)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,270 @@
+package state
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/stretchr/testify/assert"
+)
+
+// initCommunityTransition initializes a test community with the given ID, signed by its peer
+func initCommunityTransition(t *testing.T, communityID entities.CommunityID) *transitions.TransitionWrapper {
+	community, peer, key := testCommunity()
+	community.ID = communityID
+	return signed(t, &transitions.TransitionWrapper{
+		Type:           transitions.InitCommunityTransitionType,
+		Transition:     transitions.InitCommunityTransition{Community: community},
+		SequenceNumber: 1,
+	}, peer.Key, key)
+}
+
+func TestCommunityRegistryStart(t *testing.T) {
+	stateDir := t.TempDir()
+	for _, communityID := range []entities.CommunityID{"community_0", "community_1", "community_2"} {
+		sm, err := InitCommunityStateMachine(communityID, stateDir, 10)
+		assert.Nil(t, err)
+		err = sm.Apply(initCommunityTransition(t, communityID))
+		assert.Nil(t, err)
+		assert.Nil(t, sm.Close())
+	}
+	err := ioutil.WriteFile(filepath.Join(stateDir, "community_2", "snapshot"), []byte("not a snapshot"), 0644)
+	assert.Nil(t, err)
+
+	// The host's state dir and anything that isn't named after a community are skipped
+	hsm, err := InitHostStateMachine(stateDir, 10)
+	assert.Nil(t, err)
+	defer hsm.Close()
+	assert.Nil(t, os.Mkdir(filepath.Join(stateDir, "lost+found"), 0700))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(stateDir, "notes"), []byte{}, 0644))
+
+	discovered, err := DiscoverCommunities(stateDir)
+	assert.Nil(t, err)
+	assert.Equal(t, []entities.CommunityID{"community_0", "community_1", "community_2"}, discovered)
+
+	configured := make(chan entities.CommunityID, 10)
+	registry := NewCommunityRegistry(stateDir, 10)
+	registry.Configure = func(sm *CommunityStateMachine) error {
+		configured <- sm.CommunityID
+		return nil
+	}
+	err = registry.Start()
+	assert.Nil(t, err)
+	defer registry.Close()
+	assert.Equal(t, 3, len(configured))
+
+	// A community that can't be restarted doesn't keep the others from starting
+	assert.Equal(t, []entities.CommunityID{"community_0", "community_1"}, registry.Communities())
+	health := registry.Health()
+	assert.Equal(t, 3, len(health))
+	assert.Equal(t, CommunityRunning, health["community_0"].Status)
+	assert.Equal(t, uint64(1), health["community_0"].SequenceNumber)
+	assert.Nil(t, health["community_0"].Err)
+	assert.Equal(t, CommunityFailed, health["community_2"].Status)
+	assert.NotNil(t, health["community_2"].Err)
+
+	sm, ok := registry.Get("community_1")
+	assert.True(t, ok)
+	assert.Equal(t, entities.CommunityID("community_1"), sm.State.ID)
+	_, ok = registry.Get("community_2")
+	assert.False(t, ok)
+
+	// Starting again leaves the running state machines alone, and retries the failed one
+	err = registry.Start()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(configured))
+	sm2, _ := registry.Get("community_1")
+	assert.Equal(t, sm, sm2)
+
+	// Nothing to discover in a state dir that doesn't exist yet
+	discovered, err = DiscoverCommunities(filepath.Join(stateDir, "missing"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(discovered))
+}
+
+func TestCommunityRegistryRouting(t *testing.T) {
+	stateDir := t.TempDir()
+	subscriptions := NewSubscriptionRegistry()
+	registry := NewCommunityRegistry(stateDir, 10)
+	registry.Subscriptions = subscriptions
+	defer registry.Close()
+
+	hsm, err := InitHostStateMachine(stateDir, 10)
+	assert.Nil(t, err)
+	defer hsm.Close()
+	hsm.Subscriptions = subscriptions
+	_, err = subscriptions.Subscribe("community_registry", transitions.HostCategory, registry, nil)
+	assert.Nil(t, err)
+
+	// Transitions for communities this node doesn't host have nowhere to go
+	err = registry.Apply(initCommunityTransition(t, "community_0"))
+	assert.True(t, errors.Is(err, ErrCommunityNotHosted))
+
+	// Adding the community to the host starts its state machine
+	err = hsm.Apply(addCommunityTransition("community_0", 1))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		_, ok := registry.Get("community_0")
+		return ok
+	}, time.Second, time.Millisecond)
+
+	err = registry.Apply(initCommunityTransition(t, "community_0"))
+	assert.Nil(t, err)
+	sm, _ := registry.Get("community_0")
+	assert.Equal(t, uint64(1), sm.CurSequenceNumber)
+
+	// Community transitions from its log can be replayed to subscribers
+	subscriber := &recordingSubscriber{mutex: &sync.Mutex{}}
+	_, err = subscriptions.Subscribe("replayer", transitions.CommunityCategory, subscriber, map[string]uint64{"community_0": 1})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return subscriber.count() == 1
+	}, time.Second, time.Millisecond)
+
+	// Errors from the state machine are kept in its health
+	invalid := initCommunityTransition(t, "community_0")
+	invalid.SequenceNumber = 2
+	err = registry.Apply(invalid)
+	assert.NotNil(t, err)
+	assert.Equal(t, err, registry.Health()["community_0"].LastTransitionErr)
+
+	_, err = registry.Create("community_0")
+	assert.NotNil(t, err)
+
+	// The host's state dir can't be taken by a community
+	_, err = registry.Create(HostStateDir)
+	assert.NotNil(t, err)
+
+	// Transitions that take their community ID from a community they carry are rejected without one, in either form
+	for _, transition := range []transitions.Transition{
+		transitions.InitCommunityTransition{},
+		&transitions.ModifyCommMembersTransition{ModType: transitions.AddMember},
+	} {
+		err = registry.Apply(&transitions.TransitionWrapper{Type: transition.Type(), Transition: transition, SequenceNumber: 2})
+		assert.NotNil(t, err)
+		_, err = registry.Propose(&transitions.TransitionWrapper{Type: transition.Type(), Transition: transition})
+		assert.NotNil(t, err)
+	}
+
+	// Deleting the community from the host closes its state machine, which releases its state dir
+	err = hsm.Apply(&transitions.TransitionWrapper{
+		Type:           transitions.DeleteCommunityTransitionType,
+		Transition:     transitions.DeleteCommunityTransition{CommID: "community_0"},
+		SequenceNumber: 2,
+	})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return len(registry.Communities()) == 0
+	}, time.Second, time.Millisecond)
+	_, ok := registry.Health()["community_0"]
+	assert.False(t, ok)
+	_, err = subscriptions.Subscribe("replayer", transitions.CommunityCategory, subscriber, map[string]uint64{"community_0": 1})
+	assert.NotNil(t, err)
+
+	sm, err = InitCommunityStateMachine("community_0", stateDir, 10)
+	assert.Nil(t, err)
+	assert.Nil(t, sm.Close())
+}
+
+func TestCommunityRegistryRestartAfterDelete(t *testing.T) {
+	stateDir := t.TempDir()
+	subscriptions := NewSubscriptionRegistry()
+	registry := NewCommunityRegistry(stateDir, 10)
+	registry.Subscriptions = subscriptions
+	hsm, err := InitHostStateMachine(stateDir, 10)
+	assert.Nil(t, err)
+	hsm.Subscriptions = subscriptions
+	_, err = subscriptions.Subscribe("community_registry", transitions.HostCategory, registry, nil)
+	assert.Nil(t, err)
+
+	for i, communityID := range []entities.CommunityID{"community_0", "community_1"} {
+		err = hsm.Apply(addCommunityTransition(communityID, uint64(i+1)))
+		assert.Nil(t, err)
+		assert.Eventually(t, func() bool {
+			_, ok := registry.Get(communityID)
+			return ok
+		}, time.Second, time.Millisecond)
+		err = registry.Apply(initCommunityTransition(t, communityID))
+		assert.Nil(t, err)
+	}
+	err = hsm.Apply(&transitions.TransitionWrapper{
+		Type:           transitions.DeleteCommunityTransitionType,
+		Transition:     transitions.DeleteCommunityTransition{CommID: "community_1"},
+		SequenceNumber: 3,
+	})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return len(registry.Communities()) == 1
+	}, time.Second, time.Millisecond)
+	assert.Nil(t, registry.Close())
+	assert.Nil(t, hsm.Close())
+
+	// The deleted community's state dir is still there, but it isn't started again
+	hsm, err = InitHostStateMachine(stateDir, 10)
+	assert.Nil(t, err)
+	defer hsm.Close()
+	assert.Nil(t, hsm.Restart())
+	restarted := NewCommunityRegistry(stateDir, 10)
+	restarted.Hosted = func(communityID entities.CommunityID) bool {
+		_, ok := hsm.State.Communities[communityID]
+		return ok
+	}
+	err = restarted.Start()
+	assert.Nil(t, err)
+	defer restarted.Close()
+	discovered, err := DiscoverCommunities(stateDir)
+	assert.Nil(t, err)
+	assert.Equal(t, []entities.CommunityID{"community_0", "community_1"}, discovered)
+	assert.Equal(t, []entities.CommunityID{"community_0"}, restarted.Communities())
+	_, ok := restarted.Health()["community_1"]
+	assert.False(t, ok)
+}
+
+func TestCommunityRegistryCheckMembership(t *testing.T) {
+	registry := NewCommunityRegistry(t.TempDir(), 10)
+	defer registry.Close()
+	_, peer, key := testCommunity()
+	communities := make(map[entities.CommunityID]*entities.Community)
+	for _, communityID := range []entities.CommunityID{"community_0", "community_1"} {
+		_, err := registry.Create(communityID)
+		assert.Nil(t, err)
+		init := initCommunityTransition(t, communityID)
+		assert.Nil(t, registry.Apply(init))
+		communities[communityID] = init.Transition.(transitions.InitCommunityTransition).Community
+	}
+	assert.Equal(t, 0, len(registry.CheckMembership()))
+
+	// Removing a member from one community can't update the copy the other community keeps, which still lists it
+	modify := func(communityID entities.CommunityID, modType transitions.ModifyType, sequenceNumber uint64) error {
+		alice := entities.InitUser("alice", "alice")
+		alice.Communities = []entities.CommunityID{"community_0", "community_1"}
+		return registry.Apply(signed(t, &transitions.TransitionWrapper{
+			Type: transitions.ModifyCommMembersTransitionType,
+			Transition: transitions.ModifyCommMembersTransition{
+				Community: communities[communityID],
+				User:      alice,
+				ModType:   modType,
+			},
+			SequenceNumber: sequenceNumber,
+		}, peer.Key, key))
+	}
+	assert.Nil(t, modify("community_0", transitions.AddMember, 2))
+	assert.Nil(t, modify("community_1", transitions.AddMember, 2))
+	assert.Equal(t, 0, len(registry.CheckMembership()))
+	assert.Nil(t, modify("community_1", transitions.RemoveMember, 3))
+	assert.Equal(t, 0, len(registry.CheckMembership()))
+
+	// Drift in a community's own members is still found
+	sm, _ := registry.Get("community_0")
+	sm.State.Members["alice"].Communities = []entities.CommunityID{"community_1"}
+	drifts := registry.CheckMembership()
+	assert.Equal(t, 1, len(drifts))
+	assert.Equal(t, entities.CommunityID("community_0"), drifts[0].CommunityID)
+	assert.Equal(t, entities.UserID("alice"), drifts[0].UserID)
+}
@@ -0,0 +1,326 @@
+package state
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The WAL is split into segments. New entries are always appended to the active segment (the file at Log.Path),
+// and when a snapshot is taken the active segment is rotated: renamed with its first sequence number appended,
+// and replaced with an empty file. Rotated segments that are fully covered by a snapshot can then be compacted.
+
+const segmentPrefix = "wal-"
+
+// Lines can hold entire communities, so they can get much longer than bufio's default limit
+const maxLogLineSize = 64 * 1024 * 1024
+
+// Segment is a single file of the WAL
+type Segment struct {
+	Path                string
+	FirstSequenceNumber uint64
+	Active              bool
+}
+
+// Segments returns all segments of the log in order, ending with the active segment
+func (l *Log) Segments() ([]*Segment, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.segments()
+}
+
+func (l *Log) segments() ([]*Segment, error) {
+	res, err := listSegments(filepath.Dir(l.Path))
+	if err != nil {
+		return nil, err
+	}
+
+	firstSequenceNumber, _, err := firstSequenceNumber(l.Path)
+	if err != nil {
+		return nil, err
+	}
+	res = append(res, &Segment{
+		Path:                l.Path,
+		FirstSequenceNumber: firstSequenceNumber,
+		Active:              true,
+	})
+
+	return res, nil
+}
+
+// listSegments lists the rotated segments in a directory, which is either a state dir or its archive, in order
+func listSegments(dir string) ([]*Segment, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []*Segment{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	res := make([]*Segment, 0)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), segmentPrefix) {
+			continue
+		}
+		sequenceNumber, err := strconv.ParseUint(strings.TrimPrefix(file.Name(), segmentPrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		res = append(res, &Segment{
+			Path:                filepath.Join(dir, file.Name()),
+			FirstSequenceNumber: sequenceNumber,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].FirstSequenceNumber < res[j].FirstSequenceNumber
+	})
+
+	return res, nil
+}
+
+// Rotate closes off the active segment and starts a new one. It is a no-op if the active segment is empty.
+func (l *Log) Rotate() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	walWriter, ok := l.logWriter.(*WALWriter)
+	if !ok {
+		return errors.New("only logs backed by a WALWriter can be rotated")
+	}
+
+	sequenceNumber, ok, err := firstSequenceNumber(l.Path)
+	if err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
+
+	err = walWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	segmentPath := filepath.Join(filepath.Dir(l.Path), fmt.Sprintf("%s%020d", segmentPrefix, sequenceNumber))
+	err = os.Rename(l.Path, segmentPath)
+	if err != nil {
+		return err
+	}
+
+	newWriter, err := NewWALWriter(l.Path)
+	if err != nil {
+		return err
+	}
+	l.logWriter = newWriter
+
+	return nil
+}
+
+// Compact removes rotated segments that only contain entries up to and including sequenceNumber, which should be
+// the sequence number of the latest snapshot. If archiveDir is not empty, segments are moved there instead of
+// being deleted. The active segment is never compacted.
+func (l *Log) Compact(sequenceNumber uint64, archiveDir string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	segments, err := l.segments()
+	if err != nil {
+		return err
+	}
+
+	if archiveDir != "" {
+		err = os.MkdirAll(archiveDir, 0744)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, segment := range segments {
+		if segment.Active {
+			break
+		}
+
+		// A segment ends right before the next one starts. An empty active segment is treated as unbounded.
+		next := segments[i+1]
+		if next.Active && next.FirstSequenceNumber == 0 {
+			lastSequenceNumber, err := lastSequenceNumber(segment.Path)
+			if err != nil {
+				return err
+			}
+			if lastSequenceNumber > sequenceNumber {
+				break
+			}
+		} else if next.FirstSequenceNumber > sequenceNumber+1 {
+			break
+		}
+
+		if archiveDir != "" {
+			err = os.Rename(segment.Path, filepath.Join(archiveDir, filepath.Base(segment.Path)))
+		} else {
+			err = os.Remove(segment.Path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Iterator streams entries with a sequence number of at least from. Segments that end before from are not read.
+// Rotating or compacting the log while iterating over it is not supported.
+func (l *Log) Iterator(from uint64) (*LogIterator, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	segments, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	return newLogIterator(segments, from), nil
+}
+
+// newLogIterator streams entries from a list of segments in order, skipping the segments that end before from
+func newLogIterator(segments []*Segment, from uint64) *LogIterator {
+	paths := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		if i+1 < len(segments) && segments[i+1].FirstSequenceNumber != 0 && segments[i+1].FirstSequenceNumber <= from {
+			continue
+		}
+		paths = append(paths, segment.Path)
+	}
+
+	return &LogIterator{
+		from:  from,
+		paths: paths,
+	}
+}
+
+// LogIterator reads entries from a log one at a time
+type LogIterator struct {
+	from     uint64
+	paths    []string
+	file     *os.File
+	scanner  *bufio.Scanner
+	previous uint64
+}
+
+// Next returns the next entry, or io.EOF when there are none left
+func (it *LogIterator) Next() (*Entry, error) {
+	for {
+		if it.scanner == nil {
+			if len(it.paths) == 0 {
+				return nil, io.EOF
+			}
+			file, err := os.Open(it.paths[0])
+			if err != nil {
+				return nil, err
+			}
+			it.paths = it.paths[1:]
+			it.file = file
+			it.scanner = newLogScanner(file)
+		}
+
+		if it.scanner.Scan() {
+			line := it.scanner.Bytes()
+			// The final line is always empty because every entry ends with a newline
+			if len(line) == 0 {
+				continue
+			}
+			entry, err := DecodeLogEntry(line)
+			if err != nil {
+				return nil, newCorruptEntryError(it.file.Name(), line, it.previous, err)
+			}
+			it.previous = entry.SequenceNumber
+			if entry.SequenceNumber < it.from {
+				continue
+			}
+			return entry, nil
+		}
+
+		err := it.scanner.Err()
+		if err != nil {
+			return nil, err
+		}
+		err = it.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Close releases the file currently being read
+func (it *LogIterator) Close() error {
+	it.scanner = nil
+	if it.file == nil {
+		return nil
+	}
+	err := it.file.Close()
+	it.file = nil
+	return err
+}
+
+func newLogScanner(reader io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxLogLineSize)
+	return scanner
+}
+
+// firstSequenceNumber reads the sequence number at the start of a segment. Only the first line is read.
+func firstSequenceNumber(path string) (uint64, bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	scanner := newLogScanner(file)
+	if !scanner.Scan() {
+		return 0, false, scanner.Err()
+	}
+	return parseSequenceNumber(scanner.Text())
+}
+
+// lastSequenceNumber reads the sequence number at the end of a segment
+func lastSequenceNumber(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var res uint64
+	scanner := newLogScanner(file)
+	for scanner.Scan() {
+		sequenceNumber, ok, err := parseSequenceNumber(scanner.Text())
+		if err != nil {
+			return 0, err
+		} else if ok {
+			res = sequenceNumber
+		}
+	}
+	return res, scanner.Err()
+}
+
+// parseSequenceNumber reads the human readable sequence number at the start of a log line without decoding the entry
+func parseSequenceNumber(line string) (uint64, bool, error) {
+	if len(line) == 0 {
+		return 0, false, nil
+	}
+	parts := strings.SplitN(line, " ", 2)
+	sequenceNumber, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return sequenceNumber, true, nil
+}
@@ -0,0 +1,117 @@
+package state
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeEntries(t *testing.T, log *Log, from, to int) {
+	for i := from; i <= to; i++ {
+		err := log.WriteAhead(addCommunityTransition(entities.CommunityID("community"), uint64(i)))
+		assert.Nil(t, err)
+	}
+}
+
+func collectSequenceNumbers(t *testing.T, log *Log, from uint64) []uint64 {
+	it, err := log.Iterator(from)
+	assert.Nil(t, err)
+	defer it.Close()
+
+	res := make([]uint64, 0)
+	for {
+		entry, err := it.Next()
+		if err == io.EOF {
+			return res
+		}
+		assert.Nil(t, err)
+		res = append(res, entry.SequenceNumber)
+	}
+}
+
+func TestLogSegments(t *testing.T) {
+	dir := t.TempDir()
+	log, err := NewLog(filepath.Join(dir, "wal"))
+	assert.Nil(t, err)
+
+	// Rotating an empty log does nothing
+	err = log.Rotate()
+	assert.Nil(t, err)
+
+	writeEntries(t, log, 1, 3)
+	err = log.Rotate()
+	assert.Nil(t, err)
+	writeEntries(t, log, 4, 6)
+	err = log.Rotate()
+	assert.Nil(t, err)
+	writeEntries(t, log, 7, 8)
+
+	segments, err := log.Segments()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(segments))
+	assert.Equal(t, uint64(1), segments[0].FirstSequenceNumber)
+	assert.Equal(t, uint64(4), segments[1].FirstSequenceNumber)
+	assert.Equal(t, uint64(7), segments[2].FirstSequenceNumber)
+	assert.True(t, segments[2].Active)
+
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5, 6, 7, 8}, collectSequenceNumbers(t, log, 0))
+	assert.Equal(t, []uint64{5, 6, 7, 8}, collectSequenceNumbers(t, log, 5))
+	assert.Equal(t, []uint64{}, collectSequenceNumbers(t, log, 9))
+
+	// A snapshot at 5 only covers the first segment
+	archiveDir := filepath.Join(dir, "archive")
+	err = log.Compact(5, archiveDir)
+	assert.Nil(t, err)
+	segments, err = log.Segments()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(segments))
+	assert.Equal(t, uint64(4), segments[0].FirstSequenceNumber)
+
+	archived, err := ioutil.ReadDir(archiveDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(archived))
+	assert.Equal(t, "wal-00000000000000000001", archived[0].Name())
+
+	// Compacting without an archive dir deletes segments
+	err = log.Compact(6, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{7, 8}, collectSequenceNumbers(t, log, 0))
+	archived, err = ioutil.ReadDir(archiveDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(archived))
+}
+
+func TestCompactAfterSnapshot(t *testing.T) {
+	stateDir := t.TempDir()
+
+	sm, err := InitHostStateMachine(stateDir, 3)
+	assert.Nil(t, err)
+	for i := 1; i <= 4; i++ {
+		err = sm.Apply(addCommunityTransition(entities.CommunityID(fmt.Sprintf("community_%d", i)), uint64(i)))
+		assert.Nil(t, err)
+	}
+
+	// Only the entry after the snapshot is left in the log
+	assert.Equal(t, []uint64{4}, collectSequenceNumbers(t, sm.WriteAheadLog, 0))
+	archived, err := ioutil.ReadDir(sm.ArchiveDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(archived))
+
+	// Replay can't go back past the snapshot anymore
+	_, err = sm.EntriesFrom(2)
+	assert.NotNil(t, err)
+
+	err = sm.Close()
+	assert.Nil(t, err)
+	restarted, err := InitHostStateMachine(stateDir, 3)
+	assert.Nil(t, err)
+	err = restarted.Restart()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), restarted.CurSequenceNumber)
+	assert.Equal(t, 4, len(restarted.State.Communities))
+}
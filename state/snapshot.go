@@ -8,20 +8,122 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/eagraf/habitat-node/entities"
 	"github.com/eagraf/habitat-node/entities/transitions"
 )
 
+// CurrentSnapshotVersion is the schema version of the state stored in snapshots. Snapshots written before
+// versioning was introduced have no version field, and are treated as version 0.
+const CurrentSnapshotVersion = 4
+
 type Snapshot struct {
 	DataB64        string                                     `json:"data"`
 	Type           transitions.TransitionSubscriptionCategory `json:"type"`
+	Version        int                                        `json:"version"`
 	SequenceNumber uint64                                     `json:"sequence_number"`
 	Timestamp      time.Time                                  `json:"timestamp"`
+	// Index is the commit index of a community at the snapshot's sequence number. Snapshots taken before it was
+	// introduced, and host snapshots, don't have one.
+	Index *CommitIndex `json:"index,omitempty"`
+}
+
+// SnapshotUpgradeFunc converts the JSON state in a snapshot from one version to the next
+type SnapshotUpgradeFunc func(data []byte) ([]byte, error)
+
+// snapshotUpgrades maps the type of state in a snapshot to the upgrade from each version to the version after it.
+// A state type without an upgrade for a version did not change in that version.
+var snapshotUpgrades = map[transitions.TransitionSubscriptionCategory]map[int]SnapshotUpgradeFunc{
+	transitions.CommunityCategory: {
+		1: communitySnapshotUpgrade(transitions.UpgradeCommunityRoles),
+		2: communitySnapshotUpgrade(transitions.UpgradeCommunityApps),
+		3: communitySnapshotUpgrade(transitions.UpgradeMemberCommunities),
+	},
+	transitions.HostCategory: {
+		1: hostSnapshotUpgrade(transitions.UpgradeCommunityRoles),
+		2: hostSnapshotUpgrade(transitions.UpgradeCommunityApps),
+		3: hostSnapshotUpgrade(transitions.UpgradeMemberCommunities),
+	},
+}
+
+// communitySnapshotUpgrade applies a community upgrade to a community snapshot
+func communitySnapshotUpgrade(upgrade transitions.CommunityUpgrade) SnapshotUpgradeFunc {
+	return func(data []byte) ([]byte, error) {
+		var community map[string]interface{}
+		err := json.Unmarshal(data, &community)
+		if err != nil {
+			return nil, err
+		}
+		// Community state machines snapshot a nil community before it has been initialized
+		if community == nil {
+			return data, nil
+		}
+		upgrade(community)
+		return json.Marshal(community)
+	}
+}
+
+// hostSnapshotUpgrade applies a community upgrade to every community in a host snapshot
+func hostSnapshotUpgrade(upgrade transitions.CommunityUpgrade) SnapshotUpgradeFunc {
+	return func(data []byte) ([]byte, error) {
+		var host map[string]interface{}
+		err := json.Unmarshal(data, &host)
+		if err != nil {
+			return nil, err
+		}
+		if communities, ok := host["communities"].(map[string]interface{}); ok {
+			for _, community := range communities {
+				if community, ok := community.(map[string]interface{}); ok {
+					upgrade(community)
+				}
+			}
+		}
+		return json.Marshal(host)
+	}
+}
+
+// snapshotCategory determines what kind of state is being snapshotted
+func snapshotCategory(data interface{}) transitions.TransitionSubscriptionCategory {
+	switch data.(type) {
+	case *entities.Community, **entities.Community:
+		return transitions.CommunityCategory
+	case *entities.Host, **entities.Host:
+		return transitions.HostCategory
+	default:
+		return ""
+	}
+}
+
+// upgradeSnapshot brings the JSON state in a snapshot from version up to CurrentSnapshotVersion
+func upgradeSnapshot(upgrades map[transitions.TransitionSubscriptionCategory]map[int]SnapshotUpgradeFunc, category transitions.TransitionSubscriptionCategory, version int, data []byte) ([]byte, error) {
+	if version > CurrentSnapshotVersion {
+		return nil, fmt.Errorf("snapshot has version %d, which is newer than the supported version %d", version, CurrentSnapshotVersion)
+	}
+
+	for v := version; v < CurrentSnapshotVersion; v++ {
+		upgrade, ok := upgrades[category][v]
+		if !ok {
+			continue
+		}
+		upgraded, err := upgrade(data)
+		if err != nil {
+			return nil, fmt.Errorf("error upgrading %s snapshot from version %d: %s", category, v, err.Error())
+		}
+		data = upgraded
+	}
+	return data, nil
 }
 
 func WriteSnapshot(writer io.Writer, data interface{}, sequenceNumber uint64) error {
+	return writeSnapshot(writer, data, sequenceNumber, nil)
+}
+
+// writeSnapshot is WriteSnapshot with the commit index of a community
+func writeSnapshot(writer io.Writer, data interface{}, sequenceNumber uint64, index *CommitIndex) error {
 	// Data is stored as base 64 encoded JSON
 	marshalled, err := json.Marshal(data)
 	if err != nil {
@@ -32,8 +134,11 @@ func WriteSnapshot(writer io.Writer, data interface{}, sequenceNumber uint64) er
 
 	snapshot := &Snapshot{
 		DataB64:        encoded,
+		Type:           snapshotCategory(data),
+		Version:        CurrentSnapshotVersion,
 		SequenceNumber: sequenceNumber,
 		Timestamp:      time.Now(),
+		Index:          index,
 	}
 
 	// Marshal snapshot into JSON and save to snapshot file
@@ -42,9 +147,8 @@ func WriteSnapshot(writer io.Writer, data interface{}, sequenceNumber uint64) er
 		return err
 	}
 
-	// Subtle but important. ioutil.WriteFile will overwrite and truncate the existing file
-	// so the record of the old snapshot should be copied to a new file beforehand
-	//	err = ioutil.WriteFile(path, marshalledSnapshot, 0744)
+	// Subtle but important. Writing directly to the snapshot file would truncate the existing snapshot,
+	// so snapshot files should be written with atomicWriteFile instead
 	_, err = writer.Write(marshalledSnapshot)
 	if err != nil {
 		return err
@@ -71,6 +175,16 @@ func ReadSnapshot(reader io.Reader, dest interface{}) (*Snapshot, error) {
 		return nil, err
 	}
 
+	// Older snapshots don't record their type, so fall back on the type being read into
+	category := snapshot.Type
+	if category == "" {
+		category = snapshotCategory(dest)
+	}
+	decoded, err = upgradeSnapshot(snapshotUpgrades, category, snapshot.Version, decoded)
+	if err != nil {
+		return nil, err
+	}
+
 	err = json.Unmarshal(decoded, dest)
 	if err != nil {
 		return nil, err
@@ -79,34 +193,133 @@ func ReadSnapshot(reader io.Reader, dest interface{}) (*Snapshot, error) {
 	return &snapshot, nil
 }
 
-// Helper function to copy snapshot file to permanent version with timestamped name
-func ArchiveSnapshotFile(path string, sequenceNumber int) error {
+const snapshotArchivePrefix = "snapshot-"
+
+// SnapshotRetentionPolicy decides which archived snapshots are kept. The most recent snapshot is always kept.
+type SnapshotRetentionPolicy struct {
+	KeepLast int           // Maximum number of archived snapshots, 0 for no limit
+	KeepFor  time.Duration // Maximum age of archived snapshots, 0 for no limit
+}
+
+// DefaultSnapshotRetention is used by new state machines
+var DefaultSnapshotRetention = SnapshotRetentionPolicy{
+	KeepLast: 10,
+}
+
+// ArchivedSnapshot is a past snapshot kept in a state dir
+type ArchivedSnapshot struct {
+	Path           string
+	SequenceNumber uint64
+	ModTime        time.Time
+}
+
+// Helper function to copy snapshot file to permanent version named with its sequence number
+func ArchiveSnapshotFile(path string, sequenceNumber uint64) error {
 	oldFilePath := filepath.Join(path, "snapshot")
-	newFilePath := filepath.Join(path, fmt.Sprintf("snapshot-%s-%s", strconv.Itoa(sequenceNumber), strconv.Itoa(int(time.Now().Unix()))))
+	newFilePath := filepath.Join(path, fmt.Sprintf("%s%020d", snapshotArchivePrefix, sequenceNumber))
 
-	_, err := os.Stat(oldFilePath)
+	buf, err := ioutil.ReadFile(oldFilePath)
 	if os.IsNotExist(err) {
 		return nil
 	} else if err != nil {
 		return err
 	}
 
-	oldFile, err := os.Open(oldFilePath)
+	return atomicWriteFile(newFilePath, buf)
+}
+
+// ArchivedSnapshots lists the archived snapshots in a state dir, ordered from oldest to newest
+func ArchivedSnapshots(path string) ([]*ArchivedSnapshot, error) {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*ArchivedSnapshot, 0)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), snapshotArchivePrefix) {
+			continue
+		}
+		sequenceNumber, err := strconv.ParseUint(strings.TrimPrefix(file.Name(), snapshotArchivePrefix), 10, 64)
+		if err != nil {
+			// Not an archived snapshot, or a temp file from an interrupted write
+			continue
+		}
+		res = append(res, &ArchivedSnapshot{
+			Path:           filepath.Join(path, file.Name()),
+			SequenceNumber: sequenceNumber,
+			ModTime:        file.ModTime(),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].SequenceNumber < res[j].SequenceNumber
+	})
+
+	return res, nil
+}
+
+// PruneSnapshots deletes archived snapshots that fall outside of the retention policy
+func PruneSnapshots(path string, policy SnapshotRetentionPolicy) error {
+	archived, err := ArchivedSnapshots(path)
 	if err != nil {
 		return err
 	}
-	defer oldFile.Close()
 
-	newFile, err := os.OpenFile(newFilePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	now := time.Now()
+	for i, snapshot := range archived {
+		// Never prune the newest snapshot
+		newer := len(archived) - 1 - i
+		if newer == 0 {
+			break
+		}
+
+		tooMany := policy.KeepLast > 0 && newer >= policy.KeepLast
+		tooOld := policy.KeepFor > 0 && now.Sub(snapshot.ModTime) > policy.KeepFor
+		if tooMany || tooOld {
+			err := os.Remove(snapshot.Path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// atomicWriteFile makes sure that readers either see the complete old file or the complete new one, even if
+// the node crashes partway through. The data is written to a temp file, synced, and then renamed over the target.
+func atomicWriteFile(path string, data []byte) error {
+	tempPath := path + ".tmp"
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
-	defer newFile.Close()
 
-	_, err = io.Copy(newFile, oldFile)
+	_, err = file.Write(data)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		return err
+	}
+
+	// The rename is only durable once the directory has been synced
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
 }
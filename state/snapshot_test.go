@@ -2,9 +2,13 @@ package state
 
 import (
 	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -23,3 +27,73 @@ func TestSnapshot(t *testing.T) {
 	assert.Equal(t, uint64(42), sn.SequenceNumber)
 	assert.Equal(t, "My Community", newCommunity.Name)
 }
+
+func TestSnapshotArchiveAndRetention(t *testing.T) {
+	stateDir := t.TempDir()
+
+	for i := 1; i <= 5; i++ {
+		err := writeSnapshotFile(stateDir, SnapshotRetentionPolicy{KeepLast: 3}, &entities.Community{Name: "My Community"}, uint64(i*10), nil)
+		assert.Nil(t, err)
+	}
+
+	archived, err := ArchivedSnapshots(stateDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(archived))
+	assert.Equal(t, uint64(30), archived[0].SequenceNumber)
+	assert.Equal(t, uint64(50), archived[2].SequenceNumber)
+	assert.Equal(t, "snapshot-00000000000000000050", filepath.Base(archived[2].Path))
+
+	// The current snapshot is the latest one, and no temp files are left behind
+	var community entities.Community
+	sn, err := readSnapshotFile(stateDir, &community)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(50), sn.SequenceNumber)
+	_, err = os.Stat(filepath.Join(stateDir, "snapshot.tmp"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Age based pruning never removes the newest snapshot
+	old := time.Now().Add(-time.Hour)
+	for _, snapshot := range archived {
+		err = os.Chtimes(snapshot.Path, old, old)
+		assert.Nil(t, err)
+	}
+	err = PruneSnapshots(stateDir, SnapshotRetentionPolicy{KeepFor: time.Minute})
+	assert.Nil(t, err)
+	archived, err = ArchivedSnapshots(stateDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(archived))
+	assert.Equal(t, uint64(50), archived[0].SequenceNumber)
+}
+
+func TestUpgradeSnapshot(t *testing.T) {
+	// Pretend that the community name used to be stored as title
+	upgrades := map[transitions.TransitionSubscriptionCategory]map[int]SnapshotUpgradeFunc{
+		transitions.CommunityCategory: {
+			0: func(data []byte) ([]byte, error) {
+				return bytes.Replace(data, []byte(`"title"`), []byte(`"name"`), 1), nil
+			},
+		},
+	}
+
+	upgraded, err := upgradeSnapshot(upgrades, transitions.CommunityCategory, 0, []byte(`{"title":"My Community"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"name":"My Community"}`, string(upgraded))
+
+	// Other types of state are unaffected
+	upgraded, err = upgradeSnapshot(upgrades, transitions.HostCategory, 0, []byte(`{"title":"My Host"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"title":"My Host"}`, string(upgraded))
+
+	_, err = upgradeSnapshot(upgrades, transitions.CommunityCategory, CurrentSnapshotVersion+1, []byte(`{}`))
+	assert.NotNil(t, err)
+
+	// Snapshots record their type and version
+	buf := bytes.NewBuffer(make([]byte, 0))
+	err = WriteSnapshot(buf, &entities.Community{Name: "My Community"}, 1)
+	assert.Nil(t, err)
+	var community entities.Community
+	sn, err := ReadSnapshot(buf, &community)
+	assert.Nil(t, err)
+	assert.Equal(t, transitions.CommunityCategory, sn.Type)
+	assert.Equal(t, CurrentSnapshotVersion, sn.Version)
+}
@@ -0,0 +1,282 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/rs/zerolog/log"
+)
+
+// TransitionSource is a state machine that publishes committed transitions, and can replay them from its log.
+// Sequence numbers are only ordered within a single source.
+type TransitionSource interface {
+	SourceID() string
+	EntriesFrom(sequenceNumber uint64) ([]*Entry, error)
+}
+
+// SubscriptionError reports a transition that a subscriber failed to process. If the subscriber returned a
+// *transitions.SideEffectError, the transition was compensated if its source is a Compensator: Compensation is
+// the sequence number of the compensating transition, or CompensationErr says why there is none.
+type SubscriptionError struct {
+	Subscription   string
+	SourceID       string
+	SequenceNumber uint64
+	Err            error
+
+	Compensation    uint64
+	CompensationErr error
+}
+
+func (se *SubscriptionError) Error() string {
+	msg := fmt.Sprintf("subscriber %s failed to receive transition %d from %s: %s", se.Subscription, se.SequenceNumber, se.SourceID, se.Err.Error())
+	if se.Compensation != 0 {
+		return fmt.Sprintf("%s (compensated by transition %d)", msg, se.Compensation)
+	} else if se.CompensationErr != nil {
+		return fmt.Sprintf("%s (failed to compensate: %s)", msg, se.CompensationErr.Error())
+	}
+	return msg
+}
+
+func (se *SubscriptionError) Unwrap() error {
+	return se.Err
+}
+
+// SubscriptionRegistry fans out transitions committed by state machines to every TransitionSubscriber that
+// is registered for the transition's TransitionSubscriptionCategory
+type SubscriptionRegistry struct {
+	sources       map[string]TransitionSource
+	subscriptions map[transitions.TransitionSubscriptionCategory][]*Subscription
+	errChan       chan *SubscriptionError
+	mutex         *sync.Mutex
+}
+
+func NewSubscriptionRegistry() *SubscriptionRegistry {
+	return &SubscriptionRegistry{
+		sources:       make(map[string]TransitionSource),
+		subscriptions: make(map[transitions.TransitionSubscriptionCategory][]*Subscription),
+		errChan:       make(chan *SubscriptionError, 64),
+		mutex:         &sync.Mutex{},
+	}
+}
+
+// Errors returns a channel of all errors returned by subscribers. Errors are dropped if nobody is reading them.
+func (r *SubscriptionRegistry) Errors() <-chan *SubscriptionError {
+	return r.errChan
+}
+
+// AddSource makes a state machine's log available for replay
+func (r *SubscriptionRegistry) AddSource(source TransitionSource) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.sources[source.SourceID()] = source
+}
+
+// RemoveSource stops a state machine's log from being replayed, once the state machine is closed
+func (r *SubscriptionRegistry) RemoveSource(sourceID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.sources, sourceID)
+}
+
+// Subscribe registers a subscriber for all transitions in a category. replayFrom maps source ids to the first
+// sequence number that should be replayed from that source's log, which allows a restarted subscriber to pick
+// up where it left off. Sources not in replayFrom only deliver transitions published after subscribing.
+func (r *SubscriptionRegistry) Subscribe(name string, category transitions.TransitionSubscriptionCategory, subscriber transitions.TransitionSubscriber, replayFrom map[string]uint64) (*Subscription, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	sub := newSubscription(name, category, subscriber, r.errChan)
+	sub.compensate = r.compensate
+
+	// Queue up replayed transitions before any live ones. Holding the registry lock keeps Publish from
+	// interleaving, and the subscription drops anything it has already queued.
+	for sourceID, from := range replayFrom {
+		source, ok := r.sources[sourceID]
+		if !ok {
+			return nil, fmt.Errorf("no transition source with id %s", sourceID)
+		}
+		entries, err := source.EntriesFrom(from)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			entryCategory, err := transitions.GetSubscriptionCategory(entry.Transition.Type)
+			if err != nil {
+				return nil, err
+			}
+			if entryCategory == category {
+				sub.enqueue(sourceID, entry.Transition)
+			}
+		}
+	}
+
+	r.subscriptions[category] = append(r.subscriptions[category], sub)
+	go sub.run()
+
+	return sub, nil
+}
+
+// Unsubscribe stops delivery to a subscription. Transitions still buffered are discarded.
+func (r *SubscriptionRegistry) Unsubscribe(sub *Subscription) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	subs := r.subscriptions[sub.Category]
+	for i, s := range subs {
+		if s == sub {
+			r.subscriptions[sub.Category] = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	sub.close()
+}
+
+// Publish sends a committed transition to all subscribers of its category. It never blocks on subscribers.
+func (r *SubscriptionRegistry) Publish(sourceID string, transition *transitions.TransitionWrapper) error {
+	category, err := transitions.GetSubscriptionCategory(transition.Type)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, sub := range r.subscriptions[category] {
+		sub.enqueue(sourceID, transition)
+	}
+	return nil
+}
+
+// compensate has a source compensate one of its transitions
+func (r *SubscriptionRegistry) compensate(sourceID string, sequenceNumber uint64) (uint64, error) {
+	r.mutex.Lock()
+	source, ok := r.sources[sourceID]
+	r.mutex.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("no transition source with id %s", sourceID)
+	}
+
+	compensator, ok := source.(Compensator)
+	if !ok {
+		return 0, fmt.Errorf("transition source %s can't compensate transitions", sourceID)
+	}
+	return compensator.Compensate(sequenceNumber)
+}
+
+// Subscription delivers transitions to a single subscriber in order. It has its own unbounded buffer so that
+// a slow subscriber never holds up state machines or other subscribers.
+type Subscription struct {
+	Name     string
+	Category transitions.TransitionSubscriptionCategory
+
+	subscriber transitions.TransitionSubscriber
+	errChan    chan *SubscriptionError
+	compensate func(sourceID string, sequenceNumber uint64) (uint64, error)
+
+	queue         []*delivery
+	lastQueued    map[string]uint64
+	lastDelivered map[string]uint64
+	closed        bool
+	cond          *sync.Cond
+}
+
+type delivery struct {
+	sourceID   string
+	transition *transitions.TransitionWrapper
+}
+
+func newSubscription(name string, category transitions.TransitionSubscriptionCategory, subscriber transitions.TransitionSubscriber, errChan chan *SubscriptionError) *Subscription {
+	return &Subscription{
+		Name:     name,
+		Category: category,
+
+		subscriber: subscriber,
+		errChan:    errChan,
+
+		queue:         make([]*delivery, 0),
+		lastQueued:    make(map[string]uint64),
+		lastDelivered: make(map[string]uint64),
+		cond:          sync.NewCond(&sync.Mutex{}),
+	}
+}
+
+// LastDelivered returns the sequence number of the last transition from a source that was passed to the
+// subscriber. Subscribers can persist this to know where to replay from after a restart.
+func (s *Subscription) LastDelivered(sourceID string) uint64 {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	return s.lastDelivered[sourceID]
+}
+
+func (s *Subscription) enqueue(sourceID string, transition *transitions.TransitionWrapper) {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	if s.closed || transition.SequenceNumber <= s.lastQueued[sourceID] {
+		return
+	}
+	s.lastQueued[sourceID] = transition.SequenceNumber
+	s.queue = append(s.queue, &delivery{
+		sourceID:   sourceID,
+		transition: transition,
+	})
+	s.cond.Signal()
+}
+
+func (s *Subscription) close() {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	s.closed = true
+	s.queue = nil
+	s.cond.Signal()
+}
+
+func (s *Subscription) run() {
+	for {
+		s.cond.L.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.cond.L.Unlock()
+			return
+		}
+		next := s.queue[0]
+		s.queue = s.queue[1:]
+		s.cond.L.Unlock()
+
+		// Published transitions are in whatever form they were applied in, and replayed ones are decoded from the log
+		err := s.subscriber.Receive(transitions.Normalize(next.transition.Transition))
+		if err != nil {
+			subErr := &SubscriptionError{
+				Subscription:   s.Name,
+				SourceID:       next.sourceID,
+				SequenceNumber: next.transition.SequenceNumber,
+				Err:            err,
+			}
+			var sideEffectErr *transitions.SideEffectError
+			if errors.As(err, &sideEffectErr) && s.compensate != nil {
+				subErr.Compensation, subErr.CompensationErr = s.compensate(next.sourceID, next.transition.SequenceNumber)
+			}
+			s.reportError(subErr)
+		}
+
+		s.cond.L.Lock()
+		s.lastDelivered[next.sourceID] = next.transition.SequenceNumber
+		s.cond.L.Unlock()
+	}
+}
+
+func (s *Subscription) reportError(err *SubscriptionError) {
+	select {
+	case s.errChan <- err:
+	default:
+		log.Error().Msg(err.Error())
+	}
+}
@@ -0,0 +1,107 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eagraf/habitat-node/entities"
+	"github.com/eagraf/habitat-node/entities/transitions"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingSubscriber struct {
+	received []transitions.Transition
+	fail     bool
+	mutex    *sync.Mutex
+}
+
+func (rs *recordingSubscriber) Receive(transition transitions.Transition) error {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	rs.received = append(rs.received, transition)
+	if rs.fail {
+		return errors.New("subscriber failure")
+	}
+	return nil
+}
+
+func (rs *recordingSubscriber) count() int {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	return len(rs.received)
+}
+
+func TestSubscriptionReplay(t *testing.T) {
+	registry := NewSubscriptionRegistry()
+	sm, err := InitHostStateMachine(t.TempDir(), 10)
+	assert.Nil(t, err)
+	sm.Subscriptions = registry
+	registry.AddSource(sm)
+
+	for i := 1; i <= 2; i++ {
+		err = sm.Apply(addCommunityTransition(entities.CommunityID(fmt.Sprintf("community_%d", i)), uint64(i)))
+		assert.Nil(t, err)
+	}
+
+	// A subscriber coming back up after processing the first transition
+	subscriber := &recordingSubscriber{mutex: &sync.Mutex{}}
+	sub, err := registry.Subscribe("replayer", transitions.HostCategory, subscriber, map[string]uint64{HostStateDir: 2})
+	assert.Nil(t, err)
+
+	// A subscriber for a different category never hears about host transitions
+	other := &recordingSubscriber{mutex: &sync.Mutex{}}
+	_, err = registry.Subscribe("other", transitions.CommunityCategory, other, nil)
+	assert.Nil(t, err)
+
+	err = sm.Apply(addCommunityTransition("community_3", 3))
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool {
+		return sub.LastDelivered(HostStateDir) == 3
+	}, time.Second, time.Millisecond)
+
+	assert.Equal(t, 2, subscriber.count())
+	// Replayed and published transitions are delivered in the same form
+	assert.Equal(t, entities.CommunityID("community_2"), subscriber.received[0].(*transitions.AddCommunityTransition).Community.ID)
+	assert.Equal(t, entities.CommunityID("community_3"), subscriber.received[1].(*transitions.AddCommunityTransition).Community.ID)
+	assert.Equal(t, 0, other.count())
+
+	_, err = registry.Subscribe("missing", transitions.HostCategory, subscriber, map[string]uint64{"not_a_source": 1})
+	assert.NotNil(t, err)
+}
+
+func TestSubscriptionErrors(t *testing.T) {
+	registry := NewSubscriptionRegistry()
+	subscriber := &recordingSubscriber{
+		fail:  true,
+		mutex: &sync.Mutex{},
+	}
+	sub, err := registry.Subscribe("failing", transitions.HostCategory, subscriber, nil)
+	assert.Nil(t, err)
+
+	err = registry.Publish(HostStateDir, addCommunityTransition("a", 1))
+	assert.Nil(t, err)
+
+	select {
+	case subErr := <-registry.Errors():
+		assert.Equal(t, "failing", subErr.Subscription)
+		assert.Equal(t, uint64(1), subErr.SequenceNumber)
+		// Only side effect errors are compensated
+		assert.Equal(t, uint64(0), subErr.Compensation)
+		assert.Nil(t, subErr.CompensationErr)
+	case <-time.After(time.Second):
+		t.Error("timed out waiting for subscription error")
+	}
+
+	// Nothing is delivered after unsubscribing
+	registry.Unsubscribe(sub)
+	err = registry.Publish(HostStateDir, addCommunityTransition("b", 2))
+	assert.Nil(t, err)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 1, subscriber.count())
+}